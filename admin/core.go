@@ -0,0 +1,325 @@
+// Package admin provides the optional HTTP API, served on loopback only, for
+// driving and watching a running peer from dashboards and scripts
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/proto"
+	"github.com/Cryliss/chat/types"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// func New {{{
+
+// New Initializes and returns a new API, listening on the loopback
+// interface at the given port, with a freshly generated token written to
+// tokenFile. Only the user running the program can read the token file.
+func New(s types.Server, bus *events.Bus, port int, tokenFile string) (*API, error) {
+	// Generate a new token, so an old token file is no use to anyone
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("admin.New: error generating token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("admin.New: error writing token file: %w", err)
+	}
+
+	// We only ever listen on loopback - this API can do anything the
+	// user can, so it's not something to expose to the network
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("admin.New: %w", err)
+	}
+
+	api := &API{
+		s:        s,
+		bus:      bus,
+		token:    token,
+		listener: l,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", api.handlePeers)
+	mux.HandleFunc("/peers/", api.handlePeer)
+	mux.HandleFunc("/connect", api.handleConnect)
+	mux.HandleFunc("/send", api.handleSend)
+	mux.HandleFunc("/events", api.handleEvents)
+	api.srv = &http.Server{
+		Handler:           api.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return api, nil
+} // }}}
+
+// func api.Addr {{{
+
+// Addr returns the address the API is listening on
+func (api *API) Addr() string {
+	return api.listener.Addr().String()
+} // }}}
+
+// func api.Serve {{{
+
+// Serve Serves requests until Close is called
+func (api *API) Serve() error {
+	err := api.srv.Serve(api.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+} // }}}
+
+// func api.Close {{{
+
+// Close Stops serving requests, and closes any open event streams
+func (api *API) Close() error {
+	return api.srv.Close()
+} // }}}
+
+// func api.authenticate {{{
+
+// authenticate Wraps next so that it's only called for requests that present
+// our token, either as a bearer token or, for browsers using EventSource
+// which can't set headers, as the token query parameter
+func (api *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+} // }}}
+
+// func api.handlePeers {{{
+
+// handlePeers Serves GET /peers, the list of current connections
+func (api *API) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	peers := []peer{}
+	for _, p := range api.s.List() {
+		peers = append(peers, peer{ID: p.ID, IP: p.IP, Port: p.Port, Transport: p.Transport, Unread: p.Unread, Name: p.Name, Fingerprint: p.Fingerprint})
+	}
+	writeJSON(w, http.StatusOK, peers)
+} // }}}
+
+// func api.handlePeer {{{
+
+// handlePeer Serves DELETE /peers/{id}, which terminates the connection, telling
+// the peer it was kicked, and why if the reason parameter is given
+func (api *API) handlePeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/peers/"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("connection id must be a number"))
+		return
+	}
+	if !api.exists(uint32(id)) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no connection with id %d", id))
+		return
+	}
+
+	if err := api.s.Disconnect(int(id), proto.GoodbyeKicked, r.URL.Query().Get("reason")); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+} // }}}
+
+// func api.handleConnect {{{
+
+// handleConnect Serves POST /connect, which establishes a new connection
+func (api *API) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req connectRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Destination == "" || req.Port == "" {
+		writeError(w, http.StatusBadRequest, errors.New("destination and port are required"))
+		return
+	}
+
+	// The dial carries on in the background, but we wait to find out how it
+	// went, giving up on it if our own caller gives up first
+	d, err := api.s.Connect(r.Context(), req.Destination, req.Port)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	<-d.Done()
+	if err := d.Err(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+} // }}}
+
+// func api.handleSend {{{
+
+// handleSend Serves POST /send, which sends a message to a connection
+func (api *API) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req sendRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ID <= 0 || !api.exists(uint32(req.ID)) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no connection with id %d", req.ID))
+		return
+	}
+
+	if err := api.s.Send(req.ID, req.Message); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+} // }}}
+
+// func api.handleEvents {{{
+
+// handleEvents Serves GET /events, a server-sent event stream of everything
+// published on the event bus, until the client goes away
+func (api *API) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	// The bus calls us on whichever goroutine published the event, so we
+	// hand events over through a buffered channel, and drop them rather
+	// than hold that goroutine up if the client isn't keeping up
+	stream := make(chan events.Event, streamBuffer)
+	dropped := make(chan struct{}, 1)
+	unsubscribe := api.bus.Subscribe(func(e events.Event) {
+		select {
+		case stream <- e:
+		default:
+			select {
+			case dropped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	// Send a comment every now and then so proxies and clients can tell
+	// the stream is still alive
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-dropped:
+			fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+		case e := <-stream:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, data)
+		}
+		flusher.Flush()
+	}
+} // }}}
+
+// func api.exists {{{
+
+// exists reports whether there's a connection with the given id
+func (api *API) exists(id uint32) bool {
+	for _, p := range api.s.List() {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+} // }}}
+
+// func readJSON {{{
+
+// readJSON Decodes the JSON body of a request into v
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+} // }}}
+
+// func writeJSON {{{
+
+// writeJSON Writes v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+} // }}}
+
+// func writeError {{{
+
+// writeError Writes an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+} // }}}
+
+// func methodNotAllowed {{{
+
+// methodNotAllowed Writes the response for a request using a method the
+// endpoint doesn't support
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+} // }}}
@@ -0,0 +1,61 @@
+// Package admin provides the optional HTTP API, served on loopback only, for
+// driving and watching a running peer from dashboards and scripts
+package admin
+
+import (
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/types"
+	"net"
+	"net/http"
+)
+
+// How many events we'll hold on to for a slow event stream before we start
+// dropping them, so one slow client can't hold up the rest of the program
+const streamBuffer = 256
+
+// type API struct {{{
+
+// API serves the admin endpoints
+type API struct {
+	// The server we're driving
+	s types.Server
+
+	// The event bus we stream events from
+	bus *events.Bus
+
+	// Every request must present this token
+	token string
+
+	// Our listener and the HTTP server using it
+	listener net.Listener
+	srv      *http.Server
+} // }}}
+
+// type peer struct {{{
+
+// peer is how a connection is shown by GET /peers
+type peer struct {
+	ID          uint32 `json:"id"`
+	IP          string `json:"ip"`
+	Port        string `json:"port"`
+	Transport   string `json:"transport"`
+	Unread      int    `json:"unread"`
+	Name        string `json:"name,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+} // }}}
+
+// type connectRequest struct {{{
+
+// connectRequest is the body of POST /connect
+type connectRequest struct {
+	Destination string `json:"destination"`
+	Port        string `json:"port"`
+} // }}}
+
+// type sendRequest struct {{{
+
+// sendRequest is the body of POST /send
+type sendRequest struct {
+	ID      int    `json:"id"`
+	Message string `json:"message"`
+} // }}}
@@ -0,0 +1,63 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// func a.cmdAccept {{{
+
+// cmdAccept Lets a peer that's waiting to be accepted start chatting
+func (a *Application) cmdAccept(args Args) error {
+	if err := a.s.Approve(args.Int(0)); err != nil {
+		return err
+	}
+	a.Out("Accepted connection %d\n", args.Int(0))
+	return nil
+} // }}}
+
+// func a.cmdReject {{{
+
+// cmdReject Closes the connection of a peer that's waiting to be accepted,
+// with the reason the user gave, if any
+func (a *Application) cmdReject(args Args) error {
+	return a.s.Reject(args.Int(0), strings.Join(args.From(1), " "))
+} // }}}
+
+// func a.listAwaiting {{{
+
+// listAwaiting Prints the peers waiting to be accepted, below the established
+// connections, so the user can see which ids they can accept or reject
+func (a *Application) listAwaiting() {
+	for _, p := range a.s.Awaiting() {
+		a.Out(" %d | %s | %s | awaiting %s\n", p.ID, p.IP, p.Port, peerIdentity(p.Name, p.Fingerprint))
+	}
+} // }}}
+
+// func a.awaitingIDs {{{
+
+// awaitingIDs returns the IDs of the peers waiting to be accepted, for tab
+// completion
+func (a *Application) awaitingIDs() []string {
+	var ids []string
+	for _, p := range a.s.Awaiting() {
+		ids = append(ids, strconv.FormatUint(uint64(p.ID), 10))
+	}
+	return ids
+} // }}}
+
+// func peerIdentity {{{
+
+// peerIdentity returns what a peer announced about itself, for showing to the
+// user when deciding whether to accept it
+func peerIdentity(name, fingerprint string) string {
+	if name == "" {
+		name = "(no name)"
+	}
+	if fingerprint == "" {
+		return fmt.Sprintf("%s, no key", name)
+	}
+	return fmt.Sprintf("%s, key %s", name, fingerprint)
+} // }}}
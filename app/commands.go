@@ -0,0 +1,345 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/proto"
+	"strconv"
+	"strings"
+)
+
+// func builtinCommands {{{
+
+// builtinCommands returns the commands every application starts with
+func builtinCommands() []Command {
+	return []Command{
+		{
+			Name:    "help",
+			Args:    []Arg{{Name: "command", Optional: true, Variadic: true, Values: (*Application).commandNames}},
+			Summary: "Displays available application commands",
+			Run:     (*Application).cmdHelp,
+		},
+		{
+			Name:    "myip",
+			Summary: "Displays the IP address of this process",
+			Run: func(a *Application, _ Args) error {
+				a.myip()
+				return nil
+			},
+		},
+		{
+			Name:    "myport",
+			Summary: "Displays the port on which this process is listening for incoming connections",
+			Run: func(a *Application, _ Args) error {
+				a.myport()
+				return nil
+			},
+		},
+		{
+			Name:    "connect",
+			Args:    []Arg{{Name: "destination"}, {Name: "port no", Type: ArgPort}, {Name: "destination port no", Optional: true, Variadic: true}},
+			Summary: "Establishes a new TCP connection to the specified <destination> at the specified <port no>",
+			Details: `Connections are dialed in the background, and show up in list as dialing
+until they're established. Give several destinations and ports to dial them
+all at once, i.e. connect 192.168.21.20 4545 192.168.21.21 5454`,
+			Run: (*Application).cmdConnect,
+		},
+		{
+			Name:    "list",
+			Args:    []Arg{{Name: "options", Optional: true, Variadic: true, Values: (*Application).listOptionValues}},
+			Summary: "Displays a numbered list of all the connections this process is a part of",
+			Details: `For example:
+ id |  IP Address   | Port
+ ---+---------------+-----
+  1 | 192.168.21.20 | 4545
+  2 | 192.168.21.21 | 5454
+Options are:
+  -v             also show the direction, messages received and sent, how many
+                 are waiting to be sent out of how many may wait, and how many
+                 were dropped
+  -json          print JSON instead of a table
+  -sort <field>  sort by id, ip, port, name, connected, activity, unread,
+                 received or sent
+  -reverse       reverse the order
+  -dir in|out    only show connections made to us, or by us
+  -via <kind>    only show connections of one kind, i.e. tcp, ws or raw
+  -unread        only show connections with unread messages
+  -match <text>  only show connections whose address or name contains text
+i.e. list -v -dir in -sort activity`,
+			Run: (*Application).cmdList,
+		},
+		{
+			Name:    "terminate",
+			Args:    []Arg{{Name: "connection id", Type: ArgInt, Values: (*Application).connectionIDs}, {Name: "reason", Optional: true, Rest: true}},
+			Summary: "Terminates the connection associated with the given connection id",
+			Details: `The peer is told the connection was terminated on purpose, along with the
+reason, if you give one, i.e. terminate 1 back after lunch`,
+			Run: func(a *Application, args Args) error {
+				return a.s.Disconnect(args.Int(0), proto.GoodbyeTerminated, strings.Join(args.From(1), " "))
+			},
+		},
+		{
+			Name:    "send",
+			Args:    []Arg{{Name: "connection id", Type: ArgInt, Values: (*Application).connectionIDs}, {Name: "message", Rest: true}},
+			Summary: "Sends a message to the host on the connection that is designated by the connection id",
+			Details: `Wrap the message in quotes to keep leading or trailing spaces, and use
+escapes such as \n for a new line, i.e. send 1 "  first line\nsecond line".
+Backslashes outside of quotes are sent as they are, i.e. send 1 C:\temp`,
+			Run: func(a *Application, args Args) error {
+				return a.s.Send(args.Int(0), args.String(1))
+			},
+		},
+		// The first eight commands keep the numbers they've always had,
+		// so anything new goes after exit
+		{
+			Name:    "exit",
+			Summary: "Closes all connections and terminates the process",
+			Run: func(a *Application, _ Args) error {
+				a.exit()
+				return nil
+			},
+		},
+		{
+			Name:    "compose",
+			Args:    []Arg{{Name: "connection id", Type: ArgInt, Values: (*Application).connectionIDs}, {Name: "terminator", Optional: true}},
+			Summary: "Starts writing a message of several lines to the connection designated by the connection id",
+			Details: `Each line you enter is added to the message, which is sent once you enter a
+line containing only the terminator, "." unless you give another. Enter ".cancel"
+to throw the message away instead.`,
+			Run: (*Application).cmdCompose,
+		},
+		{
+			Name:    "loglevel",
+			Args:    []Arg{{Name: "subsystem", Optional: true, Values: (*Application).logLevelValues}, {Name: "level", Optional: true, Values: (*Application).logLevelValues}},
+			Summary: "Displays or changes how much is written to the log file",
+			Details: `With no arguments, shows the level each subsystem logs at. Give a level to
+set every subsystem to it, or a subsystem and a level to set just that one,
+i.e. loglevel server debug. Levels are debug, info, warn, error and off, and
+subsystems are server, client and app.`,
+			Run: (*Application).cmdLoglevel,
+		},
+		{
+			Name:    "cancel",
+			Args:    []Arg{{Name: "pending id", Type: ArgInt, Values: (*Application).dialIDs}},
+			Summary: "Gives up on a connection that is still being dialed",
+			Details: `Pending ids are shown in list. Ctrl-C gives up on all of them at once.`,
+			Run:     (*Application).cmdCancel,
+		},
+		{
+			Name:    "open",
+			Args:    []Arg{{Name: "id|name|ip:port", Values: (*Application).peerNames}},
+			Summary: "Starts chatting with a connection, so every line you enter is sent to it",
+			Details: `The connection may be given by its id, the name it announced or its address.
+Start a line with / to give a command instead, i.e. /list, or with // to
+send a message that starts with /. The prompt shows who you're chatting with.`,
+			Run: (*Application).cmdOpen,
+		},
+		{
+			Name:    "close",
+			Summary: "Stops chatting with the connection you opened, going back to entering commands",
+			Run:     (*Application).cmdClose,
+		},
+		{
+			Name:    "inbox",
+			Args:    []Arg{{Name: "id", Type: ArgInt, Optional: true, Values: (*Application).connectionIDs}},
+			Summary: "Displays the messages a connection has sent that you haven't read, or those of every connection",
+			Details: `Messages stay unread until you use markread, and closed connections keep
+theirs until then too. The Unread column of list shows how many each has.`,
+			Run: (*Application).cmdInbox,
+		},
+		{
+			Name:    "markread",
+			Args:    []Arg{{Name: "id", Type: ArgInt, Optional: true, Values: (*Application).connectionIDs}},
+			Summary: "Marks the messages a connection has sent as read, or those of every connection",
+			Run:     (*Application).cmdMarkread,
+		},
+		{
+			Name:    "accept",
+			Args:    []Arg{{Name: "pending id", Type: ArgInt, Values: (*Application).awaitingIDs}},
+			Summary: "Lets a peer that is waiting to be accepted start chatting",
+			Details: `Peers only wait to be accepted when chat was started with -inbound ask, and
+show up in list as awaiting, with the name and key fingerprint they announced.`,
+			Run: (*Application).cmdAccept,
+		},
+		{
+			Name:    "reject",
+			Args:    []Arg{{Name: "pending id", Type: ArgInt, Values: (*Application).awaitingIDs}, {Name: "reason", Optional: true, Rest: true}},
+			Summary: "Closes the connection of a peer that is waiting to be accepted",
+			Run:     (*Application).cmdReject,
+		},
+		{
+			Name:    "info",
+			Args:    []Arg{{Name: "connection id", Type: ArgInt, Values: (*Application).connectionIDs}},
+			Summary: "Displays everything known about the connection associated with the given connection id",
+			Run:     (*Application).cmdInfo,
+		},
+		{
+			Name:    "netsim",
+			Args:    []Arg{{Name: "connection id|ip:port|*", Optional: true, Values: (*Application).netsimValues}, {Name: "settings", Optional: true, Variadic: true, Values: (*Application).netsimValues}},
+			Summary: "Shows or changes the conditions of the simulated network, when chat was started with -netsim",
+			Details: `Settings apply to the links to the given peer, or to every peer with *, and
+only to what's written from then on. The settings are:
+  latency <duration>  delay everything by this long, i.e. 200ms
+  jitter <duration>   delay each piece by up to this much longer, at random
+  bandwidth <bytes>   send at most this many bytes a second, i.e. 16k, 0 for no limit
+  fragment <bytes>    deliver what's written in pieces of at most this many bytes
+  partition, heal     stop anything getting across until healed
+  reset               reset the connections, as if the peer had crashed
+  clear               forget the settings for the peer
+i.e. netsim 2 latency 200ms jitter 50ms fragment 3`,
+			Run: (*Application).cmdNetsim,
+		},
+		{
+			Name:    "grant",
+			Args:    []Arg{{Name: "browser id", Type: ArgInt, Values: (*Application).connectionIDs}, {Name: "connection id", Type: ArgInt, Optional: true, Values: (*Application).connectionIDs}},
+			Summary: "Lets a browser joined through the websocket gateway chat with another connection, or shows who it may chat with",
+			Details: `Browsers only ever see their own conversation with you, until they're granted
+another connection. They then see its messages to you, and can send it messages
+as you. i.e. grant 3 1`,
+			Run: (*Application).cmdGrant,
+		},
+		{
+			Name:    "revoke",
+			Args:    []Arg{{Name: "browser id", Type: ArgInt, Values: (*Application).connectionIDs}, {Name: "connection id", Type: ArgInt, Values: (*Application).connectionIDs}},
+			Summary: "Stops a browser chatting with a connection it was granted",
+			Run:     (*Application).cmdRevoke,
+		},
+	}
+} // }}}
+
+// func a.Register {{{
+
+// Register Adds a new command the user can give. Returns an error if the
+// command is missing anything it needs, or its name or alias is already taken.
+func (a *Application) Register(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " \t") {
+		return fmt.Errorf("a.Register: invalid command name %q", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("a.Register: command %s has nothing to run", cmd.Name)
+	}
+
+	// Make sure the argument schema makes sense before we accept it
+	for i, arg := range cmd.Args {
+		last := i == len(cmd.Args)-1
+		if (arg.Rest || arg.Variadic) && !last {
+			return fmt.Errorf("a.Register: command %s: only the last argument may take the rest of the input", cmd.Name)
+		}
+		if !arg.Optional && i > 0 && cmd.Args[i-1].Optional {
+			return fmt.Errorf("a.Register: command %s: required argument <%s> follows an optional one", cmd.Name, arg.Name)
+		}
+	}
+
+	// No alias? Then it gets the next number
+	if cmd.Alias == "" {
+		cmd.Alias = strconv.Itoa(len(a.commands) + 1)
+	}
+
+	if _, ok := a.byName[cmd.Name]; ok {
+		return fmt.Errorf("a.Register: command %s already exists", cmd.Name)
+	}
+	if _, ok := a.byName[cmd.Alias]; ok {
+		return fmt.Errorf("a.Register: alias %s of command %s is already taken", cmd.Alias, cmd.Name)
+	}
+
+	c := cmd
+	a.commands = append(a.commands, &c)
+	a.byName[c.Name] = &c
+	a.byName[c.Alias] = &c
+	return nil
+} // }}}
+
+// func a.lookup {{{
+
+// lookup returns the command with the given name or alias
+func (a *Application) lookup(name string) (*Command, bool) {
+	cmd, ok := a.byName[name]
+	return cmd, ok
+} // }}}
+
+// func c.Usage {{{
+
+// Usage returns the command name followed by its arguments, i.e.
+// "connect <destination> <port no>"
+func (c *Command) Usage() string {
+	usage := c.Name
+	for _, arg := range c.Args {
+		name := arg.Name
+		if arg.Variadic {
+			name += " ..."
+		}
+		if arg.Optional {
+			usage += " [" + name + "]"
+		} else {
+			usage += " <" + name + ">"
+		}
+	}
+	return usage
+} // }}}
+
+// func a.cmdHelp {{{
+
+// cmdHelp Prints the help text for the given commands, or all of them if
+// none were given
+func (a *Application) cmdHelp(args Args) error {
+	a.Out("\nApplication Commands\n")
+	a.Out("--------------------\n")
+
+	if args.Len() == 0 {
+		for _, cmd := range a.commands {
+			a.Out("%s", a.helpText(cmd))
+		}
+		return nil
+	}
+
+	var unknown []string
+	for _, name := range args.From(0) {
+		cmd, ok := a.lookup(name)
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		a.Out("%s", a.helpText(cmd))
+	}
+
+	if len(unknown) > 0 {
+		return errors.New("help input error: unknown command " + strings.Join(unknown, ", ") + "\nType 'help' to get a list of available commands")
+	}
+	return nil
+} // }}}
+
+// func a.helpText {{{
+
+// helpText returns the help text of a single command
+func (a *Application) helpText(cmd *Command) string {
+	text := fmt.Sprintf("%s. %s - %s\n", cmd.Alias, cmd.Usage(), cmd.Summary)
+	if cmd.Details != "" {
+		for _, line := range strings.Split(cmd.Details, "\n") {
+			text += "   " + line + "\n"
+		}
+	}
+	return text
+} // }}}
+
+// func a.commandNames {{{
+
+// commandNames returns the names of all our commands, for tab completion
+func (a *Application) commandNames() []string {
+	names := make([]string, 0, len(a.commands))
+	for _, cmd := range a.commands {
+		names = append(names, cmd.Name)
+	}
+	return names
+} // }}}
+
+// func a.connectionIDs {{{
+
+// connectionIDs returns the IDs of all our connections, for tab completion
+func (a *Application) connectionIDs() []string {
+	var ids []string
+	for _, p := range a.s.List() {
+		ids = append(ids, strconv.FormatUint(uint64(p.ID), 10))
+	}
+	return ids
+} // }}}
@@ -0,0 +1,89 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The line that ends a message being composed, unless the user picks another
+const defaultTerminator = "."
+
+// The line that throws away a message being composed
+const cancelLine = ".cancel"
+
+// func a.cmdCompose {{{
+
+// cmdCompose Starts composing a multi-line message to a connection. Every
+// line the user enters from now on is added to the message, until they enter
+// the terminator line.
+func (a *Application) cmdCompose(args Args) error {
+	terminator := defaultTerminator
+	if args.Len() > 1 {
+		terminator = args.String(1)
+	}
+
+	a.setComposition(&composition{
+		conn:       args.Int(0),
+		terminator: terminator,
+	})
+
+	a.Out("Composing a message to connection %d. End it with a line containing only %q, or %q to throw it away.\n", args.Int(0), terminator, cancelLine)
+	return nil
+} // }}}
+
+// func a.Composing {{{
+
+// Composing reports whether the user is in the middle of composing a message,
+// in which case their input is message text rather than commands
+func (a *Application) Composing() bool {
+	return a.composition() != nil
+} // }}}
+
+// func a.composition {{{
+
+// composition returns the message being composed, or nil if there isn't one
+func (a *Application) composition() *composition {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.compose
+} // }}}
+
+// func a.setComposition {{{
+
+// setComposition Changes the message being composed, nil meaning we're done
+func (a *Application) setComposition(c *composition) {
+	a.mu.Lock()
+	a.compose = c
+	a.mu.Unlock()
+} // }}}
+
+// func a.composeLine {{{
+
+// composeLine Adds a line of input to the message being composed, sending it
+// once the user enters the terminator line
+func (a *Application) composeLine(line string) error {
+	// Only the goroutine reading the users input touches the lines, so we
+	// don't need to hold the lock while we add to them
+	c := a.composition()
+
+	switch line {
+	case cancelLine:
+		a.setComposition(nil)
+		a.Out("Message to connection %d discarded\n", c.conn)
+		return nil
+	case c.terminator:
+		a.setComposition(nil)
+		if len(c.lines) == 0 {
+			a.Out("Message to connection %d was empty, so it wasn't sent\n", c.conn)
+			return nil
+		}
+		if err := a.s.Send(c.conn, strings.Join(c.lines, "\n")); err != nil {
+			return fmt.Errorf("compose: %w", err)
+		}
+		return nil
+	}
+
+	c.lines = append(c.lines, line)
+	return nil
+} // }}}
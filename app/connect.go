@@ -0,0 +1,86 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/types"
+	"strconv"
+	"strings"
+)
+
+// func a.cmdConnect {{{
+
+// cmdConnect Starts dialing every destination and port pair we were given,
+// all at once. The dials carry on in the background, so the user can get on
+// with other things, unless we're running a script, which waits to find out
+// how each went before moving on.
+func (a *Application) cmdConnect(args Args) error {
+	targets := args.From(0)
+	if len(targets)%2 != 0 {
+		return errors.New("connect input error: each <destination> needs a <port no> after it")
+	}
+	for i := 1; i < len(targets); i += 2 {
+		if p, err := strconv.Atoi(targets[i]); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("connect input error: <port no> must be a port number between 1 and 65535, got %q", targets[i])
+		}
+	}
+
+	var dials []types.Dial
+	var errs []string
+	for i := 0; i < len(targets); i += 2 {
+		d, err := a.s.Connect(context.Background(), targets[i], targets[i+1])
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		a.Out("Dialing %s:%s as connection %d .. use cancel %d to give up\n", targets[i], targets[i+1], d.ID(), d.ID())
+		dials = append(dials, d)
+	}
+
+	if a.scripting {
+		for _, d := range dials {
+			<-d.Done()
+			if err := d.Err(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+} // }}}
+
+// func a.cmdCancel {{{
+
+// cmdCancel Gives up on a connection we're still dialing
+func (a *Application) cmdCancel(args Args) error {
+	return a.s.Cancel(args.Int(0))
+} // }}}
+
+// func a.CancelDials {{{
+
+// CancelDials Gives up on every connection we're still dialing, for when the
+// user presses Ctrl-C. Returns how many there were.
+func (a *Application) CancelDials() int {
+	dials := a.s.Dials()
+	for _, d := range dials {
+		a.s.Cancel(int(d.ID))
+	}
+	return len(dials)
+} // }}}
+
+// func a.dialIDs {{{
+
+// dialIDs returns the IDs of the connections we're still dialing, for tab
+// completion
+func (a *Application) dialIDs() []string {
+	var ids []string
+	for _, p := range a.s.Dials() {
+		ids = append(ids, strconv.FormatUint(uint64(p.ID), 10))
+	}
+	return ids
+} // }}}
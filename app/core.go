@@ -2,34 +2,90 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/logging"
 	"github.com/Cryliss/chat/types"
+	"io"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 )
 
 // func New {{{
 
 // New Initializes & returns a new application and any errors that may have occurred.
-func New(port int, ip string, server types.Server) (*Application, error) {
+//
+// Nothing is displayed until the frontend calls Welcome, and events are only
+// displayed by the application if the frontend subscribes HandleEvent to the bus.
+// The conversation the user is having follows the events whichever frontend
+// is in use, so we subscribe to those ourselves.
+func New(port int, ip string, server types.Server, bus *events.Bus) (*Application, error) {
 	// Let's generate our service string, in the format "{ip}:{port}"
 	portStr := fmt.Sprintf("%d", port)
 	service := net.JoinHostPort(ip, portStr)
 
 	a := Application{
 		s:       server,
+		bus:     bus,
 		port:    port,
 		ip:      ip,
 		service: service,
+		out:     os.Stdout,
+		errOut:  os.Stderr,
+		byName:  make(map[string]*Command),
+	}
+
+	// Register the commands every application has
+	for _, cmd := range builtinCommands() {
+		if err := a.Register(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	// Subscribing before any frontend does means we're done with an event
+	// before it's displayed
+	if bus != nil {
+		bus.Subscribe(a.trackEvent)
 	}
-	a.startupText()
 
 	return &a, nil
 } // }}}
 
+// func a.SetOutput {{{
+
+// SetOutput Changes where Out and OutErr write to, for frontends that don't
+// want us writing straight to the terminal
+func (a *Application) SetOutput(out, errOut io.Writer) {
+	a.out = out
+	a.errOut = errOut
+} // }}}
+
+// func a.SetLogging {{{
+
+// SetLogging Sets where we log diagnostics to, and lets the user change the
+// levels with the loglevel command
+func (a *Application) SetLogging(root *logging.Root) {
+	a.logs = root
+	a.log = root.Logger(logging.App)
+} // }}}
+
+// func a.OnExit {{{
+
+// OnExit Registers a function to be called before the program exits
+func (a *Application) OnExit(f func()) {
+	a.onExit = append(a.onExit, f)
+} // }}}
+
+// func a.Welcome {{{
+
+// Welcome Displays the startup text
+func (a *Application) Welcome() {
+	a.startupText()
+} // }}}
+
 // func a.Out {{{
 
 // Out Prints message to the standard output device
@@ -37,10 +93,10 @@ func (a *Application) Out(format string, b ...interface{}) {
 	// We're we given any variables that should be added to the string?
 	if b == nil {
 		// No? Okay, let's not add them to Fprint, otherwise we get errors :D
-		fmt.Fprintf(os.Stdout, format)
+		fmt.Fprintf(a.out, format)
 		return
 	}
-	fmt.Fprintf(os.Stdout, format, b...)
+	fmt.Fprintf(a.out, format, b...)
 } // }}}
 
 // func a.OutErr {{{
@@ -50,34 +106,221 @@ func (a *Application) OutErr(format string, b ...interface{}) {
 	// We're we given any variables that should be added to the string?
 	if b == nil {
 		// No? Okay, let's not add them to Fprint, otherwise we get errors :D
-		fmt.Fprintf(os.Stderr, format)
+		fmt.Fprintf(a.errOut, format)
 		return
 	}
 
-	fmt.Fprintf(os.Stderr, format, b...)
+	fmt.Fprintf(a.errOut, format, b...)
+} // }}}
+
+// func a.SetLivePrompt {{{
+
+// SetLivePrompt Tells the application whether the frontend keeps the prompt
+// on screen itself, i.e. a line editor that redraws it after any output. If
+// it does, we don't print the prompt again after displaying an event.
+func (a *Application) SetLivePrompt(live bool) {
+	a.livePrompt = live
+} // }}}
+
+// func a.PromptText {{{
+
+// PromptText returns the prompt to show when asking for the next command, or
+// the next line of a message being composed
+func (a *Application) PromptText() string {
+	if c := a.composition(); c != nil {
+		return fmt.Sprintf("compose %d> ", c.conn)
+	}
+	if f := a.focused(); f != nil {
+		return fmt.Sprintf("chat %d %s:%s> ", f.conn, f.ip, f.port)
+	}
+	return prompt
+} // }}}
+
+// func a.Prompt {{{
+
+// Prompt Asks the user to enter their next command
+func (a *Application) Prompt() {
+	a.Out("\n%s", a.PromptText())
+} // }}}
+
+// func a.Complete {{{
+
+// Complete returns the possible completions of word, given the words before
+// it on the line, for tab completion in the line editor
+func (a *Application) Complete(args []string, word string) []string {
+	var options []string
+
+	if len(args) == 0 {
+		// Completing the command itself
+		options = a.commandNames()
+	} else if cmd, ok := a.lookup(args[0]); ok {
+		// Completing one of the commands arguments, so let's see which one
+		// and what values it can take
+		i := len(args) - 1
+		if n := len(cmd.Args); n > 0 && i >= n && cmd.Args[n-1].Variadic {
+			i = n - 1
+		}
+		if i < len(cmd.Args) && cmd.Args[i].Values != nil {
+			options = cmd.Args[i].Values(a)
+		}
+	}
+
+	var matches []string
+	for _, o := range options {
+		if strings.HasPrefix(o, word) {
+			matches = append(matches, o)
+		}
+	}
+	return matches
+} // }}}
+
+// func a.trackEvent {{{
+
+// trackEvent Keeps the conversation the user is having up to date with the
+// events published by the server, whichever frontend is showing them. Ends
+// the conversation if the peer goes away, marks what the peer says as read
+// as it's shown, and leaves a notice of anything else if we were asked to.
+func (a *Application) trackEvent(e events.Event) {
+	switch e.Kind {
+	case events.PeerDisconnected:
+		a.unfocus(e.ConnID)
+	case events.MessageReceived:
+		if f := a.focused(); f != nil && f.conn == int(e.ConnID) {
+			a.s.MarkRead(int(e.ConnID))
+			return
+		}
+		if !a.ShowsMessage(e.ConnID) {
+			n := len(a.s.Inbox(int(e.ConnID)))
+			a.notify("\n%s from %v | %v:%v, use inbox %v to read\n", plural(n, "new message"), e.ConnID, e.IP, e.Port, e.ConnID)
+		}
+	}
+} // }}}
+
+// func a.ShowsMessage {{{
+
+// ShowsMessage reports whether a message from the given connection should be
+// displayed when it arrives, rather than left in the inbox with a notice
+func (a *Application) ShowsMessage(conn uint32) bool {
+	if !a.notices {
+		return true
+	}
+	f := a.focused()
+	return f != nil && f.conn == int(conn)
+} // }}}
+
+// func a.HandleEvent {{{
+
+// HandleEvent Displays the events published by the server to the user, for
+// use as an event bus subscriber by the line mode frontend
+func (a *Application) HandleEvent(e events.Event) {
+	switch e.Kind {
+	case events.PeerConnected:
+		if e.Direction == events.Inbound {
+			a.notify("\nNew incoming connection: %v | %v:%v\n", e.ConnID, e.IP, e.Port)
+			return
+		}
+		// We dialed this one ourselves, in the background
+		a.notify("\nNew connection established: %v | %v:%v\n", e.ConnID, e.IP, e.Port)
+	case events.ConnectionPending:
+		a.notify("\nConnection %v from %v:%v is waiting to be accepted: %s\nUse accept %v or reject %v [reason]\n", e.ConnID, e.IP, e.Port, peerIdentity(e.Name, e.Fingerprint), e.ConnID, e.ConnID)
+	case events.Dialing:
+		// Whoever started the dial already said so
+	case events.DialFailed:
+		if errors.Is(e.Err, context.Canceled) {
+			a.notifyErr("\nGave up connecting to %v:%v\n", e.IP, e.Port)
+			return
+		}
+		a.notifyErr("\nUnable to connect to %v:%v: %v\n", e.IP, e.Port, e.Err)
+	case events.PeerDisconnected:
+		if e.Local {
+			a.Out("Successfully closed connection %d\n", e.ConnID)
+			return
+		}
+		if e.Err != nil {
+			a.notifyErr("\n\nConnection %d closed, %s: %v\n", e.ConnID, e.Reason, e.Err)
+			return
+		}
+		if e.Code != "" {
+			// They told us why they went
+			a.notifyErr("\n\nConnection %d closed, %s\n", e.ConnID, e.Reason)
+			return
+		}
+		a.notifyErr("\n\nPeer has terminated the connection - closing client# %d now.\n", e.ConnID)
+	case events.ConnectionRefused:
+		a.notifyErr("\nRefusing connection from %s:%s! %s!\n", e.IP, e.Port, e.Reason)
+	case events.MessageReceived:
+		// trackEvent has already left a notice of it instead
+		if !a.ShowsMessage(e.ConnID) {
+			return
+		}
+
+		// I want to include the time received to the message output
+		ts := e.Time.Format("2006-01-02 15:04:05")
+		a.Out("\n\n====================================\nNEW MESSAGE FROM %v:%v\n\n", e.IP, e.Port)
+		a.notify("%s:\t%s\n\nEND MESSAGE\n===================================\n", ts, e.Message)
+	case events.MessageRejected:
+		a.notifyErr("\nRejected a message from %v:%v, %s\n", e.IP, e.Port, e.Reason)
+	case events.MessageSent:
+		// The user can already see what they said to the peer they're
+		// chatting with
+		if f := a.focused(); f != nil && f.conn == int(e.ConnID) {
+			return
+		}
+		a.Out("Message sent to connection %d!\n", e.ConnID)
+	case events.SendFailed:
+		// Messages are written after Send has returned, so this is
+		// the only way the user hears it didn't go
+		if e.Reason != "" {
+			a.notifyErr("\nMessage to connection %d was not sent, %s\n", e.ConnID, e.Reason)
+			return
+		}
+		a.notifyErr("\nFailed to send message to connection %d: %v\n", e.ConnID, e.Err)
+	case events.AcceptError, events.InternalError:
+		// These are only of use when tracking down a problem, so the
+		// server logs them rather than us showing them to the user
+	case events.ListenerStopped:
+		a.notifyErr("\nListener stopped: %s\n", e.Reason)
+	}
+} // }}}
+
+// func a.notify {{{
+
+// notify Prints a message that arrived while the user was sitting at the
+// prompt, and then shows the prompt again
+func (a *Application) notify(format string, b ...interface{}) {
+	a.Out(format, b...)
+	if !a.livePrompt {
+		a.Prompt()
+	}
+} // }}}
+
+// func a.notifyErr {{{
+
+// notifyErr Prints an error that arrived while the user was sitting at the
+// prompt, and then shows the prompt again
+func (a *Application) notifyErr(format string, b ...interface{}) {
+	a.OutErr(format, b...)
+	if !a.livePrompt {
+		a.Prompt()
+	}
 } // }}}
 
 // func a.startupText {{{
 
 // Prints the text that should be displayed on application startup
 func (a *Application) startupText() {
-	sText := `
+	a.Out(`
 CHATTY: A Chat Application for Remote Message Exchange
 ------------------------------------------------------
 Available commands:
-    1. help
-    2. myip
-    3. myport
-    4. connect <destination> <port no>
-    5. list
-    6. terminate <connection id>
-    7. send <connection id> <message>
-    8. exit
-
+`)
+	for _, cmd := range a.commands {
+		a.Out("    %s. %s\n", cmd.Alias, cmd.Usage())
+	}
+	a.Out(`
 You may either type the command name, i.e. 'connect <destination> <port no>', or the command number, i.e. '4 <destination> <port no>'
 Type 'help' for an explanation of each command, or type 'help <command>' to get the explanation for a specific command
-`
-	a.Out("%s", sText)
+`)
 } // }}}
 
 // func a.ParseInput {{{
@@ -85,191 +328,63 @@ Type 'help' for an explanation of each command, or type 'help <command>' to get
 // ParseInput Parses the users input and calls the function associated with
 // the given command
 func (a *Application) ParseInput(userInput string) error {
-	// Split the users input into array of strings
-	inputArgs := strings.SplitN(userInput, " ", 3)
-	numArgs := len(inputArgs)
-
-	// Create some common errors for input mistakes we may see
-	connErr := errors.New("connect input error: You must give both the destination and the port when using the connect command")
-	termErr := errors.New("terminate input error: You must give the connection id you wish to terminate\nType `list` to get a list of connections and their ids")
-	sendErr := errors.New("send input error: You must give both the connection id and a message to the connection")
-	inputErr := errors.New("invalid input error: You must give one of the accepted app commands\nType 'help' to get a list of available commands")
+	// Composing a message? Then this is another line of it, not a command
+	if a.Composing() {
+		return a.composeLine(userInput)
+	}
 
-	// Check what the command was, the first item in the input, and
-	// perform the actions necessary for that command
-	switch inputArgs[0] {
-	case "1":
-		fallthrough
-	case "help":
-		// If we have more than 2 input args, that means they want to see
-		// the command information for multiple commands, so let's loop
-		// through each of them
-		if numArgs > 2 {
-			for i := 1; i < numArgs; i++ {
-				a.help(inputArgs[i])
-			}
-			return nil
-		}
+	// Chatting with a peer? Then this is a message, unless it says otherwise
+	if f := a.focused(); f != nil {
+		return a.focusLine(f, userInput)
+	}
 
-		// If we only have 2, then the user just wants to see this one command
-		if numArgs == 2 {
-			a.help(inputArgs[1])
-			return nil
-		}
+	return a.runCommand(userInput)
+} // }}}
 
-		// We only had help in our input, so they want the full list
-		a.help("")
-		return nil
-	case "2":
-		fallthrough
-	case "myip":
-		a.myip()
-		return nil
-	case "3":
-		fallthrough
-	case "myport":
-		a.myport()
-		return nil
-	case "4":
-		fallthrough
-	case "connect":
-		// Do we have the proper number of arguments?
-		if numArgs < 3 {
-			return connErr
-		}
+// func a.runCommand {{{
 
-		// Yes, so let's grab them from the array and attempt
-		// to establish thew new connection
-		destination := inputArgs[1]
-		port := inputArgs[2]
-		if err := a.s.Connect(destination, port); err != nil {
-			return err
-		}
-		return nil
-	case "5":
-		fallthrough
-	case "list":
-		a.s.List()
-		return nil
-	case "6":
-		fallthrough
-	case "terminate":
-		// Do we have the proper number of arguments?
-		if numArgs != 2 {
-			return termErr
-		}
+// runCommand Parses the users input as a command and runs it
+func (a *Application) runCommand(userInput string) error {
+	// Split the users input into words
+	tokens, err := tokenize(userInput)
+	if err != nil {
+		return err
+	}
 
-		// Yes, so let's get the connection that we need to terminate
-		// and attempt to terminate it
-		conn, _ := strconv.ParseInt(inputArgs[1], 10, 64)
-		if err := a.s.Terminate(int(conn)); err != nil {
-			return err
-		}
+	// Nothing but whitespace? Then there's nothing to do
+	if len(tokens) == 0 {
 		return nil
-	case "7":
-		fallthrough
-	case "send":
-		// Do we have the proper number of arguments?
-		if numArgs != 3 {
-			return sendErr
-		}
-
-		// Yes, so let's get the connection we need to send the message to,
-		// as well as the message itself
-		conn, _ := strconv.ParseInt(inputArgs[1], 10, 64)
-		msg := inputArgs[2]
+	}
 
-		// Now let's attempt to send the message
-		if err := a.s.Send(int(conn), msg); err != nil {
-			return err
-		}
-		return nil
-	case "8":
-		fallthrough
-	case "exit":
-		a.s.Exit()
-		return nil
-	default:
+	// Check what the command was, the first word in the input
+	if tokens[0].err != nil {
+		return tokens[0].err
+	}
+	cmd, ok := a.lookup(tokens[0].text)
+	if !ok {
 		// We didn't find a matching command for their input, let's throw an error
-		return inputErr
+		return &ParseError{
+			Input: userInput,
+			Start: tokens[0].start,
+			End:   tokens[0].end,
+			Msg:   fmt.Sprintf("invalid input error: unknown command %q", tokens[0].text),
+			Hint:  "Type 'help' to get a list of available commands",
+		}
 	}
-	return nil
-} // }}}
 
-// func a.help {{{
-
-// help Prints the application commands
-func (a *Application) help(command string) {
-	a.Out("\nApplication Commands\n")
-	a.Out("--------------------\n")
-
-	switch command {
-	case "":
-		cmds := `1. help - Displays available application commands
-2. myip - Displays the IP address of this process
-3. myport - Displays the port on which this process is listening for incoming connections
-4. connect <destination> <port no> - Establishes a new TCP connection to the specified <destination> at the specified <port no>
-5. list - Displays a numbered list of all the connections this process is a part of
-   For example:
-    id |  IP Address   | Port
-    ---+---------------+-----
-    1 | 192.168.21.20 | 4545
-    2 | 192.168.21.21 | 5454
-6. terminate <connection id> - Terminates the connection associated with the given connection id
-7. send <connection id> <message> - Sends a message to the host on the connection that is designated by the connection id
-8. exit - Closes all connections and terminates the process
-`
-		a.Out(cmds)
-		break
-	case "1":
-		fallthrough
-	case "help":
-		a.Out("1. help - Displays available application commands\n")
-		break
-	case "2":
-		fallthrough
-	case "myip":
-		a.Out("2. myip - Displays the IP address of this process\n")
-		break
-	case "3":
-		fallthrough
-	case "myport":
-		a.Out("3. myport - Displays the port on which this process is listening for incoming connections\n")
-		break
-	case "4":
-		fallthrough
-	case "connect":
-		a.Out("4. connect <destination> <port no> - Establishes a new TCP connection to the specified <destination> at the specified <port no>\n")
-		break
-	case "5":
-		fallthrough
-	case "list":
-		a.Out(`5. list - Displays a numbered list of all the connections this process is a part of
-for example:
-    id |  IP Address   | Port
-    ---+---------------+-----
-     1 | 192.168.21.20 | 4545
-     2 | 192.168.21.21 | 5454
-`)
-		break
-	case "6":
-		fallthrough
-	case "terminate":
-		a.Out("6. terminate <connection id> - Terminates the connection associated with the given connection id\n")
-		break
-	case "7":
-		fallthrough
-	case "send":
-		a.Out("7. send <connection id> <message> - Sends a message to the host on the connection that is designated by the connection id\n")
-		break
-	case "8":
-		fallthrough
-	case "exit":
-		a.Out("8. exit - Closes all connections and terminates the process\n")
-		break
-	default:
-		return
+	// Make sure we were given the arguments the command needs, and then
+	// perform the actions necessary for that command
+	args, err := cmd.parseArgs(userInput, tokens[1:])
+	if err != nil {
+		a.log.Debug("invalid arguments", "command", cmd.Name, "err", err)
+		return err
 	}
+	a.log.Debug("running command", "command", cmd.Name, "args", args.Len())
+	if err := cmd.Run(a, args); err != nil {
+		a.log.Debug("command failed", "command", cmd.Name, "err", err)
+		return err
+	}
+	return nil
 } // }}}
 
 // func a.myip {{{
@@ -285,3 +400,18 @@ func (a *Application) myip() {
 func (a *Application) myport() {
 	a.Out("Your port is: %d\n", a.port)
 } // }}}
+
+// func a.exit {{{
+
+// exit Closes all of our connections and exits the program
+func (a *Application) exit() {
+	a.Out("Closing any established connections .. \n")
+	a.s.Exit()
+
+	// Let the user know we're shutting down now and exit
+	a.Out("Exiting program now .. bye!\n")
+	for _, f := range a.onExit {
+		f()
+	}
+	os.Exit(0)
+} // }}}
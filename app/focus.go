@@ -0,0 +1,162 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/types"
+	"strconv"
+	"strings"
+)
+
+// What a line must start with to be run as a command while chatting
+const commandPrefix = "/"
+
+// func a.cmdOpen {{{
+
+// cmdOpen Starts a conversation with a peer, so that every line the user
+// enters is sent to it until they close the conversation
+func (a *Application) cmdOpen(args Args) error {
+	f, err := a.findPeer(args.String(0))
+	if err != nil {
+		return err
+	}
+
+	a.setFocus(f)
+	a.Out("Chatting with connection %d at %s:%s. Every line you enter is sent to it, start a line with %s to give a command instead, i.e. %sclose to go back.\n", f.conn, f.ip, f.port, commandPrefix, commandPrefix)
+
+	// Catch up on anything they said while we weren't looking
+	if messages := a.s.Inbox(f.conn); len(messages) > 0 {
+		a.showMessages(messages)
+		a.s.MarkRead(f.conn)
+	}
+	return nil
+} // }}}
+
+// func a.cmdClose {{{
+
+// cmdClose Ends the conversation, going back to entering commands
+func (a *Application) cmdClose(_ Args) error {
+	f := a.focused()
+	if f == nil {
+		return errors.New("close input error: you aren't chatting with anyone, use open <id> to start")
+	}
+
+	a.setFocus(nil)
+	a.Out("Stopped chatting with connection %d\n", f.conn)
+	return nil
+} // }}}
+
+// func a.findPeer {{{
+
+// findPeer returns the connection the user meant, given either its id, its
+// address as ip:port or the name it announced. A name more than one peer
+// announced is no good, as we can't tell which they meant.
+func (a *Application) findPeer(target string) (*focus, error) {
+	id, idErr := strconv.Atoi(target)
+	var named []types.Peer
+	for _, p := range a.s.List() {
+		if (idErr == nil && int(p.ID) == id) || target == p.IP+":"+p.Port {
+			return &focus{conn: int(p.ID), ip: p.IP, port: p.Port}, nil
+		}
+		if p.Name != "" && p.Name == target {
+			named = append(named, p)
+		}
+	}
+
+	switch len(named) {
+	case 0:
+		return nil, fmt.Errorf("open input error: no connection %s! Use list to see a list of all current connections", target)
+	case 1:
+		p := named[0]
+		return &focus{conn: int(p.ID), ip: p.IP, port: p.Port}, nil
+	}
+
+	ids := make([]string, len(named))
+	for i, p := range named {
+		ids[i] = strconv.FormatUint(uint64(p.ID), 10)
+	}
+	return nil, fmt.Errorf("open input error: connections %s are all called %s, use the id of the one you meant", strings.Join(ids, ", "), target)
+} // }}}
+
+// func a.peerNames {{{
+
+// peerNames returns the ids of our connections, and the names they
+// announced, for tab completion
+func (a *Application) peerNames() []string {
+	values := a.connectionIDs()
+	for _, p := range a.s.List() {
+		if p.Name != "" {
+			values = append(values, p.Name)
+		}
+	}
+	return values
+} // }}}
+
+// func a.focusLine {{{
+
+// focusLine Sends a line the user entered while chatting to the peer, unless
+// it's a command
+func (a *Application) focusLine(f *focus, line string) error {
+	switch {
+	case strings.HasPrefix(line, commandPrefix+commandPrefix):
+		// Doubling the prefix sends a message that starts with it
+		line = line[len(commandPrefix):]
+	case strings.HasPrefix(line, commandPrefix):
+		return a.runCommand(line[len(commandPrefix):])
+	case strings.TrimSpace(line) == "":
+		// We don't send empty messages
+		return nil
+	}
+	return a.s.Send(f.conn, line)
+} // }}}
+
+// func a.Remember {{{
+
+// Remember reports whether a line the user entered should be kept in their
+// command history. Lines of a message being composed, and those sent to the
+// peer they're chatting with, are private, so only commands are kept.
+func (a *Application) Remember(line string) bool {
+	if a.Composing() {
+		return false
+	}
+	if a.focused() == nil {
+		return true
+	}
+	return strings.HasPrefix(line, commandPrefix) && !strings.HasPrefix(line, commandPrefix+commandPrefix)
+} // }}}
+
+// func a.focused {{{
+
+// focused returns the peer the user is chatting with, or nil if they aren't
+func (a *Application) focused() *focus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.focus
+} // }}}
+
+// func a.setFocus {{{
+
+// setFocus Changes the peer the user is chatting with, nil meaning nobody
+func (a *Application) setFocus(f *focus) {
+	a.mu.Lock()
+	a.focus = f
+	a.mu.Unlock()
+} // }}}
+
+// func a.unfocus {{{
+
+// unfocus Ends the conversation if it's with the given connection, as it has
+// been closed
+func (a *Application) unfocus(conn uint32) {
+	a.mu.Lock()
+	f := a.focus
+	if f != nil && f.conn == int(conn) {
+		a.focus = nil
+	}
+	a.mu.Unlock()
+
+	if f != nil && f.conn == int(conn) {
+		a.Out("\nNo longer chatting with connection %d, back to entering commands\n", conn)
+	}
+} // }}}
@@ -0,0 +1,67 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"errors"
+	"github.com/Cryliss/chat/gateway"
+	"strconv"
+	"strings"
+)
+
+// func a.SetGateway {{{
+
+// SetGateway Sets the websocket gateway browsers join through, so the user
+// can choose who they chat with using the grant and revoke commands
+func (a *Application) SetGateway(g *gateway.Gateway) {
+	a.gateway = g
+} // }}}
+
+// func a.cmdGrant {{{
+
+// cmdGrant Lets a browser chat with another connection, or shows who it may
+// chat with if no connection was given
+func (a *Application) cmdGrant(args Args) error {
+	if a.gateway == nil {
+		return errors.New("grant error: there's no websocket gateway, start chat with -ws-port to have one")
+	}
+	browser := uint32(args.Int(0))
+
+	if args.Len() == 1 {
+		ids, err := a.gateway.Granted(browser)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			a.Out("Connection %d may only chat with you\n", browser)
+			return nil
+		}
+		granted := make([]string, len(ids))
+		for i, id := range ids {
+			granted[i] = strconv.FormatUint(uint64(id), 10)
+		}
+		a.Out("Connection %d may chat with you and %s\n", browser, strings.Join(granted, ", "))
+		return nil
+	}
+
+	peer := uint32(args.Int(1))
+	if err := a.gateway.Grant(browser, peer); err != nil {
+		return err
+	}
+	a.Out("Connection %d may now chat with connection %d\n", browser, peer)
+	return nil
+} // }}}
+
+// func a.cmdRevoke {{{
+
+// cmdRevoke Stops a browser chatting with a connection it was granted
+func (a *Application) cmdRevoke(args Args) error {
+	if a.gateway == nil {
+		return errors.New("revoke error: there's no websocket gateway, start chat with -ws-port to have one")
+	}
+	browser, peer := uint32(args.Int(0)), uint32(args.Int(1))
+	if err := a.gateway.Revoke(browser, peer); err != nil {
+		return err
+	}
+	a.Out("Connection %d may no longer chat with connection %d\n", browser, peer)
+	return nil
+} // }}}
@@ -0,0 +1,67 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"fmt"
+	"github.com/Cryliss/chat/types"
+)
+
+// func a.cmdInbox {{{
+
+// cmdInbox Shows the messages a connection has sent that haven't been read,
+// or those of every connection if none was given. They stay unread until
+// markread is used.
+func (a *Application) cmdInbox(args Args) error {
+	messages := a.s.Inbox(args.Int(0))
+	if len(messages) == 0 {
+		a.Out("No unread messages\n")
+		return nil
+	}
+
+	a.showMessages(messages)
+	a.Out("\nUse markread to mark them as read\n")
+	return nil
+} // }}}
+
+// func a.cmdMarkread {{{
+
+// cmdMarkread Marks the messages a connection has sent as read, or those of
+// every connection if none was given
+func (a *Application) cmdMarkread(args Args) error {
+	n := a.s.MarkRead(args.Int(0))
+	a.Out("Marked %s as read\n", plural(n, "message"))
+	return nil
+} // }}}
+
+// func a.SetMessageNotices {{{
+
+// SetMessageNotices Tells the application whether to show a one line notice
+// when a message arrives, leaving it in the inbox, rather than the message
+// itself
+func (a *Application) SetMessageNotices(on bool) {
+	a.notices = on
+} // }}}
+
+// func a.showMessages {{{
+
+// showMessages Prints messages grouped by the connection that sent them
+func (a *Application) showMessages(messages []types.Message) {
+	var last uint32
+	for _, m := range messages {
+		if m.ConnID != last {
+			a.Out("\nFrom %d | %s:%s\n", m.ConnID, m.IP, m.Port)
+			last = m.ConnID
+		}
+		a.Out("  %s\t%s\n", m.Time.Format("2006-01-02 15:04:05"), m.Text)
+	}
+} // }}}
+
+// func plural {{{
+
+// plural returns n followed by the noun, with an s on the end unless n is 1
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+} // }}}
@@ -0,0 +1,60 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// func a.cmdInfo {{{
+
+// cmdInfo Prints everything we know about a single connection
+func (a *Application) cmdInfo(args Args) error {
+	id := args.Int(0)
+	for _, p := range a.s.List() {
+		if int(p.ID) != id {
+			continue
+		}
+
+		name := p.Name
+		if name == "" {
+			name = "(none announced)"
+		}
+		fingerprint := p.Fingerprint
+		if fingerprint == "" {
+			fingerprint = "(none announced)"
+		}
+		version := "unknown"
+		if p.Version > 0 {
+			version = fmt.Sprintf("%d", p.Version)
+		}
+
+		a.Out("Connection %d\n", p.ID)
+		a.Out("  Address:       %s:%s\n", p.IP, p.Port)
+		a.Out("  Direction:     %s\n", p.Direction)
+		a.Out("  Transport:     %s\n", p.Transport)
+		a.Out("  Name:          %s\n", name)
+		a.Out("  Fingerprint:   %s\n", fingerprint)
+		a.Out("  Protocol:      version %s, messages of up to %d characters\n", version, p.MaxMessage)
+		a.Out("  Security:      %s\n", p.Security)
+		a.Out("  Connected:     %s\n", ago(p.Connected))
+		a.Out("  Last activity: %s\n", ago(p.LastActivity))
+		a.Out("  Received:      %s, %s\n", plural(int(p.MessagesIn), "message"), plural(int(p.BytesIn), "byte"))
+		a.Out("  Sent:          %s, %s\n", plural(int(p.MessagesOut), "message"), plural(int(p.BytesOut), "byte"))
+		a.Out("  Unread:        %d\n", p.Unread)
+		a.Out("  Send queue:    %d of %d waiting, %d dropped\n", p.Queued, p.QueueSize, p.Dropped)
+		return nil
+	}
+	return fmt.Errorf("info input error: no connection %d! Use list to see a list of all current connections", id)
+} // }}}
+
+// func ago {{{
+
+// ago returns when something happened, and how long ago that was, i.e.
+// "2021-03-04 15:04:05 (3m12s ago)"
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Format("2006-01-02 15:04:05"), time.Since(t).Round(time.Second))
+} // }}}
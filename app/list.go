@@ -0,0 +1,274 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Cryliss/chat/types"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What list can sort connections by, and how
+var listSorts = map[string]func(p, q types.Peer) bool{
+	"id":        func(p, q types.Peer) bool { return p.ID < q.ID },
+	"ip":        func(p, q types.Peer) bool { return p.IP < q.IP },
+	"port":      func(p, q types.Peer) bool { return portNumber(p.Port) < portNumber(q.Port) },
+	"name":      func(p, q types.Peer) bool { return p.Name < q.Name },
+	"connected": func(p, q types.Peer) bool { return p.Connected.Before(q.Connected) },
+	"activity":  func(p, q types.Peer) bool { return p.LastActivity.After(q.LastActivity) },
+	"unread":    func(p, q types.Peer) bool { return p.Unread > q.Unread },
+	"received":  func(p, q types.Peer) bool { return p.MessagesIn > q.MessagesIn },
+	"sent":      func(p, q types.Peer) bool { return p.MessagesOut > q.MessagesOut },
+}
+
+// func portNumber {{{
+
+// portNumber returns a port as a number, so ports sort as numbers rather than
+// text. Connections without one, i.e. in-process ones, come first.
+func portNumber(port string) int {
+	n, _ := strconv.Atoi(port)
+	return n
+} // }}}
+
+// func a.cmdList {{{
+
+// cmdList Prints the connections we have, sorted and filtered however the
+// user asked, followed by those we're still dialing or waiting to accept
+func (a *Application) cmdList(args Args) error {
+	opts, err := parseListOptions(args.From(0))
+	if err != nil {
+		return err
+	}
+
+	peers := a.s.List()
+	shown := peers[:0]
+	for _, p := range peers {
+		if opts.matches(p) {
+			shown = append(shown, p)
+		}
+	}
+	less := listSorts[opts.sort]
+	sort.SliceStable(shown, func(i, j int) bool {
+		if opts.reverse {
+			return less(shown[j], shown[i])
+		}
+		return less(shown[i], shown[j])
+	})
+
+	if opts.json {
+		return a.listJSON(shown, opts.filtered())
+	}
+
+	if !opts.verbose {
+		a.Out("id |  IP Address   | Port  | Via | Unread\n")
+		a.Out("---+---------------+-------+-----+-------\n")
+
+		for _, p := range shown {
+			a.Out(" %d | %s | %s | %s | %d\n", p.ID, p.IP, p.Port, p.Transport, p.Unread)
+		}
+	} else {
+		a.Out("id |  IP Address   | Port  | Via  | Dir      | Unread | In | Out | Queued | Dropped\n")
+		a.Out("---+---------------+-------+------+----------+--------+----+-----+--------+--------\n")
+
+		for _, p := range shown {
+			a.Out(" %d | %s | %s | %s | %s | %d | %d | %d | %d/%d | %d\n", p.ID, p.IP, p.Port, p.Transport, p.Direction, p.Unread, p.MessagesIn, p.MessagesOut, p.Queued, p.QueueSize, p.Dropped)
+		}
+	}
+
+	// Connections that aren't established yet don't have most of what we
+	// filter on, so they're only shown when nothing is filtered out
+	if !opts.filtered() {
+		a.listDials()
+		a.listAwaiting()
+	}
+	return nil
+} // }}}
+
+// func a.listDials {{{
+
+// listDials Prints the connections we're still dialing, below the established
+// ones, so the user can see which ids they can cancel
+func (a *Application) listDials() {
+	for _, p := range a.s.Dials() {
+		a.Out(" %d | %s | %s | dialing\n", p.ID, p.IP, p.Port)
+	}
+} // }}}
+
+// func a.listJSON {{{
+
+// listJSON Prints the connections as JSON, for scripts and other tools to
+// read. Those still being dialed or waiting to be accepted are only included
+// when nothing is filtered out, as with the table.
+func (a *Application) listJSON(peers []types.Peer, filtered bool) error {
+	out := listOutput{
+		Connections: make([]listPeer, 0, len(peers)),
+		Dialing:     []listPeer{},
+		Awaiting:    []listPeer{},
+	}
+	for _, p := range peers {
+		out.Connections = append(out.Connections, newListPeer(p))
+	}
+	if !filtered {
+		for _, p := range a.s.Dials() {
+			out.Dialing = append(out.Dialing, newListPeer(p))
+		}
+		for _, p := range a.s.Awaiting() {
+			out.Awaiting = append(out.Awaiting, newListPeer(p))
+		}
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("list: unable to encode connections: %w", err)
+	}
+	a.Out("%s\n", b)
+	return nil
+} // }}}
+
+// func newListPeer {{{
+
+// newListPeer returns how a connection is shown by list -json
+func newListPeer(p types.Peer) listPeer {
+	lp := listPeer{
+		ID:          p.ID,
+		IP:          p.IP,
+		Port:        p.Port,
+		Transport:   p.Transport,
+		Direction:   p.Direction,
+		Name:        p.Name,
+		Fingerprint: p.Fingerprint,
+		Version:     p.Version,
+		Security:    p.Security,
+		Unread:      p.Unread,
+		MessagesIn:  p.MessagesIn,
+		MessagesOut: p.MessagesOut,
+		BytesIn:     p.BytesIn,
+		BytesOut:    p.BytesOut,
+		Queued:      p.Queued,
+		QueueSize:   p.QueueSize,
+		Dropped:     p.Dropped,
+	}
+	if !p.Connected.IsZero() {
+		lp.Connected = p.Connected.Format(time.RFC3339)
+	}
+	if !p.LastActivity.IsZero() {
+		lp.LastActivity = p.LastActivity.Format(time.RFC3339)
+	}
+	return lp
+} // }}}
+
+// func parseListOptions {{{
+
+// parseListOptions Works out what the user asked list for
+func parseListOptions(words []string) (listOptions, error) {
+	opts := listOptions{sort: "id"}
+
+	// Some options need a value after them
+	value := func(i int) (string, error) {
+		if i+1 >= len(words) {
+			return "", fmt.Errorf("list input error: %s needs a value after it", words[i])
+		}
+		return words[i+1], nil
+	}
+
+	for i := 0; i < len(words); i++ {
+		var err error
+		switch words[i] {
+		case "-v":
+			opts.verbose = true
+		case "-json":
+			opts.json = true
+		case "-reverse":
+			opts.reverse = true
+		case "-unread":
+			opts.unread = true
+		case "-sort":
+			if opts.sort, err = value(i); err != nil {
+				return opts, err
+			}
+			if _, ok := listSorts[opts.sort]; !ok {
+				return opts, fmt.Errorf("list input error: unable to sort by %s, expected one of %s", opts.sort, strings.Join(listSortNames(), ", "))
+			}
+			i++
+		case "-dir":
+			if opts.dir, err = value(i); err != nil {
+				return opts, err
+			}
+			switch opts.dir {
+			case "in":
+				opts.dir = "inbound"
+			case "out":
+				opts.dir = "outbound"
+			default:
+				return opts, fmt.Errorf("list input error: -dir must be in or out, got %s", opts.dir)
+			}
+			i++
+		case "-via":
+			if opts.via, err = value(i); err != nil {
+				return opts, err
+			}
+			i++
+		case "-match":
+			if opts.match, err = value(i); err != nil {
+				return opts, err
+			}
+			i++
+		default:
+			return opts, fmt.Errorf("list input error: unknown option %s, type 'help list' to see the options", words[i])
+		}
+	}
+	return opts, nil
+} // }}}
+
+// func o.matches {{{
+
+// matches returns whether a connection passes every filter the user gave
+func (o listOptions) matches(p types.Peer) bool {
+	if o.dir != "" && p.Direction != o.dir {
+		return false
+	}
+	if o.via != "" && p.Transport != o.via {
+		return false
+	}
+	if o.unread && p.Unread == 0 {
+		return false
+	}
+	if o.match != "" {
+		text := strings.ToLower(p.IP + ":" + p.Port + " " + p.Name)
+		if !strings.Contains(text, strings.ToLower(o.match)) {
+			return false
+		}
+	}
+	return true
+} // }}}
+
+// func o.filtered {{{
+
+// filtered returns whether the user asked for any connections to be left out
+func (o listOptions) filtered() bool {
+	return o.dir != "" || o.via != "" || o.unread || o.match != ""
+} // }}}
+
+// func listSortNames {{{
+
+// listSortNames returns what list can sort by, in order
+func listSortNames() []string {
+	names := make([]string, 0, len(listSorts))
+	for name := range listSorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+} // }}}
+
+// func a.listOptionValues {{{
+
+// listOptionValues returns the options list takes, and the values they take,
+// for tab completion
+func (a *Application) listOptionValues() []string {
+	values := []string{"-v", "-json", "-reverse", "-unread", "-sort", "-dir", "-via", "-match", "in", "out", "tcp", "ws", "raw"}
+	return append(values, listSortNames()...)
+} // }}}
@@ -0,0 +1,57 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"errors"
+	"github.com/Cryliss/chat/logging"
+)
+
+// func a.cmdLoglevel {{{
+
+// cmdLoglevel Shows the level each subsystem logs at, or changes them
+func (a *Application) cmdLoglevel(args Args) error {
+	if a.logs == nil {
+		return errors.New("loglevel error: logging is turned off")
+	}
+
+	switch args.Len() {
+	case 0:
+		// Nothing to change, we'll just show them below
+	case 1:
+		// Either a level for everyone, or a subsystem to show
+		if level, err := logging.ParseLevel(args.String(0)); err == nil {
+			a.logs.SetDefaultLevel(level)
+			break
+		}
+		if !logging.IsSubsystem(args.String(0)) {
+			return errors.New("loglevel error: " + args.String(0) + " is neither a level nor a subsystem")
+		}
+		a.Out("%-6s %s\n", args.String(0), a.logs.Level(args.String(0)))
+		return nil
+	default:
+		level, err := logging.ParseLevel(args.String(1))
+		if err != nil {
+			return err
+		}
+		if err := a.logs.SetLevel(args.String(0), level); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range logging.Subsystems {
+		a.Out("%-6s %s\n", s, a.logs.Level(s))
+	}
+	return nil
+} // }}}
+
+// func a.logLevelValues {{{
+
+// logLevelValues returns the subsystems and levels loglevel takes, for tab
+// completion
+func (a *Application) logLevelValues() []string {
+	values := append([]string(nil), logging.Subsystems...)
+	for l := logging.LevelDebug; l <= logging.LevelOff; l++ {
+		values = append(values, l.String())
+	}
+	return values
+} // }}}
@@ -0,0 +1,204 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/netsim"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// func a.SetNetwork {{{
+
+// SetNetwork Sets the simulated network our connections are run through, so
+// the user can change its conditions with the netsim command
+func (a *Application) SetNetwork(n *netsim.Network) {
+	a.network = n
+} // }}}
+
+// func a.cmdNetsim {{{
+
+// cmdNetsim Shows the conditions of the simulated network, or changes those
+// of the links to a peer, or to every peer
+func (a *Application) cmdNetsim(args Args) error {
+	if a.network == nil {
+		return errors.New("netsim error: there's no simulated network, start chat with -netsim to have one")
+	}
+	if args.Len() == 0 {
+		a.showNetwork()
+		return nil
+	}
+
+	peer, err := a.netsimPeer(args.String(0))
+	if err != nil {
+		return err
+	}
+	if args.Len() == 1 {
+		c, _ := a.network.Rule(netsim.Any, peer)
+		a.Out("%s: %s\n", peer, describeConditions(c))
+		return nil
+	}
+
+	c, _ := a.network.Rule(netsim.Any, peer)
+	words := args.From(1)
+	for i := 0; i < len(words); i++ {
+		setting := words[i]
+
+		// Some settings need a value after them
+		value := func() (string, error) {
+			if i+1 >= len(words) {
+				return "", fmt.Errorf("netsim input error: %s needs a value after it", setting)
+			}
+			i++
+			return words[i], nil
+		}
+
+		var v string
+		switch setting {
+		case "partition":
+			c.Partitioned = true
+		case "heal":
+			c.Partitioned = false
+		case "clear":
+			a.network.Clear(netsim.Any, peer)
+			a.Out("Cleared the conditions of the links to %s\n", peer)
+			return nil
+		case "reset":
+			n := a.network.Reset(netsim.Any, peer)
+			a.Out("Reset %s to %s\n", plural(n, "connection"), peer)
+			return nil
+		case "latency", "jitter":
+			if v, err = value(); err != nil {
+				return err
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("netsim input error: %s must be a duration, i.e. 200ms, got %s", setting, v)
+			}
+			if setting == "latency" {
+				c.Latency = d
+			} else {
+				c.Jitter = d
+			}
+		case "bandwidth", "fragment":
+			if v, err = value(); err != nil {
+				return err
+			}
+			n, err := parseBytes(v)
+			if err != nil {
+				return fmt.Errorf("netsim input error: %s must be a number of bytes, i.e. 16k, got %s", setting, v)
+			}
+			if setting == "bandwidth" {
+				c.Bandwidth = n
+			} else {
+				c.Fragment = n
+			}
+		default:
+			return fmt.Errorf("netsim input error: unknown setting %s, type 'help netsim' to see the settings", setting)
+		}
+	}
+
+	a.network.Set(netsim.Any, peer, c)
+	a.Out("%s: %s\n", peer, describeConditions(c))
+	return nil
+} // }}}
+
+// func a.showNetwork {{{
+
+// showNetwork Prints the conditions we were told to give the network, and
+// the connections across it
+func (a *Application) showNetwork() {
+	rules := a.network.Rules()
+	if len(rules) == 0 {
+		a.Out("Every link is perfect\n")
+	}
+	for _, r := range rules {
+		a.Out("%s <-> %s: %s\n", r.A, r.B, describeConditions(r.Conditions))
+	}
+
+	links := a.network.Links()
+	if len(links) == 0 {
+		return
+	}
+	a.Out("\nlocal | remote | conditions | in flight\n")
+	for _, l := range links {
+		a.Out("%s | %s | %s | %s\n", l.Local, l.Remote, describeConditions(l.Conditions), plural(l.InFlight, "byte"))
+	}
+} // }}}
+
+// func a.netsimPeer {{{
+
+// netsimPeer returns the name the simulated network knows a peer by, given
+// its connection id, its address or * for every peer
+func (a *Application) netsimPeer(word string) (string, error) {
+	if word == netsim.Any || strings.Contains(word, ":") {
+		return word, nil
+	}
+	id, err := strconv.Atoi(word)
+	if err != nil {
+		return "", fmt.Errorf("netsim input error: expected a connection id, ip:port or *, got %s", word)
+	}
+	for _, p := range a.s.List() {
+		if int(p.ID) == id {
+			return net.JoinHostPort(p.IP, p.Port), nil
+		}
+	}
+	return "", fmt.Errorf("netsim input error: no connection %d! Use list to see a list of all current connections", id)
+} // }}}
+
+// func a.netsimValues {{{
+
+// netsimValues returns what netsim takes, for tab completion
+func (a *Application) netsimValues() []string {
+	values := append([]string{netsim.Any}, a.connectionIDs()...)
+	return append(values, "latency", "jitter", "bandwidth", "fragment", "partition", "heal", "reset", "clear")
+} // }}}
+
+// func describeConditions {{{
+
+// describeConditions returns the conditions of a link as the user would
+// give them, i.e. "latency 200ms, jitter 50ms, partitioned"
+func describeConditions(c netsim.Conditions) string {
+	var parts []string
+	if c.Latency > 0 {
+		parts = append(parts, "latency "+c.Latency.String())
+	}
+	if c.Jitter > 0 {
+		parts = append(parts, "jitter "+c.Jitter.String())
+	}
+	if c.Bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("bandwidth %d bytes/s", c.Bandwidth))
+	}
+	if c.Fragment > 0 {
+		parts = append(parts, fmt.Sprintf("fragment %s", plural(c.Fragment, "byte")))
+	}
+	if c.Partitioned {
+		parts = append(parts, "partitioned")
+	}
+	if len(parts) == 0 {
+		return "perfect"
+	}
+	return strings.Join(parts, ", ")
+} // }}}
+
+// func parseBytes {{{
+
+// parseBytes returns a number of bytes, which may end in k or m for
+// kilobytes or megabytes, i.e. "16k"
+func parseBytes(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult, s = 1024, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mult, s = 1024*1024, strings.TrimSuffix(s, "m")
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a number of bytes", s)
+	}
+	return n * mult, nil
+} // }}}
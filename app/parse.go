@@ -0,0 +1,320 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// func tokenize {{{
+
+// tokenize Splits the users input into words, separated by any amount of
+// whitespace.
+//
+// A word that starts with a quote runs until the matching quote, so it may
+// contain whitespace. Within single quotes everything is taken literally,
+// while double quotes and unquoted words allow backslash escapes, i.e. \n
+// for a newline. Quotes anywhere else in a word are just quotes, so that
+// messages like "don't" don't need escaping.
+//
+// A bad escape in an unquoted word isn't a mistake until the word is used
+// as one, since the rest of a message is taken as it was typed, so that
+// messages like C:\temp\dir arrive as they were sent.
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+
+	i := 0
+	for {
+		// Skip the whitespace before the next word
+		for i < len(input) && isSpace(input[i]) {
+			i++
+		}
+		if i >= len(input) {
+			return tokens, nil
+		}
+
+		start := i
+		var b, raw strings.Builder
+		var bad error
+
+		// Does the word start with a quote?
+		if q := input[i]; q == '"' || q == '\'' {
+			i++
+			closed := false
+			for i < len(input) {
+				c := input[i]
+				if c == q {
+					i++
+					closed = true
+					break
+				}
+				if c == '\\' && q == '"' {
+					n, err := unescape(input, i, &b)
+					if err != nil {
+						return nil, err
+					}
+					i = n
+					continue
+				}
+				b.WriteByte(c)
+				i++
+			}
+			if !closed {
+				return nil, &ParseError{
+					Input: input,
+					Start: start,
+					End:   len(input),
+					Msg:   "input error: unterminated quote",
+					Hint:  fmt.Sprintf("Add a closing %c, or escape the opening one with \\%c", q, q),
+				}
+			}
+
+			// What's in quotes is the same either way
+			raw.WriteString(b.String())
+		}
+
+		// Read up until the next whitespace, keeping the backslashes as
+		// they are in the raw word
+		for i < len(input) && !isSpace(input[i]) {
+			if input[i] == '\\' {
+				n, err := unescape(input, i, &b)
+				if err != nil {
+					if bad == nil {
+						bad = err
+					}
+					n = i + 1
+				}
+				raw.WriteString(input[i:n])
+				i = n
+				continue
+			}
+			b.WriteByte(input[i])
+			raw.WriteByte(input[i])
+			i++
+		}
+
+		tokens = append(tokens, token{
+			text:  b.String(),
+			raw:   raw.String(),
+			err:   bad,
+			start: start,
+			end:   i,
+		})
+	}
+} // }}}
+
+// func unescape {{{
+
+// unescape Writes the character for the escape sequence starting at the
+// backslash at input[i] to b, and returns the index just past the sequence
+func unescape(input string, i int, b *strings.Builder) (int, error) {
+	if i+1 >= len(input) {
+		return 0, &ParseError{
+			Input: input,
+			Start: i,
+			End:   i + 1,
+			Msg:   "input error: nothing to escape at the end of the input",
+			Hint:  "Use \\\\ for a backslash",
+		}
+	}
+
+	switch c := input[i+1]; c {
+	case 'n':
+		b.WriteByte('\n')
+	case 't':
+		b.WriteByte('\t')
+	case 'r':
+		b.WriteByte('\r')
+	case '\\', '"', '\'', ' ':
+		b.WriteByte(c)
+	case 'u':
+		// \uXXXX, for characters that are hard to type
+		if i+6 > len(input) {
+			return 0, escapeError(input, i, len(input))
+		}
+		r, err := strconv.ParseUint(input[i+2:i+6], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return 0, escapeError(input, i, i+6)
+		}
+		b.WriteRune(rune(r))
+		return i + 6, nil
+	default:
+		_, size := utf8.DecodeRuneInString(input[i+1:])
+		return 0, escapeError(input, i, i+1+size)
+	}
+	return i + 2, nil
+} // }}}
+
+// func escapeError {{{
+
+// escapeError returns the error for an invalid escape sequence
+func escapeError(input string, start, end int) error {
+	return &ParseError{
+		Input: input,
+		Start: start,
+		End:   end,
+		Msg:   fmt.Sprintf("input error: invalid escape sequence %s", input[start:end]),
+		Hint:  "Valid escapes are \\n \\t \\r \\\\ \\\" \\' \\<space> and \\uXXXX",
+	}
+} // }}}
+
+// func c.parseArgs {{{
+
+// parseArgs Checks the words following the command name against the
+// arguments the command takes, converting them to the right types
+func (c *Command) parseArgs(input string, tokens []token) (Args, error) {
+	var args Args
+
+	// All of our errors point somewhere in the input, and remind the
+	// user how the command is used
+	fail := func(start, end int, format string, b ...interface{}) error {
+		return &ParseError{
+			Input: input,
+			Start: start,
+			End:   end,
+			Msg:   fmt.Sprintf("%s input error: ", c.Name) + fmt.Sprintf(format, b...),
+			Hint:  fmt.Sprintf("Usage: %s\nType 'help %s' for more information", c.Usage(), c.Name),
+		}
+	}
+
+	t := 0
+	for _, arg := range c.Args {
+		if t >= len(tokens) {
+			if !arg.Optional {
+				return args, fail(len(input), len(input), "missing <%s>", arg.Name)
+			}
+			break
+		}
+
+		switch {
+		case arg.Rest:
+			// The argument takes the rest of the input, so stick the
+			// remaining words back together with the whitespace that
+			// separated them, as they were typed
+			text := tokens[t].raw
+			for i := t + 1; i < len(tokens); i++ {
+				text += input[tokens[i-1].end:tokens[i].start] + tokens[i].raw
+			}
+			rest := token{text: text, start: tokens[t].start, end: tokens[len(tokens)-1].end}
+			if err := args.add(arg, rest, fail); err != nil {
+				return args, err
+			}
+			t = len(tokens)
+		case arg.Variadic:
+			for ; t < len(tokens); t++ {
+				if err := args.add(arg, tokens[t], fail); err != nil {
+					return args, err
+				}
+			}
+		default:
+			if err := args.add(arg, tokens[t], fail); err != nil {
+				return args, err
+			}
+			t++
+		}
+	}
+
+	// Anything left over once we've filled every argument is a mistake
+	if t < len(tokens) {
+		return args, fail(tokens[t].start, tokens[len(tokens)-1].end, "too many arguments")
+	}
+	return args, nil
+} // }}}
+
+// func v.add {{{
+
+// add Converts tok to the type arg takes and adds it to the arguments,
+// using fail to build the error if it can't be converted
+func (v *Args) add(arg Arg, tok token, fail func(start, end int, format string, b ...interface{}) error) error {
+	if tok.err != nil {
+		return tok.err
+	}
+
+	n := 0
+	switch arg.Type {
+	case ArgInt:
+		i, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return fail(tok.start, tok.end, "<%s> must be a number, got %q", arg.Name, tok.text)
+		}
+		n = i
+	case ArgPort:
+		i, err := strconv.Atoi(tok.text)
+		if err != nil || i < 1 || i > 65535 {
+			return fail(tok.start, tok.end, "<%s> must be a port number between 1 and 65535, got %q", arg.Name, tok.text)
+		}
+		n = i
+	}
+
+	v.values = append(v.values, tok.text)
+	v.ints = append(v.ints, n)
+	return nil
+} // }}}
+
+// func v.Len {{{
+
+// Len returns the number of arguments given
+func (v Args) Len() int {
+	return len(v.values)
+} // }}}
+
+// func v.String {{{
+
+// String returns the i'th argument, or an empty string if it wasn't given
+func (v Args) String(i int) string {
+	if i >= len(v.values) {
+		return ""
+	}
+	return v.values[i]
+} // }}}
+
+// func v.Int {{{
+
+// Int returns the value of the i'th argument, which must be an ArgInt or
+// ArgPort argument, or zero if it wasn't given
+func (v Args) Int(i int) int {
+	if i >= len(v.ints) {
+		return 0
+	}
+	return v.ints[i]
+} // }}}
+
+// func v.From {{{
+
+// From returns the arguments from the i'th onward, i.e. everything given to
+// a variadic argument
+func (v Args) From(i int) []string {
+	if i >= len(v.values) {
+		return nil
+	}
+	return append([]string(nil), v.values[i:]...)
+} // }}}
+
+// func e.Error {{{
+
+// Error returns the description of the mistake, followed by the input with
+// the mistake underlined
+func (e *ParseError) Error() string {
+	// Tabs would throw our underline off, so show them as spaces
+	input := strings.Replace(e.Input, "\t", " ", -1)
+	col := utf8.RuneCountInString(e.Input[:e.Start])
+	width := utf8.RuneCountInString(e.Input[e.Start:e.End])
+	if width < 1 {
+		width = 1
+	}
+
+	msg := fmt.Sprintf("%s\n    %s\n    %s%s", e.Msg, input, strings.Repeat(" ", col), strings.Repeat("^", width))
+	if e.Hint != "" {
+		msg += "\n" + e.Hint
+	}
+	return msg
+} // }}}
+
+// func isSpace {{{
+
+// isSpace reports whether c separates words
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+} // }}}
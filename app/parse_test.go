@@ -0,0 +1,172 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+// func TestTokenize {{{
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		words []string
+	}{
+		{"", nil},
+		{"   \t ", nil},
+		{"send 1 hello", []string{"send", "1", "hello"}},
+		{"  send\t1   hello  ", []string{"send", "1", "hello"}},
+		{`"hello world"`, []string{"hello world"}},
+		{`'hello world'`, []string{"hello world"}},
+		{`""`, []string{""}},
+		{`"a b"c d`, []string{"a bc", "d"}},
+		{`don't`, []string{"don't"}},
+		{`say"hi"`, []string{`say"hi"`}},
+		{`'no \n escapes'`, []string{`no \n escapes`}},
+		{`"it's"`, []string{"it's"}},
+		{`'say "hi"'`, []string{`say "hi"`}},
+		{`"a\nb"`, []string{"a\nb"}},
+		{`"a\tb"`, []string{"a\tb"}},
+		{`"a\rb"`, []string{"a\rb"}},
+		{`"a\\b"`, []string{`a\b`}},
+		{`"a\"b"`, []string{`a"b`}},
+		{`"a\'b"`, []string{`a'b`}},
+		{`"a\ b"`, []string{"a b"}},
+		{`a\ b`, []string{"a b"}},
+		{`a\nb`, []string{"a\nb"}},
+		{`\"quoted\"`, []string{`"quoted"`}},
+		{`"\u00e9t\u00e9"`, []string{"été"}},
+		{`\u263A`, []string{"☺"}},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.input)
+		if err != nil {
+			t.Errorf("tokenize(%q) failed: %v", test.input, err)
+			continue
+		}
+		var words []string
+		for _, tok := range tokens {
+			if tok.err != nil {
+				t.Errorf("tokenize(%q): word %q has a bad escape: %v", test.input, tok.text, tok.err)
+			}
+			words = append(words, tok.text)
+		}
+		if strings.Join(words, "|") != strings.Join(test.words, "|") || len(words) != len(test.words) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.input, words, test.words)
+		}
+	}
+} // }}}
+
+// func TestTokenizeBadEscapes {{{
+
+// Bad escapes outside of quotes are only mistakes once the word is used,
+// while those in quotes always are
+func TestTokenizeBadEscapes(t *testing.T) {
+	tokens, err := tokenize(`C:\temp\dir x\`)
+	if err != nil {
+		t.Fatalf("tokenize failed: %v", err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("got %d words, want 2", len(tokens))
+	}
+	if tokens[0].err == nil || tokens[1].err == nil {
+		t.Errorf("expected both words to have a bad escape")
+	}
+	if tokens[0].raw != `C:\temp\dir` || tokens[1].raw != `x\` {
+		t.Errorf("raw words = %q, %q", tokens[0].raw, tokens[1].raw)
+	}
+
+	for _, input := range []string{`"\d"`, `"\u12"`, `"\uZZZZ"`, `"\uD800"`, `"abc`, `'abc`} {
+		if _, err := tokenize(input); err == nil {
+			t.Errorf("tokenize(%q) succeeded, want an error", input)
+		}
+	}
+} // }}}
+
+// func TestParseArgsRest {{{
+
+// The rest of the input keeps the whitespace it was typed with, and only has
+// the escapes within quotes undone
+func TestParseArgsRest(t *testing.T) {
+	cmd := &Command{
+		Name: "send",
+		Args: []Arg{{Name: "connection id", Type: ArgInt}, {Name: "message", Rest: true}},
+	}
+	tests := []struct {
+		input, message string
+	}{
+		{"send 1 hello", "hello"},
+		{"send 1 hello   there\tyou ", "hello   there\tyou"},
+		{`send 1 C:\temp\dir`, `C:\temp\dir`},
+		{`send 1 a\nb`, `a\nb`},
+		{`send 1 trailing\`, `trailing\`},
+		{`send 1 "quoted\tstring"  and\tthen`, "quoted\tstring  and\\tthen"},
+		{`send 1 'single \n'`, `single \n`},
+		{`send 1 don't "stop"`, `don't stop`},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.input)
+		if err != nil {
+			t.Errorf("tokenize(%q) failed: %v", test.input, err)
+			continue
+		}
+		args, err := cmd.parseArgs(test.input, tokens[1:])
+		if err != nil {
+			t.Errorf("parseArgs(%q) failed: %v", test.input, err)
+			continue
+		}
+		if args.Int(0) != 1 || args.String(1) != test.message {
+			t.Errorf("parseArgs(%q) = %d, %q, want 1, %q", test.input, args.Int(0), args.String(1), test.message)
+		}
+	}
+} // }}}
+
+// func TestParseErrorCaret {{{
+
+// Errors underline where the mistake was made
+func TestParseErrorCaret(t *testing.T) {
+	cmd := &Command{
+		Name: "connect",
+		Args: []Arg{{Name: "destination"}, {Name: "port no", Type: ArgPort}},
+	}
+	tests := []struct {
+		input string
+		caret string
+	}{
+		{"connect host nope", "             ^^^^"},
+		{"connect host 70000", "             ^^^^^"},
+		{"connect host", "            ^"},
+		{"connect host 1 2 3", "               ^^^"},
+		{`connect ho\d 4545`, "          ^^"},
+		{`connect "h\d" 4545`, "          ^^"},
+		{`connect "host 4545`, "        ^^^^^^^^^^"},
+		{`connect héllo nope`, "              ^^^^"},
+		{"connect\thost nope", "             ^^^^"},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.input)
+		if err == nil {
+			_, err = cmd.parseArgs(test.input, tokens[1:])
+		}
+		if err == nil {
+			t.Errorf("%q succeeded, want an error", test.input)
+			continue
+		}
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: got %T, want a *ParseError", test.input, err)
+			continue
+		}
+		lines := strings.Split(pe.Error(), "\n")
+		if len(lines) < 3 {
+			t.Errorf("%q: error has %d lines, want at least 3:\n%s", test.input, len(lines), pe.Error())
+			continue
+		}
+		if caret := strings.TrimPrefix(lines[2], "    "); caret != test.caret {
+			t.Errorf("%q: caret\n%q\nwant\n%q", test.input, caret, test.caret)
+		}
+	}
+} // }}}
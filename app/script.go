@@ -0,0 +1,381 @@
+// Package app provides user input functionality
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Cryliss/chat/events"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long wait-for waits, unless the script says otherwise
+const defaultScriptTimeout = 10 * time.Second
+
+// func a.RunScript {{{
+
+// RunScript Runs the commands in a script, one per line, returning a
+// *ScriptError describing the first step that failed, if any. name is used
+// to describe where the script came from in errors.
+//
+// Besides the usual commands, scripts may use these primitives:
+//
+//	wait-for connection [from <ip>[:<port>]] [timeout <duration>]
+//	wait-for disconnect [from <id|ip[:port]>] [timeout <duration>]
+//	wait-for message <pattern> [from <id|ip[:port]>] [timeout <duration>]
+//	assert peers <n>
+//	assert connected <id|ip[:port]>
+//	assert received <pattern> [from <id|ip[:port]>]
+//	expect-error <command>
+//	set timeout <duration>
+//	sleep <duration>
+//	echo <text>
+//
+// Patterns are regular expressions, best wrapped in single quotes so that
+// their backslashes aren't taken as escapes, i.e. 'ping \d+'. Each wait-for consumes the events up to
+// and including the one it matched, so a script can wait for the same kind
+// of event several times in a row, and won't miss events that happened
+// before it started waiting. Blank lines and lines starting with # are
+// ignored, and exit ends the script early.
+func (a *Application) RunScript(r io.Reader, name string) error {
+	sr := &scriptRunner{
+		a:       a,
+		name:    name,
+		timeout: defaultScriptTimeout,
+		notify:  make(chan struct{}, 1),
+	}
+	unsubscribe := a.bus.Subscribe(sr.record)
+	defer unsubscribe()
+
+	a.scripting = true
+	defer func() { a.scripting = false }()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		sr.line++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		a.Out("[%s:%d] %s\n", name, sr.line, line)
+		done, err := sr.step(line)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &ScriptError{Name: name, Line: sr.line, Err: err}
+	}
+	return nil
+} // }}}
+
+// func sr.record {{{
+
+// record Keeps hold of every event published while the script runs, so the
+// wait-for and assert steps can look through them
+func (sr *scriptRunner) record(e events.Event) {
+	sr.mu.Lock()
+	sr.events = append(sr.events, e)
+	sr.mu.Unlock()
+
+	// Wake up anyone waiting for an event, without blocking if nobody is
+	select {
+	case sr.notify <- struct{}{}:
+	default:
+	}
+} // }}}
+
+// func sr.step {{{
+
+// step Runs a single line of the script, returning true if the script
+// should end here
+func (sr *scriptRunner) step(line string) (bool, error) {
+	tokens, err := tokenize(line)
+	if err != nil {
+		return false, sr.fail(err)
+	}
+
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = t.text
+	}
+
+	// Our own steps take their words as words, so they mustn't have any
+	// bad escapes, but commands check their own
+	switch words[0] {
+	case "wait-for", "assert", "set", "sleep", "echo":
+		for _, t := range tokens {
+			if t.err != nil {
+				return false, sr.fail(t.err)
+			}
+		}
+	}
+
+	switch words[0] {
+	case "wait-for":
+		return false, sr.waitFor(words[1:])
+	case "assert":
+		return false, sr.assert(words[1:])
+	case "expect-error":
+		if len(tokens) < 2 {
+			return false, sr.failf("expect-error needs a command to run")
+		}
+		if err := sr.a.ParseInput(line[tokens[1].start:]); err == nil {
+			return false, sr.failf("expected %q to fail, but it succeeded", line[tokens[1].start:])
+		}
+		return false, nil
+	case "set":
+		if len(words) != 3 || words[1] != "timeout" {
+			return false, sr.failf("usage: set timeout <duration>")
+		}
+		d, err := time.ParseDuration(words[2])
+		if err != nil {
+			return false, sr.fail(err)
+		}
+		sr.timeout = d
+		return false, nil
+	case "sleep":
+		if len(words) != 2 {
+			return false, sr.failf("usage: sleep <duration>")
+		}
+		d, err := time.ParseDuration(words[1])
+		if err != nil {
+			return false, sr.fail(err)
+		}
+		time.Sleep(d)
+		return false, nil
+	case "echo":
+		sr.a.Out("%s\n", strings.Join(words[1:], " "))
+		return false, nil
+	}
+
+	// Exiting would take the whole program down with it, so we treat it
+	// as the end of the script and leave the exiting to our caller
+	if cmd, ok := sr.a.lookup(words[0]); ok && cmd.Name == "exit" {
+		return true, nil
+	}
+
+	// Anything else is a normal command
+	if err := sr.a.ParseInput(line); err != nil {
+		return false, sr.fail(err)
+	}
+	return false, nil
+} // }}}
+
+// func sr.waitFor {{{
+
+// waitFor Waits for an event matching the arguments of a wait-for step
+func (sr *scriptRunner) waitFor(args []string) error {
+	if len(args) == 0 {
+		return sr.failf("usage: wait-for connection|disconnect|message ...")
+	}
+
+	var kind events.Kind
+	var pattern *regexp.Regexp
+	rest := args[1:]
+
+	switch args[0] {
+	case "connection":
+		kind = events.PeerConnected
+	case "disconnect":
+		kind = events.PeerDisconnected
+	case "message":
+		kind = events.MessageReceived
+		if len(rest) == 0 {
+			return sr.failf("usage: wait-for message <pattern> [from <id|ip[:port]>] [timeout <duration>]")
+		}
+		re, err := regexp.Compile(rest[0])
+		if err != nil {
+			return sr.fail(err)
+		}
+		pattern = re
+		rest = rest[1:]
+	default:
+		return sr.failf("unknown wait-for %q, expected connection, disconnect or message", args[0])
+	}
+
+	from, timeout, err := sr.options(rest)
+	if err != nil {
+		return err
+	}
+
+	match := func(e events.Event) bool {
+		return e.Kind == kind && matchesPeer(e, from) && (pattern == nil || pattern.MatchString(e.Message))
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// Have we seen a matching event since the last thing we waited for?
+		sr.mu.Lock()
+		for i := sr.next; i < len(sr.events); i++ {
+			if match(sr.events[i]) {
+				sr.next = i + 1
+				sr.mu.Unlock()
+				return nil
+			}
+		}
+		sr.mu.Unlock()
+
+		select {
+		case <-sr.notify:
+		case <-deadline.C:
+			what := args[0]
+			if pattern != nil {
+				what += fmt.Sprintf(" matching %q", pattern)
+			}
+			if from != "" {
+				what += " from " + from
+			}
+			return sr.failf("timed out after %v waiting for %s", timeout, what)
+		}
+	}
+} // }}}
+
+// func sr.assert {{{
+
+// assert Checks the condition of an assert step holds
+func (sr *scriptRunner) assert(args []string) error {
+	if len(args) == 0 {
+		return sr.failf("usage: assert peers|connected|received ...")
+	}
+
+	switch args[0] {
+	case "peers":
+		if len(args) != 2 {
+			return sr.failf("usage: assert peers <n>")
+		}
+		want, err := strconv.Atoi(args[1])
+		if err != nil {
+			return sr.fail(err)
+		}
+		if got := len(sr.a.s.List()); got != want {
+			return sr.failf("expected %d peers, but there are %d", want, got)
+		}
+		return nil
+	case "connected":
+		if len(args) != 2 {
+			return sr.failf("usage: assert connected <id|ip[:port]>")
+		}
+		for _, p := range sr.a.s.List() {
+			e := events.Event{ConnID: p.ID, IP: p.IP, Port: p.Port}
+			if matchesPeer(e, args[1]) {
+				return nil
+			}
+		}
+		return sr.failf("expected to be connected to %s, but we aren't", args[1])
+	case "received":
+		if len(args) < 2 {
+			return sr.failf("usage: assert received <pattern> [from <id|ip[:port]>]")
+		}
+		re, err := regexp.Compile(args[1])
+		if err != nil {
+			return sr.fail(err)
+		}
+		from, _, err := sr.options(args[2:])
+		if err != nil {
+			return err
+		}
+
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+		for _, e := range sr.events {
+			if e.Kind == events.MessageReceived && matchesPeer(e, from) && re.MatchString(e.Message) {
+				return nil
+			}
+		}
+		return sr.failf("no message matching %q has been received", args[1])
+	}
+	return sr.failf("unknown assert %q, expected peers, connected or received", args[0])
+} // }}}
+
+// func sr.options {{{
+
+// options Parses the "from" and "timeout" options that may follow a step
+func (sr *scriptRunner) options(args []string) (string, time.Duration, error) {
+	from := ""
+	timeout := sr.timeout
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return "", 0, sr.failf("option %q is missing its value", args[i])
+		}
+		switch args[i] {
+		case "from":
+			from = args[i+1]
+		case "timeout":
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return "", 0, sr.fail(err)
+			}
+			timeout = d
+		default:
+			return "", 0, sr.failf("unknown option %q, expected from or timeout", args[i])
+		}
+	}
+	return from, timeout, nil
+} // }}}
+
+// func sr.fail {{{
+
+// fail returns a *ScriptError for the current line
+func (sr *scriptRunner) fail(err error) error {
+	return &ScriptError{Name: sr.name, Line: sr.line, Err: err}
+} // }}}
+
+// func sr.failf {{{
+
+// failf returns a *ScriptError for the current line with a formatted message
+func (sr *scriptRunner) failf(format string, b ...interface{}) error {
+	return sr.fail(fmt.Errorf(format, b...))
+} // }}}
+
+// func e.Error {{{
+
+// Error returns where the script failed and why
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.Name, e.Line, e.Err)
+} // }}}
+
+// func e.Unwrap {{{
+
+// Unwrap returns the error that caused the script to fail
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+} // }}}
+
+// func matchesPeer {{{
+
+// matchesPeer reports whether the event is about the peer described by
+// from, which is either a connection id, an ip or an ip:port. An empty
+// from matches any peer.
+func matchesPeer(e events.Event, from string) bool {
+	if from == "" {
+		return true
+	}
+	if id, err := strconv.ParseUint(from, 10, 32); err == nil {
+		return e.ConnID == uint32(id)
+	}
+	if host, port, err := splitHostPort(from); err == nil {
+		return e.IP == host && e.Port == port
+	}
+	return e.IP == from
+} // }}}
+
+// func splitHostPort {{{
+
+// splitHostPort splits an ip:port, returning an error if there's no port
+func splitHostPort(s string) (string, string, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("%q has no port", s)
+	}
+	return s[:i], s[i+1:], nil
+} // }}}
@@ -1,28 +1,258 @@
 // Package app provides user input functionality
 package app
 
-import "github.com/Cryliss/chat/types"
-
-// Commands the user can give the application
-// We are using a map[string]string here, just in case
-// the user wants to be lazy and not type the whole thing out
-var commands = map[string]string{
-	"1": "help",
-	"2": "myip",
-	"3": "myport",
-	"4": "connect",
-	"5": "list",
-	"6": "terminate",
-	"7": "send",
-	"8": "exit",
+import (
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/gateway"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/netsim"
+	"github.com/Cryliss/chat/types"
+	"io"
+	"sync"
+	"time"
+)
+
+// The prompt we show whenever we're waiting on the user to give us a command
+const prompt = "Please enter a command: "
+
+// type ArgType int {{{
+
+// ArgType is the type of value an argument takes
+type ArgType int
+
+const (
+	// ArgString arguments take any text
+	ArgString ArgType = iota
+
+	// ArgInt arguments must be a whole number, i.e. a connection id
+	ArgInt
+
+	// ArgPort arguments must be a valid port number
+	ArgPort
+) // }}}
+
+// type Arg struct {{{
+
+// Arg describes one of the arguments a command takes
+type Arg struct {
+	// Name of the argument, as shown in the usage text, i.e. "port no"
+	Name string
+
+	// The type of value the argument takes
+	Type ArgType
+
+	// Whether the argument may be left out. Only trailing arguments may
+	// be optional.
+	Optional bool
+
+	// Whether the argument takes the rest of the input, spaces and all,
+	// i.e. the message given to send. Backslashes outside of quotes are
+	// left as they were typed. Only the last argument may do so.
+	Rest bool
+
+	// Whether the argument may be given any number of times, i.e. the
+	// commands given to help. Only the last argument may do so.
+	Variadic bool
+
+	// Returns the values the argument may take, for tab completion.
+	// May be nil.
+	Values func(a *Application) []string
+} // }}}
+
+// type Command struct {{{
+
+// Command describes a command the user can give the application. The
+// parser, help text and startup text are all generated from these, so a
+// new command only needs to be described once.
+type Command struct {
+	// Name the user types to run the command, i.e. "connect"
+	Name string
+
+	// Shorter name the user can type instead. Left empty, the command is
+	// given the next available number, so the user can be lazy and not
+	// type the whole thing out.
+	Alias string
+
+	// The arguments the command takes, in order
+	Args []Arg
+
+	// One line description of the command, for the help text
+	Summary string
+
+	// Any further explanation, i.e. an example, shown below the summary
+	Details string
+
+	// Runs the command with the arguments the user gave. By the time this
+	// is called, we've already checked the arguments match Args.
+	Run func(a *Application, args Args) error
+} // }}}
+
+// type Args struct {{{
+
+// Args holds the arguments given to a command, already converted to the
+// types the command asked for
+type Args struct {
+	// The text of each argument, with any quotes and escapes removed
+	values []string
+
+	// The numeric value of each ArgInt or ArgPort argument
+	ints []int
+} // }}}
+
+// type token struct {{{
+
+// token is a single word of the users input
+type token struct {
+	// The word, with any quotes and escapes removed, and the word with
+	// only its quotes removed, and the escapes within them
+	text string
+	raw  string
+
+	// The first bad escape outside of quotes, if there was one
+	err error
+
+	// Where the word starts and ends in the input, in bytes
+	start int
+	end   int
+} // }}}
+
+// type ParseError struct {{{
+
+// ParseError describes a mistake in the users input, and where it was made
+type ParseError struct {
+	// What the user gave us
+	Input string
+
+	// Where the mistake starts and ends in the input, in bytes
+	Start int
+	End   int
+
+	// What was wrong
+	Msg string
+
+	// How to get it right, shown after where the mistake is
+	Hint string
+} // }}}
+
+// type scriptRunner struct {{{
+
+// scriptRunner holds the state of a script being run by RunScript
+type scriptRunner struct {
+	a *Application
+
+	// Where the script came from, and the line we're on
+	name string
+	line int
+
+	// How long wait-for waits, unless told otherwise
+	timeout time.Duration
+
+	// Locks the events below, as they're recorded by whichever goroutine
+	// published them
+	mu sync.Mutex
+
+	// Every event published since the script started, and the index of
+	// the first one the next wait-for should look at
+	events []events.Event
+	next   int
+
+	// Signalled whenever a new event is recorded
+	notify chan struct{}
+} // }}}
+
+// type ScriptError struct {{{
+
+// ScriptError describes the step of a script that failed
+type ScriptError struct {
+	// Where the script came from, and the line that failed
+	Name string
+	Line int
+
+	// Why it failed
+	Err error
+} // }}}
+
+// composition holds a multi-line message the user is in the middle of writing
+type composition struct {
+	// The connection the message is going to
+	conn int
+
+	// The line that ends the message
+	terminator string
+
+	// The lines written so far
+	lines []string
+}
+
+// focus is the peer the user is chatting with, where every line they enter
+// is sent as a message rather than run as a command
+type focus struct {
+	// The connection the messages go to, and who's on the other end
+	conn int
+	ip   string
+	port string
+}
+
+// listOptions is how the user asked list to show the connections
+type listOptions struct {
+	// Show more columns, or JSON instead of a table
+	verbose bool
+	json    bool
+
+	// What to sort by, one of listSorts, and whether to reverse it
+	sort    string
+	reverse bool
+
+	// Only show connections in this direction, over this transport, with
+	// unread messages, or whose address or name contains this text
+	dir    string
+	via    string
+	unread bool
+	match  string
+}
+
+// listOutput is what list -json prints
+type listOutput struct {
+	Connections []listPeer `json:"connections"`
+	Dialing     []listPeer `json:"dialing"`
+	Awaiting    []listPeer `json:"awaiting"`
+}
+
+// listPeer is how list -json shows a connection, leaving out what isn't known
+// about those that aren't established yet
+type listPeer struct {
+	ID           uint32 `json:"id"`
+	IP           string `json:"ip"`
+	Port         string `json:"port"`
+	Transport    string `json:"transport,omitempty"`
+	Direction    string `json:"direction,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+	Version      int    `json:"version,omitempty"`
+	Security     string `json:"security,omitempty"`
+	Connected    string `json:"connected,omitempty"`
+	LastActivity string `json:"last_activity,omitempty"`
+	Unread       int    `json:"unread"`
+	MessagesIn   uint64 `json:"messages_in"`
+	MessagesOut  uint64 `json:"messages_out"`
+	BytesIn      uint64 `json:"bytes_in"`
+	BytesOut     uint64 `json:"bytes_out"`
+	Queued       int    `json:"queued"`
+	QueueSize    int    `json:"queue_size"`
+	Dropped      uint64 `json:"dropped"`
 }
 
 // Application holds details related to our application
 type Application struct {
 	s types.Server
 
-	// Map of the application commands, see above
-	commands map[string]string
+	// The event bus the server publishes to
+	bus *events.Bus
+
+	// The commands the user can give, in the order they were registered,
+	// and the same commands by both their name and alias
+	commands []*Command
+	byName   map[string]*Command
 
 	// The port provided at runtime
 	port int
@@ -33,4 +263,45 @@ type Application struct {
 	// To hold the formatted string for the connection service
 	// ':<port>'
 	service string
+
+	// Where Out and OutErr write to, stdout and stderr unless the
+	// frontend says otherwise
+	out    io.Writer
+	errOut io.Writer
+
+	// Whether the frontend keeps the prompt on screen itself
+	livePrompt bool
+
+	// Whether a message arriving only gets a one line notice, leaving it in
+	// the inbox, rather than being shown
+	notices bool
+
+	// Whether we're running a script, which waits for each connect to
+	// finish rather than leaving it to carry on in the background
+	scripting bool
+
+	// Locks the message being composed, as frontends may ask for the
+	// prompt from other goroutines
+	mu sync.Mutex
+
+	// The message the user is composing, if they are
+	compose *composition
+
+	// The peer the user is chatting with, if they are
+	focus *focus
+
+	// Functions to call before we exit, so the frontends can clean up
+	// after themselves, i.e. restore the terminal
+	onExit []func()
+
+	// Where diagnostics are logged to, and our own logger. Nil logs
+	// nothing.
+	logs *logging.Root
+	log  *logging.Logger
+
+	// The simulated network our connections are run through, if they are
+	network *netsim.Network
+
+	// The websocket gateway browsers join through, if they can
+	gateway *gateway.Gateway
 }
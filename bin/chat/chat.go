@@ -1,14 +1,30 @@
 package main
 
 import (
-	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/Cryliss/chat/admin"
 	"github.com/Cryliss/chat/app"
+	"github.com/Cryliss/chat/capture"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/gateway"
+	"github.com/Cryliss/chat/irc"
+	"github.com/Cryliss/chat/lineedit"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/netsim"
 	"github.com/Cryliss/chat/server"
+	"github.com/Cryliss/chat/tui"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // func usage {{{
@@ -24,53 +40,406 @@ func usage() {
 
 func main() {
 	var port int
+	var eventLog string
+	var fullScreen bool
+	var messageNotices bool
+	var history string
+	var maxMessage int
+	var sendQueue int
+	var sendOverflow string
+	var writeTimeout time.Duration
+	var dialTimeout time.Duration
+	var inbound string
+	var approvalTimeout time.Duration
+	var name string
+	var identity string
+	var script string
+	var adminPort int
+	var adminToken string
+	var wsPort int
+	var wsPublic bool
+	var wsToken string
+	var ircPort int
+	var ircToken string
+	var rawPort int
+	var metricsPort int
+	var captureFile string
+	var simulate bool
+	var logFile string
+	var logLevel string
+	var logFormat string
+	var logMaxSize int
+	var logMaxBackups int
+
+	// By default we keep the command history in the users home directory
+	if home, err := os.UserHomeDir(); err == nil {
+		history = filepath.Join(home, ".chatty_history")
+		identity = filepath.Join(home, ".chatty_identity")
+	}
 
 	// Lets load our flags.
 	flag.IntVar(&port, "port", -1, "Port to listen on for incoming connections")
+	flag.StringVar(&eventLog, "events", "", "File to append a JSON log of all connection and message events to")
+	flag.BoolVar(&fullScreen, "tui", false, "Use the full screen terminal UI instead of line mode")
+	flag.BoolVar(&messageNotices, "message-notices", false, "Show a one line notice when a message arrives, leaving it in the inbox, instead of the message itself")
+	flag.IntVar(&maxMessage, "max-message", server.DefaultMaxMessage, "Longest message, in characters, to accept from peers. Peers agree on the shorter of their two limits")
+	flag.IntVar(&sendQueue, "send-queue", client.DefaultQueueSize, "How many messages may wait to be sent to each peer")
+	flag.StringVar(&sendOverflow, "send-overflow", "block", "What to do when a peers send queue is full, block, drop-oldest or disconnect")
+	flag.DurationVar(&writeTimeout, "write-timeout", client.DefaultWriteTimeout, "How long to give a single write to a peer before closing the connection, or 0 to wait forever")
+	flag.DurationVar(&dialTimeout, "dial-timeout", server.DefaultDialTimeout, "How long to wait for a peer to answer when connecting to it")
+	flag.StringVar(&inbound, "inbound", "accept", "What to do with peers that connect to us, accept them straight away or ask the user first")
+	flag.DurationVar(&approvalTimeout, "approval-timeout", server.DefaultApprovalTimeout, "How long a peer that connects to us waits to be accepted, with -inbound ask, before it's rejected")
+	flag.StringVar(&name, "name", "", "Name to announce to peers, shown to them when deciding whether to accept us")
+	flag.StringVar(&identity, "identity", identity, "File holding the key we announce to peers, so they can recognise us again. Created if it doesn't exist, or empty to not announce one")
+	flag.StringVar(&script, "script", "", "Run the commands in this file, then exit with a status of 0 if every step succeeded or 1 if one failed")
+	flag.IntVar(&adminPort, "admin-port", 0, "Port to serve the HTTP admin API on, on loopback only. Disabled unless given")
+	flag.StringVar(&adminToken, "admin-token-file", "", "File to write the admin API token to, chatty-<port>.token in the temp directory by default")
+	flag.IntVar(&wsPort, "ws-port", 0, "Port to serve the websocket gateway and browser chat page on, on loopback only unless -ws-public is given. Disabled unless given")
+	flag.BoolVar(&wsPublic, "ws-public", false, "Serve the websocket gateway on every interface, so people on other machines can reach it")
+	flag.StringVar(&wsToken, "ws-token-file", "", "File to write the websocket gateway token to, chatty-<port>-ws.token in the temp directory by default")
+	flag.IntVar(&ircPort, "irc-port", 0, "Port to serve the IRC bridge on, on loopback only. Disabled unless given")
+	flag.StringVar(&ircToken, "irc-token-file", "", "File to write the IRC bridge token to, chatty-<port>-irc.token in the temp directory by default")
+	flag.IntVar(&rawPort, "raw-port", 0, "Port to accept plain text connections on, one message per line, for tools like nc. Disabled unless given")
+	flag.IntVar(&metricsPort, "metrics-port", 0, "Port to serve Prometheus metrics on, at /metrics on loopback only. Disabled unless given")
+	flag.StringVar(&captureFile, "capture", "", "File to record every frame sent and received on new connections to, for the replay tool")
+	flag.BoolVar(&simulate, "netsim", false, "Run every connection through a simulated network, whose latency, bandwidth and faults the netsim command can change")
+	flag.StringVar(&logFile, "log-file", "", "File to write diagnostics to, chatty-<port>.log in the temp directory by default. Pass \"off\" to not log at all")
+	flag.StringVar(&logLevel, "log-level", "info", "Levels to log at, either one for everything or per subsystem, i.e. \"info,server=debug,client=warn\"")
+	flag.StringVar(&logFormat, "log-format", "logfmt", "Format of the log file, logfmt or json")
+	flag.IntVar(&logMaxSize, "log-max-size", 10, "Size in MB the log file may grow to before it's rotated")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 3, "How many rotated log files to keep")
+	flag.StringVar(&history, "history", history, "File to save command history to between sessions, or empty to not save it")
 	flag.Parse()
 
-	// Did we get a port number?
-	if port == -1 {
+	// Did we get a port number, and a sensible message length?
+	if port == -1 || maxMessage < 1 || sendQueue < 1 || writeTimeout < 0 || dialTimeout < 0 || approvalTimeout <= 0 {
 		usage()
 	}
+	if inbound != "accept" && inbound != "ask" {
+		fmt.Fprintf(os.Stderr, "unknown -inbound %q, expected accept or ask\n", inbound)
+		os.Exit(-1)
+	}
+	key, err := loadIdentity(identity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load identity: %v\n", err)
+		os.Exit(-1)
+	}
+	overflow, err := client.ParseOverflowPolicy(sendOverflow)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
 
 	// Get the ip address of the machine running the program
 	p := fmt.Sprintf("%d", port)
 	ip := GetOutboundIP(p)
 
+	// Create the event bus the server will tell everyone what it's doing on
+	bus := events.NewBus()
+
+	// Do we need to log the events to a file as well? It holds every
+	// message we send and receive, so only we may read it
+	if eventLog != "" {
+		f, err := os.OpenFile(eventLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open event log: %v\n", err)
+			os.Exit(-1)
+		}
+		defer f.Close()
+		bus.Subscribe(events.JSONLogger(f))
+	}
+
 	// Create a new server
-	server := server.New(ip, port)
+	server := server.New(ip, port, bus)
+	server.SetMaxMessage(maxMessage)
+	server.SetSendQueue(sendQueue, overflow)
+	server.SetWriteTimeout(writeTimeout)
+	server.SetDialTimeout(dialTimeout)
+	server.SetApproval(inbound == "ask", approvalTimeout)
+	server.SetIdentity(name, key)
 
 	// Create a new application for user input / output
-	app, _ := app.New(port, ip, server)
+	app, _ := app.New(port, ip, server, bus)
+	app.SetMessageNotices(messageNotices)
+
+	// Are we putting our connections through a bad network on purpose?
+	if simulate {
+		network := netsim.New()
+		server.SetNetwork(network)
+		app.SetNetwork(network)
+	}
+
+	// Do we need to capture the traffic too?
+	if captureFile != "" {
+		f, err := os.OpenFile(captureFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open capture file: %v\n", err)
+			os.Exit(-1)
+		}
+		defer f.Close()
+		server.SetCapture(capture.NewWriter(f))
+	}
+
+	// Set up our diagnostics log, well away from what the user sees
+	if logFile != "off" {
+		if logFile == "" {
+			logFile = filepath.Join(os.TempDir(), fmt.Sprintf("chatty-%d.log", port))
+		}
+		logs, closeLog, err := openLog(logFile, logLevel, logFormat, logMaxSize, logMaxBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open log: %v\n", err)
+			os.Exit(-1)
+		}
+		defer closeLog()
+		app.OnExit(closeLog)
+		server.SetLogging(logs)
+		app.SetLogging(logs)
+	}
 
-	// Set the server's app and start listening for connections
-	server.SetApplication(app)
+	// Start listening for connections
 	go server.Listen()
 
-	// Create a new bufio reader to read user input from the command line
-	reader := bufio.NewReader(os.Stdin)
+	// Were we asked to accept plain text connections too?
+	if rawPort > 0 {
+		if err := server.ListenRaw(rawPort); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to listen for raw connections: %v\n", err)
+			os.Exit(-1)
+		}
+	}
 
-	// Variable to store our scanned input into
-	var userInput string
+	// Were we asked to serve our metrics?
+	if metricsPort > 0 {
+		addr, err := serveMetrics(server, metricsPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to serve metrics: %v\n", err)
+			os.Exit(-1)
+		}
+		fmt.Printf("Metrics at http://%s/metrics\n", addr)
+	}
 
-	for {
-		// Prompt the user for a command
-		app.Out("\nPlease enter a command: ")
+	// Were we asked to serve the admin API?
+	if adminPort > 0 {
+		if adminToken == "" {
+			adminToken = filepath.Join(os.TempDir(), fmt.Sprintf("chatty-%d.token", port))
+		}
+		api, err := admin.New(server, bus, adminPort, adminToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to start the admin API: %v\n", err)
+			os.Exit(-1)
+		}
+		go api.Serve()
+		app.OnExit(func() { api.Close() })
+		fmt.Printf("Admin API listening on http://%s, token written to %s\n", api.Addr(), adminToken)
+	}
+
+	// Were we asked to let browsers join?
+	if wsPort > 0 {
+		if wsToken == "" {
+			wsToken = filepath.Join(os.TempDir(), fmt.Sprintf("chatty-%d-ws.token", port))
+		}
+		host, shown := "127.0.0.1", "127.0.0.1"
+		if wsPublic {
+			host, shown = "", ip
+		}
+		gw, err := gateway.New(server, bus, host, wsPort, wsToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to start the websocket gateway: %v\n", err)
+			os.Exit(-1)
+		}
+		go gw.Serve()
+		app.SetGateway(gw)
+		app.OnExit(func() { gw.Close() })
+		fmt.Printf("Browser chat page at http://%s/?token=<token>, token written to %s\n", net.JoinHostPort(shown, strconv.Itoa(wsPort)), wsToken)
+	}
 
-		// Read user input and save into userInput variable
-		userInput, _ = reader.ReadString('\n')
-		userInput = strings.Replace(userInput, "\n", "", -1)
+	// Were we asked to bridge to IRC clients?
+	if ircPort > 0 {
+		if ircToken == "" {
+			ircToken = filepath.Join(os.TempDir(), fmt.Sprintf("chatty-%d-irc.token", port))
+		}
+		bridge, err := irc.New(server, bus, ircPort, ircToken)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to start the IRC bridge: %v\n", err)
+			os.Exit(-1)
+		}
+		go bridge.Serve()
+		app.OnExit(func() { bridge.Close() })
+		fmt.Printf("IRC bridge listening on %s, token written to %s\n", bridge.Addr(), ircToken)
+	}
+
+	// Were we given a script to run instead of reading commands from the user?
+	if script != "" {
+		os.Exit(runScript(app, server, bus, script))
+	}
+
+	// Were we asked for the full screen UI?
+	if fullScreen {
+		ui := tui.New(app, server, bus, net.JoinHostPort(ip, p))
+		app.SetOutput(ui.Writer(), ui.Writer())
+		app.SetLivePrompt(true)
+		app.OnExit(ui.Close)
+
+		err := ui.Start()
+		if err == nil {
+			app.Welcome()
+			ui.Run()
+
+			// Stdin was closed, so there's nothing left for us to do
+			app.ParseInput("exit")
+			return
+		}
+
+		app.SetOutput(os.Stdout, os.Stderr)
+		fmt.Fprintf(os.Stderr, "Unable to start the full screen UI (%v), falling back to line mode\n", err)
+	}
+
+	runLineMode(app, bus, history)
+} // }}}
+
+// func runLineMode {{{
+
+// runLineMode Reads commands from stdin one line at a time, printing
+// events as they happen
+func runLineMode(app *app.Application, bus *events.Bus, history string) {
+	// Create a new line editor to read user input from the command line,
+	// and print everything through it so it can redraw the line being edited
+	editor := lineedit.New(app.Complete, lineedit.NewHistory(history, 0))
+	editor.SetHistoryFilter(app.Remember)
+	app.SetOutput(editor.Writer(), editor.Writer())
+	app.SetLivePrompt(editor.Interactive())
+
+	app.Welcome()
+	bus.Subscribe(app.HandleEvent)
+
+	for {
+		// Prompt the user for a command, and read their input. Lines of a
+		// message being composed follow one another without a gap.
+		if !app.Composing() {
+			app.Out("\n")
+		}
+		userInput, err := editor.ReadLine(app.PromptText())
+		if errors.Is(err, lineedit.ErrInterrupted) {
+			// They changed their mind about this line, and anything
+			// they were still dialing, so just ask again
+			app.CancelDials()
+			continue
+		}
+		if err != nil {
+			// Ctrl-D or stdin was closed, either way we're done
+			app.ParseInput("exit")
+			return
+		}
 
 		// Parse and handle the users input
 		// If the request resulted in an error, let's let the user know
-		err := app.ParseInput(userInput)
-		if err != nil {
+		if err := app.ParseInput(userInput); err != nil {
 			app.OutErr("ERROR %v\n", err)
 		}
 	}
 } // }}}
 
+// func runScript {{{
+
+// runScript Runs the commands in a script file, printing events as they
+// happen, and returns the status the program should exit with
+func runScript(app *app.Application, server *server.Server, bus *events.Bus, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open script: %v\n", err)
+		return 2
+	}
+	defer f.Close()
+
+	// Nobody is sitting at a prompt, so don't show one
+	app.SetLivePrompt(true)
+	bus.Subscribe(app.HandleEvent)
+
+	err = app.RunScript(f, path)
+
+	// We're done either way, so close any connections the script left open
+	server.Exit()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+} // }}}
+
+// func openLog {{{
+
+// openLog Opens the rotating log file and returns the root to log to, along
+// with a function that closes the file
+func openLog(path, levels, format string, maxSizeMB, maxBackups int) (*logging.Root, func(), error) {
+	f, err := logging.ParseFormat(format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := logging.OpenRotatingFile(path, int64(maxSizeMB)*1024*1024, maxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logs := logging.New(file, f, logging.LevelInfo)
+	if err := logs.SetLevels(levels); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return logs, func() { file.Close() }, nil
+} // }}}
+
+// func loadIdentity {{{
+
+// loadIdentity returns the key we announce to peers, read from the given file,
+// or made up and saved there if it doesn't exist yet. The key is only ever
+// announced, never proven, so it's no secret, but we keep the file private
+// anyway so nobody else picks it up by accident.
+func loadIdentity(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(raw)
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return key, nil
+} // }}}
+
+// func serveMetrics {{{
+
+// serveMetrics Serves the servers metrics at /metrics on the loopback
+// interface at the given port, returning the address it's listening on
+func serveMetrics(server *server.Server, port int) (string, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.Metrics())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go srv.Serve(l)
+	return l.Addr().String(), nil
+} // }}}
+
 // func GetOutboundIP {{{
 
 // GetOutboundIP gets preferred outbound ip of this machine
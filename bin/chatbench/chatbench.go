@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/netsim"
+	"github.com/Cryliss/chat/server"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// How long we give every connection to be established
+const connectTimeout = 30 * time.Second
+
+// The percentiles of latency we report
+var percentiles = []float64{50, 90, 99, 99.9}
+
+// type report struct {{{
+
+// report is what we found, as printed with -json
+type report struct {
+	Peers       int    `json:"peers"`
+	Topology    string `json:"topology"`
+	Transport   string `json:"transport"`
+	Connections int    `json:"connections"`
+	Size        int    `json:"size"`
+	Rate        int    `json:"rate"`
+
+	// How long we sent for, and how long it took for the last message to
+	// arrive after we started, in seconds
+	Duration float64 `json:"duration"`
+	Elapsed  float64 `json:"elapsed"`
+
+	// What happened to the messages: how many we tried to send, how many
+	// Send refused, were written, failed to be written, of which how many
+	// were thrown away by a full queue, and arrived. Lost are those Send
+	// took that never arrived, for whatever reason.
+	Offered    uint64 `json:"offered"`
+	Refused    uint64 `json:"refused"`
+	Written    uint64 `json:"written"`
+	Failed     uint64 `json:"failed"`
+	Overflowed uint64 `json:"overflowed"`
+	Received   uint64 `json:"received"`
+	Lost       uint64 `json:"lost"`
+
+	// How many connections were lost while we were sending
+	Disconnects uint64 `json:"disconnects"`
+
+	// Messages and bytes arriving a second, over the elapsed time
+	Throughput float64 `json:"messages_per_second"`
+	Bytes      float64 `json:"bytes_per_second"`
+
+	// How long messages took to arrive, in microseconds, by percentile,
+	// i.e. "p99"
+	Latency map[string]float64 `json:"latency_us"`
+} // }}}
+
+// func usage {{{
+
+// usage Prints information on how to use the program and then exits
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags]\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(-1)
+} // }}}
+
+// func main {{{
+
+func main() {
+	var n, size, rate, queue int
+	var shape, transport, overflowName string
+	var duration, drain time.Duration
+	var asJSON bool
+	var link netsim.Conditions
+
+	flag.IntVar(&n, "peers", 10, "Number of peers to start")
+	flag.StringVar(&shape, "topology", "star", "How the peers are connected, star, ring or mesh")
+	flag.StringVar(&transport, "transport", "pipe", "What the peers are connected over, in-process pipes, pipes across a simulated network (sim) or loopback tcp")
+	flag.IntVar(&rate, "rate", 100, "Messages a second each peer sends down each of its connections, or 0 to send as fast as they're taken")
+	flag.IntVar(&size, "size", 64, "Length of each message, in bytes")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "How long to send messages for")
+	flag.DurationVar(&drain, "drain", 5*time.Second, "How long to wait for messages still on their way once we stop sending")
+	flag.IntVar(&queue, "send-queue", client.DefaultQueueSize, "Number of messages that may wait to be written to each connection")
+	flag.StringVar(&overflowName, "send-overflow", "block", "What to do when a connections send queue is full, block, drop-oldest or disconnect")
+	flag.BoolVar(&asJSON, "json", false, "Print the results as JSON")
+	flag.DurationVar(&link.Latency, "latency", 0, "Latency of every link, with -transport sim")
+	flag.DurationVar(&link.Jitter, "jitter", 0, "Up to how much longer than the latency each piece takes, with -transport sim")
+	flag.IntVar(&link.Bandwidth, "bandwidth", 0, "Bytes a second every link carries each way, or 0 for no limit, with -transport sim")
+	flag.IntVar(&link.Fragment, "fragment", 0, "Largest piece delivered at once, in bytes, or 0 to deliver writes whole, with -transport sim")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Messages start with when they were sent, which takes 20 bytes
+	if n < 2 || size < 20 || rate < 0 || queue < 1 || duration <= 0 || link.Bandwidth < 0 || link.Fragment < 0 {
+		usage()
+	}
+	overflow, err := client.ParseOverflowPolicy(overflowName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+	edges, err := topology(shape, n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+
+	max := server.DefaultMaxMessage
+	if size > max {
+		max = size
+	}
+	network := netsim.New()
+	network.Set(netsim.Any, netsim.Any, link)
+
+	peers := startPeers(n, max, queue, overflow)
+	if err := connect(peers, edges, transport, network, connectTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect the peers: %v\n", err)
+		exitAll(peers)
+		os.Exit(1)
+	}
+
+	r := run(peers, size, rate, duration, drain)
+	r.Topology = shape
+	r.Transport = transport
+	r.Connections = len(edges)
+	exitAll(peers)
+
+	if asJSON {
+		b, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Printf("%s\n", b)
+		return
+	}
+	r.print()
+} // }}}
+
+// func run {{{
+
+// run Sends messages down every connection, in both directions, for as long
+// as we were asked to, then waits for those still on their way to arrive
+// and reports what happened to them
+func run(peers []*peer, size, rate int, duration, drain time.Duration) report {
+	var senders []*sender
+	for _, p := range peers {
+		for _, c := range p.s.List() {
+			senders = append(senders, newSender(p.s, int(c.ID), size, rate))
+		}
+	}
+
+	// Go!
+	start := time.Now()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, sn := range senders {
+		sn := sn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sn.run(start, stop)
+		}()
+	}
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+	sent := time.Since(start)
+
+	r := report{Peers: len(peers), Size: size, Rate: rate, Duration: sent.Seconds()}
+	for _, sn := range senders {
+		r.Offered += atomic.LoadUint64(&sn.offered)
+		r.Refused += atomic.LoadUint64(&sn.refused)
+	}
+
+	// Wait for whatever is still queued or on the wire to arrive, or for
+	// us to give up on it
+	deadline := time.Now().Add(drain)
+	for {
+		r.count(peers)
+		if r.Received+r.Failed >= r.Offered-r.Refused || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	latencies, last := merge(peers)
+	r.Elapsed = last.Sub(start).Seconds()
+	if r.Elapsed > 0 {
+		r.Throughput = float64(r.Received) / r.Elapsed
+		r.Bytes = r.Throughput * float64(size)
+	}
+	if accepted := r.Offered - r.Refused; accepted > r.Received {
+		r.Lost = accepted - r.Received
+	}
+
+	r.Latency = make(map[string]float64)
+	if len(latencies) > 0 {
+		r.Latency["min"] = micros(latencies[0])
+		for _, p := range percentiles {
+			r.Latency[fmt.Sprintf("p%g", p)] = micros(percentile(latencies, p))
+		}
+		r.Latency["max"] = micros(latencies[len(latencies)-1])
+	}
+	return r
+} // }}}
+
+// func r.count {{{
+
+// count Totals up what each peer has heard about the messages so far
+func (r *report) count(peers []*peer) {
+	r.Written, r.Failed, r.Overflowed, r.Received, r.Disconnects = 0, 0, 0, 0, 0
+	for _, p := range peers {
+		r.Written += atomic.LoadUint64(&p.rec.written)
+		r.Failed += atomic.LoadUint64(&p.rec.failed)
+		r.Disconnects += atomic.LoadUint64(&p.rec.disconnects)
+		for _, c := range p.s.List() {
+			r.Overflowed += c.Dropped
+		}
+		p.rec.mu.Lock()
+		r.Received += uint64(len(p.rec.latencies))
+		p.rec.mu.Unlock()
+	}
+} // }}}
+
+// func r.print {{{
+
+// print Prints the report for a person to read
+func (r report) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "peers\t%d, %s over %s, %d connections\n", r.Peers, r.Topology, r.Transport, r.Connections)
+	if r.Rate > 0 {
+		fmt.Fprintf(w, "load\t%d messages/s of %d bytes down each connection, both ways, for %.1fs\n", r.Rate, r.Size, r.Duration)
+	} else {
+		fmt.Fprintf(w, "load\tas many messages of %d bytes as each connection takes, both ways, for %.1fs\n", r.Size, r.Duration)
+	}
+	fmt.Fprintf(w, "offered\t%d (%.0f/s)\n", r.Offered, float64(r.Offered)/r.Duration)
+	fmt.Fprintf(w, "refused\t%d\n", r.Refused)
+	fmt.Fprintf(w, "written\t%d\n", r.Written)
+	fmt.Fprintf(w, "failed\t%d\n", r.Failed)
+	fmt.Fprintf(w, "overflowed\t%d\n", r.Overflowed)
+	fmt.Fprintf(w, "received\t%d (%.0f/s, %.1f MB/s)\n", r.Received, r.Throughput, r.Bytes/1e6)
+	fmt.Fprintf(w, "lost\t%d\n", r.Lost)
+	fmt.Fprintf(w, "disconnects\t%d\n", r.Disconnects)
+	if r.Received > 0 {
+		fmt.Fprintf(w, "latency\tmin %s", time.Duration(r.Latency["min"]*1e3))
+		for _, p := range percentiles {
+			name := fmt.Sprintf("p%g", p)
+			fmt.Fprintf(w, ", %s %s", name, time.Duration(r.Latency[name]*1e3))
+		}
+		fmt.Fprintf(w, ", max %s\n", time.Duration(r.Latency["max"]*1e3))
+	}
+	w.Flush()
+} // }}}
+
+// func micros {{{
+
+// micros returns a duration in microseconds
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+} // }}}
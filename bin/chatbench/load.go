@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/server"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// type recorder struct {{{
+
+// recorder keeps track of what happened to the messages a peer sent and
+// received, subscribed to its event bus
+type recorder struct {
+	// Locks the latencies, as events are published from every connections
+	// goroutine
+	mu sync.Mutex
+
+	// How long each message we received took to arrive, and when the last
+	// one did
+	latencies []time.Duration
+	last      time.Time
+
+	// How many messages we've been told were written, couldn't be, and
+	// how many connections were lost. Only access these using atomics!
+	written     uint64
+	failed      uint64
+	disconnects uint64
+} // }}}
+
+// type sender struct {{{
+
+// sender sends messages down one of a peers connections, at the rate we were
+// asked for
+type sender struct {
+	s    *server.Server
+	conn int
+
+	// How long the messages are, and how long to wait between them. Zero
+	// sends as fast as the connection takes them.
+	size     int
+	interval time.Duration
+
+	// How many messages we tried to send, and how many Send refused. Only
+	// access these using atomics!
+	offered uint64
+	refused uint64
+} // }}}
+
+// func newRecorder {{{
+
+// newRecorder Initializes and returns a new, empty, recorder
+func newRecorder() *recorder {
+	return &recorder{}
+} // }}}
+
+// func r.HandleEvent {{{
+
+// HandleEvent Records the events we care about, so it must be quick about it,
+// as the connection that published the event waits for us
+func (r *recorder) HandleEvent(e events.Event) {
+	switch e.Kind {
+	case events.MessageReceived:
+		now := time.Now()
+		sent, ok := parseStamp(e.Message)
+		r.mu.Lock()
+		if ok {
+			r.latencies = append(r.latencies, now.Sub(sent))
+		}
+		r.last = now
+		r.mu.Unlock()
+	case events.MessageSent:
+		atomic.AddUint64(&r.written, 1)
+	case events.SendFailed:
+		atomic.AddUint64(&r.failed, 1)
+	case events.PeerDisconnected:
+		atomic.AddUint64(&r.disconnects, 1)
+	}
+} // }}}
+
+// func newSender {{{
+
+// newSender Initializes and returns a sender for the given connection, which
+// sends rate messages of size bytes a second, or as many as it can if rate
+// is zero
+func newSender(s *server.Server, conn, size, rate int) *sender {
+	sn := &sender{s: s, conn: conn, size: size}
+	if rate > 0 {
+		sn.interval = time.Second / time.Duration(rate)
+	}
+	return sn
+} // }}}
+
+// func sn.run {{{
+
+// run Sends messages until stop is closed or the connection is lost. Messages
+// are sent on a schedule rather than after a fixed sleep, so a send that
+// took too long is caught up on rather than lowering the rate.
+func (sn *sender) run(start time.Time, stop <-chan struct{}) {
+	next := start
+	for {
+		if sn.interval > 0 {
+			next = next.Add(sn.interval)
+			if wait := time.Until(next); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-stop:
+					t.Stop()
+					return
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		atomic.AddUint64(&sn.offered, 1)
+		if err := sn.s.Send(sn.conn, stamp(time.Now(), sn.size)); err != nil {
+			atomic.AddUint64(&sn.refused, 1)
+
+			// Gone, rather than just full, so there's no one left to
+			// send to
+			if errors.Is(err, client.ErrClosed) || !sn.connected() {
+				return
+			}
+		}
+	}
+} // }}}
+
+// func sn.connected {{{
+
+// connected returns whether the senders connection is still established
+func (sn *sender) connected() bool {
+	for _, p := range sn.s.List() {
+		if int(p.ID) == sn.conn {
+			return true
+		}
+	}
+	return false
+} // }}}
+
+// func stamp {{{
+
+// stamp returns a message of size bytes, or as near as we can get, starting
+// with when it was sent so the peer can tell how long it took to arrive
+func stamp(t time.Time, size int) string {
+	var b strings.Builder
+	b.Grow(size)
+	b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	b.WriteByte(' ')
+	for b.Len() < size {
+		b.WriteByte('x')
+	}
+	return b.String()
+} // }}}
+
+// func parseStamp {{{
+
+// parseStamp returns when a message made by stamp was sent
+func parseStamp(message string) (time.Time, bool) {
+	i := strings.IndexByte(message, ' ')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(message[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+} // }}}
+
+// func percentile {{{
+
+// percentile returns the latency p percent of the sorted latencies are at or
+// below
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+} // }}}
+
+// func merge {{{
+
+// merge returns every peers latencies in one sorted list, and when the last
+// message arrived
+func merge(peers []*peer) ([]time.Duration, time.Time) {
+	var all []time.Duration
+	var last time.Time
+	for _, p := range peers {
+		p.rec.mu.Lock()
+		all = append(all, p.rec.latencies...)
+		if p.rec.last.After(last) {
+			last = p.rec.last
+		}
+		p.rec.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all, last
+} // }}}
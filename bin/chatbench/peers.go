@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/netsim"
+	"github.com/Cryliss/chat/proto"
+	"github.com/Cryliss/chat/server"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many connections we dial at once over TCP, so we don't overflow the
+// listeners backlog
+const dialParallel = 32
+
+// type peer struct {{{
+
+// peer is one of the simulated peers, an ordinary server with its own event
+// bus, and what we've recorded about it
+type peer struct {
+	s   *server.Server
+	bus *events.Bus
+	rec *recorder
+
+	// How many connections it should have once the topology is connected
+	degree int
+} // }}}
+
+// type edge struct {{{
+
+// edge is a connection between two peers, by their index, the first of which
+// dials the second
+type edge struct {
+	from, to int
+} // }}}
+
+// func startPeers {{{
+
+// startPeers Starts n peers listening on loopback, each taking messages of up
+// to max characters and queueing them however we were told to
+func startPeers(n, max, queue int, overflow client.OverflowPolicy) []*peer {
+	peers := make([]*peer, n)
+	for i := range peers {
+		p := &peer{bus: events.NewBus(), rec: newRecorder()}
+		p.bus.Subscribe(p.rec.HandleEvent)
+
+		p.s = server.New("127.0.0.1", 0, p.bus)
+		p.s.SetMaxMessage(max)
+		p.s.SetSendQueue(queue, overflow)
+		go p.s.Listen()
+		peers[i] = p
+	}
+	return peers
+} // }}}
+
+// func topology {{{
+
+// topology returns the connections between n peers in the given topology,
+// either "star", where the first peer is connected to each of the others,
+// "ring", where each peer is connected to the next, or "mesh", where every
+// peer is connected to every other
+func topology(name string, n int) ([]edge, error) {
+	var edges []edge
+	switch name {
+	case "star":
+		for i := 1; i < n; i++ {
+			edges = append(edges, edge{0, i})
+		}
+	case "ring":
+		// Two peers only need the one connection to make a ring
+		links := n
+		if n == 2 {
+			links = 1
+		}
+		for i := 0; i < links; i++ {
+			edges = append(edges, edge{i, (i + 1) % n})
+		}
+	case "mesh":
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				edges = append(edges, edge{i, j})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology %q, expected star, ring or mesh", name)
+	}
+	return edges, nil
+} // }}}
+
+// func connect {{{
+
+// connect Connects the peers along each edge, over in-process pipes, pipes
+// across the simulated network or loopback TCP, and waits for both ends of
+// every connection to be established
+func connect(peers []*peer, edges []edge, transport string, network *netsim.Network, timeout time.Duration) error {
+	for _, e := range edges {
+		peers[e.from].degree++
+		peers[e.to].degree++
+	}
+
+	switch transport {
+	case "pipe":
+		for _, e := range edges {
+			ours, theirs := net.Pipe()
+			peers[e.from].s.Attach(ours, proto.NewStreamCodec(ours), "pipe", events.Outbound)
+			peers[e.to].s.Attach(theirs, proto.NewStreamCodec(theirs), "pipe", events.Inbound)
+		}
+	case "sim":
+		for _, e := range edges {
+			ours, theirs := network.Pipe(fmt.Sprintf("peer%d", e.from), fmt.Sprintf("peer%d", e.to))
+			peers[e.from].s.Attach(ours, proto.NewStreamCodec(ours), "sim", events.Outbound)
+			peers[e.to].s.Attach(theirs, proto.NewStreamCodec(theirs), "sim", events.Inbound)
+		}
+	case "tcp":
+		if err := dialAll(peers, edges, timeout); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown transport %q, expected pipe, sim or tcp", transport)
+	}
+
+	// The peer being dialed hears about the connection in its own time, so
+	// wait until everyone has all of theirs
+	deadline := time.Now().Add(timeout)
+	for i, p := range peers {
+		for len(p.s.List()) < p.degree {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("peer %d only has %d of its %d connections", i, len(p.s.List()), p.degree)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+} // }}}
+
+// func dialAll {{{
+
+// dialAll Dials the connections along each edge over loopback TCP, a few at a
+// time, returning the first that fails
+func dialAll(peers []*peer, edges []edge, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failed error
+	limit := make(chan struct{}, dialParallel)
+
+	for _, e := range edges {
+		e := e
+		limit <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			port := strconv.Itoa(peers[e.to].s.Port())
+			d, err := peers[e.from].s.Connect(ctx, "127.0.0.1", port)
+			if err == nil {
+				<-d.Done()
+				err = d.Err()
+			}
+			if err != nil {
+				once.Do(func() {
+					failed = fmt.Errorf("peer %d couldn't connect to peer %d: %w", e.from, e.to, err)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+} // }}}
+
+// func exitAll {{{
+
+// exitAll Closes every peers connections, all at once, as each waits for its
+// goodbyes to be taken
+func exitAll(peers []*peer) {
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.s.Exit()
+		}()
+	}
+	wg.Wait()
+} // }}}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Cryliss/chat/capture"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/proto"
+	"github.com/Cryliss/chat/server"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long we wait for the peer to finish with the last of the connections
+// once the capture has been fed to it
+const settleTimeout = 5 * time.Second
+
+// type replayConn struct {{{
+
+// replayConn is a captured connection being replayed into the peer
+type replayConn struct {
+	// The id the peer gave the connection, which needn't be the one in
+	// the capture
+	id uint32
+
+	// Our end of the in-process connection, which plays the part of the
+	// captured peer
+	peer net.Conn
+
+	// Whether the connection has been closed yet
+	closed bool
+} // }}}
+
+// func usage {{{
+
+// usage Prints information on how to use the program and then exits
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <capture file>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(-1)
+} // }}}
+
+// func main {{{
+
+func main() {
+	var speed float64
+	var only uint
+	var logLevel string
+
+	flag.Float64Var(&speed, "speed", 0, "Replay at this multiple of the captured speed, i.e. 1 for real time, or 0 to replay as fast as possible")
+	flag.UintVar(&only, "conn", 0, "Only replay the connection with this id in the capture")
+	flag.StringVar(&logLevel, "log-level", "off", "Levels to log the peers diagnostics to stderr at, i.e. \"debug\"")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 || speed < 0 {
+		usage()
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open capture: %v\n", err)
+		os.Exit(-1)
+	}
+	defer f.Close()
+
+	// The peer we replay into is an ordinary server, listening on loopback
+	// only as nothing else should be talking to it
+	bus := events.NewBus()
+	bus.Subscribe(events.JSONLogger(os.Stdout))
+	s := server.New("127.0.0.1", 0, bus)
+
+	logs := logging.New(os.Stderr, logging.FormatLogfmt, logging.LevelOff)
+	if err := logs.SetLevels(logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+	s.SetLogging(logs)
+
+	if err := replay(capture.NewReader(f), s, bus, speed, uint32(only)); err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+		s.Exit()
+		os.Exit(1)
+	}
+	s.Exit()
+} // }}}
+
+// func replay {{{
+
+// replay Feeds every record of a capture into the server, in order, over
+// in-process connections. Frames are written one at a time, each only once
+// the peer has read the last, so a replay always plays out the same way.
+func replay(r *capture.Reader, s *server.Server, bus *events.Bus, speed float64, only uint32) error {
+	conns := make(map[uint32]*replayConn)
+
+	// Keep track of which connections the peer still has, so we can wait
+	// for it to finish with them before we stop
+	var mu sync.Mutex
+	open := make(map[uint32]bool)
+	settled := make(chan struct{}, 1)
+
+	// Messages we send are written by the connections writer, so we wait
+	// to hear how each went before moving on to the next record
+	sent := make(chan struct{}, 1)
+
+	unsubscribe := bus.Subscribe(func(e events.Event) {
+		if e.Kind == events.MessageSent || e.Kind == events.SendFailed {
+			select {
+			case sent <- struct{}{}:
+			default:
+			}
+			return
+		}
+		if e.Kind != events.PeerDisconnected {
+			return
+		}
+		mu.Lock()
+		delete(open, e.ConnID)
+		empty := len(open) == 0
+		mu.Unlock()
+		if empty {
+			select {
+			case settled <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	// connect Attaches a new in-process connection to the peer
+	connect := func(rec capture.Record) *replayConn {
+		if rec.MaxMessage > 0 {
+			s.SetMaxMessage(rec.MaxMessage)
+		} else {
+			s.SetMaxMessage(server.DefaultMaxMessage)
+		}
+		dir := events.Direction(rec.Opened)
+		if dir == "" {
+			dir = events.Inbound
+		}
+
+		ours, theirs := net.Pipe()
+		rc := &replayConn{peer: theirs}
+
+		// Whatever the peer writes to us is of no interest, but it has
+		// to be read for the write to finish
+		go func() {
+			for {
+				if _, err := proto.ReadFrame(theirs); err != nil {
+					return
+				}
+			}
+		}()
+
+		mu.Lock()
+		rc.id = s.Attach(ours, proto.NewStreamCodec(ours), "replay", dir)
+		open[rc.id] = true
+		mu.Unlock()
+
+		conns[rec.ConnID] = rc
+		return rc
+	}
+
+	var last time.Time
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading capture: %w", err)
+		}
+		if only != 0 && rec.ConnID != only {
+			continue
+		}
+
+		// Keep the gaps between records, if we were asked to
+		if speed > 0 && !last.IsZero() && rec.Time.After(last) {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(last)) / speed))
+		}
+		last = rec.Time
+
+		rc, ok := conns[rec.ConnID]
+		switch rec.Kind {
+		case capture.Open:
+			connect(rec)
+			continue
+		case capture.Frame, capture.Close:
+			if !ok {
+				// The capture is missing the start of the connection,
+				// so we make do with what we've got
+				fmt.Fprintf(os.Stderr, "connection %d was never opened, opening it now\n", rec.ConnID)
+				rc = connect(capture.Record{ConnID: rec.ConnID})
+			}
+		default:
+			return fmt.Errorf("unknown record kind %q", rec.Kind)
+		}
+		if rc.closed {
+			continue
+		}
+
+		switch {
+		case rec.Kind == capture.Close && rec.Local:
+			s.Terminate(int(rc.id))
+			rc.closed = true
+		case rec.Kind == capture.Close:
+			rc.peer.Close()
+			rc.closed = true
+		case rec.Direction == capture.In:
+			if err := proto.WriteFrame(rc.peer, rec.ProtoFrame()); err != nil {
+				return fmt.Errorf("writing frame to connection %d: %w", rc.id, err)
+			}
+		case rec.Direction == capture.Out && proto.FrameType(rec.Type) != proto.FrameMessage:
+			// Goodbyes and the like are said by the peer itself when
+			// the connection closes, so there's nothing to send
+		case rec.Direction == capture.Out:
+			// We sent this one ourselves, so we do so again
+			if err := s.Send(int(rc.id), string(rec.Payload)); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			select {
+			case <-sent:
+			case <-time.After(settleTimeout):
+				return fmt.Errorf("the peer didn't send the message to connection %d in time", rc.id)
+			}
+		}
+	}
+
+	// The capture may have ended with connections still open, so we
+	// hang up on them, and wait for the peer to notice
+	for _, rc := range conns {
+		if !rc.closed {
+			rc.peer.Close()
+		}
+	}
+
+	mu.Lock()
+	waiting := len(open) > 0
+	mu.Unlock()
+	if waiting {
+		select {
+		case <-settled:
+		case <-time.After(settleTimeout):
+			return errors.New("the peer didn't finish with every connection in time")
+		}
+	}
+	return nil
+} // }}}
@@ -0,0 +1,109 @@
+// Package capture records the frames peers send us and we send them to a
+// file, and reads them back, so an odd session can be looked at byte by byte
+// and replayed into a peer to reproduce it
+package capture
+
+import (
+	"encoding/json"
+	"github.com/Cryliss/chat/proto"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// func NewWriter {{{
+
+// NewWriter returns a Writer that writes records to w, one JSON object per
+// line
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+} // }}}
+
+// func cw.Open {{{
+
+// Open Records a connection being established
+func (cw *Writer) Open(id uint32, ip, port, transport, opened string, maxMessage int) {
+	cw.write(Record{
+		Kind:       Open,
+		ConnID:     id,
+		IP:         ip,
+		Port:       port,
+		Transport:  transport,
+		Opened:     opened,
+		MaxMessage: maxMessage,
+	})
+} // }}}
+
+// func cw.Frame {{{
+
+// Frame Records a frame read from, or written to, a connection
+func (cw *Writer) Frame(id uint32, dir Direction, f proto.Frame) {
+	// Nothing to record to, so don't bother copying the payload as text
+	if cw == nil {
+		return
+	}
+
+	r := Record{
+		Kind:      Frame,
+		ConnID:    id,
+		Direction: dir,
+		Type:      uint8(f.Type),
+		Payload:   f.Payload,
+	}
+	if utf8.Valid(f.Payload) {
+		r.Text = string(f.Payload)
+	}
+	cw.write(r)
+} // }}}
+
+// func cw.Close {{{
+
+// Close Records a connection being closed, by us if local is true
+func (cw *Writer) Close(id uint32, local bool) {
+	cw.write(Record{
+		Kind:   Close,
+		ConnID: id,
+		Local:  local,
+	})
+} // }}}
+
+// func cw.write {{{
+
+// write Timestamps and writes a record. Records are written whole, one at a
+// time, as every connection shares the one file.
+func (cw *Writer) write(r Record) {
+	if cw == nil {
+		return
+	}
+	r.Time = time.Now()
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.enc.Encode(r)
+} // }}}
+
+// func NewReader {{{
+
+// NewReader returns a Reader that reads the records written by a Writer
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+} // }}}
+
+// func cr.Next {{{
+
+// Next returns the next record, or io.EOF once there are no more
+func (cr *Reader) Next() (Record, error) {
+	var r Record
+	err := cr.dec.Decode(&r)
+	return r, err
+} // }}}
+
+// func r.ProtoFrame {{{
+
+// ProtoFrame returns the frame a Frame record holds
+func (r Record) ProtoFrame() proto.Frame {
+	return proto.Frame{
+		Type:    proto.FrameType(r.Type),
+		Payload: r.Payload,
+	}
+} // }}}
@@ -0,0 +1,83 @@
+// Package capture records the frames peers send us and we send them to a
+// file, and reads them back, so an odd session can be looked at byte by byte
+// and replayed into a peer to reproduce it
+package capture
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// type Kind string {{{
+
+// Kind is what a record in a capture describes
+type Kind string
+
+const (
+	// Open records a connection being established, with what was agreed
+	// in the handshake
+	Open Kind = "open"
+
+	// Frame records a single frame read from or written to a connection
+	Frame Kind = "frame"
+
+	// Close records a connection being closed, by either side
+	Close Kind = "close"
+) // }}}
+
+// type Direction string {{{
+
+// Direction is which way a frame was going
+type Direction string
+
+const (
+	// In frames were read from the peer
+	In Direction = "in"
+
+	// Out frames were written to the peer
+	Out Direction = "out"
+) // }}}
+
+// type Record struct {{{
+
+// Record is a single line of a capture file
+type Record struct {
+	Time   time.Time `json:"time"`
+	Kind   Kind      `json:"kind"`
+	ConnID uint32    `json:"conn"`
+
+	// For Open records, who the peer is and what we agreed on
+	IP         string `json:"ip,omitempty"`
+	Port       string `json:"port,omitempty"`
+	Transport  string `json:"transport,omitempty"`
+	Opened     string `json:"opened,omitempty"`
+	MaxMessage int    `json:"max_message,omitempty"`
+
+	// For Frame records, which way the frame went and what was in it.
+	// Payload is the exact bytes, and Text the same as text, if it is
+	// valid UTF-8, so a capture can be read without decoding it.
+	Direction Direction `json:"dir,omitempty"`
+	Type      uint8     `json:"type,omitempty"`
+	Payload   []byte    `json:"payload,omitempty"`
+	Text      string    `json:"text,omitempty"`
+
+	// For Close records, whether we closed the connection ourselves
+	Local bool `json:"local,omitempty"`
+} // }}}
+
+// type Writer struct {{{
+
+// Writer writes records to a capture file. A nil Writer captures nothing, so
+// code doesn't need to check whether capturing is turned on.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+} // }}}
+
+// type Reader struct {{{
+
+// Reader reads the records of a capture file back, in order
+type Reader struct {
+	dec *json.Decoder
+} // }}}
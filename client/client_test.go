@@ -0,0 +1,392 @@
+package client
+
+import (
+	"bytes"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/netsim"
+	"github.com/Cryliss/chat/proto"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// How long we wait for anything to happen before failing the test
+const waitTimeout = 5 * time.Second
+
+// func newPair {{{
+
+// newPair returns a client on one end of an in-process connection, whose
+// events are sent to the returned channel, and the other end of it
+func newPair(t *testing.T) (*Client, net.Conn, chan events.Event) {
+	t.Helper()
+	ours, theirs := netsim.New().Pipe("10.0.0.1:4545", "10.0.0.2:4546")
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+
+	bus := events.NewBus()
+	seen := make(chan events.Event, 1024)
+	bus.Subscribe(func(e events.Event) {
+		seen <- e
+	})
+	c := New(ours, nil, []string{"10.0.0.2", "4546"}, 1, events.Outbound, bus)
+	return c, theirs, seen
+} // }}}
+
+// func wait {{{
+
+// wait returns the next event of the given kind, skipping any others, and
+// fails the test if none is published in time
+func wait(t *testing.T, seen chan events.Event, kind events.Kind) events.Event {
+	t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case e := <-seen:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event after %s", kind, waitTimeout)
+		}
+	}
+} // }}}
+
+// func TestHandshake {{{
+
+// Both sides agree on the smaller of the two message limits, and learn who
+// the other is
+func TestHandshake(t *testing.T) {
+	for _, test := range []struct{ ours, theirs, want int }{
+		{100, 100, 100},
+		{100, 280, 100},
+		{280, 100, 100},
+		{1, 5000, 1},
+	} {
+		c, conn, _ := newPair(t)
+		peer := New(conn, nil, []string{"10.0.0.1", "4545"}, 1, events.Inbound, nil)
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- peer.Handshake(proto.Hello{Version: proto.Version, MaxMessage: test.theirs, Name: "bob", Key: "k"}, waitTimeout)
+		}()
+		if err := c.Handshake(proto.Hello{Version: proto.Version, MaxMessage: test.ours, Name: "alice"}, waitTimeout); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("peers handshake failed: %v", err)
+		}
+
+		if c.MaxMessage != test.want || peer.MaxMessage != test.want {
+			t.Errorf("%d and %d agreed on %d and %d, want %d", test.ours, test.theirs, c.MaxMessage, peer.MaxMessage, test.want)
+		}
+		if c.Name != "bob" || c.Fingerprint != proto.Fingerprint("k") || c.Version != proto.Version {
+			t.Errorf("learnt %q, %q, version %d about the peer", c.Name, c.Fingerprint, c.Version)
+		}
+		if peer.Name != "alice" || peer.Fingerprint != "" {
+			t.Errorf("peer learnt %q, %q about us", peer.Name, peer.Fingerprint)
+		}
+	}
+} // }}}
+
+// func TestReceiveLimit {{{
+
+// Messages are held to the limit we agreed on in characters, not bytes, and
+// anything that isn't UTF-8 is turned away
+func TestReceiveLimit(t *testing.T) {
+	c, conn, seen := newPair(t)
+	c.MaxMessage = 5
+	go c.HandleClient()
+
+	tests := []struct {
+		payload  string
+		accepted bool
+	}{
+		{"hello", true},
+		{"hello!", false},
+		{"\U0001F600\U0001F600\U0001F600\U0001F600\U0001F600", true},
+		{"\U0001F468\u200d\U0001F469\u200d\U0001F467 \U0001F1FA\U0001F1F8 e\u0301", true},
+		{"\U0001F600\U0001F600\U0001F600\U0001F600\U0001F600\U0001F600", false},
+		{"a\xffb", false},
+	}
+	for _, test := range tests {
+		proto.WriteFrame(conn, proto.Frame{Type: proto.FrameMessage, Payload: []byte(test.payload)})
+		want := events.MessageRejected
+		if test.accepted {
+			want = events.MessageReceived
+		}
+
+		e := <-seen
+		for e.Kind != events.MessageReceived && e.Kind != events.MessageRejected {
+			e = <-seen
+		}
+		if e.Kind != want {
+			t.Errorf("%+q was %s (%s), want %s", test.payload, e.Kind, e.Reason, want)
+		}
+		if test.accepted && e.Message != test.payload {
+			t.Errorf("received %+q, want %+q", e.Message, test.payload)
+		}
+	}
+
+	proto.WriteFrame(conn, proto.GoodbyeFrame(proto.Goodbye{Code: proto.GoodbyeShutdown}))
+	if e := wait(t, seen, events.PeerDisconnected); e.Code != string(proto.GoodbyeShutdown) || !strings.Contains(e.Reason, "shutting down") {
+		t.Errorf("disconnected with %q, %q, want %s", e.Code, e.Reason, proto.GoodbyeShutdown)
+	}
+} // }}}
+
+// func TestQueueWhileClosing {{{
+
+// Every message Queue accepts is either sent or failed, even when the
+// connection closes while it's being queued, so nobody is told a message is
+// on its way that never will be
+func TestQueueWhileClosing(t *testing.T) {
+	for _, overflow := range []OverflowPolicy{OverflowBlock, OverflowDropOldest, OverflowDisconnect} {
+		for i := 0; i < 200; i++ {
+			c, _, seen := newPair(t)
+			c.QueueSize = 4
+			c.Overflow = overflow
+			c.StartWriter()
+
+			const senders, each = 4, 8
+			accepted := make(chan int, senders)
+			for s := 0; s < senders; s++ {
+				go func() {
+					n := 0
+					for m := 0; m < each; m++ {
+						if c.Queue("hello") == nil {
+							n++
+						}
+					}
+					accepted <- n
+				}()
+			}
+			c.CloseConn()
+
+			total := 0
+			for s := 0; s < senders; s++ {
+				total += <-accepted
+			}
+			<-c.writing
+
+			// Dropping the oldest to make room fails a message that was
+			// accepted, and so does the writer giving up on the rest
+			var sent, failed int
+		count:
+			for {
+				select {
+				case e := <-seen:
+					switch e.Kind {
+					case events.MessageSent:
+						sent++
+					case events.SendFailed:
+						failed++
+					}
+				default:
+					break count
+				}
+			}
+			if sent+failed != total {
+				t.Fatalf("%s: %d messages accepted, but %d sent and %d failed, %d queued", overflow, total, sent, failed, len(c.queue))
+			}
+		}
+	}
+} // }}}
+
+// The message sizes, in bytes, the benchmarks are measured at
+var benchSizes = []int{16, 256, 4096}
+
+// The codecs the benchmarks are run with. Pooled is the stream codec we use,
+// unpooled reads and writes the way it did before its buffers were pooled.
+var benchCodecs = []struct {
+	name string
+	new  func(conn net.Conn) Codec
+}{
+	{"pooled", func(conn net.Conn) Codec { return proto.NewStreamCodec(conn) }},
+	{"unpooled", func(conn net.Conn) Codec { return unpooledCodec{conn} }},
+}
+
+// type unpooledCodec struct {{{
+
+// unpooledCodec reads every frame into a payload of its own, and writes every
+// frame with a write of its own, as the stream codec did before it pooled
+// its buffers and batched its writes
+type unpooledCodec struct {
+	rw io.ReadWriter
+} // }}}
+
+// type benchConn struct {{{
+
+// benchConn is a connection that reads the same frame over and over, as many
+// times as it was told to, and throws away everything written to it
+type benchConn struct {
+	// The frame we read, how many more times we'll read it, and how far
+	// through it we are
+	frame []byte
+	left  int
+	off   int
+
+	// How many bytes have been written, and whether we've been closed.
+	// Only access these using atomics!
+	written uint64
+	closed  int32
+} // }}}
+
+// type benchAddr struct {{{
+
+// benchAddr is the address of both ends of a benchConn
+type benchAddr struct{} // }}}
+
+// func BenchmarkReceive {{{
+
+// BenchmarkReceive Measures reading messages from a peer, up to publishing
+// them to the rest of the program, i.e. as BenchmarkReceive/pooled/bytes=256
+func BenchmarkReceive(b *testing.B) {
+	benchMessages(b, func(b *testing.B, newCodec func(net.Conn) Codec, n int) {
+		var frame bytes.Buffer
+		proto.WriteFrame(&frame, proto.Frame{Type: proto.FrameMessage, Payload: []byte(strings.Repeat("x", n))})
+
+		var received int
+		bus := events.NewBus()
+		bus.Subscribe(func(e events.Event) {
+			if e.Kind == events.MessageReceived {
+				received++
+			}
+		})
+
+		conn := &benchConn{frame: frame.Bytes(), left: b.N}
+		c := New(conn, newCodec(conn), []string{"10.0.0.1", "4545"}, 1, events.Inbound, bus)
+		c.MaxMessage = n
+
+		b.ResetTimer()
+		c.HandleClient()
+		b.StopTimer()
+
+		if received != b.N {
+			b.Fatalf("received %d messages, expected %d", received, b.N)
+		}
+	})
+} // }}}
+
+// func BenchmarkSend {{{
+
+// BenchmarkSend Measures sending messages to a peer, from queueing them to
+// hearing they've been written, i.e. as BenchmarkSend/unpooled/bytes=16
+func BenchmarkSend(b *testing.B) {
+	benchMessages(b, func(b *testing.B, newCodec func(net.Conn) Codec, n int) {
+		message := strings.Repeat("x", n)
+
+		sent := make(chan struct{}, 1)
+		var count int64
+		bus := events.NewBus()
+		bus.Subscribe(func(e events.Event) {
+			if e.Kind == events.MessageSent && atomic.AddInt64(&count, 1) == int64(b.N) {
+				sent <- struct{}{}
+			}
+		})
+
+		conn := &benchConn{}
+		c := New(conn, newCodec(conn), []string{"10.0.0.1", "4545"}, 1, events.Outbound, bus)
+		c.MaxMessage = n
+		c.StartWriter()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := c.Queue(message); err != nil {
+				b.Fatal(err)
+			}
+		}
+		<-sent
+		b.StopTimer()
+
+		// Make sure the writer has gone before the next round starts
+		if err := c.CloseConn(); err != nil {
+			b.Fatalf("CloseConn failed: %v", err)
+		}
+		<-c.writing
+
+		if written := atomic.LoadUint64(&conn.written); written < uint64(b.N*n) {
+			b.Fatalf("wrote %d bytes, expected at least %d", written, b.N*n)
+		}
+	})
+} // }}}
+
+// func benchMessages {{{
+
+// benchMessages Runs bench with each codec, at each of the message sizes we
+// measure at
+func benchMessages(b *testing.B, bench func(b *testing.B, newCodec func(net.Conn) Codec, n int)) {
+	for _, codec := range benchCodecs {
+		codec := codec
+		b.Run(codec.name, func(b *testing.B) {
+			for _, n := range benchSizes {
+				n := n
+				b.Run("bytes="+strconv.Itoa(n), func(b *testing.B) {
+					b.ReportAllocs()
+					b.SetBytes(int64(n))
+					bench(b, codec.new, n)
+				})
+			}
+		})
+	}
+} // }}}
+
+// func uc.ReadFrame {{{
+
+func (uc unpooledCodec) ReadFrame() (proto.Frame, error) {
+	return proto.ReadFrame(uc.rw)
+} // }}}
+
+// func uc.WriteFrame {{{
+
+func (uc unpooledCodec) WriteFrame(f proto.Frame) error {
+	return proto.WriteFrame(uc.rw, f)
+} // }}}
+
+// func bc.Read {{{
+
+func (bc *benchConn) Read(p []byte) (int, error) {
+	if bc.left == 0 || atomic.LoadInt32(&bc.closed) != 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, bc.frame[bc.off:])
+	bc.off += n
+	if bc.off == len(bc.frame) {
+		bc.off = 0
+		bc.left--
+	}
+	return n, nil
+} // }}}
+
+// func bc.Write {{{
+
+func (bc *benchConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&bc.closed) != 0 {
+		return 0, net.ErrClosed
+	}
+	atomic.AddUint64(&bc.written, uint64(len(p)))
+	return len(p), nil
+} // }}}
+
+// func bc.Close {{{
+
+// Close Closes the connection, the first time it's called
+func (bc *benchConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&bc.closed, 0, 1) {
+		return net.ErrClosed
+	}
+	return nil
+} // }}}
+
+func (bc *benchConn) LocalAddr() net.Addr                { return benchAddr{} }
+func (bc *benchConn) RemoteAddr() net.Addr               { return benchAddr{} }
+func (bc *benchConn) SetDeadline(t time.Time) error      { return nil }
+func (bc *benchConn) SetReadDeadline(t time.Time) error  { return nil }
+func (bc *benchConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (benchAddr) Network() string { return "bench" }
+func (benchAddr) String() string  { return "bench" }
@@ -4,96 +4,636 @@ package client
 import (
 	"errors"
 	"fmt"
-	"github.com/Cryliss/chat/types"
+	"github.com/Cryliss/chat/capture"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/grapheme"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/proto"
+	"io"
 	"net"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // func New {{{
 
-// New Initializes and returns a new Client struct
-func New(conn *net.TCPConn, addr []string, id uint32, app types.Application) *Client {
+// New Initializes and returns a new Client struct. A nil codec means the peer
+// speaks our own protocol over conn, and so must complete the Handshake.
+func New(conn net.Conn, codec Codec, addr []string, id uint32, dir events.Direction, bus *events.Bus) *Client {
+	if codec == nil {
+		codec = proto.NewStreamCodec(conn)
+	}
 	client := Client{
-		app:  app,
-		ID:   id,
-		IP:   addr[0],
-		Port: addr[1],
-		Conn: conn,
+		bus:          bus,
+		ID:           id,
+		IP:           addr[0],
+		Port:         addr[1],
+		Direction:    dir,
+		Transport:    "tcp",
+		Connected:    time.Now(),
+		QueueSize:    DefaultQueueSize,
+		WriteTimeout: DefaultWriteTimeout,
+		Conn:         conn,
+		codec:        codec,
+		done:         make(chan struct{}),
+		label:        strconv.FormatUint(uint64(id), 10),
 	}
 	return &client
 } // }}}
 
+// func ParseOverflowPolicy {{{
+
+// ParseOverflowPolicy returns the policy with the given name, either "block",
+// "drop-oldest" or "disconnect"
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "block":
+		return OverflowBlock, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+	return OverflowBlock, fmt.Errorf("client: unknown overflow policy %q, expected block, drop-oldest or disconnect", name)
+} // }}}
+
+// func p.String {{{
+
+// String returns the policies name
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "policy(" + strconv.Itoa(int(p)) + ")"
+} // }}}
+
+// func c.Handshake {{{
+
+// Handshake Tells the peer about ourselves and reads what it has to say about
+// itself, agreeing on the longest message we'll send each other. Must be
+// called before HandleClient, and gives up if the peer hasn't answered
+// within timeout.
+func (c *Client) Handshake(ours proto.Hello, timeout time.Duration) error {
+	c.Conn.SetDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	// Hellos are tiny, so both sides writing before they read won't
+	// leave either of them stuck waiting for the other to read
+	if err := proto.WriteHello(c.Conn, ours); err != nil {
+		return fmt.Errorf("c.Handshake: error sending hello: %w", err)
+	}
+	theirs, err := proto.ReadHello(c.Conn)
+	if err != nil {
+		return fmt.Errorf("c.Handshake: error reading hello: %w", err)
+	}
+
+	c.Version = theirs.Version
+	c.Name = theirs.Name
+	c.Fingerprint = proto.Fingerprint(theirs.Key)
+	c.MaxMessage = ours.MaxMessage
+	if theirs.MaxMessage < c.MaxMessage {
+		c.MaxMessage = theirs.MaxMessage
+	}
+	return nil
+} // }}}
+
+// func c.StartWriter {{{
+
+// StartWriter Starts the goroutine that writes queued messages to the peer.
+// Must be called once, after the Handshake, and before anything is queued.
+func (c *Client) StartWriter() {
+	size := c.QueueSize
+	if size < 1 {
+		size = 1
+	}
+	c.queue = make(chan string, size)
+	c.writing = make(chan struct{})
+	go c.writeLoop()
+} // }}}
+
+// func c.Queue {{{
+
+// Queue Adds a message to those waiting to be written to the peer. The writer
+// publishes whether it was sent once it's been written, so a slow peer only
+// holds up the caller if the queue is full and we were told to block.
+func (c *Client) Queue(message string) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	switch c.Overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.queue <- message:
+				c.settle()
+				return nil
+			default:
+			}
+
+			// Still full, so make room. The writer may beat us to it,
+			// in which case there's nothing to throw away
+			select {
+			case old := <-c.queue:
+				atomic.AddUint64(&c.dropped, 1)
+				c.Log.Warn("send queue full, dropped oldest message", "conn", c.ID, "bytes", len(old))
+				c.publish(events.Event{
+					Kind:    events.SendFailed,
+					Message: old,
+					Reason:  "dropped to make room for a newer message",
+					Err:     ErrQueueFull,
+				})
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		select {
+		case c.queue <- message:
+			c.settle()
+			return nil
+		default:
+		}
+		atomic.AddUint64(&c.dropped, 1)
+		c.Log.Warn("send queue full, disconnecting", "conn", c.ID, "queued", len(c.queue))
+		c.fail("send queue is full", ErrQueueFull)
+		return ErrQueueFull
+	}
+
+	select {
+	case c.queue <- message:
+		c.settle()
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+} // }}}
+
+// func c.settle {{{
+
+// settle Makes sure a message we've just queued isn't left behind. The
+// connection may have closed while we were queueing it, and the writer may
+// already have stopped, in which case we fail whatever is left ourselves, so
+// whoever queued it still hears it was never sent.
+func (c *Client) settle() {
+	select {
+	case <-c.done:
+		c.dropQueued()
+	default:
+	}
+} // }}}
+
+// func c.Queued {{{
+
+// Queued returns how many messages are waiting to be written to the peer, and
+// how many may wait at most
+func (c *Client) Queued() (int, int) {
+	return len(c.queue), cap(c.queue)
+} // }}}
+
+// func c.Dropped {{{
+
+// Dropped returns how many messages we've thrown away because the queue was
+// full
+func (c *Client) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+} // }}}
+
+// func c.Stats {{{
+
+// Stats returns what we've counted about the connection so far
+func (c *Client) Stats() Stats {
+	st := Stats{
+		MessagesIn:  atomic.LoadUint64(&c.messagesIn),
+		MessagesOut: atomic.LoadUint64(&c.messagesOut),
+		BytesIn:     atomic.LoadUint64(&c.bytesIn),
+		BytesOut:    atomic.LoadUint64(&c.bytesOut),
+	}
+	if last := atomic.LoadInt64(&c.lastActivity); last != 0 {
+		st.LastActivity = time.Unix(0, last)
+	}
+	return st
+} // }}}
+
+// func c.count {{{
+
+// count Adds a frame of the given size we've read or written to our stats
+func (c *Client) count(message bool, size int, messages, bytes *uint64) {
+	if message {
+		atomic.AddUint64(messages, 1)
+	}
+	atomic.AddUint64(bytes, uint64(size))
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+} // }}}
+
+// func c.writeLoop {{{
+
+// writeLoop Writes queued messages to the peer until the connection is
+// closed. Nothing else writes to the codec, so messages can't end up
+// interleaved. Whatever has queued up while we were writing is written in one
+// go, so a chatty peer doesn't cost us a write per message.
+func (c *Client) writeLoop() {
+	defer close(c.writing)
+
+	batch := make([]string, 0, writeBatch)
+	for {
+		batch = batch[:0]
+		select {
+		case message := <-c.queue:
+			batch = append(batch, message)
+		case <-c.done:
+			c.dropQueued()
+			return
+		}
+
+	more:
+		for len(batch) < cap(batch) {
+			select {
+			case message := <-c.queue:
+				batch = append(batch, message)
+			default:
+				break more
+			}
+		}
+
+		if err := c.write(batch); err != nil {
+			// There's no knowing which of them made it before the
+			// write failed, so none of them did
+			c.Log.Warn("send failed", "conn", c.ID, "messages", len(batch), "err", err)
+			for _, message := range batch {
+				if c.Metrics != nil {
+					c.Metrics.SendFailures.With(c.label).Inc()
+				}
+				c.publish(events.Event{
+					Kind:    events.SendFailed,
+					Message: message,
+					Err:     err,
+				})
+			}
+
+			// The peer may have been left with half a frame, so
+			// there's no trusting the connection anymore. If we're
+			// already closing it, whoever is doing so tells everyone.
+			c.writeErr = err
+			select {
+			case <-c.done:
+			default:
+				c.fail("error writing to connection", err)
+			}
+
+			// Whoever is closing the connection may not have got as
+			// far as stopping us yet, but nothing more can be queued
+			// once we've gone
+			c.stop()
+			c.dropQueued()
+			return
+		}
+
+		for _, message := range batch {
+			c.sent(message)
+		}
+	}
+} // }}}
+
+// func c.write {{{
+
+// write Writes a batch of messages to the peer, giving up if it takes longer
+// than the write timeout
+func (c *Client) write(batch []string) error {
+	if c.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		defer c.Conn.SetWriteDeadline(time.Time{})
+	}
+
+	// Codecs that can't hold on to messages get them one at a time
+	bc, ok := c.codec.(batchCodec)
+	if !ok {
+		for _, message := range batch {
+			if err := c.codec.WriteFrame(proto.Frame{Type: proto.FrameMessage, Payload: []byte(message)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, message := range batch {
+		if err := bc.BufferMessage(message); err != nil {
+			bc.Flush()
+			return err
+		}
+	}
+	return bc.Flush()
+} // }}}
+
+// func c.sent {{{
+
+// sent Lets everyone know a message has been written to the peer
+func (c *Client) sent(message string) {
+	if c.Capture != nil {
+		c.Capture.Frame(c.ID, capture.Out, proto.Frame{Type: proto.FrameMessage, Payload: []byte(message)})
+	}
+	c.count(true, len(message), &c.messagesOut, &c.bytesOut)
+	if c.Log.Enabled(logging.LevelDebug) {
+		c.Log.Debug("message sent", "conn", c.ID, "bytes", len(message))
+	}
+	if c.Metrics != nil {
+		c.Metrics.MessagesSent.With(c.label).Inc()
+		c.Metrics.BytesSent.With(c.label).Add(uint64(len(message)))
+	}
+	c.publish(events.Event{
+		Kind:    events.MessageSent,
+		Message: message,
+	})
+} // }}}
+
+// func c.Goodbye {{{
+
+// Goodbye Tells the peer why we're about to close the connection, which the
+// caller then does. Anything still waiting to be sent is dropped, and nothing
+// more can be.
+func (c *Client) Goodbye(code proto.GoodbyeCode, text string) {
+	// Nothing else may write while the writer is running, so stop it
+	// first. A peer that isn't reading doesn't get to hold us up for long.
+	c.Conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	c.stop()
+	if c.writing != nil {
+		<-c.writing
+	}
+
+	// The peer may have been left with half a frame, in which case there's
+	// no making sense of anything else we send it
+	if c.writeErr == nil {
+		c.goodbyeOnce.Do(func() {
+			f := proto.GoodbyeFrame(proto.Goodbye{Code: code, Text: text})
+			c.Conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+			if err := c.codec.WriteFrame(f); err != nil {
+				c.Log.Debug("unable to say goodbye", "conn", c.ID, "err", err)
+				return
+			}
+			c.Capture.Frame(c.ID, capture.Out, f)
+			c.count(false, len(f.Payload), &c.messagesOut, &c.bytesOut)
+		})
+	}
+} // }}}
+
+// func c.dropQueued {{{
+
+// dropQueued Throws away whatever is left in the queue once the connection is
+// closed, letting everyone know those messages were never sent
+func (c *Client) dropQueued() {
+	for {
+		select {
+		case message := <-c.queue:
+			c.publish(events.Event{
+				Kind:    events.SendFailed,
+				Message: message,
+				Reason:  "connection closed before it could be sent",
+				Err:     ErrClosed,
+			})
+		default:
+			return
+		}
+	}
+} // }}}
+
+// func c.fail {{{
+
+// fail Closes a connection we've given up on, and lets everyone know why
+func (c *Client) fail(reason string, err error) {
+	// Already closed? Then whoever closed it has told everyone
+	if c.Conn.Close() != nil {
+		return
+	}
+	if !c.closed() {
+		return
+	}
+	c.Capture.Close(c.ID, true)
+	c.publish(events.Event{
+		Kind:   events.PeerDisconnected,
+		Reason: reason,
+		Err:    err,
+	})
+} // }}}
+
 // func c.HandleClient {{{
 
-// HandleClient Handler for client connections - reads from the connection and displays
-// the message to the user.
+// HandleClient Handler for client connections - reads from the connection and publishes
+// each message it receives.
 // help src: https://ipfs.io/ipfs/QmfYeDhGH9bZzihBUDEQbCbTc5k5FZKURMUoUvfmc27BwL/socket/tcp_sockets.html
 func (c *Client) HandleClient() {
-	// Defer closing the client
+	// Defer closing the client, and stopping the writer along with it
+	defer c.stop()
 	defer c.Conn.Close()
 
-	// Create a buffer for incoming messages
-	bufferSize := 1024
-	buffer := make([]byte, bufferSize)
 	for {
-		// Read the message from the connection -
-		n, err := c.Conn.Read(buffer)
+		// Read the next frame from the connection -
+		f, err := c.codec.ReadFrame()
 		if err != nil {
-			// Closed?
-			if errors.Is(err, net.ErrClosed) {
+			// Closed? In-process connections, such as the replay tools,
+			// say so differently to real ones.
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
 				// We were told to shutdown, so just return.
-				// Some other goroutine logged the reason for the closure.
+				// Some other goroutine published the reason for the closure.
 				return
 			}
 
-			e := fmt.Sprintf("%v", err)
+			// The writer may have given up on the connection at the
+			// same time, and already told everyone
+			if !c.closed() {
+				return
+			}
+			c.Capture.Close(c.ID, false)
 
 			// EOF?
-			if e == "EOF" {
-				c.app.OutErr("\n\nPeer has terminated the connection - closing client# %d now.\n\nPlease enter a command: ", c.ID)
+			if errors.Is(err, io.EOF) {
+				c.Log.Info("peer disconnected", "conn", c.ID)
+				c.publish(events.Event{
+					Kind:   events.PeerDisconnected,
+					Reason: "peer has terminated the connection",
+				})
+				return
 			}
-			break
+
+			// Something else went wrong, so we can't trust the
+			// connection anymore
+			c.Log.Warn("error reading from connection", "conn", c.ID, "err", err)
+			c.publish(events.Event{
+				Kind:   events.PeerDisconnected,
+				Reason: "error reading from connection",
+				Err:    err,
+			})
+			return
 		}
 
-		// We don't output empty messages, so check the length.
-		if n > 0 {
-			// Let's read the message from the buffer
-			msg := string(buffer[:n])
+		c.Capture.Frame(c.ID, capture.In, f)
+		c.count(f.Type == proto.FrameMessage, len(f.Payload), &c.messagesIn, &c.bytesIn)
 
-			// I want to include the time received to the message output,
-			// so this creates the variables we need to do that.
-			now := time.Now()
-			now.Format(time.Stamp)
-			nowArr := strings.Split(now.String(), ".")
-			ts := nowArr[0]
+		// The peer is closing the connection, and has told us why
+		if f.Type == proto.FrameGoodbye {
+			c.handleGoodbye(f.Payload)
+			return
+		}
 
-			// Print the message to the user
-			c.app.Out("\n\n====================================\nNEW MESSAGE FROM %v:%v\n\n", c.IP, c.Port)
-			c.app.Out("%s:\t%s\n\nEND MESSAGE\n===================================\n\nPlease enter a command: ", ts, msg)
+		// We only care about messages - anything else is from a newer
+		// version of the protocol than we speak, so we skip over it
+		if f.Type != proto.FrameMessage {
+			c.Log.Debug("skipping unknown frame", "conn", c.ID, "type", f.Type)
+			continue
+		}
+		if c.Log.Enabled(logging.LevelDebug) {
+			c.Log.Debug("message received", "conn", c.ID, "bytes", len(f.Payload))
+		}
+		if c.Metrics != nil {
+			c.Metrics.MessagesReceived.With(c.label).Inc()
+			c.Metrics.BytesReceived.With(c.label).Add(uint64(len(f.Payload)))
 		}
+		c.handleMessage(f.Payload)
 	}
 } // }}}
 
+// func c.handleGoodbye {{{
+
+// handleGoodbye Lets everyone know the peer closed the connection on purpose,
+// and why
+func (c *Client) handleGoodbye(payload []byte) {
+	g, err := proto.ParseGoodbye(payload)
+	if err != nil {
+		// It's going away either way, we just don't know why
+		c.Log.Info("invalid goodbye", "conn", c.ID, "err", err)
+	}
+
+	// We may have been closing it ourselves at the same time
+	if !c.closed() {
+		return
+	}
+	c.Capture.Close(c.ID, false)
+
+	c.Log.Info("peer said goodbye", "conn", c.ID, "code", g.Code, "text", g.Text)
+	c.publish(events.Event{
+		Kind:   events.PeerDisconnected,
+		Reason: g.Describe(),
+		Code:   string(g.Code),
+	})
+} // }}}
+
+// func c.handleMessage {{{
+
+// handleMessage Checks a message we've received is one we're willing to
+// accept, and publishes it if so
+func (c *Client) handleMessage(payload []byte) {
+	// We don't output empty messages, so check the length.
+	if len(payload) == 0 {
+		return
+	}
+
+	if !utf8.Valid(payload) {
+		c.Log.Info("rejected message", "conn", c.ID, "reason", "invalid UTF-8")
+		c.publish(events.Event{
+			Kind:   events.MessageRejected,
+			Reason: "message is not valid UTF-8",
+		})
+		return
+	}
+
+	// Every character is at least a byte, so only messages longer than the
+	// limit in bytes are worth counting
+	msg := string(payload)
+	if len(payload) > c.MaxMessage {
+		if n := grapheme.Count(msg); n > c.MaxMessage {
+			c.Log.Info("rejected message", "conn", c.ID, "reason", "too long", "length", n, "max", c.MaxMessage)
+			c.publish(events.Event{
+				Kind:   events.MessageRejected,
+				Reason: fmt.Sprintf("message is %d characters, but we agreed on at most %d", n, c.MaxMessage),
+			})
+			return
+		}
+	}
+
+	c.publish(events.Event{
+		Kind:    events.MessageReceived,
+		Message: msg,
+	})
+} // }}}
+
 // func c.CloseConn {{{
 
-// CloseConn Handles closing connections, sending a message to the connection
-// prior to closing it. Returns any errors that may occur
+// CloseConn Handles closing connections, returning any errors that may occur
 func (c *Client) CloseConn() error {
 	// Try closing the connection and handle any errors that may happen
 	err := c.Conn.Close()
 	if err != nil {
 		// Closed?
-		if errors.Is(err, net.ErrClosed) {
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
 			// We already closed it, just return
 			return err
 		}
 		// Hmm, something else went wrong ..
-		c.app.OutErr("c.CloseConn: error closing connection!\n")
-		return err
+		return fmt.Errorf("c.CloseConn: error closing connection %d: %w", c.ID, err)
 	}
 
-	// Connction was successfully closed, let the user know and return
-	c.app.Out("Successfully closed connection %d\n", c.ID)
+	// Connction was successfully closed, let everyone know and return,
+	// unless they already heard the peer went away
+	if !c.closed() {
+		return nil
+	}
+	c.Capture.Close(c.ID, true)
+	c.publish(events.Event{
+		Kind:  events.PeerDisconnected,
+		Local: true,
+	})
 	return nil
 } // }}}
+
+// func c.OnClose {{{
+
+// OnClose Registers a function to be called once the connection is closed,
+// by either side, before the disconnect event is published. This lets the
+// server forget about the connection before anyone can ask it for a list.
+func (c *Client) OnClose(f func()) {
+	c.onClose = append(c.onClose, f)
+} // }}}
+
+// func c.closed {{{
+
+// closed Calls the OnClose functions and stops the writer, only the first
+// time it's called. Returns whether this was the first time, as only then
+// should the disconnect be published.
+func (c *Client) closed() bool {
+	first := false
+	c.onCloseOnce.Do(func() {
+		first = true
+		for _, f := range c.onClose {
+			f()
+		}
+	})
+	c.stop()
+	return first
+} // }}}
+
+// func c.stop {{{
+
+// stop Tells the writer to stop, if it hasn't been already
+func (c *Client) stop() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+} // }}}
+
+// func c.publish {{{
+
+// publish fills in the connection details of the event and publishes it
+func (c *Client) publish(e events.Event) {
+	e.ConnID = c.ID
+	e.IP = c.IP
+	e.Port = c.Port
+	e.Direction = c.Direction
+	c.bus.Publish(e)
+} // }}}
@@ -2,16 +2,94 @@
 package client
 
 import (
-	"github.com/Cryliss/chat/types"
+	"errors"
+	"github.com/Cryliss/chat/capture"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/metrics"
+	"github.com/Cryliss/chat/proto"
 	"net"
+	"sync"
+	"time"
 )
 
+// How many messages may wait to be written to a peer, and how long we give
+// a single write, unless told otherwise
+const (
+	DefaultQueueSize    = 64
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// The most queued messages the writer writes in one go
+const writeBatch = 64
+
+// How long we give a peer to take our goodbye before closing the connection
+// anyway
+const goodbyeTimeout = 2 * time.Second
+
+// Errors returned by Queue
+var (
+	ErrQueueFull = errors.New("client: send queue is full")
+	ErrClosed    = errors.New("client: connection is closed")
+)
+
+// type OverflowPolicy int {{{
+
+// OverflowPolicy is what we do with a message when the queue of messages
+// waiting to be written to a peer is already full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for there to be room in the queue
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest throws away the message that has waited longest,
+	// to make room for the new one
+	OverflowDropOldest
+
+	// OverflowDisconnect gives up on the peer and closes the connection
+	OverflowDisconnect
+) // }}}
+
+// type Stats struct {{{
+
+// Stats is what we've counted about a connection since it was established.
+// Bytes are those of the frames payloads, not counting framing overhead.
+type Stats struct {
+	MessagesIn  uint64
+	MessagesOut uint64
+	BytesIn     uint64
+	BytesOut    uint64
+
+	// When we last read or wrote anything, zero if we haven't yet
+	LastActivity time.Time
+} // }}}
+
+// type Codec interface {{{
+
+// Codec reads and writes the frames of a connection. Peers speaking our own
+// protocol use a proto.StreamCodec, while other kinds of peer, i.e. browsers
+// on the websocket gateway, bring their own.
+type Codec interface {
+	ReadFrame() (proto.Frame, error)
+	WriteFrame(f proto.Frame) error
+} // }}}
+
+// type batchCodec interface {{{
+
+// batchCodec is a Codec that can hold on to messages until it's flushed, so
+// several can be written at once, as proto.StreamCodec can
+type batchCodec interface {
+	BufferMessage(text string) error
+	Flush() error
+} // }}}
+
 // type Client struct  {{{
 
 // Client data type to hold information related to the client connection
 type Client struct {
-	// Our application so we can print to the user
-	app types.Application
+	// Our event bus so we can tell the user what's happening
+	bus *events.Bus
 
 	// Assigned ID for the connection
 	ID uint32
@@ -22,6 +100,80 @@ type Client struct {
 	// Connections port number
 	Port string
 
-	// The actual connection itself
-	Conn *net.TCPConn
+	// Which side opened the connection
+	Direction events.Direction
+
+	// What kind of connection this is, i.e. "tcp" for peers speaking our
+	// protocol over TCP, or "ws" for browsers on the websocket gateway
+	Transport string
+
+	// When the connection was established
+	Connected time.Time
+
+	// Whether the user accepted the connection before it could be used,
+	// rather than it being accepted straight away
+	Approved bool
+
+	// The protocol version the peer speaks
+	Version int
+
+	// The label our metrics are counted under, the ID as text
+	label string
+
+	// What the peer announced it would like to be called, and the
+	// fingerprint of the key it announced, if it did
+	Name        string
+	Fingerprint string
+
+	// The longest message, in user-perceived characters, we and the peer
+	// agreed to send each other
+	MaxMessage int
+
+	// Where we count what we receive, if anywhere
+	Metrics *metrics.Metrics
+
+	// Where we log diagnostics to. Nil logs nothing.
+	Log *logging.Logger
+
+	// Where we record the frames we read to. Nil records nothing.
+	Capture *capture.Writer
+
+	// The most messages that may wait to be written to the peer, what we do
+	// when there are already that many, and how long we give each write.
+	// These must be set before StartWriter is called.
+	QueueSize    int
+	Overflow     OverflowPolicy
+	WriteTimeout time.Duration
+
+	// The actual connection itself, and what we read and write its frames with
+	Conn  net.Conn
+	codec Codec
+
+	// Messages waiting to be written by the writer goroutine, which stops
+	// once done is closed. Nothing else writes to the codec once it starts,
+	// until it closes writing, having set writeErr if the last write failed.
+	queue    chan string
+	done     chan struct{}
+	doneOnce sync.Once
+	writing  chan struct{}
+	writeErr error
+
+	// Makes sure we only ever say goodbye once
+	goodbyeOnce sync.Once
+
+	// How many messages we've thrown away or failed to queue because the
+	// queue was full. Only access this using atomics!
+	dropped uint64
+
+	// What we've read and written, and when we last did either, in unix
+	// nanoseconds. Only access these using atomics too!
+	messagesIn   uint64
+	messagesOut  uint64
+	bytesIn      uint64
+	bytesOut     uint64
+	lastActivity int64
+
+	// Called once the connection is closed, before anyone is told about it
+	onClose     []func()
+	onCloseOnce sync.Once
 } // }}}
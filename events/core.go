@@ -0,0 +1,168 @@
+// Package events provides the event bus the server and its clients publish to,
+// so that each frontend can decide for itself how to show what happened
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// func NewBus {{{
+
+// NewBus initializes and returns a new Bus with no subscribers
+func NewBus() *Bus {
+	return &Bus{}
+} // }}}
+
+// func b.Subscribe {{{
+
+// Subscribe registers h to be called for every event published from now on.
+// The returned function removes the subscription again.
+func (b *Bus) Subscribe(h Handler) func() {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs = append(b.subs, subscriber{id: id, h: h})
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, sub := range b.subs {
+			if sub.id == id {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+} // }}}
+
+// func b.Publish {{{
+
+// Publish delivers e to every subscriber, in the order they subscribed.
+//
+// Handlers are called on the publishers goroutine, so they should return
+// quickly - anything slow should be handed off to a goroutine of its own.
+// Publishing on a nil Bus is allowed and does nothing, which is handy for
+// servers that nobody is watching.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	// Grab our current subscribers so we aren't holding the lock while they
+	// run, otherwise a handler that (un)subscribes would deadlock. Neither
+	// of those ever overwrite an element of an existing slice, so this one
+	// won't change underneath us.
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.h(e)
+	}
+} // }}}
+
+// func k.String {{{
+
+// String returns the name of the event kind, as used in logs
+func (k Kind) String() string {
+	switch k {
+	case PeerConnected:
+		return "peer_connected"
+	case PeerDisconnected:
+		return "peer_disconnected"
+	case ConnectionRefused:
+		return "connection_refused"
+	case ConnectionPending:
+		return "connection_pending"
+	case Dialing:
+		return "dialing"
+	case DialFailed:
+		return "dial_failed"
+	case MessageReceived:
+		return "message_received"
+	case MessageRejected:
+		return "message_rejected"
+	case MessageSent:
+		return "message_sent"
+	case SendFailed:
+		return "send_failed"
+	case AcceptError:
+		return "accept_error"
+	case ListenerStopped:
+		return "listener_stopped"
+	case InternalError:
+		return "internal_error"
+	default:
+		return "unknown"
+	}
+} // }}}
+
+// func e.MarshalJSON {{{
+
+// MarshalJSON encodes the event with only the fields that are set, and with
+// the error flattened into a string
+func (e Event) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"kind": e.Kind.String(),
+		"time": e.Time.Format(time.RFC3339Nano),
+	}
+	if e.ConnID != 0 {
+		m["conn"] = e.ConnID
+	}
+	if e.IP != "" {
+		m["ip"] = e.IP
+	}
+	if e.Port != "" {
+		m["port"] = e.Port
+	}
+	if e.Direction != "" {
+		m["direction"] = e.Direction
+	}
+	if e.Name != "" {
+		m["name"] = e.Name
+	}
+	if e.Fingerprint != "" {
+		m["fingerprint"] = e.Fingerprint
+	}
+	if e.Message != "" {
+		m["message"] = e.Message
+	}
+	if e.Reason != "" {
+		m["reason"] = e.Reason
+	}
+	if e.Kind == PeerDisconnected {
+		m["local"] = e.Local
+	}
+	if e.Code != "" {
+		m["code"] = e.Code
+	}
+	if e.Err != nil {
+		m["error"] = e.Err.Error()
+	}
+	return json.Marshal(m)
+} // }}}
+
+// func JSONLogger {{{
+
+// JSONLogger returns a Handler that writes each event to w as a single line
+// of JSON
+func JSONLogger(w io.Writer) Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+
+	return func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// There isn't anyone to tell if our log is broken, so just drop it
+		_ = enc.Encode(e)
+	}
+} // }}}
@@ -0,0 +1,149 @@
+// Package events provides the event bus the server and its clients publish to,
+// so that each frontend can decide for itself how to show what happened
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// type Kind {{{
+
+// Kind identifies what sort of event occurred
+type Kind int
+
+const (
+	// PeerConnected is published when a new connection is established,
+	// either by us dialing out or by a peer dialing in
+	PeerConnected Kind = iota + 1
+
+	// PeerDisconnected is published when a connection is closed, by
+	// either side
+	PeerDisconnected
+
+	// ConnectionRefused is published when we refuse an incoming connection
+	ConnectionRefused
+
+	// ConnectionPending is published when a peer has connected to us, but
+	// we were told to ask the user before letting it chat. Name and
+	// Fingerprint are what the peer announced about itself.
+	ConnectionPending
+
+	// Dialing is published when we start connecting to a peer, before we
+	// know whether it will work. ConnID is the id the connection will have.
+	Dialing
+
+	// DialFailed is published when we give up connecting to a peer, because
+	// it couldn't be reached, didn't complete the handshake or we were
+	// told to stop
+	DialFailed
+
+	// MessageReceived is published when a peer sends us a message
+	MessageReceived
+
+	// MessageRejected is published when a peer sends us a message we
+	// won't accept, i.e. one that's too long or isn't valid UTF-8
+	MessageRejected
+
+	// MessageSent is published once a message has been written to a peer
+	MessageSent
+
+	// SendFailed is published when a message could not be written to a peer
+	SendFailed
+
+	// AcceptError is published when the listener fails to accept a
+	// connection, but is going to keep trying
+	AcceptError
+
+	// ListenerStopped is published when the listener gives up and will no
+	// longer accept new connections
+	ListenerStopped
+
+	// InternalError is published for errors that aren't tied to anything
+	// the user did, but that they may still want to know about
+	InternalError
+) // }}}
+
+// type Direction {{{
+
+// Direction describes which side opened a connection
+type Direction string
+
+const (
+	// Inbound connections were accepted by our listener
+	Inbound Direction = "inbound"
+
+	// Outbound connections were dialed by us
+	Outbound Direction = "outbound"
+) // }}}
+
+// type Event struct {{{
+
+// Event holds everything a frontend may want to know about something that
+// happened. Only the fields relevant to the events Kind are set.
+type Event struct {
+	// What happened
+	Kind Kind
+
+	// When it happened
+	Time time.Time
+
+	// The connection the event is about, if any
+	ConnID uint32
+
+	// The address of the peer the event is about, if any
+	IP   string
+	Port string
+
+	// Which side opened the connection
+	Direction Direction
+
+	// What the peer announced it would like to be called, and the
+	// fingerprint of the key it announced, if any
+	Name        string
+	Fingerprint string
+
+	// The message that was sent or received
+	Message string
+
+	// Human readable explanation of why this happened, i.e. why a
+	// connection was refused or closed
+	Reason string
+
+	// Set on PeerDisconnected when we were the ones who closed the connection
+	Local bool
+
+	// Set on PeerDisconnected when the peer said goodbye before closing the
+	// connection, to the code it gave, i.e. "shutting_down"
+	Code string
+
+	// The error that caused the event, if any
+	Err error
+} // }}}
+
+// type Handler {{{
+
+// Handler is a function that is called for every event published on a Bus
+type Handler func(e Event) // }}}
+
+// type subscriber struct {{{
+
+// subscriber pairs a Handler with the ID used to unsubscribe it
+type subscriber struct {
+	id int
+	h  Handler
+} // }}}
+
+// type Bus struct {{{
+
+// Bus delivers published events to each of its subscribers
+type Bus struct {
+	// Locks access to our subscribers
+	mu sync.RWMutex
+
+	// Our current subscribers, in the order they subscribed
+	subs []subscriber
+
+	// The ID the next subscriber will get
+	next int
+} // }}}
@@ -0,0 +1,450 @@
+// Package gateway provides the optional websocket gateway, which lets people
+// chat from a browser by joining our peer network as ordinary connections
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/proto"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The chat page browsers are served
+//
+//go:embed index.html
+var indexHTML []byte
+
+// func New {{{
+
+// New Initializes and returns a new Gateway, listening at the given port on
+// host, which is the loopback interface unless it's been chosen on purpose,
+// or every interface if it's empty. Browsers must present the freshly
+// generated token written to tokenFile, which only the user running the
+// program can read.
+func New(s Server, bus *events.Bus, host string, port int, tokenFile string) (*Gateway, error) {
+	// Generate a new token, so an old token file is no use to anyone
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("gateway.New: error generating token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("gateway.New: error writing token file: %w", err)
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("gateway.New: %w", err)
+	}
+
+	g := &Gateway{
+		s:        s,
+		bus:      bus,
+		token:    token,
+		listener: l,
+		sessions: make(map[uint32]*session),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.handleIndex)
+	mux.HandleFunc("/ws", g.handleWebsocket)
+	g.srv = &http.Server{
+		Handler:           g.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return g, nil
+} // }}}
+
+// func g.Addr {{{
+
+// Addr returns the address the gateway is listening on
+func (g *Gateway) Addr() string {
+	return g.listener.Addr().String()
+} // }}}
+
+// func g.Serve {{{
+
+// Serve Serves requests until Close is called
+func (g *Gateway) Serve() error {
+	err := g.srv.Serve(g.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+} // }}}
+
+// func g.Close {{{
+
+// Close Stops accepting new browsers. Browsers that already joined are
+// connections like any other, and are closed by the server.
+func (g *Gateway) Close() error {
+	return g.srv.Close()
+} // }}}
+
+// func g.authenticate {{{
+
+// authenticate Wraps next so that it's only called for requests that present
+// our token, as the token query parameter, since browsers can't set headers
+// on websockets, or as a bearer token for other clients
+func (g *Gateway) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+} // }}}
+
+// func g.Grant {{{
+
+// Grant Lets the browser on connection browser talk to connection peer, so it
+// sees the messages peer sends us and can send it messages as us
+func (g *Gateway) Grant(browser, peer uint32) error {
+	sess, ok := g.session(browser)
+	if !ok {
+		return fmt.Errorf("gateway: connection %d is not a browser", browser)
+	}
+	if peer == browser {
+		return fmt.Errorf("gateway: connection %d already talks to itself", browser)
+	}
+
+	known := false
+	for _, p := range g.s.List() {
+		if p.ID == peer {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("gateway: no connection %d", peer)
+	}
+
+	sess.mu.Lock()
+	sess.granted[peer] = true
+	sess.mu.Unlock()
+	sess.nudge()
+	return nil
+} // }}}
+
+// func g.Revoke {{{
+
+// Revoke Stops the browser on connection browser talking to connection peer
+func (g *Gateway) Revoke(browser, peer uint32) error {
+	sess, ok := g.session(browser)
+	if !ok {
+		return fmt.Errorf("gateway: connection %d is not a browser", browser)
+	}
+
+	sess.mu.Lock()
+	had := sess.granted[peer]
+	delete(sess.granted, peer)
+	sess.mu.Unlock()
+
+	if !had {
+		return fmt.Errorf("gateway: connection %d was never granted connection %d", browser, peer)
+	}
+	sess.nudge()
+	return nil
+} // }}}
+
+// func g.Granted {{{
+
+// Granted returns the connections the browser on connection browser may talk
+// to, in order
+func (g *Gateway) Granted(browser uint32) ([]uint32, error) {
+	sess, ok := g.session(browser)
+	if !ok {
+		return nil, fmt.Errorf("gateway: connection %d is not a browser", browser)
+	}
+
+	sess.mu.Lock()
+	ids := make([]uint32, 0, len(sess.granted))
+	for id := range sess.granted {
+		ids = append(ids, id)
+	}
+	sess.mu.Unlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+} // }}}
+
+// func g.session {{{
+
+// session returns the browser on the given connection
+func (g *Gateway) session(id uint32) (*session, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sess, ok := g.sessions[id]
+	return sess, ok
+} // }}}
+
+// func g.handleIndex {{{
+
+// handleIndex Serves the chat page
+func (g *Gateway) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+} // }}}
+
+// func g.handleWebsocket {{{
+
+// handleWebsocket Upgrades the request to a websocket and adds the browser to
+// our connections, until it goes away
+func (g *Gateway) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	// A page on some other site could otherwise use the browser to join
+	// as the user, token and all
+	if !sameOrigin(r) {
+		http.Error(w, "gateway: cross-origin websocket refused", http.StatusForbidden)
+		return
+	}
+
+	ws, err := upgrade(w, r)
+	if err != nil {
+		// upgrade has already told the browser what went wrong
+		return
+	}
+
+	sess := &session{
+		g:       g,
+		ws:      ws,
+		out:     make(chan []byte, sendBuffer),
+		refresh: make(chan struct{}, 1),
+		granted: make(map[uint32]bool),
+		done:    make(chan struct{}),
+	}
+
+	// Listen for everyone elses messages before we join, so the browser
+	// doesn't miss any
+	unsubscribe := g.bus.Subscribe(sess.handleEvent)
+	defer unsubscribe()
+	go sess.writeLoop()
+
+	id := g.s.Attach(ws, sess, transport, events.Inbound)
+	atomic.StoreUint32(&sess.id, id)
+	g.mu.Lock()
+	g.sessions[id] = sess
+	g.mu.Unlock()
+	sess.push(outbound{Type: "welcome", ID: id}, true)
+
+	// The server reads from the browser from here on, so we just wait
+	// for it to go away
+	<-sess.done
+
+	g.mu.Lock()
+	delete(g.sessions, id)
+	g.mu.Unlock()
+} // }}}
+
+// func sess.ReadFrame {{{
+
+// ReadFrame reads the next message the browser sent to us. Messages the
+// browser sends to other connections are sent on through the server, and
+// the browser is told how that went.
+func (sess *session) ReadFrame() (proto.Frame, error) {
+	for {
+		b, err := sess.ws.ReadMessage()
+		if err != nil {
+			sess.finish()
+			return proto.Frame{}, err
+		}
+
+		var in inbound
+		if err := json.Unmarshal(b, &in); err != nil {
+			sess.push(outbound{Type: "error", Text: "invalid message: " + err.Error()}, true)
+			continue
+		}
+
+		// For us? Then it's read like a message from any other peer
+		if in.To == 0 {
+			return proto.Frame{Type: proto.FrameMessage, Payload: []byte(in.Text)}, nil
+		}
+
+		if !sess.allowed(uint32(in.To)) {
+			sess.push(outbound{Type: "error", To: in.To, Text: fmt.Sprintf("you haven't been granted connection %d", in.To)}, true)
+			continue
+		}
+		if err := sess.g.s.Send(in.To, in.Text); err != nil {
+			sess.push(outbound{Type: "error", To: in.To, Text: err.Error()}, true)
+			continue
+		}
+		sess.push(outbound{Type: "sent", To: in.To, Text: in.Text}, true)
+	}
+} // }}}
+
+// func sess.WriteFrame {{{
+
+// WriteFrame queues a message from us to be written to the browser
+func (sess *session) WriteFrame(f proto.Frame) error {
+	// We only have messages to show the browser
+	if f.Type != proto.FrameMessage {
+		return nil
+	}
+
+	if !sess.push(outbound{Type: "message", Text: string(f.Payload)}, true) {
+		return net.ErrClosed
+	}
+	return nil
+} // }}}
+
+// func sess.handleEvent {{{
+
+// handleEvent Passes on the messages of the connections the browser has been
+// granted, and lets it know when they come and go
+func (sess *session) handleEvent(e events.Event) {
+	switch e.Kind {
+	case events.MessageReceived:
+		// The browser already knows what it said itself, and mustn't
+		// hear anyone it hasn't been granted
+		if !sess.allowed(e.ConnID) {
+			return
+		}
+		sess.push(outbound{
+			Type: "message",
+			From: e.ConnID,
+			IP:   e.IP,
+			Port: e.Port,
+			Text: e.Message,
+		}, false)
+	case events.PeerDisconnected:
+		// Connection ids are never reused, but there's no sense holding
+		// on to the grant of one that's gone
+		sess.mu.Lock()
+		had := sess.granted[e.ConnID]
+		delete(sess.granted, e.ConnID)
+		sess.mu.Unlock()
+		if had {
+			sess.nudge()
+		}
+	}
+} // }}}
+
+// func sess.allowed {{{
+
+// allowed reports whether the browser may talk to the given connection
+func (sess *session) allowed(id uint32) bool {
+	if id == atomic.LoadUint32(&sess.id) {
+		return false
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.granted[id]
+} // }}}
+
+// func sess.nudge {{{
+
+// nudge Asks the write loop to send the browser its connection list again.
+// The bus calls us on whichever goroutine published the event, so the list
+// is fetched by the write loop instead.
+func (sess *session) nudge() {
+	select {
+	case sess.refresh <- struct{}{}:
+	default:
+	}
+} // }}}
+
+// func sess.push {{{
+
+// push Queues a message to be written to the browser, returning false if the
+// browser has gone away. If wait is false and the browser isn't keeping up,
+// the message is dropped rather than holding up the caller.
+func (sess *session) push(m outbound, wait bool) bool {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return false
+	}
+
+	if !wait {
+		select {
+		case sess.out <- b:
+		case <-sess.done:
+			return false
+		default:
+		}
+		return true
+	}
+
+	select {
+	case sess.out <- b:
+		return true
+	case <-sess.done:
+		return false
+	}
+} // }}}
+
+// func sess.writeLoop {{{
+
+// writeLoop Writes queued messages to the browser until it goes away
+func (sess *session) writeLoop() {
+	for {
+		var b []byte
+		select {
+		case b = <-sess.out:
+		case <-sess.refresh:
+			b = sess.peers()
+		case <-sess.done:
+			return
+		}
+
+		if err := sess.ws.WriteMessage(b); err != nil {
+			// Cut the reading side short, so the server hears the
+			// connection is gone and tells everyone
+			sess.ws.SetReadDeadline(time.Now())
+			sess.finish()
+			return
+		}
+	}
+} // }}}
+
+// func sess.peers {{{
+
+// peers returns the connections the browser has been granted, ready to write
+// to it
+func (sess *session) peers() []byte {
+	m := outbound{Type: "peers", Peers: []peer{}}
+	for _, p := range sess.g.s.List() {
+		if !sess.allowed(p.ID) {
+			continue
+		}
+		m.Peers = append(m.Peers, peer{
+			ID:        p.ID,
+			IP:        p.IP,
+			Port:      p.Port,
+			Transport: p.Transport,
+		})
+	}
+	b, _ := json.Marshal(m)
+	return b
+} // }}}
+
+// func sess.finish {{{
+
+// finish Marks the browser as gone, only the first time it's called
+func (sess *session) finish() {
+	sess.doneOnce.Do(func() {
+		close(sess.done)
+	})
+} // }}}
@@ -0,0 +1,139 @@
+// Package gateway provides the optional websocket gateway, which lets people
+// chat from a browser by joining our peer network as ordinary connections
+package gateway
+
+import (
+	"bufio"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/types"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// How many messages we'll queue up for a slow browser before we start
+// dropping the ones it didn't ask for, so one slow browser can't hold up the
+// rest of the program
+const sendBuffer = 256
+
+// The name browser connections are given in the connection list
+const transport = "ws"
+
+// type Server interface {{{
+
+// Server is what the gateway needs from the chat server: the usual commands,
+// plus being able to add connections that don't speak our own protocol
+type Server interface {
+	types.Server
+	Attach(conn net.Conn, codec client.Codec, transport string, dir events.Direction) uint32
+} // }}}
+
+// type Gateway struct {{{
+
+// Gateway serves the chat page and the websocket browsers connect to
+type Gateway struct {
+	// The server browsers join as peers
+	s Server
+
+	// The event bus we hear about everyone elses messages on
+	bus *events.Bus
+
+	// Every request must present this token
+	token string
+
+	// Our listener and the HTTP server using it
+	listener net.Listener
+	srv      *http.Server
+
+	// The browsers that have joined, by their connection id
+	mu       sync.Mutex
+	sessions map[uint32]*session
+} // }}}
+
+// type wsConn struct {{{
+
+// wsConn is a websocket connection, once the opening handshake is done
+type wsConn struct {
+	net.Conn
+
+	// Buffered reads of the underlying connection, which may hold data the
+	// browser sent straight after its handshake
+	r *bufio.Reader
+
+	// Control frames can be written while reading, so writes take turns
+	wmu sync.Mutex
+} // }}}
+
+// type session struct {{{
+
+// session is a single browser, and the client.Codec its connection is
+// served with
+type session struct {
+	g  *Gateway
+	ws *wsConn
+
+	// The connection id the server gave the browser, once it's attached.
+	// Only touched atomically, as events can arrive before it's set.
+	id uint32
+
+	// Messages waiting to be written to the browser, and a nudge to send it
+	// the connection list again
+	out     chan []byte
+	refresh chan struct{}
+
+	// The connections the user has let the browser talk to. A browser
+	// only ever sees its own conversation with us, plus those with the
+	// connections it has been granted.
+	mu      sync.Mutex
+	granted map[uint32]bool
+
+	// Closed once the browser has gone away
+	done     chan struct{}
+	doneOnce sync.Once
+} // }}}
+
+// type inbound struct {{{
+
+// inbound is a message from the browser. Messages to connection 0 are for
+// us, and everything else is sent on to that connection, if the browser has
+// been granted it.
+type inbound struct {
+	To   int    `json:"to"`
+	Text string `json:"text"`
+} // }}}
+
+// type outbound struct {{{
+
+// outbound is a message to the browser
+type outbound struct {
+	// One of "welcome", "message", "peers", "sent" or "error"
+	Type string `json:"type"`
+
+	// The browsers own connection id, for "welcome"
+	ID uint32 `json:"id,omitempty"`
+
+	// Who a message is from, 0 being us, for "message"
+	From uint32 `json:"from"`
+	IP   string `json:"ip,omitempty"`
+	Port string `json:"port,omitempty"`
+
+	// Who a message was sent to, for "sent" and "error"
+	To int `json:"to,omitempty"`
+
+	Text  string `json:"text,omitempty"`
+	Peers []peer `json:"peers,omitempty"`
+} // }}}
+
+// type peer struct {{{
+
+// peer is how a connection the browser has been granted is shown to it
+type peer struct {
+	ID        uint32 `json:"id"`
+	IP        string `json:"ip"`
+	Port      string `json:"port"`
+	Transport string `json:"transport"`
+} // }}}
+
+// Make sure a session can serve a connection
+var _ client.Codec = (*session)(nil)
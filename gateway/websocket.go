@@ -0,0 +1,260 @@
+// Package gateway provides the optional websocket gateway, which lets people
+// chat from a browser by joining our peer network as ordinary connections
+package gateway
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/Cryliss/chat/proto"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The bits of RFC 6455 we need - just enough of a websocket server for the
+// chat page, with text messages, pings and closing handshakes
+
+// Appended to the browsers key to prove we understood its handshake
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Errors returned while reading messages
+var (
+	errNotWebsocket  = errors.New("gateway: not a websocket handshake")
+	errUnmasked      = errors.New("gateway: browser sent an unmasked frame")
+	errBadControl    = errors.New("gateway: invalid control frame")
+	errBadContinue   = errors.New("gateway: unexpected continuation frame")
+	errMessageTooBig = errors.New("gateway: message is too large")
+)
+
+// func upgrade {{{
+
+// upgrade Completes the websocket opening handshake for r, and takes over its
+// connection from the HTTP server
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, errNotWebsocket.Error(), http.StatusBadRequest)
+		return nil, errNotWebsocket
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, errNotWebsocket.Error(), http.StatusBadRequest)
+		return nil, errNotWebsocket
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets are not supported", http.StatusInternalServerError)
+		return nil, errors.New("gateway: response can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, r: rw.Reader}, nil
+} // }}}
+
+// func sameOrigin {{{
+
+// sameOrigin reports whether r came from one of our own pages. Browsers
+// always say which page opened a websocket, so one without an Origin isn't
+// a browser and has to get by on the token alone.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+} // }}}
+
+// func headerContains {{{
+
+// headerContains checks whether any of the comma separated values of the
+// header name is token, ignoring case
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+} // }}}
+
+// func ws.ReadMessage {{{
+
+// ReadMessage reads the next text or binary message from the browser,
+// answering any pings along the way. Returns io.EOF once the browser closes
+// the connection.
+func (ws *wsConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// Echo the status code back, as the closing handshake asks
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.writeFrame(opClose, payload)
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				return nil, errBadContinue
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, errBadContinue
+			}
+		default:
+			return nil, errors.New("gateway: unknown opcode")
+		}
+
+		if len(msg)+len(payload) > proto.MaxFrameSize {
+			return nil, errMessageTooBig
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+} // }}}
+
+// func ws.WriteMessage {{{
+
+// WriteMessage writes a text message to the browser
+func (ws *wsConn) WriteMessage(b []byte) error {
+	return ws.writeFrame(opText, b)
+} // }}}
+
+// func ws.readFrame {{{
+
+// readFrame reads and unmasks a single frame
+func (ws *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0F
+
+	// Browsers always mask what they send us
+	if head[1]&0x80 == 0 {
+		err = errUnmasked
+		return
+	}
+
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Control frames can't be fragmented or longer than 125 bytes
+	if op >= opClose && (!fin || n > 125) {
+		err = errBadControl
+		return
+	}
+	if n > proto.MaxFrameSize {
+		err = errMessageTooBig
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+} // }}}
+
+// func ws.writeFrame {{{
+
+// writeFrame writes a single unmasked, unfragmented frame
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	head := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xFFFF:
+		head[1] = 126
+		head = append(head, 0, 0)
+		binary.BigEndian.PutUint16(head[2:], uint16(n))
+	default:
+		head[1] = 127
+		head = append(head, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(head[2:], uint64(n))
+	}
+
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	w := bufio.NewWriterSize(ws.Conn, len(head)+len(payload))
+	w.Write(head)
+	w.Write(payload)
+	return w.Flush()
+} // }}}
@@ -0,0 +1,164 @@
+// Package grapheme counts user-perceived characters, so that limits on
+// message length match what the user sees rather than how many bytes or
+// code points it takes to store them.
+//
+// It implements the parts of the Unicode extended grapheme cluster rules
+// (UAX #29) that matter for chat messages: combining marks, emoji modifier
+// and ZWJ sequences, flags, variation selectors, Hangul syllables and CRLF.
+package grapheme
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// type class int {{{
+
+// class is the grapheme cluster break property of a rune, or as much of it
+// as we care about
+type class int
+
+const (
+	other class = iota
+	cr
+	lf
+	control
+	extend
+	zwj
+	regional
+	pictographic
+	hangulL
+	hangulV
+	hangulT
+	hangulLV
+	hangulLVT
+) // }}}
+
+// func Count {{{
+
+// Count returns the number of user-perceived characters in s. Invalid UTF-8
+// is counted one byte at a time.
+func Count(s string) int {
+	n := 0
+	prev := control
+	prevPict := false // whether the cluster so far contains a pictograph
+	regionals := 0    // regional indicators in a row, as flags come in pairs
+
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		cur := classify(r)
+
+		if n == 0 || breaks(prev, cur, prevPict, regionals) {
+			n++
+			prevPict = false
+			regionals = 0
+		}
+
+		switch cur {
+		case pictographic:
+			prevPict = true
+		case regional:
+			regionals++
+		}
+		prev = cur
+	}
+	return n
+} // }}}
+
+// func breaks {{{
+
+// breaks reports whether there's a character boundary between a rune of
+// class prev and one of class cur
+func breaks(prev, cur class, pict bool, regionals int) bool {
+	switch {
+	case prev == cr && cur == lf:
+		return false
+	case prev == cr || prev == lf || prev == control:
+		return true
+	case cur == cr || cur == lf || cur == control:
+		return true
+	case prev == hangulL && (cur == hangulL || cur == hangulV || cur == hangulLV || cur == hangulLVT):
+		return false
+	case (prev == hangulLV || prev == hangulV) && (cur == hangulV || cur == hangulT):
+		return false
+	case (prev == hangulLVT || prev == hangulT) && cur == hangulT:
+		return false
+	case cur == extend || cur == zwj:
+		return false
+	case prev == zwj && cur == pictographic && pict:
+		return false
+	case prev == regional && cur == regional:
+		// Flags are pairs of regional indicators, so we only join every
+		// other one
+		return regionals%2 == 0
+	}
+	return true
+} // }}}
+
+// func classify {{{
+
+// classify returns the class of r
+func classify(r rune) class {
+	switch {
+	case r == '\r':
+		return cr
+	case r == '\n':
+		return lf
+	case r == 0x200d:
+		return zwj
+	case r >= 0x1f1e6 && r <= 0x1f1ff:
+		return regional
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		// Skin tone modifiers
+		return extend
+	case r >= 0xe0020 && r <= 0xe007f:
+		// Tags, as used by subdivision flags
+		return extend
+	case r == 0x200c:
+		return extend
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return extend
+	case unicode.Is(unicode.Cc, r), r == 0x2028, r == 0x2029:
+		return control
+	case r >= 0x1100 && r <= 0x115f, r >= 0xa960 && r <= 0xa97c:
+		return hangulL
+	case r >= 0x1160 && r <= 0x11a7, r >= 0xd7b0 && r <= 0xd7c6:
+		return hangulV
+	case r >= 0x11a8 && r <= 0x11ff, r >= 0xd7cb && r <= 0xd7fb:
+		return hangulT
+	case r >= 0xac00 && r <= 0xd7a3:
+		// Precomposed syllables are LV if they have no trailing consonant
+		if (r-0xac00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	case isPictographic(r):
+		return pictographic
+	}
+	return other
+} // }}}
+
+// func isPictographic {{{
+
+// isPictographic reports whether r is (roughly) Extended_Pictographic, the
+// property emoji ZWJ sequences are built from
+func isPictographic(r rune) bool {
+	switch {
+	case r == 0xa9, r == 0xae, r == 0x203c, r == 0x2049, r == 0x2122, r == 0x2139:
+		return true
+	case r >= 0x2194 && r <= 0x21aa:
+		return true
+	case r >= 0x231a && r <= 0x23ff:
+		return true
+	case r >= 0x25aa && r <= 0x27bf:
+		return true
+	case r >= 0x2934 && r <= 0x2935, r >= 0x2b05 && r <= 0x2b55:
+		return true
+	case r == 0x3030, r == 0x303d, r == 0x3297, r == 0x3299:
+		return true
+	case r >= 0x1f000 && r <= 0x1faff:
+		return true
+	}
+	return false
+} // }}}
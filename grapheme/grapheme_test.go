@@ -0,0 +1,79 @@
+package grapheme
+
+import "testing"
+
+// func TestCount {{{
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"spaces", "a b  c", 6},
+		{"latin precomposed", "caf\u00e9", 4},
+		{"combining acute", "cafe\u0301", 4},
+		{"several combining marks", "e\u0323\u0301\u0308!", 2},
+		{"leading combining mark", "\u0301a", 2},
+		{"cjk", "\u4f60\u597d", 2},
+
+		// Line endings
+		{"crlf", "a\r\nb", 3},
+		{"lfcr", "a\n\rb", 4},
+		{"cr cr", "\r\r", 2},
+		{"lf lf", "\n\n", 2},
+		{"combining mark after lf", "\n\u0301", 2},
+		{"tab", "a\tb", 3},
+
+		// Flags are pairs of regional indicators
+		{"one regional indicator", "\U0001F1FA", 1},
+		{"flag", "\U0001F1FA\U0001F1F8", 1},
+		{"flag and a half", "\U0001F1FA\U0001F1F8\U0001F1EC", 2},
+		{"two flags", "\U0001F1FA\U0001F1F8\U0001F1EC\U0001F1E7", 2},
+		{"five regional indicators", "\U0001F1FA\U0001F1F8\U0001F1EC\U0001F1E7\U0001F1EB", 3},
+		{"flags split by text", "\U0001F1FAx\U0001F1F8\U0001F1EC", 3},
+
+		// Emoji
+		{"emoji", "\U0001F600", 1},
+		{"emoji presentation", "\u2764\ufe0f", 1},
+		{"skin tone", "\U0001F44D\U0001F3FD", 1},
+		{"two skin tones", "\U0001F44D\U0001F3FD\U0001F44D\U0001F3FB", 2},
+		{"family", "\U0001F468\u200d\U0001F469\u200d\U0001F467\u200d\U0001F466", 1},
+		{"family with skin tones", "\U0001F468\U0001F3FB\u200d\U0001F469\U0001F3FF\u200d\U0001F467", 1},
+		{"heart on fire", "\u2764\ufe0f\u200d\U0001F525", 1},
+		{"two families", "\U0001F468\u200d\U0001F469\U0001F468\u200d\U0001F469", 2},
+		{"zwj after a letter", "a\u200d\U0001F600", 2},
+		{"trailing zwj", "\U0001F600\u200d", 1},
+		{"keycap", "1\ufe0f\u20e3", 1},
+
+		// Subdivision flags are a black flag followed by tags
+		{"scotland", "\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", 1},
+		{"scotland twice", "\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", 2},
+
+		// Hangul
+		{"precomposed syllables", "\ud55c\uad6d\uc5b4", 3},
+		{"l v", "\u1100\u1161", 1},
+		{"l v t", "\u1100\u1161\u11a8", 1},
+		{"l l v", "\u1100\u1100\u1161", 1},
+		{"lv t", "\uac00\u11a8", 1},
+		{"lvt t", "\uac01\u11a8", 1},
+		{"lvt v", "\uac01\u1161", 2},
+		{"t l", "\u11a8\u1100", 2},
+		{"v v t t", "\u1161\u1161\u11a8\u11a8", 1},
+		{"two syllables from jamo", "\u1100\u1161\u11a8\u1100\u1161", 2},
+
+		// Invalid UTF-8 is counted a byte at a time
+		{"invalid byte", "\xff", 1},
+		{"invalid bytes", "a\xff\xfeb", 4},
+		{"truncated sequence", "\xe2\x82", 2},
+		{"truncated emoji", "\xf0\x9f\x98", 3},
+	}
+
+	for _, test := range tests {
+		if got := Count(test.s); got != test.want {
+			t.Errorf("%s: Count(%+q) = %d, want %d", test.name, test.s, got, test.want)
+		}
+	}
+} // }}}
@@ -0,0 +1,127 @@
+// Package inbox keeps the messages each peer sends us until the user has read
+// them, so they aren't lost when they scroll away
+package inbox
+
+import (
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/types"
+	"sort"
+)
+
+// func New {{{
+
+// New Initializes and returns a new, empty, Inbox
+func New() *Inbox {
+	return &Inbox{
+		boxes: make(map[uint32]*mailbox),
+	}
+} // }}}
+
+// func in.HandleEvent {{{
+
+// HandleEvent Keeps the messages peers send us, for use as an event bus
+// subscriber. Subscribe it before the frontends, so the unread counts are up
+// to date by the time they hear about a message.
+func (in *Inbox) HandleEvent(e events.Event) {
+	switch e.Kind {
+	case events.MessageReceived:
+		in.mu.Lock()
+		box, ok := in.boxes[e.ConnID]
+		if !ok {
+			box = &mailbox{}
+			in.boxes[e.ConnID] = box
+		}
+		box.unread = append(box.unread, types.Message{
+			ConnID: e.ConnID,
+			IP:     e.IP,
+			Port:   e.Port,
+			Time:   e.Time,
+			Text:   e.Message,
+		})
+		if n := len(box.unread); n > MaxUnread {
+			box.unread = append(box.unread[:0:0], box.unread[n-MaxUnread:]...)
+		}
+		in.mu.Unlock()
+	case events.PeerDisconnected:
+		// We hold on to what they sent until it's been read
+		in.mu.Lock()
+		if box, ok := in.boxes[e.ConnID]; ok {
+			box.closed = true
+			if len(box.unread) == 0 {
+				delete(in.boxes, e.ConnID)
+			}
+		}
+		in.mu.Unlock()
+	}
+} // }}}
+
+// func in.Unread {{{
+
+// Unread returns how many unread messages a connection has sent us
+func (in *Inbox) Unread(id uint32) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if box, ok := in.boxes[id]; ok {
+		return len(box.unread)
+	}
+	return 0
+} // }}}
+
+// func in.Messages {{{
+
+// Messages returns the unread messages a connection has sent us, or those of
+// every connection if id is zero, sorted by connection and then by when
+// they arrived. Closed connections are included until they've been read.
+func (in *Inbox) Messages(id uint32) []types.Message {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	var messages []types.Message
+	for _, conn := range in.ids(id) {
+		messages = append(messages, in.boxes[conn].unread...)
+	}
+	return messages
+} // }}}
+
+// func in.MarkRead {{{
+
+// MarkRead Marks the messages a connection has sent us as read, or those of
+// every connection if id is zero, returning how many there were
+func (in *Inbox) MarkRead(id uint32) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	n := 0
+	for _, conn := range in.ids(id) {
+		box := in.boxes[conn]
+		n += len(box.unread)
+		box.unread = nil
+		if box.closed {
+			delete(in.boxes, conn)
+		}
+	}
+	return n
+} // }}}
+
+// func in.ids {{{
+
+// ids returns the sorted ids of the mailboxes id refers to, every one of them
+// if it's zero. The caller must hold mu.
+func (in *Inbox) ids(id uint32) []uint32 {
+	if id != 0 {
+		if _, ok := in.boxes[id]; ok {
+			return []uint32{id}
+		}
+		return nil
+	}
+
+	ids := make([]uint32, 0, len(in.boxes))
+	for conn := range in.boxes {
+		ids = append(ids, conn)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+} // }}}
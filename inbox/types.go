@@ -0,0 +1,37 @@
+// Package inbox keeps the messages each peer sends us until the user has read
+// them, so they aren't lost when they scroll away
+package inbox
+
+import (
+	"github.com/Cryliss/chat/types"
+	"sync"
+)
+
+// MaxUnread is how many unread messages we keep for each peer. Once a peer
+// has sent more, the oldest are dropped.
+const MaxUnread = 200
+
+// type mailbox struct {{{
+
+// mailbox holds the unread messages of a single connection
+type mailbox struct {
+	// The unread messages, oldest first
+	unread []types.Message
+
+	// Whether the connection has been closed, in which case the mailbox is
+	// thrown away once everything in it has been read
+	closed bool
+} // }}}
+
+// type Inbox struct {{{
+
+// Inbox holds the unread messages of every connection, subscribed to the
+// event bus to hear about them
+type Inbox struct {
+	// Locks access to our mailboxes, as events are published from every
+	// connections goroutine
+	mu sync.Mutex
+
+	// Our mailboxes, by connection id
+	boxes map[uint32]*mailbox
+} // }}}
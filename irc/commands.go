@@ -0,0 +1,452 @@
+// Package irc provides the optional IRC bridge, which lets an ordinary IRC
+// client chat with our peers. Each peer shows up as a nick, and channels are
+// rooms of peers that messages are sent to all at once.
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The commands we understand, whether they can be used before the client has
+// given us our token, and whether they can be used before it has registered
+var commands = map[string]struct {
+	handler      func(sess *session, params []string) bool
+	beforePass   bool
+	beforeSignOn bool
+}{
+	"PASS":    {(*session).pass, true, true},
+	"NICK":    {(*session).setNick, false, true},
+	"USER":    {(*session).setUser, false, true},
+	"PING":    {(*session).ping, true, true},
+	"QUIT":    {(*session).quit, true, true},
+	"JOIN":    {(*session).join, false, false},
+	"PART":    {(*session).part, false, false},
+	"NAMES":   {(*session).names, false, false},
+	"PRIVMSG": {(*session).privmsg, false, false},
+	"INVITE":  {(*session).invite, false, false},
+	"WHO":     {(*session).who, false, false},
+	"MODE":    {(*session).mode, false, false},
+}
+
+// func sess.handle {{{
+
+// handle Runs a command from the client, returning true if the client has
+// asked to leave
+func (sess *session) handle(m message) bool {
+	cmd, ok := commands[m.Command]
+	if !ok {
+		sess.replyLocked(errUnknownCmd, m.Command, "Unknown command")
+		return false
+	}
+
+	sess.b.mu.Lock()
+	authed, registered := sess.authed, sess.registered
+	sess.b.mu.Unlock()
+
+	// Clients send PASS before anything else, so one that hasn't doesn't
+	// know our token, and has no business here
+	if !authed && !cmd.beforePass {
+		sess.replyLocked(errBadPassword, "Password required, send PASS <token> before NICK and USER")
+		sess.send("", "ERROR", "Closing link: password required")
+		return true
+	}
+	if !registered && !cmd.beforeSignOn {
+		sess.replyLocked(errNotRegistered, "You have not registered")
+		return false
+	}
+
+	return cmd.handler(sess, m.Params)
+} // }}}
+
+// func sess.pass {{{
+
+// pass Handles PASS, which must give our token before the client can sign on.
+// Anyone who gets it wrong is shown the door, rather than left to guess again.
+func (sess *session) pass(params []string) bool {
+	if len(params) == 0 || params[0] == "" {
+		sess.replyLocked(errNeedMoreParam, "PASS", "Not enough parameters")
+		return false
+	}
+
+	sess.b.mu.Lock()
+	defer sess.b.mu.Unlock()
+
+	if sess.registered {
+		sess.reply(errAlreadyReg, "You may not reregister")
+		return false
+	}
+	if !sess.b.checkToken(params[0]) {
+		sess.reply(errBadPassword, "Password incorrect")
+		sess.send("", "ERROR", "Closing link: password incorrect")
+		return true
+	}
+	sess.authed = true
+	return false
+} // }}}
+
+// func sess.setNick {{{
+
+// setNick Handles NICK, choosing or changing the clients nick
+func (sess *session) setNick(params []string) bool {
+	if len(params) == 0 || params[0] == "" {
+		sess.replyLocked(errNoNickGiven, "No nickname given")
+		return false
+	}
+	nick := params[0]
+
+	// Our peers nicks are taken, and nicks can't look like rooms
+	if _, ok := peerID(nick); ok || strings.ContainsAny(nick, "#&:,!@*? ") {
+		sess.replyLocked(errErroneousNick, nick, "Erroneous nickname")
+		return false
+	}
+
+	sess.b.mu.Lock()
+	defer sess.b.mu.Unlock()
+
+	if sess.registered {
+		sess.send(sess.prefix(), "NICK", nick)
+	}
+	sess.nick = nick
+	sess.signOn()
+	return false
+} // }}}
+
+// func sess.setUser {{{
+
+// setUser Handles USER, which the client sends once when it connects
+func (sess *session) setUser(params []string) bool {
+	if len(params) == 0 || params[0] == "" {
+		sess.replyLocked(errNeedMoreParam, "USER", "Not enough parameters")
+		return false
+	}
+
+	sess.b.mu.Lock()
+	defer sess.b.mu.Unlock()
+
+	if sess.user != "" {
+		sess.reply(errAlreadyReg, "You may not reregister")
+		return false
+	}
+	sess.user = params[0]
+	sess.signOn()
+	return false
+} // }}}
+
+// func sess.signOn {{{
+
+// signOn Welcomes the client once it has given us both its nick and user.
+// The caller must hold the bridges mu.
+func (sess *session) signOn() {
+	if sess.registered || sess.nick == "" || sess.user == "" {
+		return
+	}
+	sess.registered = true
+
+	sess.reply(rplWelcome, fmt.Sprintf("Welcome to %s, %s", serverName, sess.prefix()))
+	sess.reply(rplYourHost, fmt.Sprintf("Your host is %s, bridging to our peer connections", serverName))
+	sess.reply(rplCreated, "This server was created when the program started")
+	sess.send(serverName, rplMyInfo, sess.nick, serverName, "1", "o", "o")
+	sess.reply(errNoMotd, "MOTD File is missing")
+	sess.send(serverName, "NOTICE", sess.nick, fmt.Sprintf(
+		"Peers are shown as %s<connection id>. JOIN %s to talk to every peer at once, "+
+			"or JOIN a new room and INVITE peers to it.", peerPrefix, allRoom))
+} // }}}
+
+// func sess.ping {{{
+
+// ping Handles PING, so the client knows we're still here
+func (sess *session) ping(params []string) bool {
+	token := serverName
+	if len(params) > 0 {
+		token = params[0]
+	}
+	sess.send(serverName, "PONG", serverName, token)
+	return false
+} // }}}
+
+// func sess.quit {{{
+
+// quit Handles QUIT, saying goodbye before the connection is closed
+func (sess *session) quit(params []string) bool {
+	sess.send("", "ERROR", "Closing link")
+	return true
+} // }}}
+
+// func sess.join {{{
+
+// join Handles JOIN, creating any rooms that don't exist yet
+func (sess *session) join(params []string) bool {
+	if len(params) == 0 {
+		sess.replyLocked(errNeedMoreParam, "JOIN", "Not enough parameters")
+		return false
+	}
+
+	// JOIN 0 leaves every room
+	if params[0] == "0" {
+		sess.b.mu.Lock()
+		var rooms []string
+		for room := range sess.joined {
+			rooms = append(rooms, room)
+		}
+		sess.b.mu.Unlock()
+		return sess.part([]string{strings.Join(rooms, ",")})
+	}
+
+	for _, room := range strings.Split(params[0], ",") {
+		if !validRoom(room) {
+			sess.replyLocked(errNoSuchChannel, room, "No such channel")
+			continue
+		}
+
+		sess.b.mu.Lock()
+		if room != allRoom && sess.b.rooms[room] == nil {
+			sess.b.rooms[room] = make(map[uint32]bool)
+		}
+		already := sess.joined[room]
+		sess.joined[room] = true
+		if !already {
+			sess.send(sess.prefix(), "JOIN", room)
+			sess.reply(rplNoTopic, room, "No topic is set")
+		}
+		sess.b.mu.Unlock()
+
+		if !already {
+			sess.sendNames(room)
+		}
+	}
+	return false
+} // }}}
+
+// func sess.part {{{
+
+// part Handles PART, leaving rooms. Rooms stay around, along with the peers
+// invited to them, in case anyone joins them again.
+func (sess *session) part(params []string) bool {
+	if len(params) == 0 {
+		sess.replyLocked(errNeedMoreParam, "PART", "Not enough parameters")
+		return false
+	}
+	reason := "Leaving"
+	if len(params) > 1 {
+		reason = params[1]
+	}
+
+	sess.b.mu.Lock()
+	defer sess.b.mu.Unlock()
+
+	for _, room := range strings.Split(params[0], ",") {
+		if room == "" {
+			continue
+		}
+		if !sess.joined[room] {
+			sess.reply(errNotOnChannel, room, "You're not on that channel")
+			continue
+		}
+		delete(sess.joined, room)
+		sess.send(sess.prefix(), "PART", room, reason)
+	}
+	return false
+} // }}}
+
+// func sess.names {{{
+
+// names Handles NAMES, listing who is in each room
+func (sess *session) names(params []string) bool {
+	var rooms []string
+	if len(params) > 0 {
+		rooms = strings.Split(params[0], ",")
+	} else {
+		sess.b.mu.Lock()
+		for room := range sess.joined {
+			rooms = append(rooms, room)
+		}
+		sess.b.mu.Unlock()
+	}
+
+	for _, room := range rooms {
+		sess.sendNames(room)
+	}
+	return false
+} // }}}
+
+// func sess.sendNames {{{
+
+// sendNames Lists who is in a room
+func (sess *session) sendNames(room string) {
+	peers := sess.b.members(room)
+
+	sess.b.mu.Lock()
+	defer sess.b.mu.Unlock()
+
+	_, exists := sess.b.rooms[room]
+	if exists || room == allRoom {
+		nicks := make([]string, 0, len(peers)+1)
+		if sess.joined[room] {
+			nicks = append(nicks, sess.nick)
+		}
+		for _, p := range peers {
+			nicks = append(nicks, peerNick(p.ID))
+		}
+		sess.reply(rplNamReply, "=", room, strings.Join(nicks, " "))
+	}
+	sess.reply(rplEndOfNames, room, "End of /NAMES list")
+} // }}}
+
+// func sess.privmsg {{{
+
+// privmsg Handles PRIVMSG, sending a message to a peer, or to every peer in
+// a room
+func (sess *session) privmsg(params []string) bool {
+	if len(params) == 0 {
+		sess.replyLocked(errNoRecipient, "No recipient given (PRIVMSG)")
+		return false
+	}
+	if len(params) < 2 || params[1] == "" {
+		sess.replyLocked(errNoTextToSend, "No text to send")
+		return false
+	}
+	text := params[1]
+
+	for _, target := range strings.Split(params[0], ",") {
+		if !strings.HasPrefix(target, "#") {
+			id, ok := peerID(target)
+			if !ok {
+				sess.replyLocked(errNoSuchNick, target, "No such nick/channel")
+				continue
+			}
+			sess.sendTo(id, text)
+			continue
+		}
+
+		sess.b.mu.Lock()
+		_, exists := sess.b.rooms[target]
+		joined := sess.joined[target]
+		sess.b.mu.Unlock()
+
+		if !exists && target != allRoom {
+			sess.replyLocked(errNoSuchChannel, target, "No such channel")
+			continue
+		}
+		if !joined {
+			sess.replyLocked(errCannotSend, target, "Cannot send to channel")
+			continue
+		}
+		for _, p := range sess.b.members(target) {
+			sess.sendTo(p.ID, text)
+		}
+	}
+	return false
+} // }}}
+
+// func sess.sendTo {{{
+
+// sendTo Sends a message to a peer through the server, letting the client
+// know if it couldn't be sent
+func (sess *session) sendTo(id uint32, text string) {
+	// Sending publishes an event that we handle ourselves, taking the
+	// bridges mu, so we mustn't be holding it here
+	if err := sess.b.s.Send(int(id), text); err != nil {
+		sess.b.mu.Lock()
+		sess.send(serverName, "NOTICE", sess.nick, fmt.Sprintf("Unable to send to %s: %v", peerNick(id), err))
+		sess.b.mu.Unlock()
+	}
+} // }}}
+
+// func sess.invite {{{
+
+// invite Handles INVITE, adding a peer to a room
+func (sess *session) invite(params []string) bool {
+	if len(params) < 2 {
+		sess.replyLocked(errNeedMoreParam, "INVITE", "Not enough parameters")
+		return false
+	}
+	nick, room := params[0], params[1]
+
+	id, ok := peerID(nick)
+	found, ip := false, ""
+	for _, p := range sess.b.s.List() {
+		if ok && p.ID == id {
+			found, ip = true, p.IP
+			break
+		}
+	}
+	if !found {
+		sess.replyLocked(errNoSuchNick, nick, "No such nick/channel")
+		return false
+	}
+
+	sess.b.mu.Lock()
+	defer sess.b.mu.Unlock()
+
+	members, exists := sess.b.rooms[room]
+	if !exists {
+		// Every peer is already in allRoom, so there's no inviting them
+		sess.reply(errNoSuchChannel, room, "No such channel")
+		return false
+	}
+	if !sess.joined[room] {
+		sess.reply(errNotOnChannel, room, "You're not on that channel")
+		return false
+	}
+
+	sess.reply(rplInviting, peerNick(id), room)
+	if members[id] {
+		return false
+	}
+	members[id] = true
+
+	// Let everyone in the room see the peer arrive
+	for other := range sess.b.sessions {
+		if other.joined[room] {
+			other.send(fmt.Sprintf("%s!%d@%s", peerNick(id), id, ip), "JOIN", room)
+		}
+	}
+	return false
+} // }}}
+
+// func sess.who {{{
+
+// who Handles WHO, which some clients send after joining a room. We've
+// nothing more to say than NAMES does, so we just end the list.
+func (sess *session) who(params []string) bool {
+	mask := "*"
+	if len(params) > 0 {
+		mask = params[0]
+	}
+	sess.replyLocked(rplEndOfWho, mask, "End of /WHO list")
+	return false
+} // }}}
+
+// func sess.mode {{{
+
+// mode Handles MODE, which clients send on their own after connecting and
+// joining. Neither users nor rooms have modes, so we ignore it.
+func (sess *session) mode(params []string) bool {
+	return false
+} // }}}
+
+// func sess.prefix {{{
+
+// prefix returns the prefix of the clients own commands, as echoed back to
+// it. The caller must hold the bridges mu.
+func (sess *session) prefix() string {
+	return fmt.Sprintf("%s!%s@%s", sess.nick, sess.user, serverName)
+} // }}}
+
+// func sess.replyLocked {{{
+
+// replyLocked Queues a numeric reply for the client, taking the bridges mu
+func (sess *session) replyLocked(numeric string, params ...string) {
+	sess.b.mu.Lock()
+	sess.reply(numeric, params...)
+	sess.b.mu.Unlock()
+} // }}}
+
+// func validRoom {{{
+
+// validRoom checks a room name is one an IRC client would accept
+func validRoom(room string) bool {
+	return len(room) > 1 && len(room) <= 50 && strings.HasPrefix(room, "#") &&
+		!strings.ContainsAny(room, " ,:\x07")
+} // }}}
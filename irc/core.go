@@ -0,0 +1,385 @@
+// Package irc provides the optional IRC bridge, which lets an ordinary IRC
+// client chat with our peers. Each peer shows up as a nick, and channels are
+// rooms of peers that messages are sent to all at once.
+package irc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/types"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// func New {{{
+
+// New Initializes and returns a new Bridge, listening on the loopback
+// interface at the given port, with a freshly generated token written to
+// tokenFile. Clients must give the token as their server password before
+// they can sign on, as anyone who does can send messages as us. Only the user
+// running the program can read the token file.
+func New(s types.Server, bus *events.Bus, port int, tokenFile string) (*Bridge, error) {
+	// Generate a new token, so an old token file is no use to anyone
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("irc.New: error generating token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("irc.New: error writing token file: %w", err)
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("irc.New: %w", err)
+	}
+
+	b := &Bridge{
+		s:        s,
+		bus:      bus,
+		token:    token,
+		listener: l,
+		rooms:    make(map[string]map[uint32]bool),
+		sessions: make(map[*session]bool),
+	}
+	b.unsubscribe = bus.Subscribe(b.handleEvent)
+	return b, nil
+} // }}}
+
+// func b.Addr {{{
+
+// Addr returns the address the bridge is listening on
+func (b *Bridge) Addr() string {
+	return b.listener.Addr().String()
+} // }}}
+
+// func b.Serve {{{
+
+// Serve Accepts IRC clients until Close is called
+func (b *Bridge) Serve() error {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		sess := &session{
+			b:      b,
+			conn:   conn,
+			joined: make(map[string]bool),
+			out:    make(chan string, sendBuffer),
+			done:   make(chan struct{}),
+		}
+
+		b.mu.Lock()
+		b.sessions[sess] = true
+		b.mu.Unlock()
+
+		go sess.writeLoop()
+		go sess.readLoop()
+	}
+} // }}}
+
+// func b.checkToken {{{
+
+// checkToken returns whether a client gave us our token as its password
+func (b *Bridge) checkToken(pass string) bool {
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(b.token)) == 1
+} // }}}
+
+// func b.Close {{{
+
+// Close Stops accepting IRC clients, and disconnects the ones we have
+func (b *Bridge) Close() error {
+	b.unsubscribe()
+	err := b.listener.Close()
+
+	b.mu.Lock()
+	for sess := range b.sessions {
+		sess.conn.Close()
+	}
+	b.mu.Unlock()
+	return err
+} // }}}
+
+// func b.handleEvent {{{
+
+// handleEvent Passes on what our peers are doing to the IRC clients
+func (b *Bridge) handleEvent(e events.Event) {
+	nick := peerNick(e.ConnID)
+	prefix := fmt.Sprintf("%s!%d@%s", nick, e.ConnID, e.IP)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch e.Kind {
+	case events.MessageReceived:
+		// Show the message in every room the peer is in that the client
+		// has joined, or as a private message if there aren't any
+		for sess := range b.sessions {
+			if !sess.registered {
+				continue
+			}
+			targets := b.roomsOf(sess, e.ConnID)
+			if len(targets) == 0 {
+				targets = []string{sess.nick}
+			}
+			for _, t := range targets {
+				for _, line := range strings.Split(e.Message, "\n") {
+					sess.send(prefix, "PRIVMSG", t, line)
+				}
+			}
+		}
+	case events.PeerConnected:
+		for sess := range b.sessions {
+			if sess.joined[allRoom] {
+				sess.send(prefix, "JOIN", allRoom)
+			}
+		}
+	case events.PeerDisconnected:
+		reason := e.Reason
+		if e.Local {
+			reason = "connection closed"
+		} else if reason == "" {
+			reason = "peer has terminated the connection"
+		}
+
+		// Only tell the clients that could see the peer
+		for sess := range b.sessions {
+			if len(b.roomsOf(sess, e.ConnID)) > 0 {
+				sess.send(prefix, "QUIT", reason)
+			}
+		}
+		for _, members := range b.rooms {
+			delete(members, e.ConnID)
+		}
+	}
+} // }}}
+
+// func b.roomsOf {{{
+
+// roomsOf returns the rooms the session has joined that the peer is in.
+// The caller must hold mu.
+func (b *Bridge) roomsOf(sess *session, id uint32) []string {
+	var rooms []string
+	for room := range sess.joined {
+		if room == allRoom || b.rooms[room][id] {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+} // }}}
+
+// func b.members {{{
+
+// members returns the peers in a room, sorted by their connection id
+func (b *Bridge) members(room string) []types.Peer {
+	b.mu.Lock()
+	invited := make(map[uint32]bool, len(b.rooms[room]))
+	for id := range b.rooms[room] {
+		invited[id] = true
+	}
+	b.mu.Unlock()
+
+	var peers []types.Peer
+	for _, p := range b.s.List() {
+		if room == allRoom || invited[p.ID] {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+} // }}}
+
+// func sess.readLoop {{{
+
+// readLoop Reads and handles the clients commands until it goes away
+func (sess *session) readLoop() {
+	defer sess.close()
+
+	scanner := bufio.NewScanner(sess.conn)
+	scanner.Buffer(make([]byte, maxLine), maxLine)
+	for scanner.Scan() {
+		m, ok := parseMessage(scanner.Text())
+		if !ok {
+			continue
+		}
+		if quit := sess.handle(m); quit {
+			return
+		}
+	}
+} // }}}
+
+// func sess.writeLoop {{{
+
+// writeLoop Writes queued lines to the client until it goes away
+func (sess *session) writeLoop() {
+	w := bufio.NewWriter(sess.conn)
+	for {
+		select {
+		case line := <-sess.out:
+			w.WriteString(line)
+			w.WriteString("\r\n")
+
+			// Write out everything that's queued up in one go
+			for more := true; more; {
+				select {
+				case line := <-sess.out:
+					w.WriteString(line)
+					w.WriteString("\r\n")
+				default:
+					more = false
+				}
+			}
+			if err := w.Flush(); err != nil {
+				sess.conn.Close()
+				return
+			}
+		case <-sess.done:
+			// Write anything we said on the way out, i.e. an ERROR
+			// after QUIT, before the connection is closed
+			for more := true; more; {
+				select {
+				case line := <-sess.out:
+					w.WriteString(line)
+					w.WriteString("\r\n")
+				default:
+					more = false
+				}
+			}
+			w.Flush()
+			sess.conn.Close()
+			return
+		}
+	}
+} // }}}
+
+// func sess.send {{{
+
+// send Queues a line for the client, made up of an optional prefix, the
+// command and its parameters. The last parameter is always sent as a
+// trailing parameter, so it can contain spaces. If the client isn't keeping
+// up, the line is dropped rather than holding up the caller.
+func (sess *session) send(prefix, command string, params ...string) {
+	var sb strings.Builder
+	if prefix != "" {
+		sb.WriteString(":")
+		sb.WriteString(prefix)
+		sb.WriteString(" ")
+	}
+	sb.WriteString(command)
+	for i, p := range params {
+		sb.WriteString(" ")
+		if i == len(params)-1 {
+			sb.WriteString(":")
+		}
+		// Nothing we pass on can be allowed to start a new line
+		sb.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(p))
+	}
+
+	select {
+	case sess.out <- sb.String():
+	default:
+	}
+} // }}}
+
+// func sess.reply {{{
+
+// reply Queues a numeric reply for the client, from us. The caller must hold
+// the bridges mu, as the reply is addressed to the clients nick.
+func (sess *session) reply(numeric string, params ...string) {
+	nick := sess.nick
+	if nick == "" {
+		nick = "*"
+	}
+	sess.send(serverName, numeric, append([]string{nick}, params...)...)
+} // }}}
+
+// func sess.close {{{
+
+// close Forgets about the client and closes its connection, once any last
+// lines have been written
+func (sess *session) close() {
+	sess.b.mu.Lock()
+	delete(sess.b.sessions, sess)
+	sess.b.mu.Unlock()
+
+	sess.doneOnce.Do(func() {
+		close(sess.done)
+	})
+} // }}}
+
+// func parseMessage {{{
+
+// parseMessage splits a line from a client into its command and parameters,
+// ignoring any prefix. Returns false for a line with no command.
+func parseMessage(line string) (message, bool) {
+	line = strings.TrimRight(line, "\r")
+
+	// Clients shouldn't send a prefix, but if they do it's meaningless
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return message{}, false
+		}
+		line = line[i+1:]
+	}
+
+	var m message
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+
+		// The trailing parameter takes up the rest of the line
+		if m.Command != "" && strings.HasPrefix(line, ":") {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+
+		word := line
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			word, line = line[:i], line[i+1:]
+		} else {
+			line = ""
+		}
+
+		if m.Command == "" {
+			m.Command = strings.ToUpper(word)
+		} else {
+			m.Params = append(m.Params, word)
+		}
+	}
+	return m, m.Command != ""
+} // }}}
+
+// func peerNick {{{
+
+// peerNick returns the nick a peer is shown as
+func peerNick(id uint32) string {
+	return fmt.Sprintf("%s%d", peerPrefix, id)
+} // }}}
+
+// func peerID {{{
+
+// peerID returns the connection id of the peer with the given nick
+func peerID(nick string) (uint32, bool) {
+	if len(nick) <= len(peerPrefix) || !strings.EqualFold(nick[:len(peerPrefix)], peerPrefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(nick[len(peerPrefix):], 10, 32)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return uint32(id), true
+} // }}}
@@ -0,0 +1,158 @@
+package irc
+
+import (
+	"bufio"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/types"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// type fakeServer struct {{{
+
+// fakeServer is a server with no connections. Signing on doesn't need any
+// more of one than that.
+type fakeServer struct {
+	types.Server
+} // }}}
+
+// func s.List {{{
+
+// List returns no connections
+func (s fakeServer) List() []types.Peer {
+	return nil
+} // }}}
+
+// type ircClient struct {{{
+
+// ircClient is the IRC client side of a connection to the bridge
+type ircClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+} // }}}
+
+// func newBridge {{{
+
+// newBridge Starts a bridge on any free port, returning it and the token it
+// wrote to its token file. It's closed once the test is done with it.
+func newBridge(t *testing.T) (*Bridge, string) {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "irc.token")
+	b, err := New(fakeServer{}, events.NewBus(), 0, tokenFile)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	go b.Serve()
+	t.Cleanup(func() { b.Close() })
+
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatalf("token file wasn't written: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("token file has mode %o, want 600", mode)
+	}
+	token, _ := os.ReadFile(tokenFile)
+	return b, strings.TrimSpace(string(token))
+} // }}}
+
+// func dial {{{
+
+// dial Connects a new client to the bridge
+func dial(t *testing.T, b *Bridge) *ircClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &ircClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+} // }}}
+
+// func c.send {{{
+
+// send Sends the given lines to the bridge
+func (c *ircClient) send(lines ...string) {
+	for _, line := range lines {
+		if _, err := io.WriteString(c.conn, line+"\r\n"); err != nil {
+			c.t.Fatalf("sending %q failed: %v", line, err)
+		}
+	}
+} // }}}
+
+// func c.expect {{{
+
+// expect Reads lines until one has the given command, returning it
+func (c *ircClient) expect(command string) string {
+	c.t.Helper()
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("no %s before %v", command, err)
+		}
+		if m, ok := parseMessage(strings.TrimRight(line, "\r\n")); ok && m.Command == command {
+			return line
+		}
+	}
+} // }}}
+
+// func c.expectClosed {{{
+
+// expectClosed Reads until the bridge closes the connection
+func (c *ircClient) expectClosed() {
+	c.t.Helper()
+	if _, err := io.Copy(io.Discard, c.r); err != nil {
+		c.t.Errorf("connection wasn't closed: %v", err)
+	}
+} // }}}
+
+// func TestPass {{{
+
+// Only clients that give our token before signing on may do so
+func TestPass(t *testing.T) {
+	b, token := newBridge(t)
+	if len(token) != 64 {
+		t.Fatalf("token is %q, want 64 hex digits", token)
+	}
+
+	// No password at all
+	c := dial(t, b)
+	c.send("NICK alice")
+	c.expect(errBadPassword)
+	c.expect("ERROR")
+	c.expectClosed()
+
+	// The wrong one
+	c = dial(t, b)
+	c.send("PASS " + strings.ToUpper(token) + "x")
+	if line := c.expect(errBadPassword); !strings.Contains(line, "Password incorrect") {
+		t.Errorf("wrong password got %q", line)
+	}
+	c.expectClosed()
+
+	// Unknown commands, such as capability negotiation, and PING are fine
+	// beforehand, and the password may be a trailing parameter
+	c = dial(t, b)
+	c.send("CAP LS 302", "PING :x")
+	c.expect(errUnknownCmd)
+	c.expect("PONG")
+	c.send("PASS :"+token, "NICK alice", "USER alice 0 * :Alice")
+	if line := c.expect(rplWelcome); !strings.Contains(line, "alice") {
+		t.Errorf("welcome is %q", line)
+	}
+	c.send("JOIN #all")
+	c.expect(rplEndOfNames)
+
+	c.send("PASS " + token)
+	c.expect(errAlreadyReg)
+	c.send("QUIT")
+	c.expect("ERROR")
+	c.expectClosed()
+} // }}}
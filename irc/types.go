@@ -0,0 +1,116 @@
+// Package irc provides the optional IRC bridge, which lets an ordinary IRC
+// client chat with our peers. Each peer shows up as a nick, and channels are
+// rooms of peers that messages are sent to all at once.
+package irc
+
+import (
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/types"
+	"net"
+	"sync"
+)
+
+// The name we give ourselves as an IRC server
+const serverName = "chatty"
+
+// The room every peer is in, which can't be left by peers or invited to
+const allRoom = "#all"
+
+// Peers are given the nick peerPrefix followed by their connection id
+const peerPrefix = "peer"
+
+// How long a line an IRC client may send us, including the CR LF
+const maxLine = 512
+
+// How many lines we'll queue up for a slow IRC client before we start
+// dropping them, so it can't hold up the rest of the program
+const sendBuffer = 256
+
+// Numeric replies we send
+const (
+	rplWelcome       = "001"
+	rplYourHost      = "002"
+	rplCreated       = "003"
+	rplMyInfo        = "004"
+	rplEndOfWho      = "315"
+	rplNoTopic       = "331"
+	rplInviting      = "341"
+	rplNamReply      = "353"
+	rplEndOfNames    = "366"
+	errNoSuchNick    = "401"
+	errNoSuchChannel = "403"
+	errCannotSend    = "404"
+	errNoRecipient   = "411"
+	errNoTextToSend  = "412"
+	errUnknownCmd    = "421"
+	errNoMotd        = "422"
+	errNoNickGiven   = "431"
+	errErroneousNick = "432"
+	errNotOnChannel  = "442"
+	errNotRegistered = "451"
+	errNeedMoreParam = "461"
+	errAlreadyReg    = "462"
+	errBadPassword   = "464"
+)
+
+// type Bridge struct {{{
+
+// Bridge accepts IRC clients and passes their messages on to our peers
+type Bridge struct {
+	// The server whose connections we bridge to
+	s types.Server
+
+	// The event bus we hear about our peers on
+	bus *events.Bus
+
+	// What clients must give as their password before they can sign on
+	token string
+
+	// The listener IRC clients connect to
+	listener net.Listener
+
+	// mu guards everything below
+	mu sync.Mutex
+
+	// The rooms that have been created, other than allRoom, and the peers
+	// that have been invited to each of them
+	rooms map[string]map[uint32]bool
+
+	// The IRC clients currently connected
+	sessions map[*session]bool
+
+	// Stops us hearing about events once we're closed
+	unsubscribe func()
+} // }}}
+
+// type session struct {{{
+
+// session is a single IRC client
+type session struct {
+	b    *Bridge
+	conn net.Conn
+
+	// What the client has told us about itself, and the rooms it has
+	// joined, all guarded by the bridges mu. The session is registered once
+	// it has given us our token, a nick and a user.
+	authed     bool
+	nick       string
+	user       string
+	registered bool
+	joined     map[string]bool
+
+	// Lines waiting to be written to the client
+	out chan string
+
+	// Closed once the client has gone away
+	done     chan struct{}
+	doneOnce sync.Once
+} // }}}
+
+// type message struct {{{
+
+// message is a single line from an IRC client, split into its parts
+type message struct {
+	Command string
+	Params  []string
+} // }}}
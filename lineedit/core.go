@@ -0,0 +1,515 @@
+// Package lineedit provides the line editor used by the REPL, with cursor
+// movement, persistent history and tab completion
+package lineedit
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Cryliss/chat/term"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// func New {{{
+
+// New Initializes and returns a new Editor reading from stdin and drawing to
+// stdout, that uses complete for tab completion and remembers lines in history.
+// Either may be nil.
+func New(complete Completer, history *History) *Editor {
+	if history == nil {
+		history = NewHistory("", 0)
+	}
+	return &Editor{
+		in:       os.Stdin,
+		out:      os.Stdout,
+		reader:   bufio.NewReader(os.Stdin),
+		complete: complete,
+		history:  history,
+	}
+} // }}}
+
+// func e.SetHistoryFilter {{{
+
+// SetHistoryFilter Sets which lines the user enters are added to the history
+func (e *Editor) SetHistoryFilter(filter HistoryFilter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.filter = filter
+} // }}}
+
+// func e.Interactive {{{
+
+// Interactive reports whether we're reading from a terminal, and so are
+// editing lines rather than just reading them
+func (e *Editor) Interactive() bool {
+	return term.IsTerminal(int(e.in.Fd()))
+} // }}}
+
+// func e.Writer {{{
+
+// Writer returns an io.Writer for output that may be written while the user
+// is typing. It's printed above the line being edited, which is then redrawn.
+func (e *Editor) Writer() io.Writer {
+	return lineWriter{e: e}
+} // }}}
+
+// func e.ReadLine {{{
+
+// ReadLine shows the prompt and reads a line from the user. Returns
+// ErrInterrupted if they pressed Ctrl-C, and io.EOF if they pressed Ctrl-D
+// on an empty line or the input was closed.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	fd := int(e.in.Fd())
+	if !term.IsTerminal(fd) {
+		return e.readPlain(prompt)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return e.readPlain(prompt)
+	}
+	defer term.Restore(fd, state)
+
+	e.mu.Lock()
+	e.reading = true
+	e.prompt = prompt
+	e.buf = e.buf[:0]
+	e.pos = 0
+	e.histPos = e.history.Len()
+	e.scratch = nil
+	e.lastTab = false
+	e.refresh()
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		e.reading = false
+		e.mu.Unlock()
+	}()
+
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		e.mu.Lock()
+		line, done, err := e.key(r)
+		e.mu.Unlock()
+		if done {
+			return line, err
+		}
+	}
+} // }}}
+
+// func e.readPlain {{{
+
+// readPlain Reads a line without any editing, for when we aren't reading
+// from a terminal
+func (e *Editor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	line, err := e.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+} // }}}
+
+// func e.key {{{
+
+// key Handles a single key press, returning the line and true once the
+// user has finished with it. The caller must hold the lock.
+func (e *Editor) key(r rune) (string, bool, error) {
+	tab := r == '\t'
+	defer func() { e.lastTab = tab }()
+
+	switch r {
+	case '\r', '\n':
+		line := string(e.buf)
+		io.WriteString(e.out, "\r\n")
+		if e.filter == nil || e.filter(line) {
+			e.history.Add(line)
+		}
+		return line, true, nil
+	case 0x03: // Ctrl-C throws the line away
+		io.WriteString(e.out, "^C\r\n")
+		return "", true, ErrInterrupted
+	case 0x04: // Ctrl-D exits on an empty line, and deletes otherwise
+		if len(e.buf) == 0 {
+			io.WriteString(e.out, "\r\n")
+			return "", true, io.EOF
+		}
+		e.deleteAt(e.pos)
+	case '\t':
+		e.tab()
+	case 0x7f, 0x08: // Backspace
+		if e.pos > 0 {
+			e.pos--
+			e.deleteAt(e.pos)
+		}
+	case 0x01: // Ctrl-A
+		e.pos = 0
+	case 0x05: // Ctrl-E
+		e.pos = len(e.buf)
+	case 0x02: // Ctrl-B
+		e.move(-1)
+	case 0x06: // Ctrl-F
+		e.move(1)
+	case 0x0b: // Ctrl-K deletes to the end of the line
+		e.buf = e.buf[:e.pos]
+	case 0x15: // Ctrl-U deletes to the start of the line
+		e.buf = append(e.buf[:0], e.buf[e.pos:]...)
+		e.pos = 0
+	case 0x17: // Ctrl-W deletes the word before the cursor
+		start := e.pos
+		for start > 0 && e.buf[start-1] == ' ' {
+			start--
+		}
+		start = wordStartFrom(e.buf, start)
+		e.buf = append(e.buf[:start], e.buf[e.pos:]...)
+		e.pos = start
+	case 0x0c: // Ctrl-L clears the screen
+		io.WriteString(e.out, "\x1b[H\x1b[2J")
+	case 0x10: // Ctrl-P
+		e.historyMove(-1)
+	case 0x0e: // Ctrl-N
+		e.historyMove(1)
+	case 0x1b:
+		e.escape()
+	default:
+		if !unicode.IsPrint(r) {
+			return "", false, nil
+		}
+		e.buf = append(e.buf, 0)
+		copy(e.buf[e.pos+1:], e.buf[e.pos:])
+		e.buf[e.pos] = r
+		e.pos++
+	}
+
+	e.refresh()
+	return "", false, nil
+} // }}}
+
+// func e.escape {{{
+
+// escape Handles the escape sequences sent by the arrow keys and friends.
+// The caller must hold the lock.
+func (e *Editor) escape() {
+	if b, err := e.reader.ReadByte(); err != nil || (b != '[' && b != 'O') {
+		return
+	}
+
+	// Read the parameters up until the final byte of the sequence
+	var params []byte
+	var final byte
+	for {
+		b, err := e.reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if b >= 0x40 && b <= 0x7e {
+			final = b
+			break
+		}
+		params = append(params, b)
+	}
+
+	switch final {
+	case 'A': // Up
+		e.historyMove(-1)
+	case 'B': // Down
+		e.historyMove(1)
+	case 'C': // Right
+		e.move(1)
+	case 'D': // Left
+		e.move(-1)
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.buf)
+	case '~':
+		switch string(params) {
+		case "1", "7":
+			e.pos = 0
+		case "4", "8":
+			e.pos = len(e.buf)
+		case "3": // Delete
+			e.deleteAt(e.pos)
+		}
+	}
+} // }}}
+
+// func e.move {{{
+
+// move Moves the cursor by n runes, staying within the line
+func (e *Editor) move(n int) {
+	e.pos += n
+	if e.pos < 0 {
+		e.pos = 0
+	}
+	if e.pos > len(e.buf) {
+		e.pos = len(e.buf)
+	}
+} // }}}
+
+// func e.deleteAt {{{
+
+// deleteAt Removes the rune at i, if there is one
+func (e *Editor) deleteAt(i int) {
+	if i < len(e.buf) {
+		e.buf = append(e.buf[:i], e.buf[i+1:]...)
+	}
+} // }}}
+
+// func e.wordStart {{{
+
+// wordStart returns the index of the start of the word the cursor is in
+func (e *Editor) wordStart() int {
+	return wordStartFrom(e.buf, e.pos)
+} // }}}
+
+// func e.historyMove {{{
+
+// historyMove Replaces the line with the one n steps away in the history,
+// keeping hold of whatever the user was typing before they started
+func (e *Editor) historyMove(n int) {
+	next := e.histPos + n
+	if next < 0 || next > e.history.Len() {
+		return
+	}
+
+	// Leaving the line we were typing? Save it so we can come back to it
+	if e.histPos == e.history.Len() {
+		e.scratch = append(e.scratch[:0], e.buf...)
+	}
+
+	e.histPos = next
+	if next == e.history.Len() {
+		e.buf = append(e.buf[:0], e.scratch...)
+	} else {
+		e.buf = []rune(e.history.lines[next])
+	}
+	e.pos = len(e.buf)
+} // }}}
+
+// func e.tab {{{
+
+// tab Completes the word under the cursor as far as it unambiguously can.
+// Pressing tab twice lists all of the possible completions.
+func (e *Editor) tab() {
+	if e.complete == nil {
+		return
+	}
+
+	start := e.wordStart()
+	word := string(e.buf[start:e.pos])
+	args := strings.Fields(string(e.buf[:start]))
+
+	candidates := e.complete(args, word)
+	switch len(candidates) {
+	case 0:
+		// Nothing matches, so just ring the bell
+		io.WriteString(e.out, "\a")
+		return
+	case 1:
+		e.replaceWord(start, candidates[0]+" ")
+		return
+	}
+
+	// Several things match, so complete as much as they have in common
+	prefix := commonPrefix(candidates)
+	if len([]rune(prefix)) > len([]rune(word)) {
+		e.replaceWord(start, prefix)
+		return
+	}
+
+	if e.lastTab {
+		io.WriteString(e.out, "\r\n"+strings.Join(candidates, "  ")+"\r\n")
+	}
+} // }}}
+
+// func e.replaceWord {{{
+
+// replaceWord Replaces everything from start up to the cursor with s
+func (e *Editor) replaceWord(start int, s string) {
+	rest := append([]rune(s), e.buf[e.pos:]...)
+	e.buf = append(e.buf[:start], rest...)
+	e.pos = start + len([]rune(s))
+} // }}}
+
+// func e.refresh {{{
+
+// refresh Redraws the prompt and line. Lines too long to fit are scrolled
+// horizontally, so the cursor is always visible. The caller must hold the lock.
+func (e *Editor) refresh() {
+	width, _, err := term.GetSize(int(e.out.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+
+	prompt := e.prompt
+	avail := width - len([]rune(prompt)) - 1
+	if avail < 1 {
+		avail = 1
+	}
+
+	offset := 0
+	if e.pos > avail {
+		offset = e.pos - avail
+	}
+	visible := e.buf[offset:]
+	if len(visible) > avail {
+		visible = visible[:avail]
+	}
+
+	// Back to the start of the line, draw everything, clear whatever is
+	// left over and then put the cursor where it belongs
+	s := "\r" + prompt + string(visible) + "\x1b[K"
+	if back := len(visible) - (e.pos - offset); back > 0 {
+		s += fmt.Sprintf("\x1b[%dD", back)
+	}
+	io.WriteString(e.out, s)
+} // }}}
+
+// func w.Write {{{
+
+// Write prints p above the line being edited, and then redraws the line
+func (w lineWriter) Write(p []byte) (int, error) {
+	e := w.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.reading {
+		return e.out.Write(p)
+	}
+
+	// The terminal is in raw mode, so we have to do our own carriage returns
+	text := strings.Replace(string(p), "\n", "\r\n", -1)
+	if !strings.HasSuffix(text, "\n") {
+		text += "\r\n"
+	}
+	io.WriteString(e.out, "\r\x1b[K"+text)
+	e.refresh()
+	return len(p), nil
+} // }}}
+
+// func NewHistory {{{
+
+// NewHistory Initializes and returns a new History of at most max lines,
+// loading and saving it to the file at path. An empty path keeps the
+// history in memory only, and a max of zero or less means 1000 lines.
+func NewHistory(path string, max int) *History {
+	if max <= 0 {
+		max = 1000
+	}
+	h := &History{
+		path: path,
+		max:  max,
+	}
+	h.load()
+	return h
+} // }}}
+
+// func h.Len {{{
+
+// Len returns the number of lines in the history
+func (h *History) Len() int {
+	return len(h.lines)
+} // }}}
+
+// func h.Add {{{
+
+// Add Adds line to the history, unless it's blank or the same as the last
+// line, and appends it to the history file
+func (h *History) Add(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+
+	h.lines = append(h.lines, line)
+	if len(h.lines) > h.max {
+		h.lines = append(h.lines[:0:0], h.lines[len(h.lines)-h.max:]...)
+	}
+
+	if h.path == "" {
+		return
+	}
+
+	// Losing our history isn't worth bothering the user over, so we
+	// don't report errors saving it
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+} // }}}
+
+// func h.load {{{
+
+// load Reads the history file, trimming it back down to size if it's grown
+// too long
+func (h *History) load() {
+	if h.path == "" {
+		return
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	f.Close()
+
+	if len(h.lines) <= h.max {
+		return
+	}
+
+	h.lines = h.lines[len(h.lines)-h.max:]
+	if f, err = os.Create(h.path); err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, line := range h.lines {
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+} // }}}
+
+// func wordStartFrom {{{
+
+// wordStartFrom returns the index of the start of the word that ends at pos
+func wordStartFrom(buf []rune, pos int) int {
+	for pos > 0 && buf[pos-1] != ' ' {
+		pos--
+	}
+	return pos
+} // }}}
+
+// func commonPrefix {{{
+
+// commonPrefix returns the longest prefix all of the strings share
+func commonPrefix(a []string) string {
+	prefix := []rune(a[0])
+	for _, s := range a[1:] {
+		r := []rune(s)
+		n := 0
+		for n < len(prefix) && n < len(r) && prefix[n] == r[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+} // }}}
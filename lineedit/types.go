@@ -0,0 +1,91 @@
+// Package lineedit provides the line editor used by the REPL, with cursor
+// movement, persistent history and tab completion
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"sync"
+)
+
+// ErrInterrupted is returned by ReadLine when the user presses Ctrl-C to
+// throw away the line they were typing
+var ErrInterrupted = errors.New("lineedit: interrupted")
+
+// type Completer {{{
+
+// Completer returns the possible completions of word, given the words
+// before it on the line
+type Completer func(args []string, word string) []string // }}}
+
+// type HistoryFilter {{{
+
+// HistoryFilter reports whether a line the user entered should be added to
+// the history, i.e. false for a private message
+type HistoryFilter func(line string) bool // }}}
+
+// type History struct {{{
+
+// History holds the lines the user has entered, optionally saving them to
+// a file so they're still around next time
+type History struct {
+	// The file we save to, or empty if we don't
+	path string
+
+	// The most lines we keep around
+	max int
+
+	// The lines themselves, oldest first
+	lines []string
+} // }}}
+
+// type Editor struct {{{
+
+// Editor reads lines from a terminal, letting the user edit them as they
+// go. If its input isn't a terminal, it just reads plain lines instead.
+type Editor struct {
+	// Where we read from and draw to
+	in  *os.File
+	out *os.File
+
+	// Reads our input, in both raw and plain line mode
+	reader *bufio.Reader
+
+	// Completes the word under the cursor when the user presses tab
+	complete Completer
+
+	// The lines entered so far, and which of them to remember. A nil
+	// filter remembers them all.
+	history *History
+	filter  HistoryFilter
+
+	// Locks everything below here, since output can be written by other
+	// goroutines while the user is typing
+	mu sync.Mutex
+
+	// Whether we're in the middle of reading a line, and so need to redraw
+	// it after anyone writes to the terminal
+	reading bool
+
+	// The prompt, the line being edited and where in it the cursor is
+	prompt string
+	buf    []rune
+	pos    int
+
+	// Where we are in the history while scrolling through it, and the line
+	// the user was typing before they started scrolling
+	histPos int
+	scratch []rune
+
+	// Whether the last key pressed was tab, so a second tab lists all of
+	// the possible completions
+	lastTab bool
+} // }}}
+
+// type lineWriter struct {{{
+
+// lineWriter is an io.Writer that prints above the line being edited
+type lineWriter struct {
+	e *Editor
+} // }}}
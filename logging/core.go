@@ -0,0 +1,426 @@
+// Package logging provides leveled, structured diagnostics for the parts of
+// the program, kept apart from what the user sees, and written to a file that
+// is rotated once it grows too large
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// func New {{{
+
+// New Initializes and returns a new Root, writing entries to w in the given
+// format, with every subsystem logging at level until told otherwise
+func New(w io.Writer, format Format, level Level) *Root {
+	return &Root{
+		format: format,
+		w:      w,
+		def:    level,
+		levels: make(map[string]Level),
+	}
+} // }}}
+
+// func ParseLevel {{{
+
+// ParseLevel returns the level with the given name, i.e. "debug"
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "off", "none":
+		return LevelOff, nil
+	}
+	return LevelOff, fmt.Errorf("logging: unknown level %q, expected debug, info, warn, error or off", name)
+} // }}}
+
+// func ParseFormat {{{
+
+// ParseFormat returns the format with the given name, either "logfmt" or
+// "json"
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "logfmt":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatLogfmt, fmt.Errorf("logging: unknown format %q, expected logfmt or json", name)
+} // }}}
+
+// func l.String {{{
+
+// String returns the levels name
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelOff:
+		return "off"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+} // }}}
+
+// func r.SetLevels {{{
+
+// SetLevels Sets levels from a list such as "info,server=debug,client=warn".
+// A level on its own is used by every subsystem that isn't named.
+func (r *Root) SetLevels(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		subsystem := ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			subsystem, part = part[:i], part[i+1:]
+		}
+		level, err := ParseLevel(part)
+		if err != nil {
+			return err
+		}
+
+		if subsystem == "" {
+			r.SetDefaultLevel(level)
+			continue
+		}
+		if err := r.SetLevel(subsystem, level); err != nil {
+			return err
+		}
+	}
+	return nil
+} // }}}
+
+// func r.SetDefaultLevel {{{
+
+// SetDefaultLevel Sets the level of every subsystem, forgetting any level a
+// subsystem was given on its own
+func (r *Root) SetDefaultLevel(level Level) {
+	r.mu.Lock()
+	r.def = level
+	r.levels = make(map[string]Level)
+	r.mu.Unlock()
+} // }}}
+
+// func r.SetLevel {{{
+
+// SetLevel Sets the level of a single subsystem
+func (r *Root) SetLevel(subsystem string, level Level) error {
+	if !IsSubsystem(subsystem) {
+		return fmt.Errorf("logging: unknown subsystem %q, expected one of %s", subsystem, strings.Join(Subsystems, ", "))
+	}
+	r.mu.Lock()
+	r.levels[subsystem] = level
+	r.mu.Unlock()
+	return nil
+} // }}}
+
+// func r.Level {{{
+
+// Level returns the level a subsystem logs at
+func (r *Root) Level(subsystem string) Level {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.level(subsystem)
+} // }}}
+
+// func r.level {{{
+
+// level returns the level a subsystem logs at. The caller must hold mu.
+func (r *Root) level(subsystem string) Level {
+	if l, ok := r.levels[subsystem]; ok {
+		return l
+	}
+	return r.def
+} // }}}
+
+// func r.Logger {{{
+
+// Logger returns the Logger for a subsystem
+func (r *Root) Logger(subsystem string) *Logger {
+	return &Logger{root: r, subsystem: subsystem}
+} // }}}
+
+// func l.Debug {{{
+
+// Debug Logs an entry only of use when tracking down a problem. kv are
+// alternating keys and values describing the entry, i.e. "conn", 1.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+} // }}}
+
+// func l.Info {{{
+
+// Info Logs an ordinary thing worth knowing happened
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+} // }}}
+
+// func l.Warn {{{
+
+// Warn Logs a problem we recovered from
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+} // }}}
+
+// func l.Error {{{
+
+// Error Logs a problem we couldn't recover from
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+} // }}}
+
+// func l.Enabled {{{
+
+// Enabled returns whether entries at the given level are written, so callers
+// on a busy path can skip describing entries nobody will see
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil || l.root == nil {
+		return false
+	}
+	r := l.root
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return level >= r.level(l.subsystem) && level != LevelOff
+} // }}}
+
+// func l.log {{{
+
+// log Writes an entry, if the subsystem logs at its level
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if l == nil || l.root == nil {
+		return
+	}
+	r := l.root
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if level < r.level(l.subsystem) || level == LevelOff {
+		return
+	}
+
+	fields := []interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"subsystem", l.subsystem,
+		"msg", msg,
+	}
+	fields = append(fields, kv...)
+
+	// A key with no value is a mistake, but not one worth losing the
+	// entry over
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if r.format == FormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	r.w.Write(buf.Bytes())
+} // }}}
+
+// func writeLogfmt {{{
+
+// writeLogfmt Writes the fields as a line of key=value pairs, quoting any
+// values that need it
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		v := formatValue(fields[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"\t\r\n\\") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+	buf.WriteByte('\n')
+} // }}}
+
+// func writeJSON {{{
+
+// writeJSON Writes the fields as a line holding a JSON object, keeping them
+// in the order they were given
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		var v []byte
+		var err error
+		switch val := fields[i+1].(type) {
+		case error:
+			v, err = json.Marshal(val.Error())
+		case fmt.Stringer:
+			v, err = json.Marshal(val.String())
+		default:
+			v, err = json.Marshal(val)
+		}
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+} // }}}
+
+// func formatValue {{{
+
+// formatValue returns a value as text
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case error:
+		return val.Error()
+	}
+	return fmt.Sprint(v)
+} // }}}
+
+// func IsSubsystem {{{
+
+// IsSubsystem checks whether name is one of the subsystems we log from
+func IsSubsystem(name string) bool {
+	for _, s := range Subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+} // }}}
+
+// func OpenRotatingFile {{{
+
+// OpenRotatingFile opens, or creates, the log file at path, which is rotated
+// once it grows past maxSize bytes, keeping maxBackups old files
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+} // }}}
+
+// func rf.Write {{{
+
+// Write Appends p to the file, rotating it first if p would take it past
+// its maximum size
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+} // }}}
+
+// func rf.Close {{{
+
+// Close Closes the file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+} // }}}
+
+// func rf.open {{{
+
+// open Opens the file for appending, and finds out how big it already is
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("logging: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("logging: %w", err)
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+} // }}}
+
+// func rf.rotate {{{
+
+// rotate Moves the current file out of the way, shuffling the old ones
+// along and dropping the oldest, and starts a new one. The caller must
+// hold mu.
+func (rf *RotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+
+	if rf.maxBackups < 1 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(rf.backup(rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(rf.backup(i), rf.backup(i+1))
+		}
+		os.Rename(rf.path, rf.backup(1))
+	}
+
+	return rf.open()
+} // }}}
+
+// func rf.backup {{{
+
+// backup returns the name of the i'th old file
+func (rf *RotatingFile) backup(i int) string {
+	return rf.path + "." + strconv.Itoa(i)
+} // }}}
@@ -0,0 +1,93 @@
+// Package logging provides leveled, structured diagnostics for the parts of
+// the program, kept apart from what the user sees, and written to a file that
+// is rotated once it grows too large
+package logging
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// type Level int {{{
+
+// Level is how important a log entry is
+type Level int
+
+const (
+	// LevelDebug entries are only of use when tracking down a problem
+	LevelDebug Level = iota
+
+	// LevelInfo entries are ordinary things worth knowing happened
+	LevelInfo
+
+	// LevelWarn entries are problems we recovered from
+	LevelWarn
+
+	// LevelError entries are problems we couldn't recover from
+	LevelError
+
+	// LevelOff turns logging off entirely, and is never logged at
+	LevelOff
+) // }}}
+
+// type Format int {{{
+
+// Format is how log entries are written out
+type Format int
+
+const (
+	// FormatLogfmt writes each entry as key=value pairs on one line
+	FormatLogfmt Format = iota
+
+	// FormatJSON writes each entry as a JSON object on one line
+	FormatJSON
+) // }}}
+
+// The subsystems the program logs from
+const (
+	Server = "server"
+	Client = "client"
+	App    = "app"
+)
+
+// Subsystems lists every subsystem the program logs from
+var Subsystems = []string{Server, Client, App}
+
+// type Root struct {{{
+
+// Root is where every subsystems entries are written, and keeps the level
+// each subsystem logs at
+type Root struct {
+	format Format
+
+	// mu guards everything below, and makes sure entries are written
+	// whole, one at a time
+	mu     sync.Mutex
+	w      io.Writer
+	def    Level
+	levels map[string]Level
+} // }}}
+
+// type Logger struct {{{
+
+// Logger writes the entries of a single subsystem. A nil Logger discards
+// everything, so code doesn't need to check whether it was given one.
+type Logger struct {
+	root      *Root
+	subsystem string
+} // }}}
+
+// type RotatingFile struct {{{
+
+// RotatingFile is a log file that is renamed out of the way once it grows
+// past a size, keeping a number of the old files as name.1, name.2 and so on
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+} // }}}
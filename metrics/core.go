@@ -0,0 +1,272 @@
+// Package metrics keeps counters and gauges of what a peer is doing, and
+// writes them out in the Prometheus text format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// func New {{{
+
+// New Initializes and returns a new, zeroed, set of Metrics
+func New() *Metrics {
+	return &Metrics{
+		MessagesSent:     NewCounterVec("peer"),
+		MessagesReceived: NewCounterVec("peer"),
+		BytesSent:        NewCounterVec("peer"),
+		BytesReceived:    NewCounterVec("peer"),
+		SendFailures:     NewCounterVec("peer"),
+		HandshakeSeconds: NewHistogram(handshakeBuckets),
+	}
+} // }}}
+
+// func m.Forget {{{
+
+// Forget Removes everything we've counted for a peer, once its connection is
+// closed, so we don't hold on to every peer we've ever had
+func (m *Metrics) Forget(peer string) {
+	m.MessagesSent.Delete(peer)
+	m.MessagesReceived.Delete(peer)
+	m.BytesSent.Delete(peer)
+	m.BytesReceived.Delete(peer)
+	m.SendFailures.Delete(peer)
+} // }}}
+
+// func m.WriteTo {{{
+
+// WriteTo Writes every metric to w in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	writeGauge(&buf, "chat_connections", "Connections currently established.", m.Connections.Value())
+	writeCounter(&buf, "chat_accepts_total", "Connections accepted by our listeners.", m.Accepts.Value())
+	writeCounter(&buf, "chat_accept_errors_total", "Errors accepting connections.", m.AcceptErrors.Value())
+	writeCounter(&buf, "chat_rejected_duplicates_total", "Connections refused because they already existed.", m.RejectedDuplicates.Value())
+	m.MessagesSent.write(&buf, "chat_messages_sent_total", "Messages sent, by connection id.")
+	m.MessagesReceived.write(&buf, "chat_messages_received_total", "Messages received, by connection id.")
+	m.BytesSent.write(&buf, "chat_bytes_sent_total", "Message bytes sent, by connection id.")
+	m.BytesReceived.write(&buf, "chat_bytes_received_total", "Message bytes received, by connection id.")
+	m.SendFailures.write(&buf, "chat_send_failures_total", "Messages we were unable to send, by connection id.")
+	m.HandshakeSeconds.write(&buf, "chat_handshake_duration_seconds", "How long completed handshakes took.")
+
+	return buf.WriteTo(w)
+} // }}}
+
+// func m.ServeHTTP {{{
+
+// ServeHTTP Serves the metrics to a Prometheus scraper
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+} // }}}
+
+// func c.Inc {{{
+
+// Inc Adds one to the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+} // }}}
+
+// func c.Add {{{
+
+// Add Adds n to the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+} // }}}
+
+// func c.Value {{{
+
+// Value returns the counters current value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+} // }}}
+
+// func g.Inc {{{
+
+// Inc Adds one to the gauge
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+} // }}}
+
+// func g.Dec {{{
+
+// Dec Takes one from the gauge
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+} // }}}
+
+// func g.Value {{{
+
+// Value returns the gauges current value
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+} // }}}
+
+// func NewCounterVec {{{
+
+// NewCounterVec returns a new CounterVec whose counters are told apart by
+// the given label
+func NewCounterVec(label string) *CounterVec {
+	return &CounterVec{
+		label:    label,
+		counters: make(map[string]*Counter),
+	}
+} // }}}
+
+// func cv.With {{{
+
+// With returns the counter for the given label value, creating it if needed
+func (cv *CounterVec) With(value string) *Counter {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	c, ok := cv.counters[value]
+	if !ok {
+		c = &Counter{}
+		cv.counters[value] = c
+	}
+	return c
+} // }}}
+
+// func cv.Delete {{{
+
+// Delete Removes the counter for the given label value
+func (cv *CounterVec) Delete(value string) {
+	cv.mu.Lock()
+	delete(cv.counters, value)
+	cv.mu.Unlock()
+} // }}}
+
+// func cv.write {{{
+
+// write Writes every counter, sorted by label value
+func (cv *CounterVec) write(buf *bytes.Buffer, name, help string) {
+	cv.mu.Lock()
+	values := make([]string, 0, len(cv.counters))
+	counts := make(map[string]uint64, len(cv.counters))
+	for v, c := range cv.counters {
+		values = append(values, v)
+		counts[v] = c.Value()
+	}
+	cv.mu.Unlock()
+
+	// Connection ids sort better as numbers than as strings
+	sort.Slice(values, func(i, j int) bool {
+		a, errA := strconv.Atoi(values[i])
+		b, errB := strconv.Atoi(values[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return values[i] < values[j]
+	})
+
+	writeHeader(buf, name, help, "counter")
+	for _, v := range values {
+		fmt.Fprintf(buf, "%s{%s=\"%s\"} %d\n", name, cv.label, escapeLabel(v), counts[v])
+	}
+} // }}}
+
+// func NewHistogram {{{
+
+// NewHistogram returns a new Histogram with the given bucket upper bounds,
+// which must be sorted
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+} // }}}
+
+// func h.Observe {{{
+
+// Observe Records a value in the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+} // }}}
+
+// func h.ObserveDuration {{{
+
+// ObserveDuration Records a duration in the histogram, in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+} // }}}
+
+// func h.write {{{
+
+// write Writes the histograms buckets, sum and count
+func (h *Histogram) write(buf *bytes.Buffer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(buf, name, help, "histogram")
+	for i, b := range h.buckets {
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(buf, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(buf, "%s_count %d\n", name, h.count)
+} // }}}
+
+// func writeHeader {{{
+
+// writeHeader Writes the HELP and TYPE lines that start each metric
+func writeHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+} // }}}
+
+// func writeCounter {{{
+
+// writeCounter Writes a single counter
+func writeCounter(buf *bytes.Buffer, name, help string, v uint64) {
+	writeHeader(buf, name, help, "counter")
+	fmt.Fprintf(buf, "%s %d\n", name, v)
+} // }}}
+
+// func writeGauge {{{
+
+// writeGauge Writes a single gauge
+func writeGauge(buf *bytes.Buffer, name, help string, v int64) {
+	writeHeader(buf, name, help, "gauge")
+	fmt.Fprintf(buf, "%s %d\n", name, v)
+} // }}}
+
+// func formatFloat {{{
+
+// formatFloat formats a float the way Prometheus expects
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+} // }}}
+
+// func escapeLabel {{{
+
+// escapeLabel escapes a label value for the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+} // }}}
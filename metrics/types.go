@@ -0,0 +1,73 @@
+// Package metrics keeps counters and gauges of what a peer is doing, and
+// writes them out in the Prometheus text format
+package metrics
+
+import "sync"
+
+// The upper bounds, in seconds, of the handshake duration histogram buckets
+var handshakeBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// type Counter struct {{{
+
+// Counter is a value that only ever goes up
+type Counter struct {
+	// Only access this using atomics!
+	v uint64
+} // }}}
+
+// type Gauge struct {{{
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	// Only access this using atomics!
+	v int64
+} // }}}
+
+// type CounterVec struct {{{
+
+// CounterVec is a set of counters, told apart by the value of a label
+type CounterVec struct {
+	label string
+
+	mu       sync.Mutex
+	counters map[string]*Counter
+} // }}}
+
+// type Histogram struct {{{
+
+// Histogram counts observations in buckets, along with their total
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+} // }}}
+
+// type Metrics struct {{{
+
+// Metrics holds everything we measure about a peer
+type Metrics struct {
+	// How many connections we have right now
+	Connections Gauge
+
+	// Connections accepted by our listeners, and the errors accepting them
+	Accepts      Counter
+	AcceptErrors Counter
+
+	// Connections refused, inbound or outbound, because we already had them
+	RejectedDuplicates Counter
+
+	// Messages and their bytes, labelled by connection id
+	MessagesSent     *CounterVec
+	MessagesReceived *CounterVec
+	BytesSent        *CounterVec
+	BytesReceived    *CounterVec
+
+	// Messages we were unable to write, labelled by connection id
+	SendFailures *CounterVec
+
+	// How long the handshakes we completed took
+	HandshakeSeconds *Histogram
+} // }}}
@@ -0,0 +1,746 @@
+// Package netsim simulates the network between peers, so we can see how they
+// cope with a bad one without needing one. Connections made or wrapped by a
+// Network get whatever latency, jitter, bandwidth, fragmentation and
+// partitions it's been told to give the link between their two ends, and can
+// be reset whenever we like.
+package netsim
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// func New {{{
+
+// New Initializes and returns a new Network, on which every link is perfect
+// until told otherwise
+func New() *Network {
+	return &Network{
+		rules:   make(map[pair]Conditions),
+		conns:   make(map[*Conn]struct{}),
+		changed: make(chan struct{}),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+} // }}}
+
+// func newPair {{{
+
+// newPair returns the key of the rule between a and b
+func newPair(a, b string) pair {
+	if b < a {
+		a, b = b, a
+	}
+	return pair{a, b}
+} // }}}
+
+// func n.Set {{{
+
+// Set Sets the conditions of the links between a and b, either of which may
+// be Any. The most specific rule wins, so a link between a and b has the
+// conditions set for the two of them, else those for a or b and Any, else
+// those for Any and Any. Only what's written from now on is affected.
+func (n *Network) Set(a, b string, c Conditions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules[newPair(a, b)] = c
+	n.notify()
+} // }}}
+
+// func n.Rule {{{
+
+// Rule returns the conditions set for the links between a and b, if any were
+func (n *Network) Rule(a, b string) (Conditions, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, ok := n.rules[newPair(a, b)]
+	return c, ok
+} // }}}
+
+// func n.Clear {{{
+
+// Clear Forgets the conditions set for the links between a and b, so they
+// fall back to any less specific rule
+func (n *Network) Clear(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.rules, newPair(a, b))
+	n.notify()
+} // }}}
+
+// func n.Rules {{{
+
+// Rules returns every rule we were given, in order
+func (n *Network) Rules() []Rule {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	rules := make([]Rule, 0, len(n.rules))
+	for p, c := range n.rules {
+		rules = append(rules, Rule{A: p[0], B: p[1], Conditions: c})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].A != rules[j].A {
+			return rules[i].A < rules[j].A
+		}
+		return rules[i].B < rules[j].B
+	})
+	return rules
+} // }}}
+
+// func n.Partition {{{
+
+// Partition Stops anything getting across the links between a and b, until
+// they're healed
+func (n *Network) Partition(a, b string) {
+	n.setPartitioned(a, b, true)
+} // }}}
+
+// func n.Heal {{{
+
+// Heal Lets everything held up by a partition between a and b through
+func (n *Network) Heal(a, b string) {
+	n.setPartitioned(a, b, false)
+} // }}}
+
+// func n.setPartitioned {{{
+
+// setPartitioned Changes whether the links between a and b are partitioned,
+// keeping the rest of their conditions
+func (n *Network) setPartitioned(a, b string, cut bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p := newPair(a, b)
+	c := n.rules[p]
+	c.Partitioned = cut
+	n.rules[p] = c
+	n.notify()
+} // }}}
+
+// func n.Reset {{{
+
+// Reset Resets every connection between a and b, either of which may be
+// Any, so both ends fail straight away with ErrReset and whatever was on its
+// way is lost. Returns how many were reset.
+func (n *Network) Reset(a, b string) int {
+	n.mu.Lock()
+	var reset []*Conn
+	for c := range n.conns {
+		if matches(a, b, c.local, c.remote) {
+			reset = append(reset, c)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, c := range reset {
+		c.abort()
+		c.peer.abort()
+	}
+	return len(reset)
+} // }}}
+
+// func n.Links {{{
+
+// Links returns the connections on the network, and their conditions
+func (n *Network) Links() []Link {
+	n.mu.Lock()
+	conns := make([]*Conn, 0, len(n.conns))
+	for c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mu.Unlock()
+
+	links := make([]Link, 0, len(conns))
+	for _, c := range conns {
+		// Gone, but the other end hasn't noticed yet
+		if c.finished() || c.peer.finished() {
+			continue
+		}
+		links = append(links, Link{
+			Local:      c.local,
+			Remote:     c.remote,
+			Conditions: n.conditions(c.local, c.remote),
+			InFlight:   c.out.queued() + c.peer.out.queued(),
+		})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Local != links[j].Local {
+			return links[i].Local < links[j].Local
+		}
+		return links[i].Remote < links[j].Remote
+	})
+	return links
+} // }}}
+
+// func matches {{{
+
+// matches returns whether a rule between a and b applies to the link between
+// x and y
+func matches(a, b, x, y string) bool {
+	match := func(rule, name string) bool {
+		return rule == Any || rule == name
+	}
+	return (match(a, x) && match(b, y)) || (match(a, y) && match(b, x))
+} // }}}
+
+// func n.conditions {{{
+
+// conditions returns the conditions of the link between a and b, from the
+// most specific rule that applies
+func (n *Network) conditions(a, b string) Conditions {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, _ := n.lookup(a, b)
+	return c
+} // }}}
+
+// func n.lookup {{{
+
+// lookup returns the conditions of the link between a and b, and the channel
+// that's closed when they next change. n.mu must be held.
+func (n *Network) lookup(a, b string) (Conditions, chan struct{}) {
+	for _, p := range []pair{newPair(a, b), newPair(a, Any), newPair(b, Any), newPair(Any, Any)} {
+		if c, ok := n.rules[p]; ok {
+			return c, n.changed
+		}
+	}
+	return Conditions{}, n.changed
+} // }}}
+
+// func n.notify {{{
+
+// notify Wakes everyone waiting for the rules to change. n.mu must be held.
+func (n *Network) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+} // }}}
+
+// func n.jitter {{{
+
+// jitter returns a random delay of up to max
+func (n *Network) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Duration(n.rand.Int63n(int64(max) + 1))
+} // }}}
+
+// func n.Pipe {{{
+
+// Pipe returns the two ends of a new in-process connection between the peers
+// named a and b, which has whatever conditions the link between them has.
+// Each end's address is the name it was given, so naming peers "ip:port"
+// lets the server split them as it would a real address.
+func (n *Network) Pipe(a, b string) (net.Conn, net.Conn) {
+	ours, theirs := n.pipe(a, b)
+	return ours, theirs
+} // }}}
+
+// func n.pipe {{{
+
+// pipe Makes a new connection between a and b, and starts its wires
+func (n *Network) pipe(a, b string) (*Conn, *Conn) {
+	ours := newConn(n, a, b)
+	theirs := newConn(n, b, a)
+	ours.peer, theirs.peer = theirs, ours
+	ours.out = newWire(n, ours, theirs)
+	theirs.out = newWire(n, theirs, ours)
+
+	n.mu.Lock()
+	n.conns[ours] = struct{}{}
+	n.mu.Unlock()
+
+	go ours.out.run()
+	go theirs.out.run()
+	return ours, theirs
+} // }}}
+
+// func n.Wrap {{{
+
+// Wrap returns a connection that behaves like conn would on the link between
+// local and remote. Everything we write crosses the simulated link before
+// being written to conn, and everything read from conn crosses it again
+// before it's read, so a real connection can be put through a bad network
+// as easily as an in-process one. The connection reports conn's addresses.
+func (n *Network) Wrap(local, remote string, conn net.Conn) net.Conn {
+	ours, theirs := n.pipe(local, remote)
+	ours.laddr, ours.raddr = conn.LocalAddr(), conn.RemoteAddr()
+
+	// Whichever way the copying stops first, both connections go with it
+	relay := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		if errors.Is(err, syscall.ECONNRESET) {
+			hangUp(conn)
+			theirs.abort()
+			return
+		}
+		conn.Close()
+		theirs.Close()
+	}
+	go relay(conn, theirs)
+	go relay(theirs, conn)
+	return ours
+} // }}}
+
+// func hangUp {{{
+
+// hangUp Closes a real connection without lingering, so its peer is reset
+// too, rather than told we've finished
+func hangUp(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+} // }}}
+
+// func n.forget {{{
+
+// forget Removes a connection from the network once both of its ends are
+// finished with
+func (n *Network) forget(c *Conn) {
+	if !c.peer.finished() {
+		return
+	}
+	n.mu.Lock()
+	delete(n.conns, c)
+	delete(n.conns, c.peer)
+	n.mu.Unlock()
+} // }}}
+
+// func newConn {{{
+
+// newConn Initializes and returns one end of a connection, whose addresses
+// are the names of the ends until told otherwise
+func newConn(n *Network, local, remote string) *Conn {
+	return &Conn{
+		n:      n,
+		local:  local,
+		remote: remote,
+		laddr:  Addr(local),
+		raddr:  Addr(remote),
+		wake:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+} // }}}
+
+// func c.Read {{{
+
+// Read Reads the next segment to have arrived, or as much of it as fits,
+// waiting for one to if none has
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.reset:
+			return 0, ErrReset
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(c.arrived) > 0:
+			n := copy(p, c.arrived[0])
+			if n == len(c.arrived[0]) {
+				c.arrived = c.arrived[1:]
+			} else {
+				c.arrived[0] = c.arrived[0][n:]
+			}
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		case len(p) == 0:
+			return 0, nil
+		}
+		c.wait(c.readDeadline)
+	}
+} // }}}
+
+// func c.Write {{{
+
+// Write Sends p across the link to the other end. Writes only wait when too
+// much is already on its way, as they would on a real socket, so Write
+// returning says nothing about whether anything has arrived.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.reset:
+			return 0, ErrReset
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.eof:
+			// The other end has closed, so it would reset us
+			return 0, ErrReset
+		case expired(c.writeDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		if c.out.queued() < maxInFlight {
+			break
+		}
+		c.wait(c.writeDeadline)
+	}
+
+	c.out.send(p, false)
+	return len(p), nil
+} // }}}
+
+// func c.Close {{{
+
+// Close Closes our end of the connection. The other end reads io.EOF once
+// everything we wrote before closing has arrived.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed || c.reset {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.notify()
+	c.mu.Unlock()
+
+	c.finish()
+	c.out.send(nil, true)
+	return nil
+} // }}}
+
+// func c.abort {{{
+
+// abort Resets our end of the connection, throwing away whatever has arrived
+// or is on its way to the other end
+func (c *Conn) abort() {
+	c.mu.Lock()
+	if c.reset {
+		c.mu.Unlock()
+		return
+	}
+	c.reset = true
+	c.arrived = nil
+	c.notify()
+	c.mu.Unlock()
+
+	c.finish()
+	c.out.halt()
+} // }}}
+
+// func c.finish {{{
+
+// finish Lets the wire to us know we're done with the connection
+func (c *Conn) finish() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+		c.n.forget(c)
+	})
+} // }}}
+
+// func c.finished {{{
+
+// finished returns whether we're closed or reset
+func (c *Conn) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+} // }}}
+
+// func c.receive {{{
+
+// receive Adds what arrived from the other end to what's waiting to be read,
+// unless we're no longer reading
+func (c *Conn) receive(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.reset {
+		return
+	}
+	c.arrived = append(c.arrived, data)
+	c.notify()
+} // }}}
+
+// func c.receiveEOF {{{
+
+// receiveEOF Notes that the other end closed, and everything it sent has
+// arrived
+func (c *Conn) receiveEOF() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eof = true
+	c.notify()
+} // }}}
+
+// func c.wakeUp {{{
+
+// wakeUp Wakes any blocked reads or writes, so they check again
+func (c *Conn) wakeUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify()
+} // }}}
+
+// func c.notify {{{
+
+// notify Wakes any blocked reads or writes. c.mu must be held.
+func (c *Conn) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+} // }}}
+
+// func c.wait {{{
+
+// wait Waits for something to change, or for the deadline to pass. c.mu must
+// be held, and is held again by the time we return.
+func (c *Conn) wait(deadline time.Time) {
+	wake := c.wake
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	if deadline.IsZero() {
+		<-wake
+		return
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-wake:
+	case <-t.C:
+	}
+} // }}}
+
+// func expired {{{
+
+// expired returns whether a deadline has passed
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+} // }}}
+
+// func c.LocalAddr {{{
+
+// LocalAddr returns the address of our end
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+} // }}}
+
+// func c.RemoteAddr {{{
+
+// RemoteAddr returns the address of the other end
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+} // }}}
+
+// func c.SetDeadline {{{
+
+// SetDeadline Sets when both reads and writes give up
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+} // }}}
+
+// func c.SetReadDeadline {{{
+
+// SetReadDeadline Sets when reads give up
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+} // }}}
+
+// func c.SetWriteDeadline {{{
+
+// SetWriteDeadline Sets when writes give up
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+} // }}}
+
+// func a.Network {{{
+
+// Network returns the name of the network, "netsim"
+func (a Addr) Network() string {
+	return "netsim"
+} // }}}
+
+// func a.String {{{
+
+// String returns the name of the end
+func (a Addr) String() string {
+	return string(a)
+} // }}}
+
+// func newWire {{{
+
+// newWire Initializes and returns the wire carrying what from writes to to
+func newWire(n *Network, from, to *Conn) *wire {
+	return &wire{
+		n:    n,
+		from: from,
+		to:   to,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+} // }}}
+
+// func w.send {{{
+
+// send Splits what was written into segments, as the links conditions say,
+// and works out when each will arrive. fin sends the end of the stream.
+func (w *wire) send(p []byte, fin bool) {
+	c := w.n.conditions(w.from.local, w.to.local)
+	now := time.Now()
+
+	size := c.Fragment
+	if size <= 0 || size > len(p) {
+		size = len(p)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// queue Adds a segment of the given size, once the link is free to
+	// send it, arriving no sooner than the one before it
+	queue := func(s segment, size int) {
+		depart := now
+		if w.free.After(depart) {
+			depart = w.free
+		}
+		if c.Bandwidth > 0 {
+			depart = depart.Add(time.Duration(size) * time.Second / time.Duration(c.Bandwidth))
+		}
+		w.free = depart
+
+		s.at = depart.Add(c.Latency + w.n.jitter(c.Jitter))
+		if s.at.Before(w.last) {
+			s.at = w.last
+		}
+		w.last = s.at
+		w.segs = append(w.segs, s)
+		w.inFlight += len(s.data)
+	}
+
+	for len(p) > 0 {
+		n := size
+		if n > len(p) {
+			n = len(p)
+		}
+		queue(segment{data: append([]byte(nil), p[:n]...)}, n)
+		p = p[n:]
+	}
+	if fin {
+		queue(segment{fin: true}, 0)
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+} // }}}
+
+// func w.queued {{{
+
+// queued returns how many bytes are on their way
+func (w *wire) queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.inFlight
+} // }}}
+
+// func w.halt {{{
+
+// halt Stops the wire, losing whatever was on its way
+func (w *wire) halt() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+} // }}}
+
+// func w.run {{{
+
+// run Delivers each segment to the other end once it's due, and the link
+// isn't partitioned, until the stream ends or either end gives up on it
+func (w *wire) run() {
+	// sleep Waits for ch, or for d to pass if it's more than zero,
+	// returning false if we should stop instead
+	sleep := func(ch <-chan struct{}, d time.Duration) bool {
+		var timeout <-chan time.Time
+		if d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+		case <-w.stop:
+			return false
+		case <-w.to.done:
+			return false
+		}
+		return true
+	}
+
+	for {
+		w.mu.Lock()
+		if len(w.segs) == 0 {
+			w.mu.Unlock()
+			if !sleep(w.wake, 0) {
+				return
+			}
+			continue
+		}
+		s := w.segs[0]
+		w.mu.Unlock()
+
+		// Later segments never arrive sooner, so there's nothing else
+		// to do until this one does
+		if wait := time.Until(s.at); wait > 0 {
+			if !sleep(nil, wait) {
+				return
+			}
+		}
+
+		// Nothing gets through a partition, so wait for it to heal
+		w.n.mu.Lock()
+		c, changed := w.n.lookup(w.from.local, w.to.local)
+		w.n.mu.Unlock()
+		if c.Partitioned {
+			if !sleep(changed, 0) {
+				return
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		w.segs = w.segs[1:]
+		w.inFlight -= len(s.data)
+		w.mu.Unlock()
+
+		// There's room for more to be written now
+		w.from.wakeUp()
+
+		if s.fin {
+			w.to.receiveEOF()
+			return
+		}
+		w.to.receive(s.data)
+	}
+} // }}}
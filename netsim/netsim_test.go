@@ -0,0 +1,387 @@
+package netsim
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The names of the two peers our tests connect
+const (
+	alice = "10.0.0.1:4545"
+	bob   = "10.0.0.2:4546"
+)
+
+// func readAll {{{
+
+// readAll Reads from conn until it has n bytes, returning them and the size
+// of each read, failing the test if it takes longer than a second
+func readAll(t *testing.T, conn net.Conn, n int) ([]byte, []int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var got []byte
+	var sizes []int
+	buf := make([]byte, 1024)
+	for len(got) < n {
+		m, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read after %d of %d bytes failed: %v", len(got), n, err)
+		}
+		got = append(got, buf[:m]...)
+		sizes = append(sizes, m)
+	}
+	return got, sizes
+} // }}}
+
+// func TestPerfect {{{
+
+// A perfect link delivers each write whole, straight away, both ways
+func TestPerfect(t *testing.T) {
+	n := New()
+	a, b := n.Pipe(alice, bob)
+	defer a.Close()
+	defer b.Close()
+
+	if a.LocalAddr().String() != alice || a.RemoteAddr().String() != bob {
+		t.Errorf("a is %s -> %s, want %s -> %s", a.LocalAddr(), a.RemoteAddr(), alice, bob)
+	}
+	if b.LocalAddr().Network() != "netsim" {
+		t.Errorf("b.LocalAddr().Network() = %q, want netsim", b.LocalAddr().Network())
+	}
+
+	msg := []byte("hello world")
+	if _, err := a.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got, sizes := readAll(t, b, len(msg))
+	if !bytes.Equal(got, msg) || len(sizes) != 1 {
+		t.Errorf("read %q in %d pieces, want %q in 1", got, len(sizes), msg)
+	}
+
+	b.Write([]byte("hi"))
+	if got, _ := readAll(t, a, 2); string(got) != "hi" {
+		t.Errorf("read %q, want hi", got)
+	}
+} // }}}
+
+// func TestFragment {{{
+
+// Each write is read in pieces no larger than the links fragment size, in
+// the order they were written
+func TestFragment(t *testing.T) {
+	n := New()
+	n.Set(alice, bob, Conditions{Fragment: 3, Jitter: 2 * time.Millisecond})
+	a, b := n.Pipe(alice, bob)
+	defer a.Close()
+	defer b.Close()
+
+	var want []byte
+	for _, s := range []string{"hello world", "a", "another, longer write"} {
+		a.Write([]byte(s))
+		want = append(want, s...)
+	}
+
+	got, sizes := readAll(t, b, len(want))
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	for _, size := range sizes {
+		if size > 3 {
+			t.Errorf("read %d bytes at once, want at most 3: %v", size, sizes)
+			break
+		}
+	}
+	if len(sizes) < len(want)/3 {
+		t.Errorf("read in %d pieces, want at least %d", len(sizes), len(want)/3)
+	}
+
+	// Reading with a smaller buffer than a segment gets the rest of it
+	// next time, rather than losing it
+	a.Write([]byte("xyz"))
+	small := make([]byte, 2)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if m, err := b.Read(small); err != nil || string(small[:m]) != "xy" {
+		t.Errorf("read %q, %v, want xy", small[:m], err)
+	}
+	if m, err := b.Read(small); err != nil || string(small[:m]) != "z" {
+		t.Errorf("read %q, %v, want z", small[:m], err)
+	}
+} // }}}
+
+// func TestLatency {{{
+
+// Nothing arrives before the links latency has passed, and the rule for the
+// pair wins over the one for Any
+func TestLatency(t *testing.T) {
+	n := New()
+	n.Set(Any, Any, Conditions{Latency: time.Hour})
+	n.Set(bob, alice, Conditions{Latency: 50 * time.Millisecond})
+	a, b := n.Pipe(alice, bob)
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	a.Write([]byte("ping"))
+	readAll(t, b, 4)
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("arrived after %s, want at least 50ms", took)
+	}
+
+	// Without the rule for the pair, the one for Any applies
+	n.Clear(alice, bob)
+	if _, ok := n.Rule(alice, bob); ok {
+		t.Errorf("rule for %s and %s still set after Clear", alice, bob)
+	}
+	links := n.Links()
+	if len(links) != 1 || links[0].Latency != time.Hour {
+		t.Errorf("links = %+v, want one with an hours latency", links)
+	}
+} // }}}
+
+// func TestPartition {{{
+
+// A partition holds what's written until it's healed, then delivers it
+func TestPartition(t *testing.T) {
+	n := New()
+	a, b := n.Pipe(alice, bob)
+	defer a.Close()
+	defer b.Close()
+
+	n.Partition(alice, bob)
+	if _, err := a.Write([]byte("held")); err != nil {
+		t.Fatalf("write during a partition failed: %v", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if m, err := b.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read during a partition = %d, %v, want a timeout", m, err)
+	}
+	if links := n.Links(); len(links) != 1 || !links[0].Partitioned || links[0].InFlight != 4 {
+		t.Errorf("links = %+v, want one partitioned with 4 bytes in flight", links)
+	}
+
+	n.Heal(alice, bob)
+	if got, _ := readAll(t, b, 4); string(got) != "held" {
+		t.Errorf("read %q after healing, want held", got)
+	}
+	if links := n.Links(); len(links) != 1 || links[0].Partitioned || links[0].InFlight != 0 {
+		t.Errorf("links = %+v, want one healed with nothing in flight", links)
+	}
+} // }}}
+
+// func TestReset {{{
+
+// Resetting a connection fails both ends straight away, losing whatever was
+// on its way
+func TestReset(t *testing.T) {
+	n := New()
+	n.Set(alice, bob, Conditions{Latency: time.Hour})
+	a, b := n.Pipe(alice, bob)
+
+	a.Write([]byte("lost"))
+
+	// A read that's already waiting is woken by it
+	read := make(chan error, 1)
+	go func() {
+		_, err := b.Read(make([]byte, 16))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if got := n.Reset(bob, Any); got != 1 {
+		t.Errorf("Reset = %d, want 1", got)
+	}
+	select {
+	case err := <-read:
+		if !errors.Is(err, ErrReset) {
+			t.Errorf("waiting read = %v, want ErrReset", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiting read wasn't woken by the reset")
+	}
+
+	for name, conn := range map[string]net.Conn{"a": a, "b": b} {
+		if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, ErrReset) || !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("%s.Read = %v, want ErrReset", name, err)
+		}
+		if _, err := conn.Write([]byte("x")); !errors.Is(err, ErrReset) {
+			t.Errorf("%s.Write = %v, want ErrReset", name, err)
+		}
+		if err := conn.Close(); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("%s.Close = %v, want net.ErrClosed", name, err)
+		}
+	}
+
+	if links := n.Links(); len(links) != 0 {
+		t.Errorf("links = %+v after reset, want none", links)
+	}
+	if got := n.Reset(Any, Any); got != 0 {
+		t.Errorf("Reset again = %d, want 0", got)
+	}
+} // }}}
+
+// func TestClose {{{
+
+// Closing one end lets the other read everything written before it, and then
+// io.EOF, never the other way round
+func TestClose(t *testing.T) {
+	n := New()
+	n.Set(alice, bob, Conditions{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, Fragment: 2})
+	a, b := n.Pipe(alice, bob)
+	defer b.Close()
+
+	a.Write([]byte("last words"))
+	if err := a.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if got, _ := readAll(t, b, 10); string(got) != "last words" {
+		t.Errorf("read %q, want last words", got)
+	}
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if m, err := b.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("read after everything arrived = %d, %v, want io.EOF", m, err)
+	}
+
+	// Writing to a peer that has gone resets us, while our own closed end
+	// can't be used at all
+	if _, err := b.Write([]byte("anyone there?")); !errors.Is(err, ErrReset) {
+		t.Errorf("write to a closed peer = %v, want ErrReset", err)
+	}
+	if _, err := a.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close = %v, want net.ErrClosed", err)
+	}
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after close = %v, want net.ErrClosed", err)
+	}
+	if err := a.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second close = %v, want net.ErrClosed", err)
+	}
+} // }}}
+
+// func TestDeadlines {{{
+
+// Reads and writes give up once their deadline passes, and carry on as normal
+// once it's cleared
+func TestDeadlines(t *testing.T) {
+	n := New()
+	a, b := n.Pipe(alice, bob)
+	defer a.Close()
+	defer b.Close()
+
+	// timeout returns whether err is a timeout, as net.Conn says it
+	// should be
+	timeout := func(err error) bool {
+		var ne net.Error
+		return errors.Is(err, os.ErrDeadlineExceeded) && errors.As(err, &ne) && ne.Timeout()
+	}
+
+	// Already passed
+	b.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := b.Read(make([]byte, 1)); !timeout(err) {
+		t.Errorf("read past its deadline = %v, want a timeout", err)
+	}
+
+	// Passes while we're waiting
+	start := time.Now()
+	b.SetReadDeadline(start.Add(30 * time.Millisecond))
+	if _, err := b.Read(make([]byte, 1)); !timeout(err) {
+		t.Errorf("waiting read = %v, want a timeout", err)
+	}
+	if took := time.Since(start); took < 30*time.Millisecond || took > time.Second {
+		t.Errorf("read gave up after %s, want about 30ms", took)
+	}
+
+	// Moved while we're waiting
+	read := make(chan error, 1)
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.SetDeadline(time.Now())
+	select {
+	case err := <-read:
+		if !timeout(err) {
+			t.Errorf("read whose deadline moved = %v, want a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read wasn't woken by its deadline moving")
+	}
+
+	// Cleared, so data gets through again
+	b.SetDeadline(time.Time{})
+	a.Write([]byte("ok"))
+	if got, _ := readAll(t, b, 2); string(got) != "ok" {
+		t.Errorf("read %q, want ok", got)
+	}
+
+	// Writes only wait once the link is full, which a partition makes
+	// sure of
+	n.Partition(alice, bob)
+	if _, err := a.Write(make([]byte, maxInFlight)); err != nil {
+		t.Fatalf("filling the link failed: %v", err)
+	}
+	a.SetWriteDeadline(time.Now().Add(30 * time.Millisecond))
+	if _, err := a.Write([]byte("x")); !timeout(err) {
+		t.Errorf("write to a full link = %v, want a timeout", err)
+	}
+
+	// Until it drains
+	a.SetWriteDeadline(time.Now().Add(time.Second))
+	n.Heal(alice, bob)
+	readAll(t, b, maxInFlight)
+	if _, err := a.Write([]byte("x")); err != nil {
+		t.Errorf("write once the link drained = %v", err)
+	}
+} // }}}
+
+// func TestWrap {{{
+
+// A wrapped connection crosses the simulated link on its way to and from the
+// real one, and a reset reaches the real one too
+func TestWrap(t *testing.T) {
+	n := New()
+	n.Set(alice, bob, Conditions{Fragment: 2, Latency: 5 * time.Millisecond})
+	near, far := net.Pipe()
+	defer far.Close()
+	conn := n.Wrap(alice, bob, near)
+
+	if conn.LocalAddr() != near.LocalAddr() || conn.RemoteAddr() != near.RemoteAddr() {
+		t.Errorf("wrapped addresses are %s -> %s, want %s -> %s", conn.LocalAddr(), conn.RemoteAddr(), near.LocalAddr(), near.RemoteAddr())
+	}
+
+	conn.Write([]byte("outbound"))
+	if got, _ := readAll(t, far, 8); string(got) != "outbound" {
+		t.Errorf("far end read %q, want outbound", got)
+	}
+
+	go far.Write([]byte("inbound"))
+	got, sizes := readAll(t, conn, 7)
+	if string(got) != "inbound" {
+		t.Errorf("read %q, want inbound", got)
+	}
+	for _, size := range sizes {
+		if size > 2 {
+			t.Errorf("read %d bytes at once, want at most 2: %v", size, sizes)
+			break
+		}
+	}
+
+	n.Reset(alice, bob)
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrReset) {
+		t.Errorf("read after reset = %v, want ErrReset", err)
+	}
+	far.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := far.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("far end read after reset = %v, want io.EOF", err)
+	}
+} // }}}
@@ -0,0 +1,192 @@
+// Package netsim simulates the network between peers, so we can see how they
+// cope with a bad one without needing one. Connections made or wrapped by a
+// Network get whatever latency, jitter, bandwidth, fragmentation and
+// partitions it's been told to give the link between their two ends, and can
+// be reset whenever we like.
+package netsim
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Any stands for every peer, when choosing which links conditions apply to
+const Any = "*"
+
+// The most bytes that may be on their way across a link, in one direction,
+// before writes have to wait, as they would once a sockets buffers are full
+const maxInFlight = 64 * 1024
+
+// ErrReset is returned by reads and writes on a connection that was reset,
+// either by Reset or by writing to a peer that has closed its end
+var ErrReset = fmt.Errorf("netsim: %w", syscall.ECONNRESET)
+
+// type Conditions struct {{{
+
+// Conditions describes how a link between two peers behaves. The zero value
+// is a perfect link, delivering everything straight away.
+type Conditions struct {
+	// How long everything takes to cross the link, in each direction, and
+	// up to how much longer, chosen at random for each segment. The stream
+	// is still delivered in order, as TCP would.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// The most bytes a second that can cross the link in each direction,
+	// zero for no limit
+	Bandwidth int
+
+	// The largest segment delivered at once, in bytes, so a single write
+	// is read in pieces. Zero delivers each write whole. Each read returns
+	// at most one segment, even if more have arrived, so the pieces are
+	// always seen.
+	Fragment int
+
+	// Whether nothing gets across at all. What's written in the meantime
+	// is held, not lost, until the partition is healed, or the writers
+	// give up waiting.
+	Partitioned bool
+} // }}}
+
+// type Rule struct {{{
+
+// Rule is the conditions we were told to give the links between two peers,
+// either of which may be Any
+type Rule struct {
+	A, B string
+	Conditions
+} // }}}
+
+// type Link struct {{{
+
+// Link describes a connection on the network, as returned by Links
+type Link struct {
+	// The names of its two ends, i.e. "10.0.0.1:4545"
+	Local, Remote string
+
+	// The conditions it currently has
+	Conditions
+
+	// How many bytes are on their way across it, in both directions
+	InFlight int
+} // }}}
+
+// type pair [2]string {{{
+
+// pair is the two peers a rule applies to, in order, so it's the same key
+// whichever way round they were given
+type pair [2]string // }}}
+
+// type Network struct {{{
+
+// Network holds the conditions of the links between peers, and the
+// connections across them. It's safe to use from any number of goroutines.
+type Network struct {
+	// Locks everything below
+	mu sync.Mutex
+
+	// The conditions we were told to give each pair of peers
+	rules map[pair]Conditions
+
+	// Our connections, by the end that was made first
+	conns map[*Conn]struct{}
+
+	// Closed, and replaced, whenever the rules change, so links waiting
+	// for a partition to heal notice when it does
+	changed chan struct{}
+
+	// Picks the jitter of each segment
+	rand *rand.Rand
+} // }}}
+
+// type Addr string {{{
+
+// Addr is the address of one end of an in-process connection, the name it
+// was given
+type Addr string // }}}
+
+// type segment struct {{{
+
+// segment is a piece of what was written to a link, or the end of it
+type segment struct {
+	data []byte
+
+	// When it arrives at the far end
+	at time.Time
+
+	// Whether this is the end of the stream, rather than data
+	fin bool
+} // }}}
+
+// type wire struct {{{
+
+// wire carries what one end of a connection writes across to the other
+type wire struct {
+	n        *Network
+	from, to *Conn
+
+	// Locks everything below
+	mu sync.Mutex
+
+	// What's on its way, in the order it'll arrive, and how many bytes
+	// that is
+	segs     []segment
+	inFlight int
+
+	// When the link is next free to send, given its bandwidth, and when
+	// the last segment arrives, so nothing overtakes it
+	free time.Time
+	last time.Time
+
+	// Signalled whenever a segment is added
+	wake chan struct{}
+
+	// Closed once the connection is reset, dropping whatever is left
+	stop     chan struct{}
+	stopOnce sync.Once
+} // }}}
+
+// type Conn struct {{{
+
+// Conn is one end of a connection across the network. It's a net.Conn, so
+// peers can use it like any other.
+type Conn struct {
+	n *Network
+
+	// What the ends are called, for looking up the conditions between
+	// them, and the addresses we report for them
+	local, remote string
+	laddr, raddr  net.Addr
+
+	// The other end, and the wire what we write crosses to get there
+	peer *Conn
+	out  *wire
+
+	// Locks everything below
+	mu sync.Mutex
+
+	// The segments that have arrived, but haven't been read yet
+	arrived [][]byte
+
+	// Whether the other end has closed and everything it sent has arrived,
+	// whether we've closed our end, and whether the connection was reset
+	eof    bool
+	closed bool
+	reset  bool
+
+	// When reads and writes give up, zero for never
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Closed, and replaced, whenever anything above changes, or there's
+	// room on our wire again, so blocked reads and writes check again
+	wake chan struct{}
+
+	// Closed once we're closed or reset, so the wire to us can stop
+	done     chan struct{}
+	doneOnce sync.Once
+} // }}}
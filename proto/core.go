@@ -0,0 +1,378 @@
+// Package proto implements the wire protocol peers use to talk to each
+// other.
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Size of the type and length that come before each frames payload
+const headerSize = 5
+
+// func WriteFrame {{{
+
+// WriteFrame writes f to w in a single call to Write, so that frames written
+// by different goroutines won't be interleaved
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, headerSize+len(f.Payload))
+	buf[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buf[1:headerSize], uint32(len(f.Payload)))
+	copy(buf[headerSize:], f.Payload)
+
+	_, err := w.Write(buf)
+	return err
+} // }}}
+
+// func ReadFrame {{{
+
+// ReadFrame reads the next frame from r
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	f := Frame{
+		Type:    FrameType(header[0]),
+		Payload: make([]byte, size),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		// The peer went away part way through a frame, which isn't
+		// the same as going away cleanly between frames
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+} // }}}
+
+// func WriteHello {{{
+
+// WriteHello starts a connection, writing Magic followed by our Hello
+func WriteHello(w io.Writer, h Hello) error {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(Magic)
+	if err := WriteFrame(&buf, Frame{Type: FrameHello, Payload: payload}); err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+} // }}}
+
+// func ReadHello {{{
+
+// ReadHello reads the Magic and Hello the other side started the connection
+// with
+func ReadHello(r io.Reader) (Hello, error) {
+	var h Hello
+
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(magic, Magic) {
+		return h, ErrBadMagic
+	}
+
+	f, err := ReadFrame(r)
+	if err != nil {
+		return h, err
+	}
+	if f.Type != FrameHello {
+		return h, ErrUnexpectedFrame
+	}
+	if err := json.Unmarshal(f.Payload, &h); err != nil {
+		return h, fmt.Errorf("proto: invalid hello: %w", err)
+	}
+	if h.Version < 1 || h.MaxMessage < 1 {
+		return h, fmt.Errorf("proto: invalid hello: version %d, max message %d", h.Version, h.MaxMessage)
+	}
+	return h, nil
+} // }}}
+
+// func GoodbyeFrame {{{
+
+// GoodbyeFrame returns the frame to send the given Goodbye in
+func GoodbyeFrame(g Goodbye) Frame {
+	// There's nothing in a Goodbye that can't be marshalled
+	payload, _ := json.Marshal(g)
+	return Frame{Type: FrameGoodbye, Payload: payload}
+} // }}}
+
+// func ParseGoodbye {{{
+
+// ParseGoodbye reads the Goodbye out of a goodbye frames payload
+func ParseGoodbye(payload []byte) (Goodbye, error) {
+	var g Goodbye
+	if err := json.Unmarshal(payload, &g); err != nil {
+		return g, fmt.Errorf("proto: invalid goodbye: %w", err)
+	}
+	return g, nil
+} // }}}
+
+// func g.Describe {{{
+
+// Describe returns why the peer said it closed the connection, in words fit
+// for the user, i.e. "peer is shutting down: back tomorrow"
+func (g Goodbye) Describe() string {
+	var why string
+	switch g.Code {
+	case GoodbyeTerminated:
+		why = "peer has terminated the connection"
+	case GoodbyeShutdown:
+		why = "peer is shutting down"
+	case GoodbyeKicked:
+		why = "peer has kicked us"
+	case GoodbyeRejected:
+		why = "peer has rejected the connection"
+	case GoodbyeRateLimited:
+		why = "peer says we are sending too much"
+	case GoodbyeAuthFailed:
+		why = "peer could not authenticate us"
+	default:
+		why = fmt.Sprintf("peer has closed the connection (%s)", g.Code)
+	}
+
+	if g.Text != "" {
+		return why + ": " + g.Text
+	}
+	return why
+} // }}}
+
+// func Fingerprint {{{
+
+// Fingerprint returns a short, readable digest of the key a peer announced in
+// its Hello, i.e. "3f2a:91c0:5be7:d418", or "" if it didn't announce one
+func Fingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:8])
+	return h[0:4] + ":" + h[4:8] + ":" + h[8:12] + ":" + h[12:16]
+} // }}}
+
+// func NewStreamCodec {{{
+
+// NewStreamCodec returns a StreamCodec for the given stream
+func NewStreamCodec(rw io.ReadWriter) *StreamCodec {
+	return &StreamCodec{rw: rw}
+} // }}}
+
+// func sc.ReadFrame {{{
+
+// ReadFrame reads the next frame from the stream. The payload is only good
+// until the next call to ReadFrame, which reuses it, so anything that needs
+// it for longer must take a copy.
+func (sc *StreamCodec) ReadFrame() (Frame, error) {
+	sc.release()
+
+	// Waiting on the next frame could take forever, so we only do it
+	// with a buffer if there's already something in it
+	if sc.r == nil {
+		if _, err := io.ReadFull(sc.rw, sc.header[:]); err != nil {
+			return Frame{}, err
+		}
+		sc.r = readers.Get().(*bufio.Reader)
+		sc.r.Reset(sc.rw)
+	} else if _, err := io.ReadFull(sc.r, sc.header[:]); err != nil {
+		sc.putReader()
+		return Frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(sc.header[1:])
+	if size > MaxFrameSize {
+		sc.putReader()
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	sc.payload = payloads.Get().(*[]byte)
+	if cap(*sc.payload) < int(size) {
+		*sc.payload = make([]byte, size)
+	}
+	*sc.payload = (*sc.payload)[:size]
+
+	f := Frame{Type: FrameType(sc.header[0]), Payload: *sc.payload}
+	if _, err := io.ReadFull(sc.r, f.Payload); err != nil {
+		sc.putReader()
+		// The peer went away part way through a frame, which isn't
+		// the same as going away cleanly between frames
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	// Nothing more to read yet? Then someone else can have the buffer
+	// while we wait
+	if sc.r.Buffered() == 0 {
+		sc.putReader()
+	}
+	return f, nil
+} // }}}
+
+// func sc.WriteFrame {{{
+
+// WriteFrame writes f to the stream straight away
+func (sc *StreamCodec) WriteFrame(f Frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	w := sc.writer()
+	w.Write(sc.frameHeader(f.Type, len(f.Payload)))
+	w.Write(f.Payload)
+	return sc.Flush()
+} // }}}
+
+// func sc.BufferMessage {{{
+
+// BufferMessage Adds a message frame to those waiting to be written, without
+// copying the message into a frame of its own first. Nothing is written until
+// Flush is called, unless there's more than the buffer holds.
+func (sc *StreamCodec) BufferMessage(text string) error {
+	if len(text) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	w := sc.writer()
+	w.Write(sc.frameHeader(FrameMessage, len(text)))
+	_, err := w.WriteString(text)
+	return err
+} // }}}
+
+// func sc.Flush {{{
+
+// Flush Writes every frame waiting to be written, and hands the buffer back
+// to the pool
+func (sc *StreamCodec) Flush() error {
+	if sc.w == nil {
+		return nil
+	}
+	err := sc.w.Flush()
+	sc.w.Reset(nil)
+	writers.Put(sc.w)
+	sc.w = nil
+	return err
+} // }}}
+
+// func sc.frameHeader {{{
+
+// frameHeader returns the header of a frame of the given type and size, good
+// until the next frame is written
+func (sc *StreamCodec) frameHeader(t FrameType, size int) []byte {
+	sc.out[0] = byte(t)
+	binary.BigEndian.PutUint32(sc.out[1:], uint32(size))
+	return sc.out[:]
+} // }}}
+
+// func sc.writer {{{
+
+// writer returns the buffer frames are written through, taking one from the
+// pool if we don't have one
+func (sc *StreamCodec) writer() *bufio.Writer {
+	if sc.w == nil {
+		sc.w = writers.Get().(*bufio.Writer)
+		sc.w.Reset(sc.rw)
+	}
+	return sc.w
+} // }}}
+
+// func sc.release {{{
+
+// release Hands the payload of the last frame read back to the pool, now
+// that the caller is done with it
+func (sc *StreamCodec) release() {
+	if sc.payload == nil {
+		return
+	}
+	// A peer sending the occasional huge frame shouldn't leave the pool
+	// full of huge buffers
+	if cap(*sc.payload) <= bufferSize {
+		payloads.Put(sc.payload)
+	}
+	sc.payload = nil
+} // }}}
+
+// func sc.putReader {{{
+
+// putReader Hands the read buffer back to the pool
+func (sc *StreamCodec) putReader() {
+	if sc.r == nil {
+		return
+	}
+	sc.r.Reset(nil)
+	readers.Put(sc.r)
+	sc.r = nil
+} // }}}
+
+// func NewLineCodec {{{
+
+// NewLineCodec returns a LineCodec for the given stream
+func NewLineCodec(rw io.ReadWriter) *LineCodec {
+	return &LineCodec{r: bufio.NewReader(rw), w: rw}
+} // }}}
+
+// func lc.ReadFrame {{{
+
+// ReadFrame reads the next line from the stream as a message, without its
+// line ending. A last line with no newline at all is still a message.
+func (lc *LineCodec) ReadFrame() (Frame, error) {
+	var line []byte
+	for {
+		chunk, err := lc.r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxFrameSize {
+			return Frame{}, ErrFrameTooLarge
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			// The line is longer than our buffer, so keep going
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return Frame{}, err
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return Frame{Type: FrameMessage, Payload: line}, nil
+} // }}}
+
+// func lc.WriteFrame {{{
+
+// WriteFrame writes a message to the stream, followed by a newline. There's
+// nothing but messages in plain text, so other frames are dropped.
+func (lc *LineCodec) WriteFrame(f Frame) error {
+	if f.Type != FrameMessage {
+		return nil
+	}
+	buf := make([]byte, 0, len(f.Payload)+1)
+	buf = append(buf, f.Payload...)
+	buf = append(buf, '\n')
+	_, err := lc.w.Write(buf)
+	return err
+} // }}}
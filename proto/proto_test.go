@@ -0,0 +1,389 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// type stream struct {{{
+
+// stream is a byte stream made of any reader and writer, so a codec can be
+// given a reader that misbehaves
+type stream struct {
+	io.Reader
+	io.Writer
+} // }}}
+
+// func header {{{
+
+// header returns the header of a frame of the given type and payload size,
+// however large, so broken frames can be made by hand
+func header(t FrameType, size uint32) []byte {
+	h := make([]byte, headerSize)
+	h[0] = byte(t)
+	binary.BigEndian.PutUint32(h[1:], size)
+	return h
+} // }}}
+
+// func encode {{{
+
+// encode returns the given frames as they'd be written on the wire
+func encode(tb testing.TB, frames ...Frame) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			tb.Fatalf("WriteFrame failed: %v", err)
+		}
+	}
+	return buf.Bytes()
+} // }}}
+
+// func testFrames {{{
+
+// testFrames returns a few frames of different types and sizes, including an
+// empty one and one larger than the codecs buffer
+func testFrames() []Frame {
+	return []Frame{
+		{Type: FrameMessage, Payload: []byte("hello")},
+		{Type: FrameMessage, Payload: []byte{}},
+		{Type: FrameMessage, Payload: bytes.Repeat([]byte("x"), bufferSize*2+7)},
+		{Type: FrameType(42), Payload: []byte("from a newer version")},
+		GoodbyeFrame(Goodbye{Code: GoodbyeShutdown, Text: "back tomorrow"}),
+	}
+} // }}}
+
+// func TestStreamCodecRead {{{
+
+// Frames are read whole however the stream splits them up, and the stream
+// ending is io.EOF between frames, and io.ErrUnexpectedEOF within one
+func TestStreamCodecRead(t *testing.T) {
+	frames := testFrames()
+	wire := encode(t, frames...)
+
+	readers := map[string]func(r io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data err": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		sc := NewStreamCodec(stream{wrap(bytes.NewReader(wire)), io.Discard})
+		for i, want := range frames {
+			got, err := sc.ReadFrame()
+			if err != nil {
+				t.Fatalf("%s: frame %d failed: %v", name, i, err)
+			}
+			if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("%s: frame %d = %d, %d bytes, want %d, %d bytes", name, i, got.Type, len(got.Payload), want.Type, len(want.Payload))
+			}
+		}
+		if _, err := sc.ReadFrame(); err != io.EOF {
+			t.Errorf("%s: read after the last frame = %v, want io.EOF", name, err)
+		}
+	}
+
+	// Cut off part way through a header, or a payload, whether the codec
+	// has a buffer at the time or not
+	msg := encode(t, Frame{Type: FrameMessage, Payload: []byte("cut off")})
+	for _, wire := range [][]byte{msg[:3], msg[:headerSize+2], append(append([]byte{}, msg...), msg[:headerSize+2]...)} {
+		sc := NewStreamCodec(stream{iotest.OneByteReader(bytes.NewReader(wire)), io.Discard})
+		var err error
+		for err == nil {
+			_, err = sc.ReadFrame()
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("reading %d bytes of frames = %v, want io.ErrUnexpectedEOF", len(wire), err)
+		}
+	}
+} // }}}
+
+// func TestStreamCodecReader {{{
+
+// The read buffer is only kept while there's something in it, so frames that
+// arrive together are read from it, and an idle codec holds nothing
+func TestStreamCodecReader(t *testing.T) {
+	one := Frame{Type: FrameMessage, Payload: []byte("one")}
+	two := Frame{Type: FrameMessage, Payload: []byte("two")}
+
+	r, w := io.Pipe()
+	sc := NewStreamCodec(stream{r, io.Discard})
+	go func() {
+		w.Write(encode(t, one, two))
+		w.Write(encode(t, one))
+		w.Close()
+	}()
+
+	f, err := sc.ReadFrame()
+	if err != nil || string(f.Payload) != "one" {
+		t.Fatalf("first frame = %q, %v, want one", f.Payload, err)
+	}
+	if sc.r == nil || sc.r.Buffered() == 0 {
+		t.Fatalf("read buffer was given up with the second frame still in it")
+	}
+
+	f, err = sc.ReadFrame()
+	if err != nil || string(f.Payload) != "two" {
+		t.Fatalf("second frame = %q, %v, want two", f.Payload, err)
+	}
+	if sc.r != nil {
+		t.Errorf("read buffer kept with nothing in it")
+	}
+
+	// A fresh buffer picks up where we left off
+	f, err = sc.ReadFrame()
+	if err != nil || string(f.Payload) != "one" {
+		t.Fatalf("third frame = %q, %v, want one", f.Payload, err)
+	}
+	if _, err := sc.ReadFrame(); err != io.EOF {
+		t.Errorf("read after the last frame = %v, want io.EOF", err)
+	}
+	if sc.r != nil {
+		t.Errorf("read buffer kept after the stream ended")
+	}
+} // }}}
+
+// func TestStreamCodecPayloads {{{
+
+// A payload is good until the next read, even while other codecs use the
+// pooled buffers, and a copy of it is good for as long as the caller likes
+func TestStreamCodecPayloads(t *testing.T) {
+	first := Frame{Type: FrameMessage, Payload: []byte("first message")}
+	second := Frame{Type: FrameMessage, Payload: []byte("SECOND")}
+	wire := encode(t, first, second)
+
+	sc := NewStreamCodec(stream{bytes.NewReader(wire), io.Discard})
+	f, err := sc.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+	kept := append([]byte(nil), f.Payload...)
+
+	// Plenty of other connections reading frames in the meantime
+	for i := 0; i < 10; i++ {
+		other := NewStreamCodec(stream{bytes.NewReader(encode(t, second, second)), io.Discard})
+		for j := 0; j < 2; j++ {
+			if _, err := other.ReadFrame(); err != nil {
+				t.Fatalf("other codec failed: %v", err)
+			}
+		}
+	}
+	if string(f.Payload) != "first message" {
+		t.Errorf("payload is %q before the next read, want first message", f.Payload)
+	}
+
+	g, err := sc.ReadFrame()
+	if err != nil || !bytes.Equal(g.Payload, second.Payload) {
+		t.Fatalf("second frame = %q, %v, want %q", g.Payload, err, second.Payload)
+	}
+	if !bytes.Equal(kept, first.Payload) {
+		t.Errorf("kept copy of the first payload is %q, want %q", kept, first.Payload)
+	}
+} // }}}
+
+// func TestFrameSize {{{
+
+// Frames up to MaxFrameSize are fine, and anything larger is refused whether
+// we're reading or writing it
+func TestFrameSize(t *testing.T) {
+	max := Frame{Type: FrameMessage, Payload: bytes.Repeat([]byte("m"), MaxFrameSize)}
+	sc := NewStreamCodec(stream{bytes.NewReader(encode(t, max)), io.Discard})
+	if f, err := sc.ReadFrame(); err != nil || len(f.Payload) != MaxFrameSize {
+		t.Errorf("reading a frame of MaxFrameSize = %d bytes, %v", len(f.Payload), err)
+	}
+
+	// The length alone is enough to refuse it, before any of the payload
+	// has arrived
+	for _, size := range []uint32{MaxFrameSize + 1, 1 << 31, 1<<32 - 1} {
+		wire := header(FrameMessage, size)
+		sc := NewStreamCodec(stream{bytes.NewReader(wire), io.Discard})
+		if _, err := sc.ReadFrame(); err != ErrFrameTooLarge {
+			t.Errorf("StreamCodec reading a frame of %d bytes = %v, want ErrFrameTooLarge", size, err)
+		}
+		if _, err := ReadFrame(bytes.NewReader(wire)); err != ErrFrameTooLarge {
+			t.Errorf("ReadFrame of %d bytes = %v, want ErrFrameTooLarge", size, err)
+		}
+	}
+
+	var out bytes.Buffer
+	sc = NewStreamCodec(stream{bytes.NewReader(nil), &out})
+	big := Frame{Type: FrameMessage, Payload: make([]byte, MaxFrameSize+1)}
+	if err := sc.WriteFrame(big); err != ErrFrameTooLarge {
+		t.Errorf("WriteFrame of a frame too large = %v, want ErrFrameTooLarge", err)
+	}
+	if err := sc.BufferMessage(string(big.Payload)); err != ErrFrameTooLarge {
+		t.Errorf("BufferMessage of a message too large = %v, want ErrFrameTooLarge", err)
+	}
+	if err := WriteFrame(&out, big); err != ErrFrameTooLarge {
+		t.Errorf("WriteFrame of a frame too large = %v, want ErrFrameTooLarge", err)
+	}
+	sc.Flush()
+	if out.Len() != 0 {
+		t.Errorf("refused frames wrote %d bytes", out.Len())
+	}
+} // }}}
+
+// func TestStreamCodecWrite {{{
+
+// Written frames read back the same, whether they were written one at a time
+// or buffered and flushed together, and nothing buffered is written early
+func TestStreamCodecWrite(t *testing.T) {
+	var out bytes.Buffer
+	sc := NewStreamCodec(stream{bytes.NewReader(nil), &out})
+
+	if err := sc.WriteFrame(Frame{Type: FrameMessage, Payload: []byte("straight away")}); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+	written := out.Len()
+	for _, text := range []string{"one", "", "three"} {
+		if err := sc.BufferMessage(text); err != nil {
+			t.Fatalf("BufferMessage failed: %v", err)
+		}
+	}
+	if out.Len() != written {
+		t.Errorf("buffered messages were written before the flush")
+	}
+	if err := sc.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if sc.w != nil {
+		t.Errorf("write buffer kept after the flush")
+	}
+	sc.WriteFrame(GoodbyeFrame(Goodbye{Code: GoodbyeTerminated}))
+
+	r := bytes.NewReader(out.Bytes())
+	for _, want := range []string{"straight away", "one", "", "three"} {
+		f, err := ReadFrame(r)
+		if err != nil || f.Type != FrameMessage || string(f.Payload) != want {
+			t.Errorf("frame = %d, %q, %v, want a message of %q", f.Type, f.Payload, err, want)
+		}
+	}
+	f, err := ReadFrame(r)
+	if err != nil || f.Type != FrameGoodbye {
+		t.Fatalf("last frame = %d, %v, want a goodbye", f.Type, err)
+	}
+	if g, err := ParseGoodbye(f.Payload); err != nil || g.Code != GoodbyeTerminated {
+		t.Errorf("goodbye = %+v, %v, want %s", g, err, GoodbyeTerminated)
+	}
+} // }}}
+
+// func TestHello {{{
+
+// Hellos arrive as they were sent, however the stream splits them, and
+// anything that isn't a valid hello from a peer speaking our protocol is
+// refused
+func TestHello(t *testing.T) {
+	want := Hello{Version: Version, MaxMessage: 280, Name: "alice", Key: "secret"}
+	var buf bytes.Buffer
+	if err := WriteHello(&buf, want); err != nil {
+		t.Fatalf("WriteHello failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), Magic) {
+		t.Errorf("hello doesn't start with Magic")
+	}
+	got, err := ReadHello(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+	if err != nil || got != want {
+		t.Errorf("ReadHello = %+v, %v, want %+v", got, err, want)
+	}
+
+	// wire returns Magic followed by a frame of the given type and payload
+	wire := func(magic []byte, t FrameType, payload string) []byte {
+		var buf bytes.Buffer
+		buf.Write(magic)
+		WriteFrame(&buf, Frame{Type: t, Payload: []byte(payload)})
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name string
+		wire []byte
+		err  error
+	}{
+		{"bad magic", wire([]byte("\x00CHATTX"), FrameHello, `{"version":1,"max_message":100}`), ErrBadMagic},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), ErrBadMagic},
+		{"message first", wire(Magic, FrameMessage, `{"version":1,"max_message":100}`), ErrUnexpectedFrame},
+		{"too large", append(append([]byte{}, Magic...), header(FrameHello, MaxFrameSize+1)...), ErrFrameTooLarge},
+		{"short magic", Magic[:3], io.ErrUnexpectedEOF},
+		{"nothing", nil, io.EOF},
+		{"cut off", wire(Magic, FrameHello, `{"version":1,"max_message":100}`)[:len(Magic)+headerSize+4], io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		if _, err := ReadHello(bytes.NewReader(test.wire)); !errors.Is(err, test.err) {
+			t.Errorf("%s: ReadHello = %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// Hellos that parse, but that we can't agree on anything with
+	for _, payload := range []string{`not json`, `{"version":0,"max_message":100}`, `{"version":1,"max_message":0}`, `{"version":1}`, `{"version":1,"max_message":-5}`} {
+		_, err := ReadHello(bytes.NewReader(wire(Magic, FrameHello, payload)))
+		if err == nil || !strings.HasPrefix(err.Error(), "proto: invalid hello") {
+			t.Errorf("ReadHello of %s = %v, want an invalid hello", payload, err)
+		}
+	}
+} // }}}
+
+// func TestGoodbye {{{
+
+// Goodbyes survive the trip, and are described in words whether or not we
+// know their code
+func TestGoodbye(t *testing.T) {
+	tests := []struct {
+		g    Goodbye
+		want string
+	}{
+		{Goodbye{Code: GoodbyeShutdown}, "peer is shutting down"},
+		{Goodbye{Code: GoodbyeKicked, Text: "spam"}, "peer has kicked us: spam"},
+		{Goodbye{Code: GoodbyeRateLimited}, "peer says we are sending too much"},
+		{Goodbye{Code: "gone_fishing", Text: "back soon"}, "peer has closed the connection (gone_fishing): back soon"},
+	}
+	for _, test := range tests {
+		f := GoodbyeFrame(test.g)
+		if f.Type != FrameGoodbye {
+			t.Errorf("GoodbyeFrame type = %d, want %d", f.Type, FrameGoodbye)
+		}
+		g, err := ParseGoodbye(f.Payload)
+		if err != nil || g != test.g {
+			t.Errorf("ParseGoodbye = %+v, %v, want %+v", g, err, test.g)
+		}
+		if got := g.Describe(); got != test.want {
+			t.Errorf("Describe = %q, want %q", got, test.want)
+		}
+	}
+
+	if _, err := ParseGoodbye([]byte("{")); err == nil {
+		t.Errorf("ParseGoodbye of broken JSON succeeded")
+	}
+} // }}}
+
+// func TestLineCodec {{{
+
+// Each line is a message, whatever it ends with, and only messages are written
+func TestLineCodec(t *testing.T) {
+	var out bytes.Buffer
+	in := "hello\r\nworld\n\nno newline"
+	lc := NewLineCodec(stream{iotest.OneByteReader(strings.NewReader(in)), &out})
+	for _, want := range []string{"hello", "world", "", "no newline"} {
+		f, err := lc.ReadFrame()
+		if err != nil || f.Type != FrameMessage || string(f.Payload) != want {
+			t.Errorf("line = %q, %v, want %q", f.Payload, err, want)
+		}
+	}
+	if _, err := lc.ReadFrame(); err != io.EOF {
+		t.Errorf("read after the last line = %v, want io.EOF", err)
+	}
+
+	long := NewLineCodec(stream{strings.NewReader(strings.Repeat("y", MaxFrameSize+1) + "\n"), &out})
+	if _, err := long.ReadFrame(); err != ErrFrameTooLarge {
+		t.Errorf("reading a line too long = %v, want ErrFrameTooLarge", err)
+	}
+
+	lc.WriteFrame(Frame{Type: FrameMessage, Payload: []byte("hi")})
+	lc.WriteFrame(GoodbyeFrame(Goodbye{Code: GoodbyeShutdown}))
+	if out.String() != "hi\n" {
+		t.Errorf("wrote %q, want only the message", out.String())
+	}
+} // }}}
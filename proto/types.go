@@ -0,0 +1,170 @@
+// Package proto implements the wire protocol peers use to talk to each
+// other.
+//
+// Each side starts a connection by writing Magic followed by a Hello frame,
+// and then reads the other sides Hello. Everything after that is a stream of
+// frames, each a one byte type and a four byte big endian payload length,
+// followed by the payload itself.
+package proto
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Version is the version of the protocol we speak
+const Version = 1
+
+// Magic is written at the very start of every connection, so we can tell a
+// peer speaking our protocol from something else entirely
+var Magic = []byte("\x00CHATTY")
+
+// MaxFrameSize is the largest payload we'll accept, so a broken or
+// malicious peer can't make us allocate as much memory as it likes
+const MaxFrameSize = 64 * 1024
+
+// How big the buffers a StreamCodec reads and writes through are, and how big
+// a payload buffer starts out
+const (
+	bufferSize  = 4096
+	payloadSize = 512
+)
+
+// Pools of buffers shared by every StreamCodec
+var (
+	readers  = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, bufferSize) }}
+	writers  = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, bufferSize) }}
+	payloads = sync.Pool{New: func() interface{} { b := make([]byte, 0, payloadSize); return &b }}
+)
+
+// Errors returned while reading frames
+var (
+	ErrBadMagic        = errors.New("proto: peer is not speaking our protocol")
+	ErrFrameTooLarge   = errors.New("proto: frame is too large")
+	ErrUnexpectedFrame = errors.New("proto: unexpected frame type")
+)
+
+// type FrameType uint8 {{{
+
+// FrameType identifies what a frames payload holds
+type FrameType uint8
+
+const (
+	// FrameHello carries a JSON encoded Hello, and is always the first
+	// frame sent on a connection
+	FrameHello FrameType = iota + 1
+
+	// FrameMessage carries a chat message, as UTF-8 text
+	FrameMessage
+
+	// FrameGoodbye carries a JSON encoded Goodbye, and is the last frame
+	// sent by a peer closing the connection on purpose
+	FrameGoodbye
+) // }}}
+
+// type GoodbyeCode string {{{
+
+// GoodbyeCode is why a peer closed the connection
+type GoodbyeCode string
+
+const (
+	// GoodbyeTerminated is the user closing the connection
+	GoodbyeTerminated GoodbyeCode = "terminated"
+
+	// GoodbyeShutdown is the peer exiting
+	GoodbyeShutdown GoodbyeCode = "shutting_down"
+
+	// GoodbyeKicked is someone other than the user, i.e. the admin API,
+	// closing the connection
+	GoodbyeKicked GoodbyeCode = "kicked"
+
+	// GoodbyeRejected is the user turning down a connection that was
+	// waiting to be accepted
+	GoodbyeRejected GoodbyeCode = "rejected"
+
+	// GoodbyeRateLimited is the peer closing a connection sending more
+	// than it's willing to take
+	GoodbyeRateLimited GoodbyeCode = "rate_limited"
+
+	// GoodbyeAuthFailed is the peer closing a connection it doesn't trust
+	GoodbyeAuthFailed GoodbyeCode = "auth_failed"
+) // }}}
+
+// type Frame struct {{{
+
+// Frame is a single unit of data sent between peers
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+} // }}}
+
+// type Hello struct {{{
+
+// Hello is what each peer tells the other about itself when connecting
+type Hello struct {
+	// The protocol version the peer speaks
+	Version int `json:"version"`
+
+	// The longest message, in user-perceived characters, the peer is
+	// willing to accept
+	MaxMessage int `json:"max_message"`
+
+	// What the peer would like to be called, if anything
+	Name string `json:"name,omitempty"`
+
+	// A value the peer keeps between runs, so it can be recognised again
+	// by its Fingerprint. Nothing proves the peer owns it, so it only
+	// tells honest peers apart.
+	Key string `json:"key,omitempty"`
+} // }}}
+
+// type Goodbye struct {{{
+
+// Goodbye is what a peer tells the other when it closes the connection on
+// purpose, so it can be told apart from the connection dropping
+type Goodbye struct {
+	// Why the connection is being closed. Peers may send codes newer
+	// than the ones we know.
+	Code GoodbyeCode `json:"code"`
+
+	// Anything the peer wanted to add, in its own words
+	Text string `json:"text,omitempty"`
+} // }}}
+
+// type StreamCodec struct {{{
+
+// StreamCodec reads and writes frames on a byte stream, such as a TCP
+// connection, once the handshake is out of the way. Its buffers come from
+// pools shared by every connection, and are only held on to while there's
+// something in them, so peers that are sat idle don't cost us any.
+type StreamCodec struct {
+	rw io.ReadWriter
+
+	// Buffers what we read, while there's more to read than we've used
+	r *bufio.Reader
+
+	// The header of the frame being read
+	header [headerSize]byte
+
+	// The payload of the last frame read, which is handed back to the pool
+	// on the next read
+	payload *[]byte
+
+	// Buffers what we write, until it's flushed, and the header of the
+	// frame being written. Reads and writes happen on different
+	// goroutines, so they don't share a header.
+	w   *bufio.Writer
+	out [headerSize]byte
+} // }}}
+
+// type LineCodec struct {{{
+
+// LineCodec reads and writes messages as lines of plain text, for peers that
+// don't speak our protocol at all, i.e. someone debugging with netcat. Each
+// line they send is a message, and each message we send ends in a newline.
+type LineCodec struct {
+	r *bufio.Reader
+	w io.Writer
+} // }}}
@@ -0,0 +1,214 @@
+// Package registry keeps track of the connections we have established, in
+// order, so they can be found quickly by id or by address, and listed without
+// holding anyone up
+package registry
+
+import (
+	"github.com/Cryliss/chat/client"
+	"net"
+	"sort"
+)
+
+// func New {{{
+
+// New Initializes and returns a new, empty, Registry
+func New() *Registry {
+	return &Registry{
+		byID:   make(map[uint32]int),
+		byAddr: make(map[string]uint32),
+	}
+} // }}}
+
+// func r.Add {{{
+
+// Add Adds a connection to the registry, returning ErrExists if we already
+// have one with the same id or address. Connections without a port, i.e.
+// in-process ones, can't be told apart by address, so they're only ever
+// found by id.
+func (r *Registry) Add(c *client.Client) error {
+	addr := address(c.IP, c.Port)
+	byAddr := c.Port != ""
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byID[c.ID]; ok {
+		return ErrExists
+	}
+	if _, ok := r.byAddr[addr]; ok && byAddr {
+		return ErrExists
+	}
+
+	// Ids are handed out in order, so new connections almost always go on
+	// the end. Those that took a while to establish, i.e. ones the user had
+	// to accept, go back where their id puts them.
+	n := len(r.entries)
+	if n == 0 || r.last() < c.ID {
+		r.entries = append(r.entries, c)
+		r.byID[c.ID] = n
+	} else {
+		// The holes left by removed connections would throw the search
+		// off, so get rid of them first
+		if r.removed > 0 {
+			r.compact()
+		}
+		i := sort.Search(len(r.entries), func(i int) bool {
+			return r.entries[i].ID > c.ID
+		})
+		r.entries = append(r.entries, nil)
+		copy(r.entries[i+1:], r.entries[i:])
+		r.entries[i] = c
+		r.reindex(i)
+	}
+
+	if byAddr {
+		r.byAddr[addr] = c.ID
+	}
+	r.snapshot = nil
+	return nil
+} // }}}
+
+// func r.Remove {{{
+
+// Remove Removes the connection with the given id from the registry,
+// returning it, or nil if there wasn't one
+func (r *Registry) Remove(id uint32) *client.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.byID[id]
+	if !ok {
+		return nil
+	}
+	c := r.entries[i]
+
+	r.entries[i] = nil
+	r.removed++
+	delete(r.byID, id)
+	if c.Port != "" {
+		delete(r.byAddr, address(c.IP, c.Port))
+	}
+	r.snapshot = nil
+
+	// Don't let the holes pile up
+	if r.removed >= compactMin && r.removed > len(r.entries)/2 {
+		r.compact()
+	}
+	return c
+} // }}}
+
+// func r.Get {{{
+
+// Get returns the connection with the given id, if we have it
+func (r *Registry) Get(id uint32) (*client.Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, ok := r.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return r.entries[i], true
+} // }}}
+
+// func r.ByAddr {{{
+
+// ByAddr returns the connection to the given ip and port, if we have it
+func (r *Registry) ByAddr(ip, port string) (*client.Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.byAddr[address(ip, port)]
+	if !ok {
+		return nil, false
+	}
+	return r.entries[r.byID[id]], true
+} // }}}
+
+// func r.Len {{{
+
+// Len returns how many connections we have
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.byID)
+} // }}}
+
+// func r.Snapshot {{{
+
+// Snapshot returns our connections, sorted by id. The slice is shared with
+// everyone else who asks before anything changes, so it must not be modified,
+// but it's never changed underneath the caller either, so they can take as
+// long as they like over it without holding anyone else up.
+func (r *Registry) Snapshot() []*client.Client {
+	r.mu.RLock()
+	snapshot := r.snapshot
+	r.mu.RUnlock()
+	if snapshot != nil {
+		return snapshot
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Someone else may have taken it while we waited for the lock
+	if r.snapshot != nil {
+		return r.snapshot
+	}
+	snapshot = make([]*client.Client, 0, len(r.byID))
+	for _, c := range r.entries {
+		if c != nil {
+			snapshot = append(snapshot, c)
+		}
+	}
+	r.snapshot = snapshot
+	return snapshot
+} // }}}
+
+// func r.compact {{{
+
+// compact Closes up the holes left by removed connections. The caller must
+// hold the lock.
+func (r *Registry) compact() {
+	entries := make([]*client.Client, 0, len(r.byID))
+	for _, c := range r.entries {
+		if c != nil {
+			entries = append(entries, c)
+		}
+	}
+	r.entries = entries
+	r.removed = 0
+	r.reindex(0)
+} // }}}
+
+// func r.reindex {{{
+
+// reindex Updates where the connections from the i'th entry onward are, after
+// they've been moved. The caller must hold the lock.
+func (r *Registry) reindex(i int) {
+	for ; i < len(r.entries); i++ {
+		if c := r.entries[i]; c != nil {
+			r.byID[c.ID] = i
+		}
+	}
+} // }}}
+
+// func r.last {{{
+
+// last returns the id of the last connection in entries, removed or not. The
+// caller must hold the lock.
+func (r *Registry) last() uint32 {
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if c := r.entries[i]; c != nil {
+			return c.ID
+		}
+	}
+	return 0
+} // }}}
+
+// func address {{{
+
+// address returns the key we find connections by address under
+func address(ip, port string) string {
+	return net.JoinHostPort(ip, port)
+} // }}}
@@ -0,0 +1,527 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// The numbers of connections the benchmarks are measured at
+var benchSizes = []int{100, 1000, 10000}
+
+// type store interface {{{
+
+// store is somewhere to keep connections, so the benchmarks can compare the
+// registry with the way connections were stored before it
+type store interface {
+	Add(c *client.Client)
+	Remove(id uint32)
+	Get(id uint32) (*client.Client, bool)
+	ByAddr(ip, port string) (*client.Client, bool)
+	Each(f func(c *client.Client))
+} // }}}
+
+// type registryStore struct {{{
+
+// registryStore keeps connections in a registry
+type registryStore struct {
+	r *Registry
+} // }}}
+
+// type syncMapStore struct {{{
+
+// syncMapStore keeps connections in a sync.Map, with a slice of every id
+// ever added to list them in order, as the server did before the registry
+type syncMapStore struct {
+	conns sync.Map
+	mu    sync.Mutex
+	ids   []uint32
+} // }}}
+
+// The stores the benchmarks are run against
+var stores = []struct {
+	name string
+	new  func() store
+}{
+	{"registry", func() store { return registryStore{New()} }},
+	{"syncmap", func() store { return &syncMapStore{} }},
+}
+
+// func TestAddGetRemove {{{
+
+func TestAddGetRemove(t *testing.T) {
+	r := New()
+	for id := uint32(1); id <= 3; id++ {
+		if err := r.Add(newClient(id)); err != nil {
+			t.Fatalf("Add(%d) failed: %v", id, err)
+		}
+	}
+	if r.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", r.Len())
+	}
+
+	c, ok := r.Get(2)
+	if !ok || c.ID != 2 {
+		t.Fatalf("Get(2) = %v, %v", c, ok)
+	}
+	if c, ok := r.ByAddr(c.IP, c.Port); !ok || c.ID != 2 {
+		t.Fatalf("ByAddr of connection 2 = %v, %v", c, ok)
+	}
+	if _, ok := r.Get(4); ok {
+		t.Errorf("Get(4) found a connection that was never added")
+	}
+
+	if got := r.Remove(2); got == nil || got.ID != 2 {
+		t.Fatalf("Remove(2) = %v", got)
+	}
+	if got := r.Remove(2); got != nil {
+		t.Errorf("removing connection 2 twice returned %v", got)
+	}
+	if _, ok := r.Get(2); ok {
+		t.Errorf("Get(2) found a removed connection")
+	}
+	if _, ok := r.ByAddr(c.IP, c.Port); ok {
+		t.Errorf("ByAddr found a removed connection")
+	}
+	checkOrder(t, r, 1, 3)
+} // }}}
+
+// func TestAddExisting {{{
+
+// Connections are refused if we already have their id or address, unless
+// they have no port, as in-process ones can't be told apart by address
+func TestAddExisting(t *testing.T) {
+	r := New()
+	if err := r.Add(newClient(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(newClient(1)); err != ErrExists {
+		t.Errorf("adding id 1 twice: got %v, want ErrExists", err)
+	}
+
+	same := newClient(2)
+	same.IP, same.Port = newClient(1).IP, newClient(1).Port
+	if err := r.Add(same); err != ErrExists {
+		t.Errorf("adding the address of connection 1 again: got %v, want ErrExists", err)
+	}
+
+	for id := uint32(3); id <= 5; id++ {
+		pipe := client.New(nil, nil, []string{"pipe", ""}, id, events.Inbound, nil)
+		if err := r.Add(pipe); err != nil {
+			t.Errorf("adding in-process connection %d failed: %v", id, err)
+		}
+	}
+	if _, ok := r.ByAddr("pipe", ""); ok {
+		t.Errorf("in-process connections were found by address")
+	}
+
+	// Once removed, an address may be used again
+	r.Remove(1)
+	if err := r.Add(same); err != nil {
+		t.Errorf("re-using the address of a removed connection failed: %v", err)
+	}
+	checkOrder(t, r, 2, 3, 4, 5)
+} // }}}
+
+// func TestOutOfOrder {{{
+
+// Connections that took a while to be established go back where their id
+// puts them, even when there are holes left by removed ones
+func TestOutOfOrder(t *testing.T) {
+	r := New()
+	for _, id := range []uint32{1, 2, 3, 5, 8, 9} {
+		if err := r.Add(newClient(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Remove(2)
+	r.Remove(8)
+
+	for _, id := range []uint32{4, 7, 10, 6} {
+		if err := r.Add(newClient(id)); err != nil {
+			t.Fatalf("Add(%d) failed: %v", id, err)
+		}
+	}
+	checkOrder(t, r, 1, 3, 4, 5, 6, 7, 9, 10)
+
+	// Everything must still be found where it was put
+	for _, id := range []uint32{1, 3, 4, 5, 6, 7, 9, 10} {
+		c, ok := r.Get(id)
+		if !ok || c.ID != id {
+			t.Errorf("Get(%d) = %v, %v", id, c, ok)
+			continue
+		}
+		if c, ok := r.ByAddr(c.IP, c.Port); !ok || c.ID != id {
+			t.Errorf("ByAddr of connection %d = %v, %v", id, c, ok)
+		}
+	}
+
+	// Including at the very start
+	if err := r.Add(newClient(0)); err != nil {
+		t.Fatal(err)
+	}
+	r.Remove(5)
+	checkOrder(t, r, 0, 1, 3, 4, 6, 7, 9, 10)
+} // }}}
+
+// func TestCompaction {{{
+
+// Holes are only closed up once there are at least compactMin of them, and
+// they make up more than half the entries
+func TestCompaction(t *testing.T) {
+	const n = 100
+	r := New()
+	for id := uint32(1); id <= n; id++ {
+		r.Add(newClient(id))
+	}
+
+	id := uint32(1)
+	remove := func(count int) {
+		for i := 0; i < count; i++ {
+			r.Remove(id)
+			id++
+		}
+	}
+
+	// Plenty of holes, but not more than half
+	remove(n / 2)
+	if r.removed != n/2 || len(r.entries) != n {
+		t.Fatalf("after removing %d: removed %d of %d entries, want %d of %d", n/2, r.removed, len(r.entries), n/2, n)
+	}
+
+	// One more tips it over
+	remove(1)
+	if r.removed != 0 || len(r.entries) != n/2-1 {
+		t.Fatalf("after removing %d: removed %d of %d entries, want 0 of %d", n/2+1, r.removed, len(r.entries), n/2-1)
+	}
+	for want := id; want <= n; want++ {
+		if c, ok := r.Get(want); !ok || c.ID != want {
+			t.Fatalf("after compacting, Get(%d) = %v, %v", want, c, ok)
+		}
+	}
+
+	// With only a few entries, more than half of them being removed
+	// isn't worth compacting until there are compactMin
+	small := New()
+	for id := uint32(1); id <= compactMin; id++ {
+		small.Add(newClient(id))
+	}
+	for id := uint32(1); id < compactMin; id++ {
+		small.Remove(id)
+	}
+	if small.removed != compactMin-1 {
+		t.Errorf("compacted %d entries with only %d removed", compactMin, compactMin-1)
+	}
+	small.Remove(compactMin)
+	if small.removed != 0 || len(small.entries) != 0 {
+		t.Errorf("removing everything left %d removed of %d entries", small.removed, len(small.entries))
+	}
+} // }}}
+
+// func TestSnapshot {{{
+
+// Snapshots are shared until something changes, and never change underneath
+// whoever has one
+func TestSnapshot(t *testing.T) {
+	r := New()
+	for id := uint32(1); id <= 3; id++ {
+		r.Add(newClient(id))
+	}
+
+	first := r.Snapshot()
+	if again := r.Snapshot(); &again[0] != &first[0] {
+		t.Errorf("Snapshot made a new copy when nothing had changed")
+	}
+
+	// Failing to change anything doesn't count as a change
+	r.Add(newClient(2))
+	r.Remove(42)
+	if again := r.Snapshot(); &again[0] != &first[0] {
+		t.Errorf("Snapshot made a new copy after nothing was changed")
+	}
+
+	r.Add(newClient(4))
+	added := r.Snapshot()
+	if len(added) != 4 || &added[0] == &first[0] {
+		t.Errorf("Snapshot after Add has %d connections, sharing the old one: %v", len(added), &added[0] == &first[0])
+	}
+
+	r.Remove(1)
+	removed := r.Snapshot()
+	if len(removed) != 3 || removed[0].ID != 2 {
+		t.Errorf("Snapshot after Remove = %v", ids(removed))
+	}
+
+	// The older snapshots are just as they were
+	if got := ids(first); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("first snapshot changed to %v", got)
+	}
+	if got := ids(added); fmt.Sprint(got) != "[1 2 3 4]" {
+		t.Errorf("second snapshot changed to %v", got)
+	}
+} // }}}
+
+// func TestConcurrent {{{
+
+// Everything can be used at once, for the race detector to check
+func TestConcurrent(t *testing.T) {
+	r := New()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := uint32(w*1000 + i + 1)
+				r.Add(newClient(id))
+				r.Get(id)
+				r.Snapshot()
+				if i%2 == 0 {
+					r.Remove(id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.Len() != 400 {
+		t.Errorf("Len() = %d, want 400", r.Len())
+	}
+	snapshot := r.Snapshot()
+	for i := 1; i < len(snapshot); i++ {
+		if snapshot[i-1].ID >= snapshot[i].ID {
+			t.Fatalf("snapshot out of order at %d: %d then %d", i, snapshot[i-1].ID, snapshot[i].ID)
+		}
+	}
+} // }}}
+
+// func BenchmarkGet {{{
+
+// BenchmarkGet Measures finding a connection by id
+func BenchmarkGet(b *testing.B) {
+	benchStores(b, func(b *testing.B, st store, conns []*client.Client) {
+		n := len(conns)
+		for i := 0; i < b.N; i++ {
+			if _, ok := st.Get(uint32(i%n) + 1); !ok {
+				b.Fatal("connection not found")
+			}
+		}
+	})
+} // }}}
+
+// func BenchmarkByAddr {{{
+
+// BenchmarkByAddr Measures finding a connection by address
+func BenchmarkByAddr(b *testing.B) {
+	benchStores(b, func(b *testing.B, st store, conns []*client.Client) {
+		for i := 0; i < b.N; i++ {
+			c := conns[i%len(conns)]
+			if _, ok := st.ByAddr(c.IP, c.Port); !ok {
+				b.Fatal("connection not found")
+			}
+		}
+	})
+} // }}}
+
+// func BenchmarkList {{{
+
+// BenchmarkList Measures going over every connection in order, as List does
+func BenchmarkList(b *testing.B) {
+	benchStores(b, func(b *testing.B, st store, conns []*client.Client) {
+		for i := 0; i < b.N; i++ {
+			count := 0
+			st.Each(func(*client.Client) { count++ })
+			if count != len(conns) {
+				b.Fatalf("listed %d connections, expected %d", count, len(conns))
+			}
+		}
+	})
+} // }}}
+
+// func BenchmarkChurn {{{
+
+// BenchmarkChurn Measures replacing the oldest connection with a new one
+func BenchmarkChurn(b *testing.B) {
+	benchStores(b, func(b *testing.B, st store, conns []*client.Client) {
+		n := len(conns)
+		for i := 0; i < b.N; i++ {
+			st.Remove(uint32(i) + 1)
+			st.Add(newClient(uint32(n + i + 1)))
+		}
+	})
+} // }}}
+
+// func BenchmarkChurnList {{{
+
+// BenchmarkChurnList Measures replacing the oldest connection with a new one,
+// and then listing them, as a frontend showing the connections does
+func BenchmarkChurnList(b *testing.B) {
+	benchStores(b, func(b *testing.B, st store, conns []*client.Client) {
+		n := len(conns)
+		for i := 0; i < b.N; i++ {
+			st.Remove(uint32(i) + 1)
+			st.Add(newClient(uint32(n + i + 1)))
+			st.Each(func(*client.Client) {})
+		}
+	})
+} // }}}
+
+// func benchStores {{{
+
+// benchStores Runs bench against each store, holding each of the numbers of
+// connections we measure at, i.e. as BenchmarkGet/registry/conns=1000
+func benchStores(b *testing.B, bench func(b *testing.B, st store, conns []*client.Client)) {
+	for _, st := range stores {
+		st := st
+		b.Run(st.name, func(b *testing.B) {
+			for _, n := range benchSizes {
+				n := n
+				b.Run("conns="+strconv.Itoa(n), func(b *testing.B) {
+					s, conns := fill(st.new, n)
+					b.ReportAllocs()
+					b.ResetTimer()
+					bench(b, s, conns)
+				})
+			}
+		})
+	}
+} // }}}
+
+// func checkOrder {{{
+
+// checkOrder Fails the test unless the registry holds exactly the given ids,
+// in order
+func checkOrder(t *testing.T, r *Registry, want ...uint32) {
+	t.Helper()
+	got := ids(r.Snapshot())
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Snapshot() = %v, want %v", got, want)
+	}
+	if r.Len() != len(want) {
+		t.Errorf("Len() = %d, want %d", r.Len(), len(want))
+	}
+} // }}}
+
+// func ids {{{
+
+// ids returns the ids of the connections, in the order given
+func ids(conns []*client.Client) []uint32 {
+	out := make([]uint32, len(conns))
+	for i, c := range conns {
+		out[i] = c.ID
+	}
+	return out
+} // }}}
+
+// func fill {{{
+
+// fill returns a new store holding n connections, with ids 1 to n, along with
+// the connections themselves
+func fill(newStore func() store, n int) (store, []*client.Client) {
+	st := newStore()
+	conns := make([]*client.Client, n)
+	for i := range conns {
+		conns[i] = newClient(uint32(i + 1))
+		st.Add(conns[i])
+	}
+	return st, conns
+} // }}}
+
+// func newClient {{{
+
+// newClient returns a connection with the given id, and an address of its own
+func newClient(id uint32) *client.Client {
+	addr := []string{"10.0." + strconv.Itoa(int(id>>8&0xff)) + "." + strconv.Itoa(int(id&0xff)), strconv.Itoa(int(1024 + id>>16))}
+	return client.New(nil, nil, addr, id, events.Inbound, nil)
+} // }}}
+
+// func rs.Add {{{
+
+func (rs registryStore) Add(c *client.Client) {
+	rs.r.Add(c)
+} // }}}
+
+// func rs.Remove {{{
+
+func (rs registryStore) Remove(id uint32) {
+	rs.r.Remove(id)
+} // }}}
+
+// func rs.Get {{{
+
+func (rs registryStore) Get(id uint32) (*client.Client, bool) {
+	return rs.r.Get(id)
+} // }}}
+
+// func rs.ByAddr {{{
+
+func (rs registryStore) ByAddr(ip, port string) (*client.Client, bool) {
+	return rs.r.ByAddr(ip, port)
+} // }}}
+
+// func rs.Each {{{
+
+func (rs registryStore) Each(f func(c *client.Client)) {
+	for _, c := range rs.r.Snapshot() {
+		f(c)
+	}
+} // }}}
+
+// func ss.Add {{{
+
+func (ss *syncMapStore) Add(c *client.Client) {
+	ss.conns.Store(c.ID, c)
+	ss.mu.Lock()
+	ss.ids = append(ss.ids, c.ID)
+	ss.mu.Unlock()
+} // }}}
+
+// func ss.Remove {{{
+
+func (ss *syncMapStore) Remove(id uint32) {
+	ss.conns.Delete(id)
+} // }}}
+
+// func ss.Get {{{
+
+func (ss *syncMapStore) Get(id uint32) (*client.Client, bool) {
+	v, ok := ss.conns.Load(id)
+	if !ok {
+		return nil, false
+	}
+	c, ok := v.(*client.Client)
+	return c, ok
+} // }}}
+
+// func ss.ByAddr {{{
+
+func (ss *syncMapStore) ByAddr(ip, port string) (*client.Client, bool) {
+	var found *client.Client
+	ss.conns.Range(func(_, v interface{}) bool {
+		c, ok := v.(*client.Client)
+		if ok && c.IP == ip && c.Port == port {
+			found = c
+			return false
+		}
+		return true
+	})
+	return found, found != nil
+} // }}}
+
+// func ss.Each {{{
+
+func (ss *syncMapStore) Each(f func(c *client.Client)) {
+	ss.mu.Lock()
+	ids := ss.ids
+	ss.mu.Unlock()
+
+	for _, id := range ids {
+		if c, ok := ss.Get(id); ok {
+			f(c)
+		}
+	}
+} // }}}
@@ -0,0 +1,42 @@
+// Package registry keeps track of the connections we have established, in
+// order, so they can be found quickly by id or by address, and listed without
+// holding anyone up
+package registry
+
+import (
+	"errors"
+	"github.com/Cryliss/chat/client"
+	"sync"
+)
+
+// Once a registry has at least this many removed entries, and they make up
+// more than half of it, the entries are compacted
+const compactMin = 32
+
+// Errors returned by Add
+var (
+	ErrExists = errors.New("registry: connection already exists")
+)
+
+// type Registry struct {{{
+
+// Registry holds our established connections. It's safe to use from any
+// number of goroutines.
+type Registry struct {
+	// Locks everything below
+	mu sync.RWMutex
+
+	// Our connections, sorted by id. Removed connections leave a nil
+	// behind, until there are enough of them to be worth compacting.
+	entries []*client.Client
+	removed int
+
+	// Where each connection is in entries, by id, and each connections id
+	// by its address, as "ip:port"
+	byID   map[uint32]int
+	byAddr map[string]uint32
+
+	// The connections as of the last change, handed out by Snapshot. Nil
+	// once anything has changed, until someone asks for it again.
+	snapshot []*client.Client
+} // }}}
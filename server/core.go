@@ -2,28 +2,61 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/Cryliss/chat/capture"
 	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/grapheme"
+	"github.com/Cryliss/chat/inbox"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/metrics"
+	"github.com/Cryliss/chat/netsim"
+	"github.com/Cryliss/chat/proto"
+	"github.com/Cryliss/chat/registry"
 	"github.com/Cryliss/chat/types"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // func New {{{
 
-// New initializes and returns a new Server.
-func New(ip string, port int) *Server {
+// New initializes and returns a new Server, which publishes everything
+// it does on the given event bus.
+func New(ip string, port int, bus *events.Bus) *Server {
 	var s Server
 	var err error
-	var ids []uint32
 
-	// Set our ids variable for the server
-	s.ids = ids
+	// Keep track of our connections
+	s.conns = registry.New()
+
+	// Set our event bus
+	s.bus = bus
+
+	// The longest message we'll accept, unless told otherwise
+	s.maxMessage = DefaultMaxMessage
+	s.dials = make(map[uint32]*dial)
+	s.dialTimeout = DefaultDialTimeout
+	s.awaiting = make(map[uint32]*approval)
+	s.approvalTimeout = DefaultApprovalTimeout
+	s.queueSize = client.DefaultQueueSize
+	s.writeTimeout = client.DefaultWriteTimeout
+
+	// Start counting
+	s.metrics = metrics.New()
+
+	// Keep hold of the messages peers send us until they've been read.
+	// We subscribe before any frontend can, so the unread counts are up
+	// to date by the time they hear about a message.
+	s.inbox = inbox.New()
+	bus.Subscribe(s.inbox.HandleEvent)
 
 	// Set our server TCP Address
 	s.bindy = net.TCPAddr{
@@ -37,25 +70,55 @@ func New(ip string, port int) *Server {
 		os.Exit(-1)
 	}
 
+	// We may have asked for any free port, so remember which we got
+	s.bindy.Port = s.listener.Addr().(*net.TCPAddr).Port
+
 	// Return the new server
 	return &s
 } // }}}
 
-// func s.SetApplication {{{
-
-// SetApplication sets the application of the server, since we make the server
-// prior to making the application
-func (s *Server) SetApplication(app types.Application) {
-	s.app = app
-} // }}}
-
 // func s.Listen {{{
 
 // Listen uses the servers listener to continuously accept incoming TCP connections
 func (s *Server) Listen() {
+	s.accept(s.listener, s.handleInbound)
+} // }}}
+
+// func s.Port {{{
+
+// Port returns the port we accept connections on
+func (s *Server) Port() int {
+	return s.bindy.Port
+} // }}}
+
+// func s.ListenRaw {{{
+
+// ListenRaw Starts accepting connections on the given port from peers that
+// don't speak our protocol, i.e. someone debugging with netcat. Each line
+// they send is a message, and each message we send them ends in a newline.
+func (s *Server) ListenRaw(port int) error {
+	addr := net.TCPAddr{IP: s.bindy.IP, Port: port}
+	l, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("s.ListenRaw: %w", err)
+	}
+
+	s.mu.Lock()
+	s.rawListener = l
+	s.mu.Unlock()
+
+	go s.accept(l, s.handleRaw)
+	return nil
+} // }}}
+
+// func s.accept {{{
+
+// accept Continuously accepts connections on l, handing each to handle in a
+// new goroutine, until l is closed
+func (s *Server) accept(l *net.TCPListener, handle func(conn *net.TCPConn)) {
 	var errs int
 	for {
-		conn, err := s.listener.AcceptTCP()
+		conn, err := l.AcceptTCP()
 
 		// Any kind of error?
 		if err != nil {
@@ -64,11 +127,17 @@ func (s *Server) Listen() {
 				// This basically means we are shutting down, so not a real "error".
 				return
 			}
+			s.metrics.AcceptErrors.Inc()
+			s.log.Warn("accept failed", "listener", l.Addr(), "err", err)
 
 			// We don't know what this error is, but its not a closed socket?
 			//
-			// Log it and attempt to continue.
-			s.app.OutErr("AcceptTCP(%s): %s\nPlease enter a command: ", s.listener.Addr(), err)
+			// Publish it and attempt to continue.
+			s.bus.Publish(events.Event{
+				Kind:   events.AcceptError,
+				Reason: fmt.Sprintf("AcceptTCP(%s)", l.Addr()),
+				Err:    err,
+			})
 
 			// Increase the error count, since we do not specifically
 			// handle this error, we are unsure if its safe to continue
@@ -80,73 +149,453 @@ func (s *Server) Listen() {
 			//
 			// The error count is reset when we get a new connection.
 			if errs > 5 {
-				s.app.OutErr("Too many accept errors, unable to accept any new connections\nPlease enter a command: ")
+				s.log.Error("listener stopped after too many accept errors", "listener", l.Addr())
+				s.bus.Publish(events.Event{
+					Kind:   events.ListenerStopped,
+					Reason: "too many accept errors, unable to accept any new connections",
+				})
 
 				s.mu.Lock()
-				s.listener.Close()
+				l.Close()
 				s.mu.Unlock()
 
 				return
 			}
+
+			// There's no connection to handle, so go back to accepting
+			continue
 		}
 
 		// We have a new connection with no errors, so reset the error counter if needed.
 		errs = 0
+		s.metrics.Accepts.Inc()
 
-		// Let's get the connections address
-		remoteAddr := conn.RemoteAddr()
-		connAddr := strings.Split(remoteAddr.String(), ":")
+		// Handle the connection in a new goroutine.
+		//
+		// The loop then returns to accepting, so that
+		// multiple connections may be served concurrently, and
+		// a peer that's slow to say hello can't hold up the rest.
+		go handle(conn)
+	}
+} // }}}
 
-		// Before we make a new Client and it to our sync map, let's see if this
-		// connection already exists for whatever reason
-		if s.checkExisting(connAddr[0], connAddr[1]) {
-			s.app.OutErr("s.Listen: refusing connection from %s:%s! connection already exists!\nPlease enter a command: ", connAddr[0], connAddr[1])
-			continue
-		}
+// func s.handleInbound {{{
 
-		// Lets get the id for our new connection, using atmoics!
-		id := atomic.AddUint32(&s.nextID, 1)
+// handleInbound Sets up a connection we've just accepted, and serves it
+// until it's closed
+func (s *Server) handleInbound(conn *net.TCPConn) {
+	// Let's get the connections address
+	remoteAddr := conn.RemoteAddr()
+	connAddr := strings.Split(remoteAddr.String(), ":")
 
-		// Createa a new client
-		c := client.New(conn, connAddr, id, s.app)
+	// Lets us tell everyone why we aren't keeping the connection
+	refuse := func(reason string, err error) {
+		s.log.Info("refused connection", "ip", connAddr[0], "port", connAddr[1], "reason", reason, "err", err)
+		s.bus.Publish(events.Event{
+			Kind:   events.ConnectionRefused,
+			IP:     connAddr[0],
+			Port:   connAddr[1],
+			Reason: reason,
+			Err:    err,
+		})
+		conn.Close()
+	}
 
-		// Add the new client to our sync map
-		s.conns.Store(c.ID, c)
+	// Before we make a new Client and it to our sync map, let's see if this
+	// connection already exists for whatever reason
+	if s.checkExisting(connAddr[0], connAddr[1]) {
+		s.metrics.RejectedDuplicates.Inc()
+		refuse("connection already exists", nil)
+		return
+	}
 
-		// Add the new ID to our ids array -- this is only used so
-		// we can get a sorted list of connections when List() is called
-		s.mu.Lock()
-		s.ids = append(s.ids, c.ID)
-		s.mu.Unlock()
+	// Lets get the id for our new connection, using atmoics!
+	id := atomic.AddUint32(&s.nextID, 1)
 
-		// Inform the user of the new connection
-		s.app.Out("\nNew incoming connection: %v | %v:%v\n\nPlease enter a command: ", c.ID, c.IP, c.Port)
+	// Createa a new client, and make sure it speaks our protocol
+	c := client.New(s.simulate(conn), nil, connAddr, id, events.Inbound, s.bus)
+	s.instrument(c)
+	start := time.Now()
+	if err := c.Handshake(s.hello(), handshakeTimeout); err != nil {
+		refuse("handshake failed", err)
+		return
+	}
+	s.metrics.HandshakeSeconds.ObserveDuration(time.Since(start))
+	s.log.Debug("handshake complete", "conn", id, "version", c.Version, "max_message", c.MaxMessage, "name", c.Name, "fingerprint", c.Fingerprint, "took", time.Since(start))
 
-		// Handle the connection in a new goroutine.
-		//
-		// The loop then returns to accepting, so that
-		// multiple connections may be served concurrently.
-		go func() {
-			// Ensure we close our connection and remove it from the sync
-			// map once HandleClient returns
-			defer func() {
-				// The only time we should return is when the connection
-				// is closed, or some otherwise unrecoverable error.
-				//
-				// So we remove ourself from the connect list
-				// automatically when we return here.
-				s.conns.Delete(c.ID)
-
-				// We also (just in case), call Close() on the connection
-				// again,  as this will handle any other errors that don't
-				// end up closing the connection properly.
-				//
-				// Note this is safe to call on an already closed connection.
-				c.Conn.Close()
-			}()
-			c.HandleClient()
+	// Does the user want to decide whether to keep it first?
+	s.mu.Lock()
+	ask := s.askFirst
+	s.mu.Unlock()
+	if ask {
+		s.hold(c)
+		return
+	}
+
+	s.serve(c)
+} // }}}
+
+// func s.hold {{{
+
+// hold Keeps a peer that connected to us waiting until the user accepts or
+// rejects it, or nobody has in time. Nothing is read from the connection in
+// the meantime, so anything the peer sends waits for us to accept it.
+func (s *Server) hold(c *client.Client) {
+	s.mu.Lock()
+	timeout := s.approvalTimeout
+	s.awaiting[c.ID] = &approval{
+		c: c,
+		timer: time.AfterFunc(timeout, func() {
+			s.refuseHeld(c.ID, proto.GoodbyeRejected, fmt.Sprintf("nobody accepted it within %s", timeout))
+		}),
+	}
+	s.mu.Unlock()
+
+	s.log.Info("connection awaiting approval", "conn", c.ID, "ip", c.IP, "port", c.Port, "name", c.Name, "fingerprint", c.Fingerprint)
+	s.bus.Publish(events.Event{
+		Kind:        events.ConnectionPending,
+		ConnID:      c.ID,
+		IP:          c.IP,
+		Port:        c.Port,
+		Direction:   c.Direction,
+		Name:        c.Name,
+		Fingerprint: c.Fingerprint,
+	})
+} // }}}
+
+// func s.Approve {{{
+
+// Approve Lets a peer that's waiting to be accepted start chatting
+func (s *Server) Approve(id int) error {
+	a := s.takeHeld(uint32(id))
+	if a == nil {
+		return fmt.Errorf("s.Approve: %d is not a connection waiting to be accepted! Use list to see which ones are", id)
+	}
+
+	s.log.Info("connection accepted", "conn", id)
+	a.c.Approved = true
+	s.serve(a.c)
+	return nil
+} // }}}
+
+// func s.Reject {{{
+
+// Reject Closes the connection of a peer that's waiting to be accepted,
+// letting everyone know why
+func (s *Server) Reject(id int, reason string) error {
+	if !s.refuseHeld(uint32(id), proto.GoodbyeRejected, reason) {
+		return fmt.Errorf("s.Reject: %d is not a connection waiting to be accepted! Use list to see which ones are", id)
+	}
+	return nil
+} // }}}
+
+// func s.Awaiting {{{
+
+// Awaiting returns the peers waiting to be accepted, sorted by id
+func (s *Server) Awaiting() []types.Peer {
+	s.mu.Lock()
+	peers := make([]types.Peer, 0, len(s.awaiting))
+	for _, a := range s.awaiting {
+		peers = append(peers, types.Peer{
+			ID:          a.c.ID,
+			IP:          a.c.IP,
+			Port:        a.c.Port,
+			Transport:   a.c.Transport,
+			Name:        a.c.Name,
+			Fingerprint: a.c.Fingerprint,
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+} // }}}
+
+// func s.refuseHeld {{{
+
+// refuseHeld Closes the connection of a peer waiting to be accepted, saying
+// goodbye with the given code and text, and lets everyone know why. Returns
+// false if it wasn't waiting, i.e. the user has already answered.
+func (s *Server) refuseHeld(id uint32, code proto.GoodbyeCode, text string) bool {
+	a := s.takeHeld(id)
+	if a == nil {
+		return false
+	}
+
+	a.c.Goodbye(code, text)
+	a.c.Conn.Close()
+
+	reason := text
+	switch {
+	case reason != "":
+	case code == proto.GoodbyeShutdown:
+		reason = "shutting down"
+	default:
+		reason = "rejected by the user"
+	}
+	s.log.Info("refused connection", "conn", id, "ip", a.c.IP, "port", a.c.Port, "reason", reason)
+	s.bus.Publish(events.Event{
+		Kind:   events.ConnectionRefused,
+		ConnID: id,
+		IP:     a.c.IP,
+		Port:   a.c.Port,
+		Reason: reason,
+	})
+	return true
+} // }}}
+
+// func s.takeHeld {{{
+
+// takeHeld Removes a peer from those waiting to be accepted, returning nil if
+// it wasn't waiting. Whoever takes it decides what becomes of it.
+func (s *Server) takeHeld(id uint32) *approval {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.awaiting[id]
+	if !ok {
+		return nil
+	}
+	delete(s.awaiting, id)
+	a.timer.Stop()
+	return a
+} // }}}
+
+// func s.handleRaw {{{
+
+// handleRaw Sets up a plain text connection we've just accepted, and serves
+// it until it's closed. There's no handshake, as it doesn't speak our protocol.
+func (s *Server) handleRaw(tcp *net.TCPConn) {
+	conn := s.simulate(tcp)
+	s.Attach(conn, proto.NewLineCodec(conn), "raw", events.Inbound)
+} // }}}
+
+// func s.serve {{{
+
+// serve Adds a client whose handshake is complete to our connections, and
+// handles it in a new goroutine until it's closed
+func (s *Server) serve(c *client.Client) {
+	// Once the connection is closed, we remove it from the registry
+	// before the rest of the program hears about it
+	peer := strconv.FormatUint(uint64(c.ID), 10)
+	c.OnClose(func() {
+		s.conns.Remove(c.ID)
+		s.metrics.Connections.Dec()
+		s.metrics.Forget(peer)
+	})
+	c.Metrics = s.metrics
+	s.capture.Open(c.ID, c.IP, c.Port, c.Transport, string(c.Direction), c.MaxMessage)
+
+	// Messages are written by their own goroutine, so a slow peer can't
+	// hold up whoever is sending to it
+	s.mu.Lock()
+	c.QueueSize = s.queueSize
+	c.Overflow = s.overflow
+	c.WriteTimeout = s.writeTimeout
+	s.mu.Unlock()
+	c.StartWriter()
+
+	// Add the new client to the registry, unless the same peer beat it
+	// there, in which case nobody has heard of it yet and nobody needs to
+	if err := s.conns.Add(c); err != nil {
+		c.Goodbye(proto.GoodbyeRejected, "already connected")
+		c.Conn.Close()
+		s.capture.Close(c.ID, true)
+		s.metrics.RejectedDuplicates.Inc()
+		s.log.Info("refused connection", "conn", c.ID, "ip", c.IP, "port", c.Port, "reason", "connection already exists")
+		s.bus.Publish(events.Event{
+			Kind:   events.ConnectionRefused,
+			ConnID: c.ID,
+			IP:     c.IP,
+			Port:   c.Port,
+			Reason: "connection already exists",
+		})
+		return
+	}
+	s.metrics.Connections.Inc()
+
+	// Inform everyone of the new connection
+	s.log.Info("connection established", "conn", c.ID, "ip", c.IP, "port", c.Port, "direction", c.Direction, "transport", c.Transport)
+	s.publishConnected(c)
+
+	go func() {
+		// Ensure we close our connection and remove it from the
+		// registry once HandleClient returns
+		defer func() {
+			// The only time we should return is when the connection
+			// is closed, or some otherwise unrecoverable error.
+			//
+			// So we remove ourself from the connect list
+			// automatically when we return here.
+			s.conns.Remove(c.ID)
+
+			// We also (just in case), call Close() on the connection
+			// again,  as this will handle any other errors that don't
+			// end up closing the connection properly.
+			//
+			// Note this is safe to call on an already closed connection.
+			c.Conn.Close()
 		}()
+		c.HandleClient()
+	}()
+} // }}}
+
+// func s.Attach {{{
+
+// Attach Adds a connection that didn't come from our own listener or dialer,
+// i.e. a browser on the websocket gateway, and serves it like any other. The
+// codec reads and writes its messages, so no handshake takes place and the
+// connection gets our own message length limit. transport describes the kind
+// of connection for the connection list. Returns the new connections id.
+func (s *Server) Attach(conn net.Conn, codec client.Codec, transport string, dir events.Direction) uint32 {
+	// Let's get the connections address
+	connAddr := strings.Split(conn.RemoteAddr().String(), ":")
+	if len(connAddr) < 2 {
+		connAddr = append(connAddr, "")
+	}
+
+	// Lets get the id for our new connection
+	id := atomic.AddUint32(&s.nextID, 1)
+
+	c := client.New(conn, codec, connAddr, id, dir, s.bus)
+	s.instrument(c)
+	c.Transport = transport
+	c.MaxMessage = s.hello().MaxMessage
+
+	s.serve(c)
+	return id
+} // }}}
+
+// func s.hello {{{
+
+// hello returns what we tell peers about ourselves when connecting
+func (s *Server) hello() proto.Hello {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return proto.Hello{
+		Version:    proto.Version,
+		MaxMessage: s.maxMessage,
+		Name:       s.name,
+		Key:        s.key,
+	}
+} // }}}
+
+// func s.SetLogging {{{
+
+// SetLogging Sets where we, and our clients, log diagnostics to. Clients that
+// are already connected keep logging wherever they were.
+func (s *Server) SetLogging(root *logging.Root) {
+	s.log = root.Logger(logging.Server)
+	s.clientLog = root.Logger(logging.Client)
+} // }}}
+
+// func s.SetCapture {{{
+
+// SetCapture Starts recording every frame read from, or written to, new
+// connections. Connections that are already established aren't captured.
+func (s *Server) SetCapture(w *capture.Writer) {
+	s.capture = w
+} // }}}
+
+// func s.instrument {{{
+
+// instrument Tells a new client where to log and capture to
+func (s *Server) instrument(c *client.Client) {
+	c.Log = s.clientLog
+	c.Capture = s.capture
+} // }}}
+
+// func s.SetMaxMessage {{{
+
+// SetMaxMessage Sets the longest message, in user-perceived characters, we're
+// willing to accept. Peers agree on the shorter of their two limits when they
+// connect, so this only affects new connections.
+func (s *Server) SetMaxMessage(n int) {
+	s.mu.Lock()
+	s.maxMessage = n
+	s.mu.Unlock()
+} // }}}
+
+// func s.SetSendQueue {{{
+
+// SetSendQueue Sets how many messages may wait to be written to each peer, and
+// what we do with a new message when there are already that many. Only
+// affects new connections.
+func (s *Server) SetSendQueue(size int, overflow client.OverflowPolicy) {
+	s.mu.Lock()
+	s.queueSize = size
+	s.overflow = overflow
+	s.mu.Unlock()
+} // }}}
+
+// func s.SetWriteTimeout {{{
+
+// SetWriteTimeout Sets how long we give a single write to a peer before we
+// give up on it and close the connection. Zero waits forever. Only affects
+// new connections.
+func (s *Server) SetWriteTimeout(d time.Duration) {
+	s.mu.Lock()
+	s.writeTimeout = d
+	s.mu.Unlock()
+} // }}}
+
+// func s.SetApproval {{{
+
+// SetApproval Sets whether peers that connect to us must be accepted by the
+// user before they can chat, and how long they wait for that before we give
+// up on them
+func (s *Server) SetApproval(ask bool, timeout time.Duration) {
+	s.mu.Lock()
+	s.askFirst = ask
+	s.approvalTimeout = timeout
+	s.mu.Unlock()
+} // }}}
+
+// func s.SetIdentity {{{
+
+// SetIdentity Sets what we announce about ourselves to peers, a name and a key
+// they can recognise us by again. See proto.Hello.
+func (s *Server) SetIdentity(name, key string) {
+	s.mu.Lock()
+	s.name = name
+	s.key = key
+	s.mu.Unlock()
+} // }}}
+
+// func s.SetDialTimeout {{{
+
+// SetDialTimeout Sets how long we wait for a peer we dial to answer
+func (s *Server) SetDialTimeout(d time.Duration) {
+	s.mu.Lock()
+	s.dialTimeout = d
+	s.mu.Unlock()
+} // }}}
+
+// func s.SetNetwork {{{
+
+// SetNetwork Runs the connections we accept or dial from now on through a
+// simulated network, whose conditions can be changed as we go, to see how we
+// cope with a bad one. Our end of each link is named after our own address,
+// and the other after the peers, i.e. "10.0.0.2:4545".
+func (s *Server) SetNetwork(n *netsim.Network) {
+	s.mu.Lock()
+	s.network = n
+	s.mu.Unlock()
+} // }}}
+
+// func s.simulate {{{
+
+// simulate returns conn run through our simulated network, if we have one
+func (s *Server) simulate(conn net.Conn) net.Conn {
+	s.mu.Lock()
+	n := s.network
+	s.mu.Unlock()
+	if n == nil {
+		return conn
 	}
+	return n.Wrap(s.bindy.String(), conn.RemoteAddr().String(), conn)
 } // }}}
 
 // func s.checkExisting {{{
@@ -154,171 +603,317 @@ func (s *Server) Listen() {
 // checkExisting checks if the the connection attempting to be establed
 // already exists or not
 func (s *Server) checkExisting(ip, port string) bool {
-	found := false
-
-	// Range over our connections sync map so we can check
-	// the conns ip and port values
-	//
-	// This provides us with a k, v pair that are interfaces
-	// so we need to type assert our value to *client.Client,
-	// it's actual data type.
-	s.conns.Range(func(_, v interface{}) bool {
-		// Type assert the loaded value to the correct type
-		c, ok := v.(*client.Client)
-		if !ok {
-			s.app.OutErr("s.checkExisting: error asserting client type\nPlease enter a command: ")
-			return false
-		}
-
-		// Are the IP and port the same as the ones provided?
-		if c.IP == ip && c.Port == port {
-			found = true
-			return found
-		}
-		return found
-	})
+	_, found := s.conns.ByAddr(ip, port)
 	return found
 } // }}}
 
 // func s.Connect {{{
 
-// Connect attempts to establish a new connection, returning an error should
-// anything go wrong
-func (s *Server) Connect(destination, port string) error {
+// Connect Starts establishing a new connection to the given destination and
+// port in the background, returning a Dial the caller can wait on or cancel.
+// Anything wrong with the destination itself is returned straight away, while
+// failing to reach the peer is published as DialFailed. Cancelling ctx gives
+// up on the connection, if it isn't established yet.
+func (s *Server) Connect(ctx context.Context, destination, port string) (types.Dial, error) {
 	connErr := errors.New("s.Connect: connection already exists")
+	dialErr := errors.New("s.Connect: already connecting to that peer")
 	selfErr := errors.New("s.Connect: self connections not allowed")
 
 	invIP := fmt.Sprintf("s.Connect: invalid ip given! %s:%s", destination, port)
 	invIPErr := errors.New(invIP)
 
-	invPort := fmt.Sprintf("s.Connect: invalid port given! Dial request timed out %s:%s", destination, port)
-	invPortErr := errors.New(invPort)
-
 	// Does this connection already exist?
 	if s.checkExisting(destination, port) {
-		return connErr
+		s.metrics.RejectedDuplicates.Inc()
+		return nil, connErr
 	}
 
 	// Are we trying to establish a connnection on our own port?
 	p, _ := strconv.ParseInt(port, 10, 64)
 	if s.bindy.Port == int(p) {
-		return selfErr
+		return nil, selfErr
 	}
 
 	// Were we given an invalid IP address?
 	ip := net.ParseIP(destination)
 	if ip == nil {
-		return invIPErr
+		return nil, invIPErr
 	}
 
-	// Create a new net Dialer and set the timeout to be 10 seconds
-	// Timeout is max time allowed to wait for a dial to connect
-	// (was 20s but that felt painfully slow)
-	//
+	// Lets get the id for our new connection, which the user can
+	// cancel it by until it's established
+	id := atomic.AddUint32(&s.nextID, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	d := &dial{
+		id:     id,
+		ip:     destination,
+		port:   port,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// Are we already dialing it?
+	s.mu.Lock()
+	for _, other := range s.dials {
+		if other.ip == destination && other.port == port {
+			s.mu.Unlock()
+			cancel()
+			return nil, dialErr
+		}
+	}
+	s.dials[id] = d
+	timeout := s.dialTimeout
+	s.mu.Unlock()
+
+	s.bus.Publish(events.Event{
+		Kind:      events.Dialing,
+		ConnID:    id,
+		IP:        destination,
+		Port:      port,
+		Direction: events.Outbound,
+	})
+
+	go s.dial(ctx, d, timeout)
+	return d, nil
+} // }}}
+
+// func s.dial {{{
+
+// dial Establishes a connection started by Connect, and lets everyone know
+// how it went
+func (s *Server) dial(ctx context.Context, d *dial, timeout time.Duration) {
+	c, err := s.establish(ctx, d, timeout)
+
+	// Whichever way it went, we're no longer dialing
+	s.mu.Lock()
+	delete(s.dials, d.id)
+	s.mu.Unlock()
+
+	if err != nil {
+		d.finish(err)
+		s.bus.Publish(events.Event{
+			Kind:      events.DialFailed,
+			ConnID:    d.id,
+			IP:        d.ip,
+			Port:      d.port,
+			Direction: events.Outbound,
+			Err:       err,
+		})
+		return
+	}
+
+	s.serve(c)
+	d.finish(nil)
+} // }}}
+
+// func s.establish {{{
+
+// establish Dials the peer and completes the handshake, giving up if ctx is
+// cancelled along the way
+func (s *Server) establish(ctx context.Context, d *dial, timeout time.Duration) (*client.Client, error) {
 	// We're using a timeout so we don't completely break the program
 	// if we never get a new connection cos the user didn't give us a
 	// valid IP
-	timeout, _ := time.ParseDuration("10s")
 	dialer := net.Dialer{Timeout: timeout}
 
 	// Dial the connection adddress to establish connection.
-	tcpAddr := net.JoinHostPort(destination, port)
-	conn, err := dialer.Dial("tcp", tcpAddr)
+	tcpAddr := net.JoinHostPort(d.ip, d.port)
+	s.log.Debug("dialing", "conn", d.id, "addr", tcpAddr)
+	conn, err := dialer.DialContext(ctx, "tcp", tcpAddr)
 	if err != nil {
+		if ctx.Err() != nil {
+			s.log.Info("dial cancelled", "conn", d.id, "addr", tcpAddr)
+			return nil, fmt.Errorf("s.Connect: gave up connecting to %s: %w", tcpAddr, ctx.Err())
+		}
+		s.log.Info("dial failed", "conn", d.id, "addr", tcpAddr, "err", err)
 		// We timed out, most likey due to an inavlid IP/port combo
-		return invPortErr
+		return nil, fmt.Errorf("s.Connect: unable to reach %s: %w", tcpAddr, err)
 	}
+	conn = s.simulate(conn)
 
-	// We went a net.TCPConn, not net.Conn so we've gotta do some type assertion
-	tcpConn, ok := conn.(*net.TCPConn)
-	if !ok {
-		return errors.New("s.Connect: error asserting connection type")
-	}
-
-	// Lets get the id for our new connection
-	id := atomic.AddUint32(&s.nextID, 1)
+	// Being cancelled during the handshake closes the connection, which
+	// is the only way to cut it short. We wait for the watcher to stop
+	// once the handshake is done, as ctx is always cancelled after.
+	handshaking := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshaking:
+		}
+	}()
 
 	// Let's get the connections address
 	remoteAddr := conn.RemoteAddr()
 	connAddr := strings.Split(remoteAddr.String(), ":")
 
-	// Createa a new client
-	c := client.New(tcpConn, connAddr, id, s.app)
+	// Createa a new client, and make sure it speaks our protocol
+	c := client.New(conn, nil, connAddr, d.id, events.Outbound, s.bus)
+	s.instrument(c)
+	start := time.Now()
+	err = c.Handshake(s.hello(), handshakeTimeout)
+	close(handshaking)
+	<-stopped
+	if ctx.Err() != nil {
+		s.log.Info("dial cancelled", "conn", d.id, "addr", tcpAddr)
+		conn.Close()
+		return nil, fmt.Errorf("s.Connect: gave up connecting to %s: %w", tcpAddr, ctx.Err())
+	}
+	if err != nil {
+		s.log.Info("handshake failed", "ip", d.ip, "port", d.port, "err", err)
+		conn.Close()
+		return nil, fmt.Errorf("s.Connect: %s is not a chat peer: %w", tcpAddr, err)
+	}
+	s.metrics.HandshakeSeconds.ObserveDuration(time.Since(start))
+	s.log.Debug("handshake complete", "conn", d.id, "version", c.Version, "max_message", c.MaxMessage, "took", time.Since(start))
+	return c, nil
+} // }}}
 
-	// Add the new client to our sync map
-	s.conns.Store(c.ID, c)
+// func s.Dials {{{
 
-	// Add the new ID to our ids array -- this is only used so
-	// we can get a sorted list of connections when List() is called
+// Dials returns the connections we're still in the middle of establishing,
+// sorted by the id they'll have
+func (s *Server) Dials() []types.Peer {
 	s.mu.Lock()
-	s.ids = append(s.ids, c.ID)
+	peers := make([]types.Peer, 0, len(s.dials))
+	for _, d := range s.dials {
+		peers = append(peers, types.Peer{
+			ID:        d.id,
+			IP:        d.ip,
+			Port:      d.port,
+			Transport: "tcp",
+		})
+	}
 	s.mu.Unlock()
 
-	// Inform the user of the new connection
-	s.app.Out("\nNew connection established: %v:%v\n", c.IP, c.Port)
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+} // }}}
 
-	// Handle the connection in a new goroutine.
-	//
-	// The loop then returns to accepting, so that
-	// multiple connections may be served concurrently.
-	go func() {
-		// Ensure we close our connection and remove it from the sync
-		// map once HandleClient returns
-		defer func() {
-			// The only time we should return is when the connection
-			// is closed, or some otherwise unrecoverable error.
-			//
-			// So we remove ourself from the connect list
-			// automatically when we return here.
-			s.conns.Delete(c.ID)
+// func s.Cancel {{{
 
-			// We also (just in case), call Close() on the connection
-			// again,  as this will handle any other errors that don't
-			// end up closing the connection properly.
-			//
-			// Note this is safe to call on an already closed connection.
-			c.Conn.Close()
-		}()
-		c.HandleClient()
-	}()
+// Cancel Gives up on a connection we're still dialing. The dial is reported
+// as failed once it has stopped.
+func (s *Server) Cancel(id int) error {
+	s.mu.Lock()
+	d, ok := s.dials[uint32(id)]
+	s.mu.Unlock()
 
+	if !ok {
+		return fmt.Errorf("s.Cancel: %d is not a connection being dialed! Use list to see which ones are", id)
+	}
+	d.Cancel()
 	return nil
 } // }}}
 
-// func s.List {{{
+// func d.ID {{{
 
-// List lists the IP addresses and port numbers associated with all
-// currently established connections
-func (s *Server) List() {
-	s.app.Out("id |  IP Address   | Port\n")
-	s.app.Out("---+---------------+-----\n")
+// ID returns the id the connection will have once it's established
+func (d *dial) ID() uint32 {
+	return d.id
+} // }}}
 
-	// Let's grab the ids the server currently has
-	s.mu.Lock()
-	ids := s.ids
-	s.mu.Unlock()
+// func d.Cancel {{{
 
-	// Range over our arry of ids and print them.
-	for _, id := range ids {
-		// Try loading our connection from our sync map
-		v, ok := s.conns.Load(id)
+// Cancel Gives up on the connection, if it isn't established yet
+func (d *dial) Cancel() {
+	d.cancel()
+} // }}}
 
-		// Check if it loaded or not - if it didn't its likely been
-		// deleted from the map so just continue
-		if !ok {
-			continue
-		}
+// func d.Done {{{
 
-		// Type assert the loaded value to the correct type
-		c, ok := v.(*client.Client)
-		if !ok {
-			s.app.OutErr("s.List: error asserting client type\nPlease enter a command: ")
-			return
-		}
+// Done returns a channel that's closed once the connection is established,
+// or we've given up on it
+func (d *dial) Done() <-chan struct{} {
+	return d.done
+} // }}}
+
+// func d.Err {{{
+
+// Err returns why we gave up on the connection, or nil if it was established
+// or we're still dialing
+func (d *dial) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+} // }}}
+
+// func d.finish {{{
+
+// finish Records how the dial went, and wakes up anyone waiting on it
+func (d *dial) finish(err error) {
+	d.err = err
+	d.cancel()
+	close(d.done)
+} // }}}
+
+// func s.List {{{
+
+// List returns the IP addresses and port numbers associated with all
+// currently established connections, sorted by their connection ID
+func (s *Server) List() []types.Peer {
+	// The snapshot is already sorted, and nobody changes it underneath us,
+	// so we don't hold anyone up while we collect the details
+	conns := s.conns.Snapshot()
+	peers := make([]types.Peer, 0, len(conns))
+
+	for _, c := range conns {
+		queued, size := c.Queued()
+		st := c.Stats()
+		peers = append(peers, types.Peer{
+			ID:           c.ID,
+			IP:           c.IP,
+			Port:         c.Port,
+			Transport:    c.Transport,
+			Direction:    string(c.Direction),
+			Connected:    c.Connected,
+			LastActivity: st.LastActivity,
+			Version:      c.Version,
+			MaxMessage:   c.MaxMessage,
+			Security:     security(c),
+			MessagesIn:   st.MessagesIn,
+			MessagesOut:  st.MessagesOut,
+			BytesIn:      st.BytesIn,
+			BytesOut:     st.BytesOut,
+			Queued:       queued,
+			QueueSize:    size,
+			Dropped:      c.Dropped(),
+			Unread:       s.inbox.Unread(c.ID),
+			Name:         c.Name,
+			Fingerprint:  c.Fingerprint,
+		})
+	}
+	return peers
+} // }}}
+
+// func security {{{
+
+// security Describes how far the user can trust a connection. Nothing we
+// speak is encrypted, so this is mostly about what the peer has told us.
+func security(c *client.Client) string {
+	var parts []string
+	parts = append(parts, "plaintext")
+
+	switch {
+	case c.Transport != "tcp":
+		// Only peers speaking our protocol can announce a key
+	case c.Fingerprint == "":
+		parts = append(parts, "no key announced")
+	default:
+		parts = append(parts, "key announced but not proven")
+	}
 
-		// Print the connection details
-		s.app.Out(" %d | %s | %s\n", c.ID, c.IP, c.Port)
+	if c.Approved {
+		parts = append(parts, "accepted by the user")
 	}
+	return strings.Join(parts, ", ")
 } // }}}
 
 // func s.Terminate {{{
@@ -326,28 +921,30 @@ func (s *Server) List() {
 // Terminate terminates the connection associated with the given connection id,
 // returning an error should anything go wrong
 func (s *Server) Terminate(conn int) error {
-	invInput := fmt.Sprintf("s.Terminate: must give a valid connection ID! Use list to see a list of all current connections.")
-	invInputErr := errors.New(invInput)
+	return s.Disconnect(conn, proto.GoodbyeTerminated, "")
+} // }}}
 
-	// Try loading our connection from our sync map
-	v, ok := s.conns.Load(uint32(conn))
+// func s.Disconnect {{{
+
+// Disconnect Closes the connection associated with the given connection id,
+// first telling the peer why with the given goodbye code and text
+func (s *Server) Disconnect(conn int, code proto.GoodbyeCode, text string) error {
+	invInput := fmt.Sprintf("s.Disconnect: must give a valid connection ID! Use list to see a list of all current connections.")
+	invInputErr := errors.New(invInput)
 
 	// Were we given a valid connection ID?
+	c, ok := s.conns.Get(uint32(conn))
 	if !ok {
 		return invInputErr
 	}
 
-	// Type assert the loaded value to the correct type
-	c, ok := v.(*client.Client)
-	if !ok {
-		return errors.New("s.Terminate: error asserting client type")
-	}
-
 	// Attempt to close the connection
 	//
 	// We don't need to do anything to remove the connection from the
-	// connections map because it will already be removed once the client
+	// registry because it will already be removed once the client
 	// returns from the HandleClient func
+	s.log.Info("terminating connection", "conn", c.ID, "code", code, "text", text)
+	c.Goodbye(code, text)
 	if err := c.CloseConn(); err != nil {
 		return err
 	}
@@ -358,71 +955,124 @@ func (s *Server) Terminate(conn int) error {
 // func s.Send {{{
 
 // Send attempts to send a given message to the connection associated with the
-// given connection id, returning an error should anything go wrong
+// given connection id, returning an error should anything go wrong. The
+// message is queued for the connections writer, which publishes MessageSent
+// or SendFailed once it knows how the write went.
 func (s *Server) Send(conn int, message string) error {
-	invInput := fmt.Sprintf("s.Send: %d invalid ID! Use list to see a list of all current connections", conn)
-	invInputErr := errors.New(invInput)
-
-	tooLong := fmt.Sprintf("s.Send: message is too long! Max length a message can be is 100 characters. Your message is %d characters", len(message))
-	tooLongErr := errors.New(tooLong)
-
-	// Were we given a message of valid length?
-	if len(message) > 100 {
-		return tooLongErr
+	// Load our connection from the provided connection ID, if it's valid
+	c, ok := s.conns.Get(uint32(conn))
+	if !ok {
+		return fmt.Errorf("s.Send: %d invalid ID! Use list to see a list of all current connections", conn)
 	}
 
-	// Load our connection from the provided connection ID
-	v, ok := s.conns.Load(uint32(conn))
-
-	// Were we given a valid connection ID?
-	if !ok {
-		return invInputErr
+	// Were we given a message of valid length? We count what the user
+	// sees as a character, rather than bytes, so emoji don't count extra.
+	// Every character is at least a byte, so shorter messages needn't be
+	// counted at all.
+	if len(message) > c.MaxMessage {
+		if n := grapheme.Count(message); n > c.MaxMessage {
+			return fmt.Errorf("s.Send: message is too long! Max length a message to connection %d can be is %d characters. Your message is %d characters", c.ID, c.MaxMessage, n)
+		}
 	}
 
-	// Type assert the loaded value to the correct type
-	c, ok := v.(*client.Client)
-	if !ok {
-		return errors.New("s.Send: error asserting client type")
+	// Okay now that we've loaded the connection, let's queue the message
+	// for its writer, which lets everyone know once it's been sent
+	if err := c.Queue(message); err != nil {
+		return fmt.Errorf("s.Send: unable to send to connection %d: %w", c.ID, err)
 	}
+	return nil
+} // }}}
 
-	// Lets create a byte array of our message to send to the connection
-	msg := []byte(message)
+// func s.Inbox {{{
 
-	// Okay now that we've loaded the connection, let's try to send
-	// the message
-	c.Conn.Write(msg)
-	s.app.Out("Message sent to connection %d!\n", c.ID)
-	return nil
+// Inbox returns the messages a connection has sent that haven't been read
+// yet, or those of every connection if conn is zero. Closed connections keep
+// theirs until they've been read.
+func (s *Server) Inbox(conn int) []types.Message {
+	return s.inbox.Messages(uint32(conn))
+} // }}}
+
+// func s.MarkRead {{{
+
+// MarkRead Marks the messages a connection has sent as read, or those of
+// every connection if conn is zero, returning how many there were
+func (s *Server) MarkRead(conn int) int {
+	return s.inbox.MarkRead(uint32(conn))
 } // }}}
 
 // func s.Exit {{{
 
-// Exit exits the program, closing any established connections prior to doing so
+// Exit closes any established connections and stops listening for new ones,
+// so that the program can exit cleanly
 func (s *Server) Exit() {
-	s.app.Out("Closing any established connections .. \n")
-
-	s.conns.Range(func(k, v interface{}) bool {
-		// Type assert the loaded value to the correct type
-		c, ok := v.(*client.Client)
-		if !ok {
-			s.app.OutErr("s.Exit: error asserting client type\n")
-			return false
-		}
+	// Give up on anything we're still dialing, and wait for it to stop so
+	// nothing is established behind our back ..
+	s.mu.Lock()
+	dials := make([]*dial, 0, len(s.dials))
+	for _, d := range s.dials {
+		dials = append(dials, d)
+	}
+	s.mu.Unlock()
+	for _, d := range dials {
+		d.Cancel()
+		<-d.done
+	}
+
+	// .. and on anyone still waiting to be accepted
+	for _, p := range s.Awaiting() {
+		s.refuseHeld(p.ID, proto.GoodbyeShutdown, "")
+	}
+
+	// Tell everyone we're going, all at once, so peers that aren't reading
+	// only hold us up once between them
+	var wg sync.WaitGroup
+	for _, c := range s.conns.Snapshot() {
+		c := c
 
 		// Try and close the connection
-		if err := c.CloseConn(); err != nil {
-			s.app.OutErr("s.Exit: error closing connection %d! err:=%v\n", c.ID, err)
-			return false
-		}
-		return true
-	})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Goodbye(proto.GoodbyeShutdown, "")
+			if err := c.CloseConn(); err != nil && !errors.Is(err, net.ErrClosed) {
+				s.log.Error("error closing connection", "conn", c.ID, "err", err)
+				s.bus.Publish(events.Event{
+					Kind:   events.InternalError,
+					ConnID: c.ID,
+					Err:    err,
+				})
+			}
+		}()
+	}
+	wg.Wait()
 
 	// Stop listening for new connections ..
 	s.mu.Lock()
 	s.listener.Close()
+	if s.rawListener != nil {
+		s.rawListener.Close()
+	}
 	s.mu.Unlock()
+} // }}}
 
-	// Let the user know we're shutting down now and exit
-	s.app.Out("Exiting program now .. bye!\n")
-	os.Exit(0)
+// func s.Metrics {{{
+
+// Metrics returns what we've counted about ourselves, for the metrics endpoint
+func (s *Server) Metrics() *metrics.Metrics {
+	return s.metrics
+} // }}}
+
+// func s.publishConnected {{{
+
+// publishConnected lets everyone know a new connection has been established
+func (s *Server) publishConnected(c *client.Client) {
+	s.bus.Publish(events.Event{
+		Kind:        events.PeerConnected,
+		ConnID:      c.ID,
+		IP:          c.IP,
+		Port:        c.Port,
+		Direction:   c.Direction,
+		Name:        c.Name,
+		Fingerprint: c.Fingerprint,
+	})
 } // }}}
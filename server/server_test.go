@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/netsim"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// How long we wait for anything to happen before failing the test. Long
+// enough for the slowest link we simulate, several times over.
+const waitTimeout = 5 * time.Second
+
+// A bad network, but one that still gets everything across eventually
+var badLink = netsim.Conditions{
+	Latency:   5 * time.Millisecond,
+	Jitter:    5 * time.Millisecond,
+	Bandwidth: 64 * 1024,
+	Fragment:  3,
+}
+
+// type watcher struct {{{
+
+// watcher records the events a server publishes, so tests can wait for them
+type watcher struct {
+	events chan events.Event
+} // }}}
+
+// func newServer {{{
+
+// newServer Starts a server on any free loopback port, announcing name, and
+// returns it with a watcher of its events. It's shut down once the test is
+// done with it.
+func newServer(t *testing.T, name string) (*Server, *watcher) {
+	t.Helper()
+	bus := events.NewBus()
+	w := &watcher{events: make(chan events.Event, 256)}
+	bus.Subscribe(func(e events.Event) {
+		w.events <- e
+	})
+
+	s := New("127.0.0.1", 0, bus)
+	s.SetIdentity(name, "")
+	go s.Listen()
+	t.Cleanup(s.Exit)
+	return s, w
+} // }}}
+
+// func w.wait {{{
+
+// wait returns the next event of the given kind, skipping any others, and
+// fails the test if none is published in time
+func (w *watcher) wait(t *testing.T, kind events.Kind) events.Event {
+	t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case e := <-w.events:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event after %s", kind, waitTimeout)
+		}
+	}
+} // }}}
+
+// func TestPipeHandshake {{{
+
+// Two servers joined by an in-process connection across a bad link complete
+// the handshake, chat both ways, and both notice when the link is reset
+func TestPipeHandshake(t *testing.T) {
+	alice, aliceEvents := newServer(t, "alice")
+	bob, bobEvents := newServer(t, "bob")
+
+	n := netsim.New()
+	n.Set(netsim.Any, netsim.Any, badLink)
+	a, b := n.Pipe("10.0.0.1:4545", "10.0.0.2:4546")
+
+	// Each side handshakes as it would a connection it dialed or accepted,
+	// at the same time, as real peers do
+	ca := client.New(a, nil, strings.Split(a.RemoteAddr().String(), ":"), atomic.AddUint32(&alice.nextID, 1), events.Outbound, alice.bus)
+	cb := client.New(b, nil, strings.Split(b.RemoteAddr().String(), ":"), atomic.AddUint32(&bob.nextID, 1), events.Inbound, bob.bus)
+	errs := make(chan error, 2)
+	go func() { errs <- ca.Handshake(alice.hello(), waitTimeout) }()
+	go func() { errs <- cb.Handshake(bob.hello(), waitTimeout) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+	}
+	if ca.Name != "bob" || cb.Name != "alice" {
+		t.Errorf("peers announced %q and %q, want bob and alice", ca.Name, cb.Name)
+	}
+
+	alice.serve(ca)
+	bob.serve(cb)
+	if e := aliceEvents.wait(t, events.PeerConnected); e.IP != "10.0.0.2" || e.Port != "4546" {
+		t.Errorf("alice connected to %s:%s, want 10.0.0.2:4546", e.IP, e.Port)
+	}
+	bobEvents.wait(t, events.PeerConnected)
+
+	// Fragments of three bytes make sure the messages are put back
+	// together from pieces that split their frames
+	msg := "hello across a bad link, \U0001F44B"
+	if err := alice.Send(int(ca.ID), msg); err != nil {
+		t.Fatalf("alice.Send failed: %v", err)
+	}
+	if e := bobEvents.wait(t, events.MessageReceived); e.Message != msg || e.ConnID != cb.ID {
+		t.Errorf("bob received %q on %d, want %q on %d", e.Message, e.ConnID, msg, cb.ID)
+	}
+	if err := bob.Send(int(cb.ID), "and back"); err != nil {
+		t.Fatalf("bob.Send failed: %v", err)
+	}
+	if e := aliceEvents.wait(t, events.MessageReceived); e.Message != "and back" {
+		t.Errorf("alice received %q, want and back", e.Message)
+	}
+
+	if got := n.Reset(netsim.Any, netsim.Any); got != 1 {
+		t.Errorf("Reset = %d, want 1", got)
+	}
+	aliceEvents.wait(t, events.PeerDisconnected)
+	bobEvents.wait(t, events.PeerDisconnected)
+	if len(alice.List()) != 0 || len(bob.List()) != 0 {
+		t.Errorf("connections left after the reset: %v, %v", alice.List(), bob.List())
+	}
+} // }}}
+
+// func TestWrapConnect {{{
+
+// A connection dialed and accepted over TCP, with both servers running it
+// through a simulated network, survives a bad link and a partition during the
+// handshake, and is closed on both sides when it's reset
+func TestWrapConnect(t *testing.T) {
+	alice, aliceEvents := newServer(t, "alice")
+	bob, bobEvents := newServer(t, "bob")
+
+	n := netsim.New()
+	n.Set(netsim.Any, netsim.Any, badLink)
+	alice.SetNetwork(n)
+	bob.SetNetwork(n)
+
+	// Nothing gets across until we heal the partition, so the handshake
+	// has to wait for it
+	n.Partition(netsim.Any, netsim.Any)
+	d, err := alice.Connect(context.Background(), "127.0.0.1", strconv.Itoa(bob.Port()))
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-d.Done():
+		t.Fatalf("connected through a partition: %v", d.Err())
+	default:
+	}
+	n.Heal(netsim.Any, netsim.Any)
+
+	select {
+	case <-d.Done():
+		if err := d.Err(); err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("dial didn't finish after %s", waitTimeout)
+	}
+	aliceEvents.wait(t, events.PeerConnected)
+	e := bobEvents.wait(t, events.PeerConnected)
+	if e.Name != "alice" {
+		t.Errorf("bob was connected to %q, want alice", e.Name)
+	}
+
+	msg := strings.Repeat("fragmented ", 8)
+	if err := alice.Send(int(d.ID()), msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got := bobEvents.wait(t, events.MessageReceived); got.Message != msg {
+		t.Errorf("bob received %q, want %q", got.Message, msg)
+	}
+
+	// Each server wrapped its own end, so there are two links to reset
+	if got := n.Reset(netsim.Any, netsim.Any); got != 2 {
+		t.Errorf("Reset = %d, want 2", got)
+	}
+	aliceEvents.wait(t, events.PeerDisconnected)
+	bobEvents.wait(t, events.PeerDisconnected)
+} // }}}
@@ -2,34 +2,48 @@
 package server
 
 import (
-	"github.com/Cryliss/chat/types"
+	"context"
+	"github.com/Cryliss/chat/capture"
+	"github.com/Cryliss/chat/client"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/inbox"
+	"github.com/Cryliss/chat/logging"
+	"github.com/Cryliss/chat/metrics"
+	"github.com/Cryliss/chat/netsim"
+	"github.com/Cryliss/chat/registry"
 	"net"
 	"sync"
+	"time"
 )
 
+// DefaultMaxMessage is the longest message, in user-perceived characters, we
+// accept unless told otherwise
+const DefaultMaxMessage = 100
+
+// How long we give a peer to say hello before we give up on it
+const handshakeTimeout = 10 * time.Second
+
+// DefaultApprovalTimeout is how long a peer that connects to us waits for the
+// user to accept it, when we were told to ask, unless told otherwise
+const DefaultApprovalTimeout = time.Minute
+
+// DefaultDialTimeout is how long we wait for a peer we dial to answer, unless
+// told otherwise
+const DefaultDialTimeout = 10 * time.Second
+
 // type Server struct {{{
 
 // Server holds private information related to the server
 type Server struct {
-	// Our application so we can display messages to the user
-	//
-	// We are using types.Application rather than app.Application
-	// because that causes an import loop which is not allowed ...
-	app types.Application
+	// Our event bus, so the frontends can display what we're up to
+	// however they like
+	bus *events.Bus
 
 	// The tcpAddr we want to bind to & accept connections on
 	bindy net.TCPAddr
 
-	// A sync map for our connections
-	//
-	// This allows us to use atomics to safely get new connection
-	// ID values, without fear of data races
-	conns sync.Map
-
-	// List of connection IDs .. only using this so that my list
-	// of connections will be sorted .. doesn't work that way if I just
-	// range over the sync map
-	ids []uint32
+	// Our established connections, kept in order of their IDs
+	conns *registry.Registry
 
 	// Locks reading on this struct, avoids data races!
 	mu sync.Mutex
@@ -39,6 +53,85 @@ type Server struct {
 	// Only access this using atomics!
 	nextID uint32
 
+	// Connections we're still dialing, by the id they'll have once
+	// they're established. Guarded by mu.
+	dials map[uint32]*dial
+
+	// How long we wait for a peer we dial to answer
+	dialTimeout time.Duration
+
+	// Whether peers that connect to us must be accepted by the user before
+	// they can chat, and how long they wait for that before we give up
+	askFirst        bool
+	approvalTimeout time.Duration
+
+	// Peers waiting to be accepted, by the id they'll keep once they are.
+	// Guarded by mu.
+	awaiting map[uint32]*approval
+
+	// What we announce about ourselves when connecting
+	name string
+	key  string
+
 	// Listener that will accept incoming connections
 	listener *net.TCPListener
+
+	// Listener for plain text connections, if we were asked for one
+	rawListener *net.TCPListener
+
+	// The longest message, in user-perceived characters, we'll accept
+	maxMessage int
+
+	// How many messages may wait to be written to each peer, what we do
+	// when there are already that many, and how long we give each write
+	queueSize    int
+	overflow     client.OverflowPolicy
+	writeTimeout time.Duration
+
+	// What we count about ourselves, for the metrics endpoint
+	metrics *metrics.Metrics
+
+	// Where we, and our clients, log diagnostics to. Nil logs nothing.
+	log       *logging.Logger
+	clientLog *logging.Logger
+
+	// Where we record the frames of new connections to. Nil records
+	// nothing.
+	capture *capture.Writer
+
+	// The simulated network new connections are run through, to see how
+	// we cope with a bad one. Nil uses the real one as it is. Guarded by mu.
+	network *netsim.Network
+
+	// The messages peers have sent that the user hasn't read yet
+	inbox *inbox.Inbox
+} // }}}
+
+// type approval struct {{{
+
+// approval is a peer that has connected to us and completed the handshake,
+// waiting for the user to accept or reject it
+type approval struct {
+	c *client.Client
+
+	// Gives up on the peer if nobody answers in time
+	timer *time.Timer
+} // }}}
+
+// type dial struct {{{
+
+// dial is a connection we're in the middle of establishing, which the user
+// may give up on
+type dial struct {
+	// The id the connection will have, and who we're dialing
+	id   uint32
+	ip   string
+	port string
+
+	// Stops the dial, or the handshake if we've got that far
+	cancel context.CancelFunc
+
+	// Closed once we're done, one way or the other, after err is set
+	done chan struct{}
+	err  error
 } // }}}
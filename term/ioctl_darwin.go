@@ -0,0 +1,10 @@
+// Package term provides the bits of terminal handling the full screen and
+// line editing frontends need - raw mode and the window size
+package term
+
+import "syscall"
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
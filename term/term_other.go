@@ -0,0 +1,37 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+// Package term provides the bits of terminal handling the full screen and
+// line editing frontends need - raw mode and the window size
+package term
+
+type termios struct{}
+
+// func IsTerminal {{{
+
+// IsTerminal reports whether fd refers to a terminal. We can't tell on this
+// platform, so we always say no and the frontends fall back to line mode.
+func IsTerminal(fd int) bool {
+	return false
+} // }}}
+
+// func MakeRaw {{{
+
+// MakeRaw is not supported on this platform
+func MakeRaw(fd int) (*State, error) {
+	return nil, ErrUnsupported
+} // }}}
+
+// func Restore {{{
+
+// Restore is not supported on this platform
+func Restore(fd int, st *State) error {
+	return ErrUnsupported
+} // }}}
+
+// func GetSize {{{
+
+// GetSize is not supported on this platform
+func GetSize(fd int) (width, height int, err error) {
+	return 0, 0, ErrUnsupported
+} // }}}
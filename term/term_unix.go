@@ -0,0 +1,80 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// Package term provides the bits of terminal handling the full screen and
+// line editing frontends need - raw mode and the window size
+package term
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type termios = syscall.Termios
+
+// func ioctl {{{
+
+// ioctl performs the given terminal ioctl request on fd
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+} // }}}
+
+// func IsTerminal {{{
+
+// IsTerminal reports whether fd refers to a terminal
+func IsTerminal(fd int) bool {
+	var t termios
+	return ioctl(fd, ioctlGetTermios, unsafe.Pointer(&t)) == nil
+} // }}}
+
+// func MakeRaw {{{
+
+// MakeRaw puts the terminal on fd into raw mode - no echo, no line
+// buffering and no signals for Ctrl-C and friends - and returns the state
+// it was in before, so it can be restored with Restore.
+func MakeRaw(fd int) (*State, error) {
+	var old termios
+	if err := ioctl(fd, ioctlGetTermios, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+
+	// These are the same settings cfmakeraw(3) uses
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctl(fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return &State{state: old}, nil
+} // }}}
+
+// func Restore {{{
+
+// Restore puts the terminal on fd back into the state it was in before
+// MakeRaw was called
+func Restore(fd int, st *State) error {
+	return ioctl(fd, ioctlSetTermios, unsafe.Pointer(&st.state))
+} // }}}
+
+// func GetSize {{{
+
+// GetSize returns the width and height of the terminal on fd
+func GetSize(fd int) (width, height int, err error) {
+	var ws struct {
+		Row, Col, Xpixel, Ypixel uint16
+	}
+	if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return 0, 0, err
+	}
+	return int(ws.Col), int(ws.Row), nil
+} // }}}
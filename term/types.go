@@ -0,0 +1,17 @@
+// Package term provides the bits of terminal handling the full screen and
+// line editing frontends need - raw mode and the window size
+package term
+
+import "errors"
+
+// ErrUnsupported is returned on platforms we don't know how to put the
+// terminal into raw mode on
+var ErrUnsupported = errors.New("term: raw mode is not supported on this platform")
+
+// type State struct {{{
+
+// State holds the terminal settings from before we changed them, so they
+// can be restored when we're done
+type State struct {
+	state termios
+} // }}}
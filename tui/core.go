@@ -0,0 +1,588 @@
+// Package tui provides the optional full screen terminal frontend, with a
+// scrolling message pane, a peer sidebar, a status bar and a fixed input line
+package tui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/term"
+	"github.com/Cryliss/chat/types"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrNotTerminal is returned by Start when stdin or stdout isn't a terminal,
+// in which case the caller should fall back to line mode
+var ErrNotTerminal = errors.New("tui: stdin and stdout must both be terminals")
+
+// func New {{{
+
+// New Initializes and returns a new UI. Nothing is drawn until Start is called.
+func New(app types.Application, s types.Server, bus *events.Bus, title string) *UI {
+	return &UI{
+		app:    app,
+		s:      s,
+		bus:    bus,
+		title:  title,
+		in:     os.Stdin,
+		out:    os.Stdout,
+		status: "Type 'help' for a list of commands",
+		done:   make(chan struct{}),
+	}
+} // }}}
+
+// func u.Writer {{{
+
+// Writer returns an io.Writer that appends to the message pane, for the
+// application to write its output to
+func (u *UI) Writer() io.Writer {
+	return paneWriter{u: u}
+} // }}}
+
+// func u.Start {{{
+
+// Start puts the terminal into raw mode, switches to the alternate screen
+// and starts displaying events. Returns ErrNotTerminal if we can't draw a
+// full screen UI here.
+func (u *UI) Start() error {
+	if !term.IsTerminal(int(u.in.Fd())) || !term.IsTerminal(int(u.out.Fd())) {
+		return ErrNotTerminal
+	}
+
+	state, err := term.MakeRaw(int(u.in.Fd()))
+	if err != nil {
+		return err
+	}
+	u.state = state
+
+	// Switch to the alternate screen, so we don't trash the users scrollback
+	fmt.Fprint(u.out, "\x1b[?1049h")
+
+	u.unsubscribe = u.bus.Subscribe(u.handleEvent)
+
+	// There's no portable way to be told the terminal was resized, so just
+	// check every now and then
+	go u.watchSize()
+
+	u.mu.Lock()
+	u.draw()
+	u.mu.Unlock()
+	return nil
+} // }}}
+
+// func u.Close {{{
+
+// Close restores the terminal to the state it was in before Start was
+// called. Safe to call more than once.
+func (u *UI) Close() {
+	u.closeOnce.Do(func() {
+		close(u.done)
+		if u.unsubscribe != nil {
+			u.unsubscribe()
+		}
+		if u.state == nil {
+			return
+		}
+
+		// Leave the alternate screen and make sure the cursor is visible
+		u.mu.Lock()
+		fmt.Fprint(u.out, "\x1b[?25h\x1b[?1049l")
+		term.Restore(int(u.in.Fd()), u.state)
+		u.mu.Unlock()
+	})
+} // }}}
+
+// func u.Run {{{
+
+// Run reads and handles the users key presses until stdin is closed
+func (u *UI) Run() {
+	reader := bufio.NewReader(u.in)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+
+		switch r {
+		case '\r', '\n':
+			u.submit()
+		case 0x03: // Ctrl-C cancels the current line, and anything we're dialing
+			u.edit(func() {
+				u.input = u.input[:0]
+				u.cursor = 0
+			})
+			for _, d := range u.s.Dials() {
+				u.s.Cancel(int(d.ID))
+			}
+		case 0x04: // Ctrl-D on an empty line exits, like a shell would
+			u.mu.Lock()
+			empty := len(u.input) == 0
+			u.mu.Unlock()
+			if empty {
+				u.run("exit")
+			}
+		case 0x7f, 0x08: // Backspace
+			u.edit(func() {
+				if u.cursor > 0 {
+					u.input = append(u.input[:u.cursor-1], u.input[u.cursor:]...)
+					u.cursor--
+				}
+			})
+		case 0x01: // Ctrl-A
+			u.edit(func() { u.cursor = 0 })
+		case 0x05: // Ctrl-E
+			u.edit(func() { u.cursor = len(u.input) })
+		case 0x0c: // Ctrl-L redraws everything
+			u.edit(func() {})
+		case 0x1b:
+			u.escape(reader)
+		default:
+			if unicode.IsPrint(r) {
+				u.edit(func() {
+					u.input = append(u.input, 0)
+					copy(u.input[u.cursor+1:], u.input[u.cursor:])
+					u.input[u.cursor] = r
+					u.cursor++
+				})
+			}
+		}
+	}
+} // }}}
+
+// func u.escape {{{
+
+// escape Handles the escape sequences sent by the arrow and paging keys
+func (u *UI) escape(reader *bufio.Reader) {
+	if b, err := reader.ReadByte(); err != nil || (b != '[' && b != 'O') {
+		return
+	}
+
+	// Read the parameters up until the final byte of the sequence
+	var params []byte
+	var final byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if b >= 0x40 && b <= 0x7e {
+			final = b
+			break
+		}
+		params = append(params, b)
+	}
+
+	u.edit(func() {
+		switch final {
+		case 'C': // Right
+			if u.cursor < len(u.input) {
+				u.cursor++
+			}
+		case 'D': // Left
+			if u.cursor > 0 {
+				u.cursor--
+			}
+		case 'H':
+			u.cursor = 0
+		case 'F':
+			u.cursor = len(u.input)
+		case '~':
+			switch string(params) {
+			case "1", "7":
+				u.cursor = 0
+			case "4", "8":
+				u.cursor = len(u.input)
+			case "3": // Delete
+				if u.cursor < len(u.input) {
+					u.input = append(u.input[:u.cursor], u.input[u.cursor+1:]...)
+				}
+			case "5": // Page up
+				u.scroll += u.paneHeight() / 2
+			case "6": // Page down
+				u.scroll -= u.paneHeight() / 2
+				if u.scroll < 0 {
+					u.scroll = 0
+				}
+			}
+		}
+	})
+} // }}}
+
+// func u.edit {{{
+
+// edit Runs f with the UI locked and then redraws the screen
+func (u *UI) edit(f func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f()
+	u.draw()
+} // }}}
+
+// func u.submit {{{
+
+// submit Runs the line the user has typed as a command
+func (u *UI) submit() {
+	u.mu.Lock()
+	line := string(u.input)
+	u.input = u.input[:0]
+	u.cursor = 0
+	u.scroll = 0
+	u.mu.Unlock()
+
+	// Blank lines are still passed on, as they may be part of a message
+	// being composed
+	u.run(line)
+} // }}}
+
+// func u.run {{{
+
+// run Echoes the command to the message pane and runs it
+func (u *UI) run(line string) {
+	u.appendLines(u.app.PromptText() + line)
+
+	// We must not hold the lock here, as the command output comes back to
+	// us through the pane writer
+	if err := u.app.ParseInput(line); err != nil {
+		u.appendLines(fmt.Sprintf("ERROR %v", err))
+		u.setStatus(firstLine(err.Error()))
+	}
+} // }}}
+
+// func u.handleEvent {{{
+
+// handleEvent Displays the events published by the server in the message
+// pane and status bar
+func (u *UI) handleEvent(e events.Event) {
+	ts := e.Time.Format("15:04:05")
+	peer := fmt.Sprintf("%d %s:%s", e.ConnID, e.IP, e.Port)
+
+	switch e.Kind {
+	case events.PeerConnected:
+		u.appendLines(fmt.Sprintf("%s *** connection %s established (%s)", ts, peer, e.Direction))
+		u.setStatus(fmt.Sprintf("Connected to %s:%s", e.IP, e.Port))
+	case events.PeerDisconnected:
+		switch {
+		case e.Local:
+			u.appendLines(fmt.Sprintf("%s *** closed connection %s", ts, peer))
+		case e.Err != nil:
+			u.appendLines(fmt.Sprintf("%s *** connection %s closed, %s: %v", ts, peer, e.Reason, e.Err))
+		case e.Code != "":
+			u.appendLines(fmt.Sprintf("%s *** connection %s closed, %s", ts, peer, e.Reason))
+		default:
+			u.appendLines(fmt.Sprintf("%s *** peer %s has terminated the connection", ts, peer))
+		}
+		u.setStatus(fmt.Sprintf("Disconnected from %s:%s", e.IP, e.Port))
+	case events.ConnectionPending:
+		u.appendLines(fmt.Sprintf("%s *** connection %s is waiting to be accepted, %s %s, use accept %d or reject %d", ts, peer, e.Name, e.Fingerprint, e.ConnID, e.ConnID))
+		u.setStatus(fmt.Sprintf("Connection %d waiting to be accepted", e.ConnID))
+	case events.Dialing:
+		u.appendLines(fmt.Sprintf("%s *** dialing %s:%s as connection %d", ts, e.IP, e.Port, e.ConnID))
+		u.setStatus(fmt.Sprintf("Dialing %s:%s", e.IP, e.Port))
+	case events.DialFailed:
+		u.appendLines(fmt.Sprintf("%s !!! unable to connect to %s:%s, %v", ts, e.IP, e.Port, e.Err))
+		u.setStatus(fmt.Sprintf("Unable to connect to %s:%s", e.IP, e.Port))
+	case events.ConnectionRefused:
+		u.appendLines(fmt.Sprintf("%s *** refused connection from %s:%s, %s", ts, e.IP, e.Port, e.Reason))
+	case events.MessageReceived:
+		// Left in the inbox? Then the application has already said so
+		if u.app.ShowsMessage(e.ConnID) {
+			u.appendLines(prefixLines(fmt.Sprintf("%s <%s> ", ts, peer), e.Message)...)
+		}
+		u.setStatus(fmt.Sprintf("New message from %s", peer))
+	case events.MessageRejected:
+		u.appendLines(fmt.Sprintf("%s !!! rejected a message from %s, %s", ts, peer, e.Reason))
+	case events.MessageSent:
+		u.appendLines(prefixLines(fmt.Sprintf("%s -> %d ", ts, e.ConnID), e.Message)...)
+		u.setStatus(fmt.Sprintf("Message sent to connection %d", e.ConnID))
+	case events.SendFailed:
+		u.appendLines(fmt.Sprintf("%s !!! failed to send to %s: %v", ts, peer, e.Err))
+	case events.AcceptError, events.InternalError:
+		// These are only of use when tracking down a problem, so the
+		// server logs them rather than us showing them to the user
+	case events.ListenerStopped:
+		u.appendLines(fmt.Sprintf("%s !!! listener stopped, %s", ts, e.Reason))
+		u.setStatus("Not accepting new connections")
+	}
+} // }}}
+
+// func u.appendLines {{{
+
+// appendLines Adds complete lines to the message pane and redraws it
+func (u *UI) appendLines(lines ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addLines(lines)
+	u.draw()
+} // }}}
+
+// func u.addLines {{{
+
+// addLines Adds lines to the message pane, dropping the oldest ones once
+// we've got too many. The caller must hold the lock.
+func (u *UI) addLines(lines []string) {
+	for _, l := range lines {
+		l = strings.Replace(l, "\t", "    ", -1)
+		l = strings.TrimRight(l, "\r ")
+
+		// The applications output is written with a terminal in mind and
+		// is full of blank lines, which just waste space in our pane
+		if l == "" && (len(u.lines) == 0 || u.lines[len(u.lines)-1] == "") {
+			continue
+		}
+		u.lines = append(u.lines, l)
+	}
+
+	if len(u.lines) > maxLines {
+		u.lines = append(u.lines[:0:0], u.lines[len(u.lines)-maxLines:]...)
+	}
+} // }}}
+
+// func u.setStatus {{{
+
+// setStatus Changes the message shown in the status bar
+func (u *UI) setStatus(status string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = status
+	u.draw()
+} // }}}
+
+// func u.watchSize {{{
+
+// watchSize Redraws the screen whenever the terminal changes size, or the
+// number of connections changes. Connections are only removed from the
+// server after their disconnect event has been published, so we'd
+// otherwise show them in the sidebar until something else redraws it.
+func (u *UI) watchSize() {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+			w, h, err := term.GetSize(int(u.out.Fd()))
+			if err != nil {
+				continue
+			}
+			n := len(u.s.List())
+			u.mu.Lock()
+			if w != u.width || h != u.height || n != u.peerCount {
+				u.draw()
+			}
+			u.mu.Unlock()
+		}
+	}
+} // }}}
+
+// func u.paneHeight {{{
+
+// paneHeight returns how many rows the message pane has. The caller must
+// hold the lock.
+func (u *UI) paneHeight() int {
+	// Leave room for the status bar and input line
+	if u.height < 3 {
+		return 1
+	}
+	return u.height - 2
+} // }}}
+
+// func u.draw {{{
+
+// draw Redraws the whole screen. The caller must hold the lock.
+func (u *UI) draw() {
+	if u.state == nil {
+		// We haven't started yet, or we've already closed
+		return
+	}
+
+	w, h, err := term.GetSize(int(u.out.Fd()))
+	if err != nil || w < 10 || h < 3 {
+		w, h = 80, 24
+	}
+	u.width, u.height = w, h
+	paneH := u.paneHeight()
+
+	// Work out how the screen is split between the pane and the sidebar
+	paneW := w
+	sideW := 0
+	if w >= sidebarMin {
+		sideW = sidebarWidth
+		paneW = w - sideW - 1
+	}
+
+	// Wrap enough of the newest lines to fill the pane, allowing for
+	// however far the user has scrolled up
+	var wrapped []string
+	for i := len(u.lines) - 1; i >= 0 && len(wrapped) < paneH+u.scroll; i-- {
+		wrapped = append(wrapLine(u.lines[i], paneW), wrapped...)
+	}
+	if max := len(wrapped) - paneH; u.scroll > max {
+		u.scroll = max
+		if u.scroll < 0 {
+			u.scroll = 0
+		}
+	}
+	end := len(wrapped) - u.scroll
+	start := end - paneH
+	if start < 0 {
+		start = 0
+	}
+	view := wrapped[start:end]
+
+	peers := u.s.List()
+	u.peerCount = len(peers)
+	sidebar := sidebarRows(peers, sideW, paneH)
+
+	var b strings.Builder
+
+	// Hide the cursor while we draw, and start from the top left
+	b.WriteString("\x1b[?25l\x1b[H")
+	for row := 0; row < paneH; row++ {
+		line := ""
+		if row < len(view) {
+			line = view[row]
+		}
+		b.WriteString(pad(line, paneW))
+		if sideW > 0 {
+			b.WriteString("\x1b[2m│\x1b[0m")
+			b.WriteString(pad(sidebar[row], sideW))
+		}
+		b.WriteString("\r\n")
+	}
+
+	// The status bar, in reverse video
+	left := fmt.Sprintf(" CHATTY %s | %d peers | %s", u.title, len(peers), u.status)
+	right := ""
+	if u.scroll > 0 {
+		right = fmt.Sprintf("[scrolled %d] ", u.scroll)
+	} else {
+		right = "PgUp/PgDn to scroll "
+	}
+	status := pad(left, w-len([]rune(right))) + right
+	b.WriteString("\x1b[7m" + pad(status, w) + "\x1b[0m\r\n")
+
+	// The input line, scrolled horizontally so the cursor is always visible
+	promptStr := u.app.PromptText()
+	promptW := len([]rune(promptStr))
+	inW := w - promptW - 1
+	if inW < 1 {
+		inW = 1
+	}
+	offset := 0
+	if u.cursor > inW {
+		offset = u.cursor - inW
+	}
+	visible := u.input[offset:]
+	if len(visible) > inW {
+		visible = visible[:inW]
+	}
+	b.WriteString(pad(promptStr+string(visible), w))
+
+	// And finally put the cursor back where the user is typing
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", h, promptW+u.cursor-offset+1)
+
+	io.WriteString(u.out, b.String())
+} // }}}
+
+// func sidebarRows {{{
+
+// sidebarRows Builds the rows of the peer sidebar from the servers connection list
+func sidebarRows(peers []types.Peer, width, height int) []string {
+	rows := make([]string, height)
+	if width == 0 {
+		return rows
+	}
+
+	rows[0] = fmt.Sprintf(" Peers (%d)", len(peers))
+	if height > 1 {
+		rows[1] = " " + strings.Repeat("─", width-2)
+	}
+	for i, p := range peers {
+		row := i + 2
+		if row >= height {
+			break
+		}
+		rows[row] = fmt.Sprintf(" %-3d %s:%s", p.ID, p.IP, p.Port)
+	}
+	return rows
+} // }}}
+
+// func w.Write {{{
+
+// Write adds p to the message pane, holding on to anything after the last
+// newline until the rest of the line is written
+func (w paneWriter) Write(p []byte) (int, error) {
+	w.u.mu.Lock()
+	defer w.u.mu.Unlock()
+
+	text := w.u.partial + string(p)
+	lines := strings.Split(text, "\n")
+	w.u.partial = lines[len(lines)-1]
+	w.u.addLines(lines[:len(lines)-1])
+	w.u.draw()
+	return len(p), nil
+} // }}}
+
+// func wrapLine {{{
+
+// wrapLine splits a line into rows no wider than width
+func wrapLine(line string, width int) []string {
+	r := []rune(line)
+	if len(r) <= width || width <= 0 {
+		return []string{line}
+	}
+
+	var rows []string
+	for len(r) > width {
+		rows = append(rows, string(r[:width]))
+		r = r[width:]
+	}
+	return append(rows, string(r))
+} // }}}
+
+// func pad {{{
+
+// pad truncates or pads s with spaces so it's exactly width runes wide
+func pad(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+} // }}}
+
+// func prefixLines {{{
+
+// prefixLines splits a message into lines, prefixing the first with prefix
+// and indenting the rest to line up with it
+func prefixLines(prefix, msg string) []string {
+	lines := strings.Split(strings.TrimRight(msg, "\r\n"), "\n")
+	indent := strings.Repeat(" ", len([]rune(prefix)))
+	for i := range lines {
+		if i == 0 {
+			lines[i] = prefix + lines[i]
+			continue
+		}
+		lines[i] = indent + lines[i]
+	}
+	return lines
+} // }}}
+
+// func firstLine {{{
+
+// firstLine returns the first line of s
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+} // }}}
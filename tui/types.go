@@ -0,0 +1,86 @@
+// Package tui provides the optional full screen terminal frontend, with a
+// scrolling message pane, a peer sidebar, a status bar and a fixed input line
+package tui
+
+import (
+	"github.com/Cryliss/chat/events"
+	"github.com/Cryliss/chat/term"
+	"github.com/Cryliss/chat/types"
+	"os"
+	"sync"
+)
+
+// The most lines we keep in the message pane before dropping the oldest ones
+const maxLines = 1000
+
+// Width of the peer sidebar, and how wide the terminal needs to be before
+// we bother showing it
+const (
+	sidebarWidth = 26
+	sidebarMin   = 60
+)
+
+// type UI struct {{{
+
+// UI holds the state of the full screen frontend
+type UI struct {
+	// Our application, so we can run the users commands
+	app types.Application
+
+	// Our server, so we can show the connections it has in the sidebar
+	s types.Server
+
+	// The event bus the server publishes to, and the function that
+	// unsubscribes us from it again
+	bus         *events.Bus
+	unsubscribe func()
+
+	// Shown in the status bar, i.e. our ip:port
+	title string
+
+	// The terminal we're drawing on, and the state it was in before we
+	// put it into raw mode
+	in    *os.File
+	out   *os.File
+	state *term.State
+
+	// Locks everything below here, avoids data races between the input loop
+	// and the goroutines publishing events!
+	mu sync.Mutex
+
+	// The lines in the message pane, oldest first
+	lines []string
+
+	// Output that hasn't been terminated with a newline yet
+	partial string
+
+	// How many lines the user has scrolled the message pane up by
+	scroll int
+
+	// The message shown in the status bar
+	status string
+
+	// The line the user is typing, and where in it their cursor is
+	input  []rune
+	cursor int
+
+	// The size of the terminal and the number of peers the last time we
+	// drew the screen
+	width     int
+	height    int
+	peerCount int
+
+	// Makes sure we only restore the terminal once
+	closeOnce sync.Once
+
+	// Closed once we've restored the terminal, so the resize watcher stops
+	done chan struct{}
+} // }}}
+
+// type paneWriter struct {{{
+
+// paneWriter is an io.Writer that adds whatever is written to it to the
+// message pane, so the application's output ends up there
+type paneWriter struct {
+	u *UI
+} // }}}
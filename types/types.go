@@ -1,5 +1,11 @@
 package types
 
+import (
+    "context"
+    "github.com/Cryliss/chat/proto"
+    "time"
+)
+
 // This package is required to avoid import cycles in Go
 //
 // It defines the three types of interfaces we have in our progam
@@ -9,6 +15,8 @@ type Application interface {
     Out(format string, a ...interface{})
     OutErr(format string, a ...interface{})
     ParseInput(userInput string) error
+    PromptText() string
+    ShowsMessage(conn uint32) bool
 }
 
 type Client interface {
@@ -17,9 +25,85 @@ type Client interface {
 }
 
 type Server interface {
-    Connect(destination, port string) error
-    List()
+    Connect(ctx context.Context, destination, port string) (Dial, error)
+    List() []Peer
+    Dials() []Peer
+    Cancel(id int) error
     Terminate(conn int) error
+    Disconnect(conn int, code proto.GoodbyeCode, text string) error
     Send(conn int, message string) error
+    Inbox(conn int) []Message
+    Awaiting() []Peer
+    Approve(id int) error
+    Reject(id int, reason string) error
+    MarkRead(conn int) int
     Exit()
 }
+
+// Dial is a connection we're still in the middle of establishing, as returned
+// by Server.Connect
+type Dial interface {
+    // The id the connection will have once it's established
+    ID() uint32
+
+    // Gives up on the connection, if it isn't established yet
+    Cancel()
+
+    // Closed once the connection is established or we've given up on it,
+    // after which Err says which
+    Done() <-chan struct{}
+    Err() error
+}
+
+// Peer holds the details of an established connection, as returned by
+// Server.List so that the frontends can display them however they like
+type Peer struct {
+    ID        uint32
+    IP        string
+    Port      string
+    Transport string
+
+    // Which side opened the connection, "inbound" or "outbound", when it was
+    // established, and when we last read or wrote anything on it
+    Direction    string
+    Connected    time.Time
+    LastActivity time.Time
+
+    // The protocol version the peer speaks, and the longest message we
+    // agreed to send each other
+    Version    int
+    MaxMessage int
+
+    // How far the connection can be trusted, i.e. "plaintext, no key announced"
+    Security string
+
+    // What we've read and written, counting the payloads of frames
+    MessagesIn  uint64
+    MessagesOut uint64
+    BytesIn     uint64
+    BytesOut    uint64
+
+    // How many messages are waiting to be written to the peer, how many may
+    // wait at most, and how many were thrown away because the queue was full
+    Queued    int
+    QueueSize int
+    Dropped   uint64
+
+    // How many messages the peer has sent that the user hasn't read yet
+    Unread int
+
+    // What the peer announced it would like to be called, and the
+    // fingerprint of the key it announced, if any
+    Name        string
+    Fingerprint string
+}
+
+// Message is a message a peer sent us, as kept in the inbox until the user
+// has read it
+type Message struct {
+    ConnID uint32
+    IP     string
+    Port   string
+    Time   time.Time
+    Text   string
+}